@@ -0,0 +1,625 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// apiPrefix は JSON API のパス。互換性のない変更をするときは版を上げて並行して提供する。
+const apiPrefix = "/api/v1"
+
+const (
+	// defaultPageSize と maxPageSize はメッセージ履歴の 1 ページの件数。
+	defaultPageSize = 50
+	maxPageSize     = 200
+	// maxRoomNameLength はルーム名の最大文字数。
+	maxRoomNameLength = 64
+	// defaultMaxRooms は API.maxRooms の既定値。
+	defaultMaxRooms = 100
+)
+
+// roomIDPattern は API で指定できるルーム ID。URL にそのまま使える文字に限る。
+var roomIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+// apiTokenAuth はリクエストを API トークンで認証したことを echo.Context に記録するキー。
+const apiTokenAuth = "apiToken"
+
+// tokenExpiryKey は API トークンのペイロードに入れる有効期限（Unix 時間）。
+// この項目を持つ値は認証 Cookie としては受け付けない。
+const tokenExpiryKey = "token_exp"
+
+// makeAPIToken は userData のユーザーとして expires まで使える API トークンを作る。
+// 認証 Cookie と同じ鍵で署名する。
+func makeAPIToken(userData map[string]any, expires time.Time) string {
+	payload := make(map[string]any, len(userData)+1)
+	for k, v := range userData {
+		payload[k] = v
+	}
+	payload[tokenExpiryKey] = expires.Unix()
+	return makeAuthCookieValue(payload)
+}
+
+// parseAPIToken は API トークンを検証し、ユーザー情報を返す。
+func parseAPIToken(raw string, now time.Time) (map[string]any, error) {
+	userData, err := parseAuthCookieValue(raw)
+	if err != nil {
+		return nil, err
+	}
+	exp, ok := userData[tokenExpiryKey].(float64)
+	if !ok {
+		return nil, errors.New("not an API token")
+	}
+	if now.Unix() >= int64(exp) {
+		return nil, errors.New("API token expired")
+	}
+	delete(userData, tokenExpiryKey)
+	return userData, nil
+}
+
+// API は /api/v1 の JSON API。ルーム・メッセージ・ユーザーを扱う。
+// 認証は認証 Cookie か Authorization: Bearer の API トークンで行う。
+type API struct {
+	rooms    *roomRegistry
+	roomRepo domain.RoomRepository
+	access   *AccessControl
+	// bans が nil の場合はサイト全体の BAN を確認しない
+	bans     banChecker
+	auditLog domain.AuditLog
+	// tokenTTL は発行する API トークンの有効期間。
+	tokenTTL time.Duration
+	// maxRooms は作成できるルームの上限。既定のルームを含む。
+	maxRooms int
+	// broker が nil の場合は他のサーバーにルームの作成を知らせない
+	broker domain.Broker
+	// node はルームの作成を知らせるときにこのサーバーを識別する ID。
+	node string
+	// createMu は上限の確認とルームの作成をまとめて行うためのロック。
+	createMu sync.Mutex
+	now      func() time.Time
+}
+
+// NewAPI は API を生成する。ルームを作成すると既定のルームと同じ設定で動かし、rooms に加える。
+// 他のサーバーで作成したルームも受け取るには FollowRooms を呼び出す。
+func NewAPI(rooms *roomRegistry, roomRepo domain.RoomRepository, access *AccessControl) *API {
+	return &API{
+		rooms:    rooms,
+		roomRepo: roomRepo,
+		access:   access,
+		tokenTTL: 24 * time.Hour,
+		maxRooms: defaultMaxRooms,
+		node:     generateUUID(),
+		now:      time.Now,
+	}
+}
+
+// apiParam はクエリパラメーター。OpenAPI ドキュメントに載せる。
+type apiParam struct {
+	name        string
+	description string
+	// kind は OpenAPI の型（"string" や "integer"）。
+	kind string
+}
+
+// apiRoute は API の 1 つのエンドポイント。ルーティングと OpenAPI ドキュメントの両方をこの定義から作る。
+type apiRoute struct {
+	method, path string
+	operationID  string
+	summary      string
+	query        []apiParam
+	// request と response はリクエストとレスポンスの本文の型のゼロ値。本文がない場合は nil。
+	request, response any
+	status            int
+	// perm が空でない場合はその権限を要求する。ルームの権限は :room のルームで判定する。
+	perm domain.Permission
+	// public はログインせずに呼び出せることを示す。
+	public  bool
+	handler echo.HandlerFunc
+}
+
+func (a *API) routes() []apiRoute {
+	return []apiRoute{
+		{method: http.MethodGet, path: "/openapi.json", operationID: "getOpenAPI", summary: "Get this OpenAPI document",
+			response: map[string]any{}, status: http.StatusOK, public: true, handler: a.OpenAPI},
+		{method: http.MethodPost, path: "/tokens", operationID: "createToken", summary: "Issue a bearer token for the signed-in user",
+			response: tokenResponse{}, status: http.StatusCreated, handler: a.CreateToken},
+		{method: http.MethodGet, path: "/rooms", operationID: "listRooms", summary: "List rooms",
+			response: []roomResponse{}, status: http.StatusOK, handler: a.ListRooms},
+		{method: http.MethodPost, path: "/rooms", operationID: "createRoom", summary: "Create a room",
+			request: createRoomRequest{}, response: roomResponse{}, status: http.StatusCreated, perm: domain.PermCreateRoom, handler: a.CreateRoom},
+		{method: http.MethodGet, path: "/rooms/:room", operationID: "getRoom", summary: "Get a room",
+			response: roomResponse{}, status: http.StatusOK, handler: a.GetRoom},
+		{method: http.MethodGet, path: "/rooms/:room/messages", operationID: "listMessages", summary: "Fetch recent messages, newest page first",
+			query: []apiParam{
+				{name: "before", description: "Only return messages with a sequence number lower than this. Use next_before from the previous page.", kind: "integer"},
+				{name: "limit", description: "Maximum number of messages to return (1-200, default 50).", kind: "integer"},
+			},
+			response: messagePage{}, status: http.StatusOK, handler: a.ListMessages},
+		{method: http.MethodPost, path: "/rooms/:room/messages", operationID: "postMessage", summary: "Post a message",
+			request: messageRequest{}, response: messageResponse{}, status: http.StatusCreated, perm: domain.PermSendMessage, handler: a.PostMessage},
+		{method: http.MethodPatch, path: "/rooms/:room/messages/:id", operationID: "editMessage", summary: "Edit one of your messages",
+			request: messageRequest{}, response: messageResponse{}, status: http.StatusOK, perm: domain.PermSendMessage, handler: a.EditMessage},
+		{method: http.MethodDelete, path: "/rooms/:room/messages/:id", operationID: "deleteMessage", summary: "Delete one of your messages, or any message as a moderator",
+			status: http.StatusNoContent, handler: a.DeleteMessage},
+		{method: http.MethodGet, path: "/rooms/:room/members", operationID: "listMembers", summary: "List users connected to a room",
+			response: []PresenceUser{}, status: http.StatusOK, handler: a.ListMembers},
+		{method: http.MethodGet, path: "/users/me", operationID: "getCurrentUser", summary: "Get the signed-in user",
+			response: userResponse{}, status: http.StatusOK, handler: a.CurrentUser},
+		{method: http.MethodGet, path: "/users", operationID: "findUsers", summary: "Look up users by name",
+			query:    []apiParam{{name: "name", description: "Exact user name.", kind: "string"}},
+			response: []userResponse{}, status: http.StatusOK, handler: a.FindUsers},
+		{method: http.MethodGet, path: "/users/:id", operationID: "getUser", summary: "Get a user",
+			response: userResponse{}, status: http.StatusOK, handler: a.GetUser},
+	}
+}
+
+// Register は API のルートを e に登録する。
+func (a *API) Register(e *echo.Echo) {
+	g := e.Group(apiPrefix)
+	for _, rt := range a.routes() {
+		var mw []echo.MiddlewareFunc
+		if !rt.public {
+			mw = append(mw, a.authenticate)
+		}
+		if rt.perm != "" {
+			mw = append(mw, a.access.Require(rt.perm))
+		}
+		g.Add(rt.method, rt.path, rt.handler, mw...)
+	}
+}
+
+// authenticate は API トークンか認証 Cookie でユーザーを確かめる。
+// ページとは違い、ログインしていない場合はリダイレクトせずに 401 を返す。
+func (a *API) authenticate(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var userData map[string]any
+		var err error
+		if token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+			userData, err = parseAPIToken(strings.TrimSpace(token), a.now())
+			c.Set(apiTokenAuth, true)
+		} else {
+			userData, err = getAuthUserData(c)
+		}
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		}
+		userID, _ := userData["id"].(string)
+		if a.bans != nil {
+			if s, banned := a.bans.GlobalBan(c.Request().Context(), userID); banned {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": describeSanction(s, "")})
+			}
+		}
+		if isRecoverySession(userData) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "register a new passkey before using the API"})
+		}
+		c.Set("userData", userData)
+		return next(c)
+	}
+}
+
+// errorResponse は API のエラーレスポンス。
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type tokenResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreateToken は API トークンを発行する。トークンで延長し続けられないよう、認証 Cookie でのみ発行する。
+func (a *API) CreateToken(c echo.Context) error {
+	if c.Get(apiTokenAuth) != nil {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "tokens can only be issued to a signed-in session"})
+	}
+	userData, err := getAuthUserData(c)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	expires := a.now().Add(a.tokenTTL).Truncate(time.Second)
+	return c.JSON(http.StatusCreated, tokenResponse{Token: makeAPIToken(userData, expires), TokenType: "Bearer", ExpiresAt: expires})
+}
+
+type roomResponse struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newRoomResponse(r domain.Room) roomResponse {
+	return roomResponse{ID: r.ID, Name: r.Name, CreatedBy: r.CreatedBy, CreatedAt: r.CreatedAt}
+}
+
+type createRoomRequest struct {
+	// ID を省略するとサーバーが割り当てる。
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// ListRooms はルームを作成順に返す。
+func (a *API) ListRooms(c echo.Context) error {
+	rooms, err := a.roomRepo.List(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list rooms"})
+	}
+	resp := make([]roomResponse, 0, len(rooms))
+	for _, r := range rooms {
+		resp = append(resp, newRoomResponse(r))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// GetRoom は :room のルームを返す。
+func (a *API) GetRoom(c echo.Context) error {
+	room, err := a.roomRepo.Get(c.Request().Context(), c.Param("room"))
+	if err != nil {
+		return roomError(c, err)
+	}
+	return c.JSON(http.StatusOK, newRoomResponse(room))
+}
+
+// CreateRoom はルームを作成し、すぐに接続やメッセージを受け付けられるようにする。
+// 他のサーバーにもバックプレーンで知らせ、同じルームを動かしてもらう。
+func (a *API) CreateRoom(c echo.Context) error {
+	user, err := currentUser(c, a.access.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	var req createRoomRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || utf8.RuneCountInString(name) > maxRoomNameLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required and must be at most " + strconv.Itoa(maxRoomNameLength) + " characters"})
+	}
+	if req.ID == "" {
+		req.ID = generateUUID()
+	} else if !roomIDPattern.MatchString(req.ID) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "id must be 1-32 lowercase letters, digits or hyphens"})
+	}
+	if _, ok := a.rooms.get(defaultRoomID); !ok {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "default room is not running"})
+	}
+
+	ctx := c.Request().Context()
+	a.createMu.Lock()
+	defer a.createMu.Unlock()
+	existing, err := a.roomRepo.List(ctx)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list rooms"})
+	}
+	if len(existing) >= a.maxRooms {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "room limit reached"})
+	}
+	room := domain.Room{ID: req.ID, Name: name, CreatedBy: user.ID, CreatedAt: a.now()}
+	if err := a.roomRepo.Create(ctx, room); err != nil {
+		return roomError(c, err)
+	}
+	a.startRoom(room.ID)
+	a.announceRooms(ctx, room)
+	recordAudit(ctx, a.auditLog, domain.AuditEvent{Action: "room.create", ActorID: user.ID, Target: room.ID,
+		Detail: map[string]string{"name": room.Name}})
+	return c.JSON(http.StatusCreated, newRoomResponse(room))
+}
+
+// roomError は RoomRepository のエラーをレスポンスにする。
+func roomError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, domain.ErrRoomNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": errRoomNotFound.Error()})
+	case errors.Is(err, domain.ErrRoomExists):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "room already exists"})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to load room"})
+	}
+}
+
+// apiError はリクエストを処理できなかった理由。apiErrorResponse がレスポンスにする。
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e *apiError) Error() string { return e.msg }
+
+// apiErrorResponse は apiError をレスポンスにする。それ以外のエラーは 500 にする。
+func apiErrorResponse(c echo.Context, err error) error {
+	var ae *apiError
+	if !errors.As(err, &ae) {
+		ae = &apiError{status: http.StatusInternalServerError, msg: "internal error"}
+	}
+	return c.JSON(ae.status, map[string]string{"error": ae.msg})
+}
+
+// room は :room のルームを返す。WebSocket と同じく、BAN やキックされたユーザーにはルームを使わせない。
+func (a *API) room(c echo.Context) (*room, error) {
+	r, ok := a.rooms.get(c.Param("room"))
+	if !ok {
+		return nil, &apiError{http.StatusNotFound, errRoomNotFound.Error()}
+	}
+	userData, _ := c.Get("userData").(map[string]any)
+	if s, blocked := r.joinBlocked(userData); blocked {
+		return nil, &apiError{http.StatusForbidden, describeSanction(s, r.id)}
+	}
+	return r, nil
+}
+
+type messageResponse struct {
+	ID string `json:"id"`
+	// Seq はルームでの通し番号。投稿直後のレスポンスではまだ振られていないため省略する。
+	Seq       uint64     `json:"seq,omitempty"`
+	UserID    string     `json:"user_id"`
+	Name      string     `json:"name"`
+	Text      string     `json:"text"`
+	AvatarURL string     `json:"avatar_url,omitempty"`
+	SentAt    time.Time  `json:"sent_at"`
+	EditedAt  *time.Time `json:"edited_at,omitempty"`
+}
+
+func newMessageResponse(msg *message) messageResponse {
+	return messageResponse{ID: msg.ID, Seq: msg.Seq, UserID: msg.UserID, Name: msg.Name, Text: msg.Message,
+		AvatarURL: msg.AvatarURL, SentAt: msg.When, EditedAt: msg.EditedAt}
+}
+
+type messagePage struct {
+	// Messages は古い順。
+	Messages []messageResponse `json:"messages"`
+	// NextBefore はさらに前のページを取得するときの before。前のメッセージがない場合は省略する。
+	NextBefore uint64 `json:"next_before,omitempty"`
+}
+
+type messageRequest struct {
+	Text string `json:"text"`
+}
+
+// ListMessages はルームの最近のメッセージを新しいページから返す。サーバーが保持している範囲に限る。
+func (a *API) ListMessages(c echo.Context) error {
+	r, err := a.room(c)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	var before uint64
+	if s := c.QueryParam("before"); s != "" {
+		if before, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "before must be a message sequence number"})
+		}
+	}
+	limit := defaultPageSize
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxPageSize {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "limit must be between 1 and " + strconv.Itoa(maxPageSize)})
+		}
+	}
+	msgs, more := r.history.before(before, limit)
+	page := messagePage{Messages: make([]messageResponse, 0, len(msgs))}
+	for _, msg := range msgs {
+		page.Messages = append(page.Messages, newMessageResponse(msg))
+	}
+	if more && len(msgs) > 0 {
+		page.NextBefore = msgs[0].Seq
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// bindText は messageRequest を読み取って本文を検証する。
+func bindText(c echo.Context, r *room) (string, error) {
+	var req messageRequest
+	if err := c.Bind(&req); err != nil {
+		return "", &apiError{http.StatusBadRequest, "invalid request body"}
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		return "", &apiError{http.StatusBadRequest, "text is required"}
+	}
+	if int64(len(req.Text)) > r.connConfig.MaxMessageSize {
+		return "", &apiError{http.StatusRequestEntityTooLarge, "message too large"}
+	}
+	return req.Text, nil
+}
+
+// sender は API から投稿するユーザーを、ルームに参加していない接続として表す。
+// WebSocket の接続と同じ検査を通すために使う。
+func (a *API) sender(c echo.Context, r *room) *client {
+	userData, _ := getAuthUserData(c)
+	sender := &client{room: r, userData: userData}
+	if r.limiter != nil {
+		// 接続ごとの制限は API では意味がないため、ユーザーごとの制限だけが効く
+		sender.limit = r.limiter.connBucket()
+	}
+	return sender
+}
+
+// rejectionError は受け付けなかったメッセージをレスポンスにする。
+func rejectionError(c echo.Context, rej *rejection) error {
+	status := http.StatusForbidden
+	switch rej.reason {
+	case dropRateLimited, dropRateDisconnect:
+		status = http.StatusTooManyRequests
+	case dropFiltered:
+		status = http.StatusUnprocessableEntity
+	}
+	text := "permission denied"
+	if rej.notice != nil {
+		text = rej.notice.Message
+	}
+	return c.JSON(status, map[string]string{"error": text})
+}
+
+// PostMessage はルームにメッセージを投稿する。WebSocket で送った場合と同じ制限とフィルターを適用する。
+func (a *API) PostMessage(c echo.Context) error {
+	r, err := a.room(c)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	text, err := bindText(c, r)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	sender := a.sender(c, r)
+	ctx, span := startSpan(c.Request().Context(), "chat.message.receive",
+		oteltrace.WithAttributes(attribute.String("chat.room", r.id), attribute.String("chat.user", sender.userID())))
+	defer span.End()
+	msg := &message{Message: text}
+	rej, err := sender.admit(ctx, msg)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to post message"})
+	}
+	if rej != nil {
+		return rejectionError(c, rej)
+	}
+	injectTrace(ctx, msg)
+	// 配信を始めると room.run が msg を書き換えるため、先にレスポンスを作る
+	body := newMessageResponse(msg)
+	select {
+	case r.forward <- msg:
+	case <-r.done:
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "room is shutting down"})
+	}
+	return c.JSON(http.StatusCreated, body)
+}
+
+// chatMessage は履歴から :id のチャットメッセージを返す。
+func chatMessage(c echo.Context, r *room) (message, error) {
+	msg, ok := r.history.get(c.Param("id"))
+	if !ok || msg.System != nil {
+		return message{}, &apiError{http.StatusNotFound, "message not found"}
+	}
+	return msg, nil
+}
+
+// EditMessage は自分のメッセージの本文を書き換える。新しい本文は投稿と同じように検査する。
+func (a *API) EditMessage(c echo.Context) error {
+	r, err := a.room(c)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	msg, err := chatMessage(c, r)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	text, err := bindText(c, r)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	sender := a.sender(c, r)
+	if msg.UserID != sender.userID() {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "only the author can edit a message"})
+	}
+	// 編集も全員に配信するため、投稿と同じレート制限・権限・ミュート・フィルターを通す
+	edited := &message{Message: text}
+	rej, err := sender.admit(c.Request().Context(), edited)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to edit message"})
+	}
+	if rej != nil {
+		return rejectionError(c, rej)
+	}
+	now := a.now()
+	r.editMessage(msg.ID, edited.Message)
+	msg.Message, msg.EditedAt = edited.Message, &now
+	return c.JSON(http.StatusOK, newMessageResponse(&msg))
+}
+
+// DeleteMessage は自分のメッセージを削除する。他人のメッセージはルームのモデレーター以上が削除できる。
+func (a *API) DeleteMessage(c echo.Context) error {
+	r, err := a.room(c)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	msg, err := chatMessage(c, r)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	ctx := c.Request().Context()
+	userID := a.sender(c, r).userID()
+	if msg.UserID != userID {
+		if err := a.access.Authorize(ctx, userID, r.id, domain.PermModerate); err != nil {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "permission denied"})
+		}
+		recordAudit(ctx, a.auditLog, domain.AuditEvent{Action: "message.delete", ActorID: userID, Target: msg.UserID,
+			Detail: map[string]string{"room": r.id, "message_id": msg.ID}})
+	}
+	r.deleteMessage(msg.ID)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ListMembers はルームに接続しているユーザーを返す。他のサーバーに接続しているユーザーも含む。
+func (a *API) ListMembers(c echo.Context) error {
+	r, err := a.room(c)
+	if err != nil {
+		return apiErrorResponse(c, err)
+	}
+	return c.JSON(http.StatusOK, r.presence.list())
+}
+
+type userResponse struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+	Role        string `json:"role"`
+	// Email は本人にだけ返す。
+	Email string `json:"email,omitempty"`
+}
+
+func newUserResponse(u domain.User) userResponse {
+	return userResponse{ID: u.ID, Name: u.Name, DisplayName: u.DisplayName, AvatarURL: u.AvatarURL, Role: string(u.Role.OrDefault())}
+}
+
+// CurrentUser はログインしているユーザーを返す。
+func (a *API) CurrentUser(c echo.Context) error {
+	user, err := currentUser(c, a.access.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	resp := newUserResponse(user)
+	resp.Email = user.Email
+	return c.JSON(http.StatusOK, resp)
+}
+
+// GetUser は :id のユーザーを返す。
+func (a *API) GetUser(c echo.Context) error {
+	user, err := a.access.userRepo.GetByID(c.Request().Context(), c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	return c.JSON(http.StatusOK, newUserResponse(user))
+}
+
+// FindUsers は名前が一致するユーザーを返す。一致しない場合は空の配列を返す。
+func (a *API) FindUsers(c echo.Context) error {
+	name := c.QueryParam("name")
+	if name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "name is required"})
+	}
+	resp := []userResponse{}
+	if user, err := a.access.userRepo.GetByName(c.Request().Context(), name); err == nil {
+		resp = append(resp, newUserResponse(user))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// seedRooms は起動時に動いているルームを RoomRepository に登録する。既に登録されているルームはそのまま使う。
+func seedRooms(ctx context.Context, repo domain.RoomRepository, rooms ...*room) error {
+	for _, r := range rooms {
+		err := repo.Create(ctx, domain.Room{ID: r.id, Name: r.id, CreatedAt: time.Now()})
+		if err != nil && !errors.Is(err, domain.ErrRoomExists) {
+			return err
+		}
+	}
+	return nil
+}
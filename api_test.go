@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/labstack/echo/v4"
+)
+
+// newAPITest は既定のルームを動かし、API を登録した echo を返す。
+func newAPITest(t *testing.T, users ...domain.User) (*API, *echo.Echo, *room, *memory.AuditStore) {
+	t.Helper()
+	m, r, auditLog := newModerationTest(t, users...)
+	roomRepo := memory.NewRoomStore()
+	if err := seedRooms(context.Background(), roomRepo, r); err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(m.rooms, roomRepo, m.access)
+	api.bans = m
+	api.auditLog = auditLog
+	e := echo.New()
+	api.Register(e)
+	t.Cleanup(func() {
+		for _, r := range m.rooms.list() {
+			r.Stop()
+		}
+	})
+	return api, e, r, auditLog
+}
+
+// apiCookie は userID のユーザーとしてログインしている認証 Cookie の値。
+func apiCookie(userID string) string {
+	return makeAuthCookieValue(map[string]any{"id": userID, "name": userID, "avatar_url": "/avatars/" + userID + ".png"})
+}
+
+// serveAPI は API にリクエストを送る。auth は "Bearer " で始まる場合は Authorization ヘッダーに、
+// それ以外は空でなければ認証 Cookie の値として送る。
+func serveAPI(e *echo.Echo, method, path, body, auth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, apiPrefix+path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		req.Header.Set(echo.HeaderAuthorization, auth)
+	case auth != "":
+		req.AddCookie(&http.Cookie{Name: "auth", Value: auth})
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeBody[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("failed to decode %q: %v", rec.Body.String(), err)
+	}
+	return v
+}
+
+func TestAPI_Authentication(t *testing.T) {
+	api, e, _, _ := newAPITest(t, domain.User{ID: "alice", Name: "alice", Email: "alice@example.com"})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	api.now = func() time.Time { return now }
+
+	rec := serveAPI(e, http.MethodGet, "/users/me", "", "")
+	if rec.Code != http.StatusUnauthorized || rec.Header().Get(echo.HeaderWWWAuthenticate) != "Bearer" {
+		t.Fatalf("expected 401 with a bearer challenge, got %d %v", rec.Code, rec.Header())
+	}
+
+	rec = serveAPI(e, http.MethodPost, "/tokens", "", apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	token := decodeBody[tokenResponse](t, rec)
+	if token.TokenType != "Bearer" || !token.ExpiresAt.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		auth   string
+		at     time.Time
+		want   int
+	}{
+		{name: "cookie", method: http.MethodGet, path: "/users/me", auth: apiCookie("alice"), at: now, want: http.StatusOK},
+		{name: "bearer token", method: http.MethodGet, path: "/users/me", auth: "Bearer " + token.Token, at: now, want: http.StatusOK},
+		{name: "expired token", method: http.MethodGet, path: "/users/me", auth: "Bearer " + token.Token, at: token.ExpiresAt, want: http.StatusUnauthorized},
+		{name: "cookie as token", method: http.MethodGet, path: "/users/me", auth: "Bearer " + apiCookie("alice"), at: now, want: http.StatusUnauthorized},
+		{name: "token as cookie", method: http.MethodGet, path: "/users/me", auth: token.Token, at: now, want: http.StatusUnauthorized},
+		{name: "tampered token", method: http.MethodGet, path: "/users/me", auth: "Bearer " + token.Token + "0", at: now, want: http.StatusUnauthorized},
+		{name: "token cannot issue tokens", method: http.MethodPost, path: "/tokens", auth: "Bearer " + token.Token, at: now, want: http.StatusForbidden},
+		{name: "openapi is public", method: http.MethodGet, path: "/openapi.json", at: now, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api.now = func() time.Time { return tt.at }
+			if rec := serveAPI(e, tt.method, tt.path, "", tt.auth); rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPI_Rooms(t *testing.T) {
+	api, e, _, auditLog := newAPITest(t,
+		domain.User{ID: "alice", Name: "alice", Role: domain.RoleModerator},
+		domain.User{ID: "bob", Name: "bob"},
+		domain.User{ID: "guest", Name: "guest", Role: domain.RoleGuest},
+	)
+	api.maxRooms = 3
+
+	rec := serveAPI(e, http.MethodPost, "/rooms", `{"id":"random","name":"Random"}`, apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if room := decodeBody[roomResponse](t, rec); room.ID != "random" || room.Name != "Random" || room.CreatedBy != "alice" {
+		t.Errorf("unexpected room %+v", room)
+	}
+	if events, _ := auditLog.List(context.Background()); len(events) == 0 || events[len(events)-1].Action != "room.create" {
+		t.Errorf("expected room.create audit event, got %+v", events)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		user string
+		want int
+	}{
+		{name: "duplicate", body: `{"id":"random","name":"Again"}`, user: "alice", want: http.StatusConflict},
+		{name: "invalid id", body: `{"id":"Not A Slug","name":"x"}`, user: "alice", want: http.StatusBadRequest},
+		{name: "missing name", body: `{"id":"empty"}`, user: "alice", want: http.StatusBadRequest},
+		{name: "guest", body: `{"id":"guests","name":"Guests"}`, user: "guest", want: http.StatusForbidden},
+		{name: "member", body: `{"id":"members","name":"Members"}`, user: "bob", want: http.StatusForbidden},
+		{name: "generated id", body: `{"name":"Unnamed"}`, user: "alice", want: http.StatusCreated},
+		{name: "over the limit", body: `{"id":"more","name":"More"}`, user: "alice", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serveAPI(e, http.MethodPost, "/rooms", tt.body, apiCookie(tt.user)); rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+
+	rooms := decodeBody[[]roomResponse](t, serveAPI(e, http.MethodGet, "/rooms", "", apiCookie("guest")))
+	if len(rooms) != 3 || rooms[0].ID != defaultRoomID || rooms[1].ID != "random" {
+		t.Errorf("unexpected rooms %+v", rooms)
+	}
+	if rec := serveAPI(e, http.MethodGet, "/rooms/missing", "", apiCookie("alice")); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+
+	// 作成したルームはすぐにメッセージを受け付ける
+	rec = serveAPI(e, http.MethodPost, "/rooms/random/messages", `{"text":"hello"}`, apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	created, _ := api.rooms.get("random")
+	syncRoom(created)
+	page := decodeBody[messagePage](t, serveAPI(e, http.MethodGet, "/rooms/random/messages", "", apiCookie("alice")))
+	if len(page.Messages) != 1 || page.Messages[0].Text != "hello" || page.Messages[0].Seq != 1 {
+		t.Errorf("unexpected history %+v", page)
+	}
+}
+
+func TestAPI_Messages(t *testing.T) {
+	_, e, r, auditLog := newAPITest(t,
+		domain.User{ID: "mod", Name: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "alice", Name: "alice"},
+		domain.User{ID: "bob", Name: "bob"},
+	)
+	bob := joinTestClient(r, "bob")
+
+	rec := serveAPI(e, http.MethodPost, "/rooms/general/messages", `{"text":"hello"}`, apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	posted := decodeBody[messageResponse](t, rec)
+	if posted.ID == "" || posted.UserID != "alice" || posted.Text != "hello" || posted.AvatarURL != "/avatars/alice.png" {
+		t.Errorf("unexpected message %+v", posted)
+	}
+	// WebSocket の参加者にも同じメッセージが届く
+	if msg, _ := receive(t, bob); msg.ID != posted.ID || msg.Message != "hello" {
+		t.Errorf("unexpected broadcast %+v", msg)
+	}
+
+	rec = serveAPI(e, http.MethodPatch, "/rooms/general/messages/"+posted.ID, `{"text":"hello, world"}`, apiCookie("alice"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if edited := decodeBody[messageResponse](t, rec); edited.Text != "hello, world" || edited.EditedAt == nil {
+		t.Errorf("unexpected edited message %+v", edited)
+	}
+	if msg, _ := receive(t, bob); msg.System == nil || msg.System.Action != "message_edited" || msg.System.MessageID != posted.ID || msg.Message != "hello, world" {
+		t.Errorf("expected message_edited event, got %+v", msg)
+	}
+	if got, _ := r.history.get(posted.ID); got.Message != "hello, world" || got.EditedAt == nil {
+		t.Errorf("expected history to hold the edited message, got %+v", got)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		user   string
+		want   int
+	}{
+		{name: "edit someone else's message", method: http.MethodPatch, body: `{"text":"hijacked"}`, user: "bob", want: http.StatusForbidden},
+		{name: "empty edit", method: http.MethodPatch, body: `{"text":"  "}`, user: "alice", want: http.StatusBadRequest},
+		{name: "member deletes someone else's message", method: http.MethodDelete, user: "bob", want: http.StatusForbidden},
+		{name: "moderator deletes", method: http.MethodDelete, user: "mod", want: http.StatusNoContent},
+		{name: "already deleted", method: http.MethodDelete, user: "alice", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serveAPI(e, tt.method, "/rooms/general/messages/"+posted.ID, tt.body, apiCookie(tt.user)); rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d: %s", tt.want, rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if events, _ := auditLog.List(context.Background()); len(events) == 0 || events[len(events)-1].Action != "message.delete" {
+		t.Errorf("expected message.delete audit event, got %+v", events)
+	}
+}
+
+func TestAPI_MessageHistory(t *testing.T) {
+	_, e, r, _ := newAPITest(t, domain.User{ID: "alice", Name: "alice"})
+	for i := range 5 {
+		r.forward <- &message{ID: fmt.Sprintf("m%d", i+1), Message: fmt.Sprint(i + 1), When: time.Now()}
+	}
+	r.forward <- newSystemMessage("ignored", systemEvent{Action: "typing"})
+	syncRoom(r)
+
+	page := decodeBody[messagePage](t, serveAPI(e, http.MethodGet, "/rooms/general/messages?limit=2", "", apiCookie("alice")))
+	if len(page.Messages) != 2 || page.Messages[0].ID != "m4" || page.Messages[1].ID != "m5" || page.NextBefore != 4 {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	page = decodeBody[messagePage](t, serveAPI(e, http.MethodGet, fmt.Sprintf("/rooms/general/messages?limit=2&before=%d", page.NextBefore), "", apiCookie("alice")))
+	if len(page.Messages) != 2 || page.Messages[0].ID != "m2" || page.NextBefore != 2 {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+	page = decodeBody[messagePage](t, serveAPI(e, http.MethodGet, "/rooms/general/messages?limit=2&before=2", "", apiCookie("alice")))
+	if len(page.Messages) != 1 || page.Messages[0].ID != "m1" || page.NextBefore != 0 {
+		t.Fatalf("unexpected last page %+v", page)
+	}
+
+	for _, query := range []string{"?limit=0", "?limit=1000", "?before=-1"} {
+		if rec := serveAPI(e, http.MethodGet, "/rooms/general/messages"+query, "", apiCookie("alice")); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, rec.Code)
+		}
+	}
+}
+
+func TestAPI_MessagesRateLimited(t *testing.T) {
+	_, e, r, _ := newAPITest(t, domain.User{ID: "alice", Name: "alice"})
+	r.limiter = newMessageLimiter(RateLimitConfig{ConnBurst: 5, ConnRate: 0.001, UserBurst: 1, UserRate: 0.001})
+
+	rec := serveAPI(e, http.MethodPost, "/rooms/general/messages", `{"text":"one"}`, apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", rec.Code)
+	}
+	posted := decodeBody[messageResponse](t, rec)
+	syncRoom(r)
+	if rec := serveAPI(e, http.MethodPost, "/rooms/general/messages", `{"text":"two"}`, apiCookie("alice")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// 編集も配信されるため同じ制限を受ける
+	if rec := serveAPI(e, http.MethodPatch, "/rooms/general/messages/"+posted.ID, `{"text":"uno"}`, apiCookie("alice")); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 for an edit, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := r.history.get(posted.ID); got.Message != "one" {
+		t.Errorf("expected the rejected edit not to apply, got %+v", got)
+	}
+}
+
+func TestAPI_Users(t *testing.T) {
+	_, e, r, _ := newAPITest(t,
+		domain.User{ID: "alice", Name: "alice", DisplayName: "Alice", Email: "alice@example.com"},
+		domain.User{ID: "bob", Name: "bob", Role: domain.RoleModerator, Email: "bob@example.com"},
+	)
+
+	me := decodeBody[userResponse](t, serveAPI(e, http.MethodGet, "/users/me", "", apiCookie("alice")))
+	if me.ID != "alice" || me.DisplayName != "Alice" || me.Email != "alice@example.com" || me.Role != "member" {
+		t.Errorf("unexpected current user %+v", me)
+	}
+	other := decodeBody[userResponse](t, serveAPI(e, http.MethodGet, "/users/bob", "", apiCookie("alice")))
+	if other.ID != "bob" || other.Role != "moderator" || other.Email != "" {
+		t.Errorf("expected bob without email, got %+v", other)
+	}
+	if rec := serveAPI(e, http.MethodGet, "/users/nobody", "", apiCookie("alice")); rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+	found := decodeBody[[]userResponse](t, serveAPI(e, http.MethodGet, "/users?name=bob", "", apiCookie("alice")))
+	if len(found) != 1 || found[0].ID != "bob" {
+		t.Errorf("unexpected lookup result %+v", found)
+	}
+	if found := decodeBody[[]userResponse](t, serveAPI(e, http.MethodGet, "/users?name=carol", "", apiCookie("alice"))); len(found) != 0 {
+		t.Errorf("expected no users, got %+v", found)
+	}
+
+	joinTestClient(r, "bob")
+	syncRoom(r)
+	members := decodeBody[[]PresenceUser](t, serveAPI(e, http.MethodGet, "/rooms/general/members", "", apiCookie("alice")))
+	if len(members) != 1 || members[0].UserID != "bob" {
+		t.Errorf("unexpected members %+v", members)
+	}
+}
+
+func TestAPI_BannedFromRoom(t *testing.T) {
+	mod := domain.User{ID: "mod", Name: "mod", Role: domain.RoleModerator}
+	alice := domain.User{ID: "alice", Name: "alice"}
+	_, e, r, _ := newAPITest(t, mod, alice)
+
+	rec := serveAPI(e, http.MethodPost, "/rooms/general/messages", `{"text":"hello"}`, apiCookie("alice"))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	posted := decodeBody[messageResponse](t, rec)
+	syncRoom(r)
+	if _, err := r.moderation.Issue(context.Background(), mod, alice, domain.SanctionBan, defaultRoomID, "abuse", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{name: "post", method: http.MethodPost, path: "/rooms/general/messages", body: `{"text":"again"}`},
+		{name: "edit", method: http.MethodPatch, path: "/rooms/general/messages/" + posted.ID, body: `{"text":"edited"}`},
+		{name: "delete", method: http.MethodDelete, path: "/rooms/general/messages/" + posted.ID},
+		{name: "history", method: http.MethodGet, path: "/rooms/general/messages"},
+		{name: "members", method: http.MethodGet, path: "/rooms/general/members"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveAPI(e, tt.method, tt.path, tt.body, apiCookie("alice"))
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "banned from #general") {
+				t.Errorf("expected status 403 with the ban, got %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+	// 他のユーザーはそのまま使える
+	if rec := serveAPI(e, http.MethodGet, "/rooms/general/messages", "", apiCookie("mod")); rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestAPI_RoomsAcrossServers(t *testing.T) {
+	broker := memory.NewBroker()
+	t.Cleanup(func() { _ = broker.Close() })
+	newServer := func() (*API, *echo.Echo) {
+		api, e, _, _ := newAPITest(t, domain.User{ID: "alice", Name: "alice", Role: domain.RoleModerator})
+		api.broker = broker
+		if err := api.FollowRooms(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return api, e
+	}
+	waitRoom := func(api *API, id string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			if _, ok := api.rooms.get(id); ok {
+				if _, err := api.roomRepo.Get(context.Background(), id); err == nil {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("room %s did not start", id)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	_, first := newServer()
+	second, _ := newServer()
+	if rec := serveAPI(first, http.MethodPost, "/rooms", `{"id":"random","name":"Random"}`, apiCookie("alice")); rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	waitRoom(second, "random")
+
+	// あとから起動したサーバーも既存のルームを受け取る
+	third, _ := newServer()
+	waitRoom(third, "random")
+}
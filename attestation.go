@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/metadata/providers/memory"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+var (
+	errAAGUIDDenied        = errors.New("authenticator is on the deny list")
+	errAAGUIDNotAllowed    = errors.New("authenticator is not on the allow list")
+	errAttestationRequired = errors.New("attestation is required to verify the authenticator")
+)
+
+// loadMetadataProvider はローカルの FIDO MDS BLOB ファイルを読み込み、
+// 登録時のアテステーション検証に使う metadata.Provider を返す。
+// rootPath が空の場合は FIDO Alliance の本番ルート証明書で署名を検証する。
+// requireEntry が true の場合、BLOB に載っていない認証器のアテステーションは拒否される。
+func loadMetadataProvider(blobPath, rootPath string, requireEntry bool) (metadata.Provider, error) {
+	blob, err := os.ReadFile(blobPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata blob: %w", err)
+	}
+
+	opts := []metadata.DecoderOption{metadata.WithIgnoreEntryParsingErrors()}
+	if rootPath != "" {
+		root, err := readCertificate(rootPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, metadata.WithRootCertificate(root))
+	}
+
+	decoder, err := metadata.NewDecoder(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create metadata decoder: %w", err)
+	}
+	payload, err := decoder.DecodeBytes(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify metadata blob: %w", err)
+	}
+	parsed, err := decoder.Parse(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata blob: %w", err)
+	}
+	if n := len(parsed.Unparsed); n > 0 {
+		log.Printf("metadata blob: skipped %d entries that could not be parsed", n)
+	}
+	if parsed.Parsed.NextUpdate.Before(time.Now()) {
+		log.Printf("metadata blob: nextUpdate %s has passed; download a fresh blob", parsed.Parsed.NextUpdate.Format(time.DateOnly))
+	}
+
+	return memory.New(
+		memory.WithMetadata(parsed.ToMap()),
+		memory.WithValidateEntry(requireEntry),
+	)
+}
+
+// readCertificate は PEM または DER の証明書ファイルを読み込み、
+// metadata.WithRootCertificate が受け付ける base64 文字列にする。
+func readCertificate(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read metadata root certificate: %w", err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// AAGUIDPolicy は登録できる認証器を AAGUID で制限する。
+// 拒否リストが優先され、許可リストが空でなければ許可リストにある認証器のみ登録できる。
+type AAGUIDPolicy struct {
+	allow map[string]struct{}
+	deny  map[string]struct{}
+}
+
+// NewAAGUIDPolicy は AAGUID の許可リストと拒否リストから AAGUIDPolicy を生成する。
+func NewAAGUIDPolicy(allow, deny []string) (*AAGUIDPolicy, error) {
+	p := &AAGUIDPolicy{}
+	var err error
+	if p.allow, err = aaguidSet(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = aaguidSet(deny); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func aaguidSet(values []string) (map[string]struct{}, error) {
+	set := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AAGUID %q: %w", v, err)
+		}
+		set[id.String()] = struct{}{}
+	}
+	return set, nil
+}
+
+// Check は登録されたクレデンシャルがポリシーを満たすか確認する。
+// 許可リストを使う場合、自己申告の AAGUID を信用しないよう "none" 以外のアテステーションを要求する。
+func (p *AAGUIDPolicy) Check(cred webauthn.Credential) error {
+	aaguid := formatAAGUID(cred.Authenticator.AAGUID)
+	if _, ok := p.deny[aaguid]; ok {
+		return errAAGUIDDenied
+	}
+	if len(p.allow) == 0 {
+		return nil
+	}
+	if cred.AttestationType == "" || protocol.AttestationFormat(cred.AttestationType) == protocol.AttestationFormatNone {
+		return errAttestationRequired
+	}
+	if _, ok := p.allow[aaguid]; !ok {
+		return errAAGUIDNotAllowed
+	}
+	return nil
+}
+
+// recordRegistrationRejected はポリシーで拒否された登録を監査ログに残す。
+func (h *PasskeyHandler) recordRegistrationRejected(ctx context.Context, user domain.User, cred webauthn.Credential, reason error) {
+	h.audit(ctx, domain.AuditEvent{
+		Action:  "passkey.registration_rejected",
+		ActorID: user.ID,
+		Target:  base64.RawURLEncoding.EncodeToString(cred.ID),
+		Detail: map[string]string{
+			"aaguid":      formatAAGUID(cred.Authenticator.AAGUID),
+			"attestation": cred.AttestationType,
+			"reason":      reason.Error(),
+		},
+	})
+}
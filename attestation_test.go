@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	testHardwareAAGUID = "ee882879-721c-4913-9775-3dfcce97072a"
+	testPlatformAAGUID = "fbfc3007-154e-4ecc-8c0b-6e020557d7bd"
+)
+
+func TestAAGUIDPolicy_Check(t *testing.T) {
+	hardware := uuid.MustParse(testHardwareAAGUID)
+	platform := uuid.MustParse(testPlatformAAGUID)
+
+	tests := []struct {
+		name        string
+		allow, deny []string
+		aaguid      uuid.UUID
+		format      string
+		want        error
+	}{
+		{name: "no lists", aaguid: platform, format: "none"},
+		{name: "denied", deny: []string{testPlatformAAGUID}, aaguid: platform, format: "packed", want: errAAGUIDDenied},
+		{name: "not denied", deny: []string{testPlatformAAGUID}, aaguid: hardware, format: "none"},
+		{name: "allowed", allow: []string{testHardwareAAGUID}, aaguid: hardware, format: "packed"},
+		{name: "allowed in upper case", allow: []string{strings.ToUpper(testHardwareAAGUID)}, aaguid: hardware, format: "packed"},
+		{name: "not allowed", allow: []string{testHardwareAAGUID}, aaguid: platform, format: "packed", want: errAAGUIDNotAllowed},
+		{name: "allowlist needs attestation", allow: []string{testHardwareAAGUID}, aaguid: hardware, format: "none", want: errAttestationRequired},
+		{name: "deny wins over allow", allow: []string{testHardwareAAGUID}, deny: []string{testHardwareAAGUID}, aaguid: hardware, format: "packed", want: errAAGUIDDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewAAGUIDPolicy(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("NewAAGUIDPolicy failed: %v", err)
+			}
+			cred := webauthn.Credential{
+				AttestationType: tt.format,
+				Authenticator:   webauthn.Authenticator{AAGUID: tt.aaguid[:]},
+			}
+			if err := p.Check(cred); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestNewAAGUIDPolicy_InvalidAAGUID(t *testing.T) {
+	if _, err := NewAAGUIDPolicy([]string{"yubikey"}, nil); err == nil {
+		t.Error("expected error for invalid AAGUID")
+	}
+}
+
+// --- FIDO MDS BLOB ---
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) base64() string {
+	return base64.StdEncoding.EncodeToString(c.cert.Raw)
+}
+
+// writeMetadataBlob は signer で署名した MDS BLOB と、その検証に使うルート証明書（PEM）を書き出す。
+func writeMetadataBlob(t *testing.T, entries []map[string]any) (blobPath, rootPath string) {
+	t.Helper()
+	root := newTestCert(t, "Test MDS Root", true, nil)
+	intermediate := newTestCert(t, "Test MDS Intermediate", true, root)
+	signer := newTestCert(t, "Test MDS Signer", false, intermediate)
+
+	header, _ := json.Marshal(map[string]any{
+		"alg": "ES256",
+		"typ": "JWT",
+		"x5c": []string{signer.base64(), intermediate.base64()},
+	})
+	payload, _ := json.Marshal(map[string]any{
+		"legalHeader": "test",
+		"no":          1,
+		"nextUpdate":  time.Now().AddDate(0, 1, 0).Format(time.DateOnly),
+		"entries":     entries,
+	})
+	enc := base64.RawURLEncoding.EncodeToString
+	signingInput := enc(header) + "." + enc(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, signer.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign blob: %v", err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	dir := t.TempDir()
+	blobPath = filepath.Join(dir, "blob.jwt")
+	rootPath = filepath.Join(dir, "root.pem")
+	if err := os.WriteFile(blobPath, []byte(signingInput+"."+enc(sig)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	rootPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})
+	if err := os.WriteFile(rootPath, rootPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return blobPath, rootPath
+}
+
+func testMetadataEntry(aaguid string, attestationTypes ...string) map[string]any {
+	return map[string]any{
+		"aaguid":                 aaguid,
+		"timeOfLastStatusChange": "2024-01-01",
+		"statusReports": []map[string]any{
+			{"status": "FIDO_CERTIFIED", "effectiveDate": "2024-01-01"},
+		},
+		"metadataStatement": map[string]any{
+			"aaguid":           aaguid,
+			"description":      "Test Authenticator",
+			"attestationTypes": attestationTypes,
+		},
+	}
+}
+
+func TestLoadMetadataProvider(t *testing.T) {
+	blobPath, rootPath := writeMetadataBlob(t, []map[string]any{
+		testMetadataEntry(testHardwareAAGUID, "basic_full"),
+	})
+
+	mds, err := loadMetadataProvider(blobPath, rootPath, true)
+	if err != nil {
+		t.Fatalf("loadMetadataProvider failed: %v", err)
+	}
+	entry, err := mds.GetEntry(context.Background(), uuid.MustParse(testHardwareAAGUID))
+	if err != nil || entry == nil {
+		t.Fatalf("expected metadata entry, got %v, %v", entry, err)
+	}
+	if entry.MetadataStatement.Description != "Test Authenticator" {
+		t.Errorf("unexpected description: %q", entry.MetadataStatement.Description)
+	}
+	if !mds.GetValidateEntry(context.Background()) {
+		t.Error("expected entries to be required")
+	}
+}
+
+func TestLoadMetadataProvider_UntrustedRoot(t *testing.T) {
+	blobPath, _ := writeMetadataBlob(t, nil)
+	_, otherRoot := writeMetadataBlob(t, nil)
+
+	if _, err := loadMetadataProvider(blobPath, otherRoot, false); err == nil {
+		t.Error("expected error for blob signed under another root")
+	}
+	if _, err := loadMetadataProvider(blobPath, "", false); err == nil {
+		t.Error("expected error for blob not signed by the FIDO Alliance root")
+	}
+}
+
+func TestLoadMetadataProvider_MissingFile(t *testing.T) {
+	if _, err := loadMetadataProvider(filepath.Join(t.TempDir(), "missing.jwt"), "", false); err == nil {
+		t.Error("expected error for missing blob")
+	}
+}
+
+// --- Registration ---
+
+// attestation は navigator.credentials.create() の結果に相当する JSON を返す。
+// format が "packed" の場合はクレデンシャルの鍵による自己アテステーションを付ける。
+func (a *testAuthenticator) attestation(t *testing.T, challenge, origin, rpID, format string, aaguid uuid.UUID) string {
+	t.Helper()
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.create",
+		"challenge": challenge,
+		"origin":    origin,
+	})
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, 0x45) // UP | UV | AT
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+	authData = append(authData, aaguid[:]...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credID)))
+	authData = append(authData, a.credID...)
+	authData = append(authData, a.credential(t, 0).PublicKey...)
+
+	attStmt := map[string]any{}
+	if format == "packed" {
+		clientDataHash := sha256.Sum256(clientData)
+		digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+		sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+		if err != nil {
+			t.Fatalf("failed to sign attestation: %v", err)
+		}
+		attStmt = map[string]any{"alg": -7, "sig": sig}
+	}
+	attestationObject, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      format,
+		"attStmt":  attStmt,
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode attestation object: %v", err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    enc(a.credID),
+		"rawId": enc(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"attestationObject": enc(attestationObject),
+			"clientDataJSON":    enc(clientData),
+		},
+	})
+	return string(body)
+}
+
+// registerWithAuthenticator は BeginRegistration から FinishRegistration までを実行し、
+// FinishRegistration のレスポンスを返す。
+func registerWithAuthenticator(t *testing.T, h *PasskeyHandler, format string, aaguid uuid.UUID) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+
+	beginReq := httptest.NewRequest(http.MethodPost, "/passkey/register", strings.NewReader(`{"username":"bob"}`))
+	beginReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	beginRec := httptest.NewRecorder()
+	if err := h.BeginRegistration(e.NewContext(beginReq, beginRec)); err != nil {
+		t.Fatalf("BeginRegistration failed: %v", err)
+	}
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			User      struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(beginRec.Body.Bytes(), &options); err != nil {
+		t.Fatalf("failed to decode registration options: %v", err)
+	}
+
+	userHandle, _ := base64.RawURLEncoding.DecodeString(options.PublicKey.User.ID)
+	auth := newTestAuthenticator(t, userHandle)
+	body := auth.attestation(t, options.PublicKey.Challenge, "http://localhost:8080", "localhost", format, aaguid)
+	finishReq := httptest.NewRequest(http.MethodPost, "/passkey/register/finish", strings.NewReader(body))
+	finishReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for _, cookie := range beginRec.Result().Cookies() {
+		finishReq.AddCookie(cookie)
+	}
+	finishRec := httptest.NewRecorder()
+	if err := h.FinishRegistration(e.NewContext(finishReq, finishRec)); err != nil {
+		t.Fatalf("FinishRegistration failed: %v", err)
+	}
+	return finishRec
+}
+
+func newRegistrationTestHandler(t *testing.T, mds metadata.Provider) (*PasskeyHandler, *mockUserRepo, *memory.AuditStore) {
+	t.Helper()
+	wa, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Test",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:8080"},
+		MDS:           mds,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userRepo := newMockUserRepo()
+	auditLog := memory.NewAuditStore()
+	h := NewPasskeyHandler(wa, userRepo, newMockSessionRepo())
+	h.auditLog = auditLog
+	return h, userRepo, auditLog
+}
+
+func TestFinishRegistration_AAGUIDPolicy(t *testing.T) {
+	hardware := uuid.MustParse(testHardwareAAGUID)
+	platform := uuid.MustParse(testPlatformAAGUID)
+
+	tests := []struct {
+		name        string
+		allow, deny []string
+		format      string
+		aaguid      uuid.UUID
+		wantStatus  int
+	}{
+		{name: "no policy", format: "none", aaguid: platform, wantStatus: http.StatusOK},
+		{name: "allowed with attestation", allow: []string{testHardwareAAGUID}, format: "packed", aaguid: hardware, wantStatus: http.StatusOK},
+		{name: "allowed without attestation", allow: []string{testHardwareAAGUID}, format: "none", aaguid: hardware, wantStatus: http.StatusForbidden},
+		{name: "not allowed", allow: []string{testHardwareAAGUID}, format: "packed", aaguid: platform, wantStatus: http.StatusForbidden},
+		{name: "denied", deny: []string{testPlatformAAGUID}, format: "none", aaguid: platform, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, userRepo, auditLog := newRegistrationTestHandler(t, nil)
+			if tt.allow != nil || tt.deny != nil {
+				policy, err := NewAAGUIDPolicy(tt.allow, tt.deny)
+				if err != nil {
+					t.Fatal(err)
+				}
+				h.aaguidPolicy = policy
+			}
+
+			rec := registerWithAuthenticator(t, h, tt.format, tt.aaguid)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+
+			_, err := userRepo.GetByName(context.Background(), "bob")
+			events, _ := auditLog.List(context.Background())
+			if tt.wantStatus == http.StatusOK {
+				if err != nil {
+					t.Errorf("expected user to be created: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Error("rejected registration must not create the user")
+			}
+			if len(events) != 1 || events[0].Action != "passkey.registration_rejected" {
+				t.Fatalf("expected a registration_rejected audit event, got %+v", events)
+			}
+			if events[0].Detail["aaguid"] != tt.aaguid.String() {
+				t.Errorf("unexpected aaguid in audit event: %s", events[0].Detail["aaguid"])
+			}
+		})
+	}
+}
+
+func TestFinishRegistration_VerifiesAgainstMetadata(t *testing.T) {
+	blobPath, rootPath := writeMetadataBlob(t, []map[string]any{
+		testMetadataEntry(testHardwareAAGUID, "basic_full"),
+		testMetadataEntry(testPlatformAAGUID, "basic_surrogate"),
+	})
+	mds, err := loadMetadataProvider(blobPath, rootPath, true)
+	if err != nil {
+		t.Fatalf("loadMetadataProvider failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		aaguid     uuid.UUID
+		wantStatus int
+	}{
+		{name: "attestation type listed in metadata", aaguid: uuid.MustParse(testPlatformAAGUID), wantStatus: http.StatusOK},
+		{name: "self attestation from a full-attestation authenticator", aaguid: uuid.MustParse(testHardwareAAGUID), wantStatus: http.StatusBadRequest},
+		{name: "authenticator missing from metadata", aaguid: uuid.MustParse("d548826e-79b4-db40-a3d8-11116f7e8349"), wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _ := newRegistrationTestHandler(t, mds)
+
+			rec := registerWithAuthenticator(t, h, "packed", tt.aaguid)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// recordAudit は監査ログにイベントを記録する。監査ログ未設定時は何もしない。
+// 記録に失敗しても元の操作は取り消さず、ログに残すだけにする。
+func recordAudit(ctx context.Context, auditLog domain.AuditLog, event domain.AuditEvent) {
+	if auditLog == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := auditLog.Record(ctx, event); err != nil {
+		log.Printf("failed to record audit event %s: %v", event.Action, err)
+	}
+}
+
+// AuditHandler は管理者向けに監査ログの検索・エクスポート・検証を提供する。
+type AuditHandler struct {
+	auditLog domain.AuditLog
+}
+
+// NewAuditHandler は AuditHandler を生成する。
+func NewAuditHandler(al domain.AuditLog) *AuditHandler {
+	return &AuditHandler{auditLog: al}
+}
+
+type auditEventResponse struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`
+	ActorID  string            `json:"actor_id,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	Detail   map[string]string `json:"detail,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+func newAuditEventResponse(e domain.AuditEvent) auditEventResponse {
+	return auditEventResponse{
+		Seq:      e.Seq,
+		Time:     e.Time,
+		Action:   e.Action,
+		ActorID:  e.ActorID,
+		Target:   e.Target,
+		Detail:   e.Detail,
+		PrevHash: e.PrevHash,
+		Hash:     e.Hash,
+	}
+}
+
+// parseAuditQuery は ?actor=&action=&since=&until=&limit= を解釈する。時刻は RFC 3339 形式。
+func parseAuditQuery(c echo.Context) (domain.AuditQuery, error) {
+	q := domain.AuditQuery{
+		ActorID: c.QueryParam("actor"),
+		Action:  c.QueryParam("action"),
+	}
+	for _, p := range []struct {
+		name string
+		dst  *time.Time
+	}{
+		{"since", &q.Since},
+		{"until", &q.Until},
+	} {
+		v := c.QueryParam(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return domain.AuditQuery{}, fmt.Errorf("%s must be an RFC 3339 timestamp", p.name)
+		}
+		*p.dst = t
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return domain.AuditQuery{}, errors.New("limit must be a positive integer")
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// Query は条件に一致する監査イベントを記録順に返す。
+func (h *AuditHandler) Query(c echo.Context) error {
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	events, err := h.auditLog.Query(c.Request().Context(), q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to query audit log"})
+	}
+	resp := make([]auditEventResponse, 0, len(events))
+	for _, e := range events {
+		resp = append(resp, newAuditEventResponse(e))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Export は条件に一致する監査イベントを JSON Lines 形式でダウンロードさせる。
+// 各行に hash と prev_hash を含むため、エクスポート後もチェーンを検証できる。
+func (h *AuditHandler) Export(c echo.Context) error {
+	q, err := parseAuditQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	ctx := c.Request().Context()
+	events, err := h.auditLog.Query(ctx, q)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to query audit log"})
+	}
+
+	userData, _ := getAuthUserData(c)
+	actorID, _ := userData["id"].(string)
+	recordAudit(ctx, h.auditLog, domain.AuditEvent{
+		Action:  "audit.exported",
+		ActorID: actorID,
+		Detail:  map[string]string{"events": strconv.Itoa(len(events))},
+	})
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/x-ndjson")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+	res.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(res)
+	for _, e := range events {
+		if err := enc.Encode(newAuditEventResponse(e)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify は監査ログ全体のハッシュチェーンを検証する。
+func (h *AuditHandler) Verify(c echo.Context) error {
+	events, err := h.auditLog.List(c.Request().Context())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to read audit log"})
+	}
+	if err := domain.VerifyAuditChain(events); err != nil {
+		return c.JSON(http.StatusConflict, map[string]any{"status": "broken", "error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"status": "ok", "events": len(events)})
+}
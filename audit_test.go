@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+)
+
+func newAuditTestLog(t *testing.T) *memory.AuditStore {
+	t.Helper()
+	auditLog := memory.NewAuditStore()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []domain.AuditEvent{
+		{Action: "auth.login", ActorID: "alice", Detail: map[string]string{"method": "passkey"}},
+		{Action: "sanction.issued", ActorID: "mod", Target: "bob"},
+		{Action: "auth.logout", ActorID: "alice"},
+		{Action: "sanction.revoked", ActorID: "mod", Target: "bob"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := auditLog.Record(context.Background(), e); err != nil {
+			t.Fatalf("Record: %v", err)
+		}
+	}
+	return auditLog
+}
+
+func TestAuditHandler_Query(t *testing.T) {
+	h := NewAuditHandler(newAuditTestLog(t))
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		wantSeqs []uint64
+	}{
+		{name: "all", query: "", wantCode: http.StatusOK, wantSeqs: []uint64{1, 2, 3, 4}},
+		{name: "actor", query: "actor=alice", wantCode: http.StatusOK, wantSeqs: []uint64{1, 3}},
+		{name: "action prefix", query: "action=sanction.", wantCode: http.StatusOK, wantSeqs: []uint64{2, 4}},
+		{name: "exact action", query: "action=auth.login", wantCode: http.StatusOK, wantSeqs: []uint64{1}},
+		{name: "time range", query: "since=2026-01-01T01:00:00Z&until=2026-01-01T03:00:00Z", wantCode: http.StatusOK, wantSeqs: []uint64{2, 3}},
+		{name: "limit keeps latest", query: "limit=2", wantCode: http.StatusOK, wantSeqs: []uint64{3, 4}},
+		{name: "invalid since", query: "since=yesterday", wantCode: http.StatusBadRequest},
+		{name: "invalid limit", query: "limit=0", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newSignedInContext(http.MethodGet, "/admin/audit?"+tt.query, "", "admin")
+			if err := h.Query(c); err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantCode, rec.Code, rec.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var events []auditEventResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+				t.Fatalf("unmarshal: %v", err)
+			}
+			var seqs []uint64
+			for _, e := range events {
+				seqs = append(seqs, e.Seq)
+			}
+			if len(seqs) != len(tt.wantSeqs) {
+				t.Fatalf("expected seqs %v, got %v", tt.wantSeqs, seqs)
+			}
+			for i := range seqs {
+				if seqs[i] != tt.wantSeqs[i] {
+					t.Fatalf("expected seqs %v, got %v", tt.wantSeqs, seqs)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditHandler_Export(t *testing.T) {
+	auditLog := newAuditTestLog(t)
+	h := NewAuditHandler(auditLog)
+
+	c, rec := newSignedInContext(http.MethodGet, "/admin/audit/export?actor=mod", "", "admin")
+	if err := h.Export(c); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("expected ndjson content type, got %q", got)
+	}
+	if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, "attachment;") {
+		t.Errorf("expected attachment disposition, got %q", got)
+	}
+
+	var exported []auditEventResponse
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		var e auditEventResponse
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		exported = append(exported, e)
+	}
+	if len(exported) != 2 || exported[0].Seq != 2 || exported[1].Seq != 4 {
+		t.Fatalf("expected sanction events 2 and 4, got %v", exported)
+	}
+
+	events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "audit.exported"})
+	if len(events) != 1 || events[0].ActorID != "admin" || events[0].Detail["events"] != "2" {
+		t.Errorf("expected export to be audited, got %v", events)
+	}
+}
+
+// tamperedAuditLog は List の結果を書き換えて改ざんされた監査ログを再現する。
+type tamperedAuditLog struct {
+	*memory.AuditStore
+}
+
+func (l tamperedAuditLog) List(ctx context.Context) ([]domain.AuditEvent, error) {
+	events, err := l.AuditStore.List(ctx)
+	if err == nil && len(events) > 1 {
+		events[1].Target = "someone-else"
+	}
+	return events, err
+}
+
+func TestAuditHandler_Verify(t *testing.T) {
+	auditLog := newAuditTestLog(t)
+
+	c, rec := newSignedInContext(http.MethodGet, "/admin/audit/verify", "", "admin")
+	if err := NewAuditHandler(auditLog).Verify(c); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"ok"`) {
+		t.Fatalf("expected intact chain, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	c, rec = newSignedInContext(http.MethodGet, "/admin/audit/verify", "", "admin")
+	if err := NewAuditHandler(tamperedAuditLog{auditLog}).Verify(c); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"broken"`) {
+		t.Fatalf("expected broken chain, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLogoutHandler_Audits(t *testing.T) {
+	auditLog := memory.NewAuditStore()
+	c, rec := newSignedInContext(http.MethodGet, "/logout", "", "alice")
+	if err := logoutHandler(auditLog)(c); err != nil {
+		t.Fatalf("logout: %v", err)
+	}
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected redirect, got %d", rec.Code)
+	}
+	events, _ := auditLog.List(context.Background())
+	if len(events) != 1 || events[0].Action != "auth.logout" || events[0].ActorID != "alice" {
+		t.Errorf("expected logout audit event, got %v", events)
+	}
+}
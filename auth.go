@@ -3,21 +3,20 @@ package main
 import (
 	"context"
 	"crypto/hmac"
-	"crypto/md5"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"encoding/base64"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"strings"
 	"sync"
 
+	"github.com/dchf12/chat/domain"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/objx"
 	"golang.org/x/oauth2"
@@ -32,7 +31,10 @@ var (
 	authOnce    sync.Once
 )
 
-const oauthStateCookieName = "oauth_state"
+const (
+	oauthStateCookieName = "oauth_state"
+	oauthLinkCookieName  = "oauth_link"
+)
 
 func init() {
 	creds, err := loadCredentials()
@@ -56,7 +58,14 @@ func init() {
 	}
 }
 
-func AuthMiddleware() echo.MiddlewareFunc {
+// banChecker はサイト全体の BAN を確認する。
+type banChecker interface {
+	GlobalBan(ctx context.Context, userID string) (domain.Sanction, bool)
+}
+
+// AuthMiddleware はログインしていないリクエストを /login にリダイレクトする。
+// bans が nil でなければ、サイト全体で BAN されたユーザーを拒否する。
+func AuthMiddleware(bans banChecker) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			userData, err := getAuthUserData(c)
@@ -64,24 +73,73 @@ func AuthMiddleware() echo.MiddlewareFunc {
 				clearAuthCookie(c)
 				return c.Redirect(http.StatusTemporaryRedirect, "/login")
 			}
+			if bans != nil {
+				userID, _ := userData["id"].(string)
+				if s, banned := bans.GlobalBan(c.Request().Context(), userID); banned {
+					clearAuthCookie(c)
+					return c.String(http.StatusForbidden, describeSanction(s, ""))
+				}
+			}
+			if isRecoverySession(userData) && !allowedDuringRecovery(c.Path()) {
+				// ページは設定画面に誘導し、それ以外の操作はリダイレクトで繰り返させずに拒否する
+				if c.Request().Method != http.MethodGet {
+					return c.JSON(http.StatusForbidden, map[string]string{"error": "register a new passkey first"})
+				}
+				return c.Redirect(http.StatusTemporaryRedirect, "/settings")
+			}
 			c.Set("userData", userData)
 			return next(c)
 		}
 	}
 }
 
-func loginHandler(c echo.Context) error {
+// SignedInMiddleware は有効な auth Cookie があるリクエストだけに mws を適用する。
+// パスキー登録のようにログインせずに使えるが、ログイン中はアカウントを変更する
+// エンドポイントと同じ認証・BAN・権限の確認を受けるべきルートに使う。
+func SignedInMiddleware(mws ...echo.MiddlewareFunc) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		guarded := next
+		for i := len(mws) - 1; i >= 0; i-- {
+			guarded = mws[i](guarded)
+		}
+		return func(c echo.Context) error {
+			if _, err := getAuthUserData(c); err != nil {
+				return next(c)
+			}
+			return guarded(c)
+		}
+	}
+}
+
+// OAuthHandler は外部 IdP による OAuth ログインのハンドラー。
+// ログインしたユーザーは UserRepository に永続化され、パスキーと同じ domain.User として扱われる。
+type OAuthHandler struct {
+	userRepo domain.UserRepository
+	// access が設定されている場合は新規ユーザーに管理者のブートストラップを適用する
+	access   *AccessControl
+	auditLog domain.AuditLog
+	// metrics が nil の場合はログインの成否を記録しない
+	metrics *Metrics
+}
+
+// NewOAuthHandler は OAuthHandler を生成する。
+func NewOAuthHandler(ur domain.UserRepository) *OAuthHandler {
+	return &OAuthHandler{userRepo: ur}
+}
+
+// Auth は /auth/:action/:provider をアクションごとに振り分ける。
+func (h *OAuthHandler) Auth(c echo.Context) error {
 	switch action := c.Param("action"); action {
-	case "login":
-		return handleLogin(c)
+	case "login", "link":
+		return h.handleLogin(c)
 	case "callback":
-		return handleCallback(c)
+		return h.handleCallback(c)
 	default:
 		return c.String(http.StatusNotFound, fmt.Sprintf("Auth action %s not supported", action))
 	}
 }
 
-func handleLogin(c echo.Context) error {
+func (h *OAuthHandler) handleLogin(c echo.Context) error {
 	provider := c.Param("provider")
 	if provider != "google" {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Unsupported provider: %s", provider))
@@ -89,6 +147,12 @@ func handleLogin(c echo.Context) error {
 	if googleConf == nil {
 		return c.String(http.StatusServiceUnavailable, "OAuth is not configured")
 	}
+	linking := c.Param("action") == "link"
+	if linking {
+		if _, err := currentUser(c, h.userRepo); err != nil {
+			return c.String(http.StatusUnauthorized, "sign in before linking an account")
+		}
+	}
 	state, err := generateOAuthState()
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to generate OAuth state")
@@ -102,11 +166,22 @@ func handleLogin(c echo.Context) error {
 		SameSite: http.SameSiteLaxMode,
 		Secure:   c.IsTLS(),
 	})
+	if linking {
+		c.SetCookie(&http.Cookie{
+			Name:     oauthLinkCookieName,
+			Value:    "1",
+			Path:     "/",
+			MaxAge:   300,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   c.IsTLS(),
+		})
+	}
 	loginURL := googleConf.AuthCodeURL(state, oauth2.AccessTypeOffline)
 	return c.Redirect(http.StatusTemporaryRedirect, loginURL)
 }
 
-func handleCallback(c echo.Context) error {
+func (h *OAuthHandler) handleCallback(c echo.Context) error {
 	provider := c.Param("provider")
 	if provider != "google" {
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Unsupported provider: %s", provider))
@@ -117,10 +192,12 @@ func handleCallback(c echo.Context) error {
 
 	stateCookie, err := c.Cookie(oauthStateCookieName)
 	if err != nil || stateCookie.Value == "" {
+		h.metrics.login("oauth", false)
 		return c.String(http.StatusBadRequest, "missing oauth state cookie")
 	}
 	queryState := c.QueryParam("state")
 	if queryState == "" || !hmac.Equal([]byte(queryState), []byte(stateCookie.Value)) {
+		h.metrics.login("oauth", false)
 		return c.String(http.StatusBadRequest, "invalid oauth state")
 	}
 	c.SetCookie(&http.Cookie{
@@ -132,34 +209,138 @@ func handleCallback(c echo.Context) error {
 		SameSite: http.SameSiteLaxMode,
 		Secure:   c.IsTLS(),
 	})
+	linkCookie, err := c.Cookie(oauthLinkCookieName)
+	linking := err == nil && linkCookie.Value != ""
+	if linking {
+		c.SetCookie(&http.Cookie{
+			Name:     oauthLinkCookieName,
+			Value:    "",
+			Path:     "/",
+			MaxAge:   -1,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+			Secure:   c.IsTLS(),
+		})
+	}
 
 	code := c.QueryParam("code")
 	ctx := context.Background()
 	token, err := googleConf.Exchange(ctx, code)
 	if err != nil {
+		h.metrics.login("oauth", false)
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Code exchange failed: %s", err.Error()))
 	}
 	client := googleConf.Client(ctx, token)
 	oauth2Service, err := oauth2api.NewService(ctx, option.WithHTTPClient(client))
 	if err != nil {
+		h.metrics.login("oauth", false)
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Failed to create a new oauth2 service: %s", err.Error()))
 	}
 	userInfo, err := oauth2Service.Userinfo.Get().Do()
 	if err != nil {
+		h.metrics.login("oauth", false)
 		return c.String(http.StatusBadRequest, fmt.Sprintf("Failed to get user info: %s", err.Error()))
 	}
-	m := md5.New()
-	_, _ = io.WriteString(m, strings.ToLower(userInfo.Email))
-	userID := fmt.Sprintf("%x", m.Sum(nil))
-	setAuthCookieValue(c, map[string]any{
-		"userid":     userID,
-		"name":       userInfo.Name,
-		"avatar_url": userInfo.Picture,
-		"email":      userInfo.Email,
+
+	reqCtx := c.Request().Context()
+	identity := domain.Identity{Provider: provider, Subject: userInfo.Id}
+	if linking {
+		user, err := h.linkIdentity(c, identity)
+		if err != nil {
+			return err
+		}
+		recordAudit(reqCtx, h.auditLog, domain.AuditEvent{
+			Action:  "identity.linked",
+			ActorID: user.ID,
+			Target:  user.ID,
+			Detail:  map[string]string{"provider": provider, "ip": c.RealIP()},
+		})
+		setAuthCookie(c, user)
+		return c.Redirect(http.StatusTemporaryRedirect, "/")
+	}
+
+	detail := map[string]string{"method": "oauth", "provider": provider, "ip": c.RealIP()}
+	user, err := h.userRepo.GetByIdentity(reqCtx, identity)
+	if err != nil {
+		user, err = h.createOAuthUser(reqCtx, identity, userInfo)
+		if err != nil {
+			h.metrics.login("oauth", false)
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Failed to create user: %s", err.Error()))
+		}
+		detail["new_account"] = "true"
+	}
+	recordAudit(reqCtx, h.auditLog, domain.AuditEvent{
+		Action:  "auth.login",
+		ActorID: user.ID,
+		Target:  user.ID,
+		Detail:  detail,
 	})
+	h.metrics.login("oauth", true)
+	setAuthCookie(c, user)
 	return c.Redirect(http.StatusTemporaryRedirect, "/")
 }
 
+// linkIdentity はログイン中のユーザーに外部 IdP アカウントを紐付ける。
+// 失敗時はレスポンスを書き込んだ上で echo に返すエラーを返す。
+func (h *OAuthHandler) linkIdentity(c echo.Context, identity domain.Identity) (domain.User, error) {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return domain.User{}, c.String(http.StatusUnauthorized, "sign in before linking an account")
+	}
+	if err := h.userRepo.LinkIdentity(c.Request().Context(), user.ID, identity); err != nil {
+		return domain.User{}, c.String(http.StatusConflict, "this account is already linked to another user")
+	}
+	return user, nil
+}
+
+// createOAuthUser は初回 OAuth ログインのユーザーを作成し、外部 IdP アカウントを紐付ける。
+// userid（Email の MD5）が従来の Cookie と一致するよう Email を保存する。
+func (h *OAuthHandler) createOAuthUser(ctx context.Context, identity domain.Identity, info *oauth2api.Userinfo) (domain.User, error) {
+	webAuthnID := make([]byte, 64)
+	if _, err := rand.Read(webAuthnID); err != nil {
+		return domain.User{}, fmt.Errorf("failed to generate WebAuthn ID: %w", err)
+	}
+
+	name := strings.ToLower(info.Email)
+	if _, err := h.userRepo.GetByName(ctx, name); err == nil || name == "" {
+		name = identity.Provider + ":" + identity.Subject
+	}
+
+	user := domain.User{
+		ID:          generateUUID(),
+		WebAuthnIDB: webAuthnID,
+		Name:        name,
+		DisplayName: info.Name,
+		Email:       info.Email,
+		AvatarURL:   info.Picture,
+	}
+	if err := h.userRepo.Create(ctx, user); err != nil {
+		return domain.User{}, err
+	}
+	if err := h.userRepo.LinkIdentity(ctx, user.ID, identity); err != nil {
+		return domain.User{}, err
+	}
+	var verifiedEmail string
+	if info.VerifiedEmail != nil && *info.VerifiedEmail {
+		verifiedEmail = info.Email
+	}
+	bootstrapRole(ctx, h.access, user, verifiedEmail)
+	return user, nil
+}
+
+// currentUser は認証Cookieが指すユーザーを UserRepository から取得する。
+func currentUser(c echo.Context, repo domain.UserRepository) (domain.User, error) {
+	userData, err := getAuthUserData(c)
+	if err != nil {
+		return domain.User{}, err
+	}
+	id, ok := userData["id"].(string)
+	if !ok || id == "" {
+		return domain.User{}, errors.New("auth cookie has no user id")
+	}
+	return repo.GetByID(c.Request().Context(), id)
+}
+
 func getAuthUserData(c echo.Context) (map[string]any, error) {
 	if v := c.Get("userData"); v != nil {
 		if userData, ok := v.(map[string]any); ok {
@@ -171,7 +352,15 @@ func getAuthUserData(c echo.Context) (map[string]any, error) {
 	if err != nil || cookie.Value == "" {
 		return nil, errors.New("auth cookie not found")
 	}
-	return parseAuthCookieValue(cookie.Value)
+	userData, err := parseAuthCookieValue(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	// API トークンは有効期限を Cookie では確かめられないため受け付けない
+	if _, ok := userData[tokenExpiryKey]; ok {
+		return nil, errors.New("API token used as auth cookie")
+	}
+	return userData, nil
 }
 
 func setAuthCookieValue(c echo.Context, userData map[string]any) {
@@ -64,7 +64,8 @@ func TestHandleLogin_SetsStateCookie(t *testing.T) {
 	c.SetParamNames("action", "provider")
 	c.SetParamValues("login", "google")
 
-	if err := handleLogin(c); err != nil {
+	h := NewOAuthHandler(newMockUserRepo())
+	if err := h.handleLogin(c); err != nil {
 		t.Fatalf("handleLogin failed: %v", err)
 	}
 	if rec.Code != http.StatusTemporaryRedirect {
@@ -104,10 +105,37 @@ func TestHandleCallback_InvalidState(t *testing.T) {
 	c.SetParamNames("action", "provider")
 	c.SetParamValues("callback", "google")
 
-	if err := handleCallback(c); err != nil {
+	h := NewOAuthHandler(newMockUserRepo())
+	if err := h.handleCallback(c); err != nil {
 		t.Fatalf("handleCallback failed: %v", err)
 	}
 	if rec.Code != http.StatusBadRequest {
 		t.Fatalf("unexpected status: %d", rec.Code)
 	}
 }
+
+func TestHandleLogin_LinkRequiresSignIn(t *testing.T) {
+	prev := googleConf
+	googleConf = &oauth2.Config{
+		ClientID: "cid",
+		Endpoint: oauth2.Endpoint{
+			AuthURL: "https://example.com/auth",
+		},
+	}
+	defer func() { googleConf = prev }()
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/auth/link/google", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("action", "provider")
+	c.SetParamValues("link", "google")
+
+	h := NewOAuthHandler(newMockUserRepo())
+	if err := h.handleLogin(c); err != nil {
+		t.Fatalf("handleLogin failed: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+}
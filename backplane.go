@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/dchf12/chat/infra/redis"
+	"github.com/dchf12/chat/trace"
+	"github.com/labstack/echo/v4"
+)
+
+// ルームのイベントをバックプレーンに流すときの種類。
+const (
+	// envelopeMessage はルーム全体へのメッセージ（削除通知などのシステムメッセージを含む）。
+	envelopeMessage = "message"
+	// envelopeDirect はユーザーや権限を宛先とするメッセージ。キックやミュートの通知に使う。
+	envelopeDirect = "direct"
+	// envelopePresence は接続の参加・退出。
+	envelopePresence = "presence"
+	// envelopePresenceSnapshot は発行したサーバーにいる接続の一覧。ハートビートを兼ねる。
+	envelopePresenceSnapshot = "presence_snapshot"
+	// envelopePresenceSync は他のサーバーに一覧の送信を求める。購読を始めたときに送る。
+	envelopePresenceSync = "presence_sync"
+)
+
+// backplaneBufferSize はバックプレーンとの送受信で溜められるイベントの数。
+const backplaneBufferSize = 1024
+
+// dedupWindow は重複排除のために覚えておくイベント ID の数。
+const dedupWindow = 4096
+
+// defaultPresenceInterval はプレゼンスの一覧を他のサーバーに送る間隔。
+const defaultPresenceInterval = 10 * time.Second
+
+// presenceMissedBeats 回続けて一覧が届かないサーバーは停止したとみなし、その接続をプレゼンスから取り除く。
+const presenceMissedBeats = 3
+
+// openBroker は -broker フラグの値から Broker を生成する。
+func openBroker(kind, redisAddr string) (domain.Broker, error) {
+	switch kind {
+	case "memory":
+		return memory.NewBroker(), nil
+	case "redis":
+		if redisAddr == "" {
+			return nil, fmt.Errorf("redis-addr is required for the redis broker")
+		}
+		return redis.NewBroker(redisAddr), nil
+	default:
+		return nil, fmt.Errorf("broker must be memory or redis, got %q", kind)
+	}
+}
+
+// envelope はバックプレーンで中継するルームのイベント。
+type envelope struct {
+	// ID は重複排除に使う。チャットメッセージではメッセージ ID と同じ。
+	ID string `json:"id"`
+	// Node は発行したサーバー。自分が発行したイベントは受信時に無視する。
+	Node       string            `json:"node"`
+	Kind       string            `json:"kind"`
+	Message    *message          `json:"message,omitempty"`
+	UserID     string            `json:"user_id,omitempty"`
+	Name       string            `json:"name,omitempty"`
+	Perm       domain.Permission `json:"perm,omitempty"`
+	Disconnect bool              `json:"disconnect,omitempty"`
+	Joined     bool              `json:"joined,omitempty"`
+	// Users は envelopePresenceSnapshot で送る、発行したサーバーにいる接続。
+	Users []PresenceUser `json:"users,omitempty"`
+}
+
+// roomTopic はルームのイベントを流す Broker のトピック。
+func roomTopic(id string) string {
+	return "chat:room:" + id
+}
+
+// dedupSet は最近見たイベント ID を上限付きで覚える。
+type dedupSet struct {
+	ids  map[string]struct{}
+	ring []string
+	next int
+}
+
+func newDedupSet(size int) *dedupSet {
+	return &dedupSet{ids: make(map[string]struct{}, size), ring: make([]string, size)}
+}
+
+// add は ID を記録し、初めて見た ID なら true を返す。
+func (s *dedupSet) add(id string) bool {
+	if _, ok := s.ids[id]; ok {
+		return false
+	}
+	if old := s.ring[s.next]; old != "" {
+		delete(s.ids, old)
+	}
+	s.ring[s.next] = id
+	s.next = (s.next + 1) % len(s.ring)
+	s.ids[id] = struct{}{}
+	return true
+}
+
+// presenceTable はクラスタ全体でルームに接続しているユーザーを数える。
+// room.run 以外の goroutine からも参照するためロックで保護する。
+type presenceTable struct {
+	mu    sync.Mutex
+	users map[string]*presenceEntry
+	// heard はサーバーごとに最後にイベントが届いた時刻。停止したサーバーの接続を取り除くのに使う。
+	heard map[string]time.Time
+}
+
+type presenceEntry struct {
+	name string
+	// nodes はサーバーごとの接続数。
+	nodes map[string]int
+}
+
+// PresenceUser は GET /rooms/:room/presence が返すユーザー。
+type PresenceUser struct {
+	UserID      string `json:"user_id"`
+	Name        string `json:"name"`
+	Connections int    `json:"connections"`
+}
+
+func newPresenceTable() *presenceTable {
+	return &presenceTable{users: make(map[string]*presenceEntry), heard: make(map[string]time.Time)}
+}
+
+// update は node での userID の接続数を増減し、接続中かどうかが変わったユーザーを返す。
+func (p *presenceTable) update(node, userID, name string, joined bool) []presenceChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.heard[node] = time.Now()
+	old, was := p.users[userID]
+	p.add(node, userID, name, joined)
+	e, ok := p.users[userID]
+	switch {
+	case ok == was:
+		return nil
+	case ok:
+		return []presenceChange{{userID: userID, name: e.name, online: true}}
+	default:
+		return []presenceChange{{userID: userID, name: old.name}}
+	}
+}
+
+func (p *presenceTable) add(node, userID, name string, joined bool) {
+	e, ok := p.users[userID]
+	if !ok {
+		if !joined {
+			return
+		}
+		e = &presenceEntry{nodes: make(map[string]int)}
+		p.users[userID] = e
+	}
+	if name != "" {
+		e.name = name
+	}
+	if joined {
+		e.nodes[node]++
+		return
+	}
+	if e.nodes[node]--; e.nodes[node] <= 0 {
+		delete(e.nodes, node)
+	}
+	if len(e.nodes) == 0 {
+		delete(p.users, userID)
+	}
+}
+
+// presenceChange はユーザーがクラスタ全体で接続し始めたか、すべての接続が切れたことを表す。
+type presenceChange struct {
+	userID string
+	name   string
+	online bool
+}
+
+// online は接続中のユーザーの ID と名前を返す。
+func (p *presenceTable) online() map[string]string {
+	names := make(map[string]string, len(p.users))
+	for id, e := range p.users {
+		names[id] = e.name
+	}
+	return names
+}
+
+// changes は before から接続し始めたユーザーと、いなくなったユーザーを ID 順に返す。
+func (p *presenceTable) changes(before map[string]string) []presenceChange {
+	var changes []presenceChange
+	for id, e := range p.users {
+		if _, ok := before[id]; !ok {
+			changes = append(changes, presenceChange{userID: id, name: e.name, online: true})
+		}
+	}
+	for id, name := range before {
+		if _, ok := p.users[id]; !ok {
+			changes = append(changes, presenceChange{userID: id, name: name})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].userID < changes[j].userID })
+	return changes
+}
+
+// replace は node の接続を node から届いた一覧で置き換え、接続中かどうかが変わったユーザーを返す。
+func (p *presenceTable) replace(node string, users []PresenceUser) []presenceChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	before := p.online()
+	p.heard[node] = time.Now()
+	p.drop(node)
+	for _, u := range users {
+		for range u.Connections {
+			p.add(node, u.UserID, u.Name, true)
+		}
+	}
+	return p.changes(before)
+}
+
+// expire は cutoff 以降にイベントが届いていないサーバーの接続を取り除き、いなくなったユーザーを返す。
+// local は自分なので取り除かない。
+func (p *presenceTable) expire(local string, cutoff time.Time) []presenceChange {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	before := p.online()
+	for node, at := range p.heard {
+		if node != local && at.Before(cutoff) {
+			p.drop(node)
+			delete(p.heard, node)
+		}
+	}
+	return p.changes(before)
+}
+
+func (p *presenceTable) drop(node string) {
+	for id, e := range p.users {
+		delete(e.nodes, node)
+		if len(e.nodes) == 0 {
+			delete(p.users, id)
+		}
+	}
+}
+
+// snapshot は node にいる接続を ID 順に返す。
+func (p *presenceTable) snapshot(node string) []PresenceUser {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var users []PresenceUser
+	for id, e := range p.users {
+		if n := e.nodes[node]; n > 0 {
+			users = append(users, PresenceUser{UserID: id, Name: e.name, Connections: n})
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	return users
+}
+
+// list は接続中のユーザーを ID 順に返す。
+func (p *presenceTable) list() []PresenceUser {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	users := make([]PresenceUser, 0, len(p.users))
+	for id, e := range p.users {
+		n := 0
+		for _, c := range e.nodes {
+			n += c
+		}
+		users = append(users, PresenceUser{UserID: id, Name: e.name, Connections: n})
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	return users
+}
+
+// startBackplane はルームのトピックを購読し、バックプレーンへの発行を始める。
+// 受信したイベントは inbound を通して room.run が処理する。
+func (r *room) startBackplane() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := r.broker.Subscribe(ctx, roomTopic(r.id))
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		<-r.done
+		cancel()
+	}()
+	go r.receiveBackplane(events)
+	go r.publishBackplane(ctx)
+	// 先に起動していたサーバーにいる接続を次のハートビートを待たずに知る
+	r.publish(envelope{Kind: envelopePresenceSync})
+	return nil
+}
+
+// heartbeat は一定時間イベントが届いていないサーバーの接続をプレゼンスから取り除き、
+// このサーバーにいる接続の一覧を他のサーバーに送る。
+func (r *room) heartbeat() {
+	r.announcePresence(r.presence.expire(r.node, time.Now().Add(-presenceMissedBeats*r.presenceInterval)))
+	r.publishPresence()
+}
+
+// publishPresence はこのサーバーにいる接続の一覧を他のサーバーに送る。
+func (r *room) publishPresence() {
+	r.publish(envelope{Kind: envelopePresenceSnapshot, Users: r.presence.snapshot(r.node)})
+}
+
+func (r *room) receiveBackplane(events <-chan []byte) {
+	for payload := range events {
+		var env envelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			r.tracer.Warn(context.Background(), trace.Event{Name: "backplane.invalid", Room: r.id,
+				Attrs: []slog.Attr{slog.String("error", err.Error())}})
+			continue
+		}
+		if env.Node == r.node {
+			continue
+		}
+		select {
+		case r.inbound <- env:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+func (r *room) publishBackplane(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-r.outbox:
+			if err := r.broker.Publish(ctx, roomTopic(r.id), payload); err != nil {
+				r.tracer.Warn(ctx, trace.Event{Name: "backplane.publish_failed", Room: r.id,
+					Attrs: []slog.Attr{slog.String("error", err.Error())}})
+			}
+		}
+	}
+}
+
+// publish はイベントをバックプレーンに送る。room.run を止めないよう、送信待ちが溢れたイベントは捨てる。
+func (r *room) publish(env envelope) {
+	if r.broker == nil {
+		return
+	}
+	if env.ID == "" {
+		env.ID = generateUUID()
+	}
+	env.Node = r.node
+	r.seen.add(env.ID)
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return
+	}
+	select {
+	case r.outbox <- payload:
+	default:
+		r.tracer.Warn(context.Background(), trace.Event{Name: "backplane.dropped", Room: r.id, MessageID: env.ID})
+	}
+}
+
+// receiveEnvelope は他のサーバーから届いたイベントをこのサーバーの接続に配信する。
+func (r *room) receiveEnvelope(ctx context.Context, env envelope) {
+	if !r.seen.add(env.ID) {
+		return
+	}
+	switch env.Kind {
+	case envelopeMessage:
+		if env.Message != nil {
+			r.broadcast(ctx, env.Message)
+		}
+	case envelopeDirect:
+		if env.Message != nil {
+			r.deliver(ctx, directedMessage{userID: env.UserID, perm: env.Perm, msg: env.Message, disconnect: env.Disconnect})
+		}
+	case envelopePresence:
+		r.announcePresence(r.presence.update(env.Node, env.UserID, env.Name, env.Joined))
+	case envelopePresenceSnapshot:
+		r.announcePresence(r.presence.replace(env.Node, env.Users))
+	case envelopePresenceSync:
+		r.publishPresence()
+	}
+}
+
+// PresenceHandler はクラスタ全体でルームに接続しているユーザーを返す。
+func (r *room) PresenceHandler(c echo.Context) error {
+	if c.Param("room") != r.id {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "room not found"})
+	}
+	return c.JSON(http.StatusOK, r.presence.list())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// newClusterNode は broker を共有するルームを起動し、別のサーバーに見立てる。
+func newClusterNode(t *testing.T, broker domain.Broker) (*room, *httptest.Server) {
+	t.Helper()
+	r := newRoom(UseAuthAvatar)
+	r.broker = broker
+	go r.run()
+	t.Cleanup(r.Stop)
+	// run が購読を終えてループに入るまで待つ
+	r.sendTo("nobody", &message{}, false)
+	return r, newRoomServer(t, echo.New(), r)
+}
+
+// waitPresence は r から見たクラスタ全体の接続ユーザーが want 人になるまで待つ。
+func waitPresence(t *testing.T, r *room, want int) []PresenceUser {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		users := r.presence.list()
+		if len(users) == want {
+			return users
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d users present, got %v", want, users)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// readMessage は hello や presence を読み飛ばして次のメッセージを返す。
+func readMessage(t *testing.T, ws *websocket.Conn) message {
+	t.Helper()
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		var got message
+		if err := ws.ReadJSON(&got); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if !isAnnouncement(&got) {
+			return got
+		}
+	}
+}
+
+// isAnnouncement は参加時の hello と、ユーザーの接続状態を知らせる presence を見分ける。
+func isAnnouncement(msg *message) bool {
+	return msg.System != nil && (msg.System.Action == "hello" || msg.System.Action == "presence")
+}
+
+func TestBackplane_MessageAcrossNodes(t *testing.T) {
+	broker := memory.NewBroker()
+	t.Cleanup(func() { _ = broker.Close() })
+	nodeA, srvA := newClusterNode(t, broker)
+	_, srvB := newClusterNode(t, broker)
+
+	alice, _, err := dialRoom(srvA, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial A: %v", err)
+	}
+	defer func() { _ = alice.Close() }()
+	bob, _, err := dialRoom(srvB, map[string]any{"id": "u2", "name": "bob", "avatar_url": "/b.png"})
+	if err != nil {
+		t.Fatalf("dial B: %v", err)
+	}
+	defer func() { _ = bob.Close() }()
+	users := waitPresence(t, nodeA, 2)
+	if users[1].UserID != "u2" || users[1].Name != "bob" {
+		t.Errorf("expected bob on the other node to be present, got %v", users)
+	}
+
+	if err := alice.WriteJSON(map[string]any{"Message": "hello"}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sent := readMessage(t, alice)
+	got := readMessage(t, bob)
+	if got.Message != "hello" || got.Name != "alice" || got.ID != sent.ID {
+		t.Errorf("expected bob to receive alice's message %s, got %+v", sent.ID, got)
+	}
+	if _, ok := nodeA.history.get(sent.ID); !ok {
+		t.Error("expected the message in the origin node's history")
+	}
+}
+
+func TestBackplane_Dedup(t *testing.T) {
+	broker := memory.NewBroker()
+	t.Cleanup(func() { _ = broker.Close() })
+	_, srv := newClusterNode(t, broker)
+
+	bob, _, err := dialRoom(srv, map[string]any{"id": "u2", "name": "bob", "avatar_url": "/b.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = bob.Close() }()
+
+	publish := func(id, text string) {
+		t.Helper()
+		payload, err := json.Marshal(envelope{ID: id, Node: "other", Kind: envelopeMessage, Message: &message{ID: id, Name: "alice", Message: text}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := broker.Publish(t.Context(), roomTopic(defaultRoomID), payload); err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+	publish("m1", "first")
+	publish("m1", "first")
+	publish("m2", "second")
+
+	for _, want := range []string{"first", "second"} {
+		if got := readMessage(t, bob); got.Message != want {
+			t.Fatalf("expected %q, got %+v", want, got)
+		}
+	}
+}
+
+func TestBackplane_KickAcrossNodes(t *testing.T) {
+	broker := memory.NewBroker()
+	t.Cleanup(func() { _ = broker.Close() })
+	nodeA, _ := newClusterNode(t, broker)
+	nodeB, srvB := newClusterNode(t, broker)
+
+	bob, _, err := dialRoom(srvB, map[string]any{"id": "u2", "name": "bob", "avatar_url": "/b.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = bob.Close() }()
+	waitPresence(t, nodeA, 1)
+
+	nodeA.sendTo("u2", newSystemMessage("kicked", systemEvent{Action: "kicked"}), true)
+
+	got := readMessage(t, bob)
+	if got.System == nil || got.System.Action != "kicked" {
+		t.Fatalf("expected kick notice, got %+v", got)
+	}
+	_ = bob.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err := bob.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+	waitPresence(t, nodeA, 0)
+	waitPresence(t, nodeB, 0)
+}
+
+func TestBackplane_PresenceHeartbeat(t *testing.T) {
+	broker := memory.NewBroker()
+	t.Cleanup(func() { _ = broker.Close() })
+	start := func() *room {
+		r := newRoom(UseAuthAvatar)
+		r.broker = broker
+		r.presenceInterval = 20 * time.Millisecond
+		go r.run()
+		t.Cleanup(r.Stop)
+		return r
+	}
+	nodeA := start()
+	srvA := newRoomServer(t, echo.New(), nodeA)
+	alice, _, err := dialRoom(srvA, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = alice.Close() }()
+	waitPresence(t, nodeA, 1)
+
+	// 後から起動したサーバーも既にいる接続を知る
+	nodeB := start()
+	if users := waitPresence(t, nodeB, 1); users[0].UserID != "u1" || users[0].Connections != 1 {
+		t.Errorf("expected alice from the other node, got %v", users)
+	}
+
+	// 退出を知らせずに止まったサーバーの接続はハートビートが途絶えると取り除かれる
+	nodeA.Stop()
+	waitPresence(t, nodeB, 0)
+}
+
+func TestRoom_PresenceEvents(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	t.Cleanup(r.Stop)
+	alice := joinTestClient(r, "alice")
+	next := func() *message {
+		t.Helper()
+		select {
+		case msg := <-alice.send:
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for presence")
+			return nil
+		}
+	}
+	if msg := next(); msg.System.Action != "presence" || msg.UserID != "alice" || msg.System.Reason != "online" {
+		t.Fatalf("expected alice to come online, got %+v", msg)
+	}
+
+	bob := &client{send: make(chan *message, 8), room: r, userData: map[string]any{"id": "bob", "name": "bob"}}
+	r.join <- bob
+	if msg := next(); msg.UserID != "bob" || msg.Name != "bob" || msg.System.Reason != "online" || msg.Seq != 0 {
+		t.Fatalf("expected bob to come online, got %+v", msg)
+	}
+	// 同じユーザーの 2 つ目の接続では知らせない
+	second := joinTestClient(r, "bob")
+	r.leave <- second
+	syncRoom(r)
+	if len(alice.send) != 0 {
+		t.Errorf("expected no presence for bob's second connection, got %+v", <-alice.send)
+	}
+	r.leave <- bob
+	if msg := next(); msg.UserID != "bob" || msg.System.Reason != "offline" {
+		t.Fatalf("expected bob to go offline, got %+v", msg)
+	}
+	if msgs, _ := r.history.since(0); len(msgs) != 0 {
+		t.Errorf("presence must not enter history, got %d messages", len(msgs))
+	}
+}
+
+func TestPresenceTable_Snapshot(t *testing.T) {
+	p := newPresenceTable()
+	p.update("local", "u1", "alice", true)
+	p.update("n1", "u1", "alice", true)
+	p.update("n1", "u2", "bob", true)
+	p.update("n2", "u3", "carol", true)
+
+	// 一覧は届いた時点の n1 の接続で置き換える
+	p.replace("n1", []PresenceUser{{UserID: "u4", Name: "dave", Connections: 2}})
+	want := []PresenceUser{
+		{UserID: "u1", Name: "alice", Connections: 1},
+		{UserID: "u3", Name: "carol", Connections: 1},
+		{UserID: "u4", Name: "dave", Connections: 2},
+	}
+	if got := p.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+	if got := p.snapshot("n1"); !reflect.DeepEqual(got, want[2:]) {
+		t.Errorf("expected n1 to have %v, got %v", want[2:], got)
+	}
+
+	// 自分の接続は期限切れにしない
+	p.expire("local", time.Now().Add(time.Minute))
+	want = []PresenceUser{{UserID: "u1", Name: "alice", Connections: 1}}
+	if got := p.list(); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRoom_PresenceHandler(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	r.presence.update("n1", "u1", "alice", true)
+	r.presence.update("n2", "u1", "alice", true)
+	r.presence.update("n2", "u2", "bob", true)
+	r.presence.update("n2", "u2", "bob", false)
+
+	tests := []struct {
+		name     string
+		room     string
+		wantCode int
+		want     []PresenceUser
+	}{
+		{name: "room", room: defaultRoomID, wantCode: http.StatusOK, want: []PresenceUser{{UserID: "u1", Name: "alice", Connections: 2}}},
+		{name: "unknown room", room: "other", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := echo.New()
+			rec := httptest.NewRecorder()
+			c := e.NewContext(httptest.NewRequest(http.MethodGet, "/rooms/"+tt.room+"/presence", nil), rec)
+			c.SetParamNames("room")
+			c.SetParamValues(tt.room)
+			if err := r.PresenceHandler(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode {
+				t.Fatalf("expected status %d, got %d", tt.wantCode, rec.Code)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []PresenceUser
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != tt.want[0] {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+)
+
+// SlowClientPolicy は送信バッファが一杯になった接続への対応。
+type SlowClientPolicy string
+
+const (
+	// SlowClientDisconnect は closeSlowConsumer のクローズコードで接続を切る。
+	SlowClientDisconnect SlowClientPolicy = "disconnect"
+	// SlowClientDropOldest は古いメッセージから捨て、捨てた件数を知らせる通知を差し込む。
+	SlowClientDropOldest SlowClientPolicy = "drop_oldest"
+	// SlowClientCoalesce は入力中表示などの一時的なイベントを最新のものだけに畳み、
+	// それでも空かなければ drop_oldest と同じく古いメッセージを捨てる。
+	SlowClientCoalesce SlowClientPolicy = "coalesce"
+)
+
+// closeSlowConsumer は送信が追いつかない接続を切るときのクローズコード（アプリケーション定義の範囲）。
+const closeSlowConsumer = 4001
+
+// ephemeralActions は後から届いたもので置き換えてよい一時的なシステムイベント。
+// typing はクライアントが入力中に送り、presence はユーザーの接続状態が変わるとサーバーが送る。
+// どちらも番号を振らず履歴にも残さない。
+var ephemeralActions = map[string]bool{
+	"typing":   true,
+	"presence": true,
+}
+
+// BackpressureConfig は送信が追いつかない接続の扱い。
+type BackpressureConfig struct {
+	Policy SlowClientPolicy
+	// SendBuffer は接続ごとに溜められるメッセージの数。
+	SendBuffer int
+}
+
+func defaultBackpressureConfig() BackpressureConfig {
+	return BackpressureConfig{Policy: SlowClientDisconnect, SendBuffer: 256}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+func (c *BackpressureConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar((*string)(&c.Policy), "slow-client-policy", string(c.Policy), "What to do when a client's send buffer is full: disconnect, drop_oldest or coalesce.")
+	fs.IntVar(&c.SendBuffer, "send-buffer", c.SendBuffer, "Messages buffered per WebSocket client before the slow client policy applies.")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c BackpressureConfig) Validate() error {
+	var errs []error
+	switch c.Policy {
+	case SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce:
+	default:
+		errs = append(errs, fmt.Errorf("slow-client-policy must be disconnect, drop_oldest or coalesce, got %q", c.Policy))
+	}
+	// 通知と新しいメッセージの 2 件分は空けられる必要がある
+	if c.SendBuffer < 2 {
+		errs = append(errs, fmt.Errorf("send-buffer must be at least 2, got %d", c.SendBuffer))
+	}
+	return errors.Join(errs...)
+}
+
+// coalesceKey は置き換え可能なイベントの種類と送信者を返す。置き換えられないメッセージは空文字列。
+func coalesceKey(msg *message) string {
+	if msg.System == nil || !ephemeralActions[msg.System.Action] {
+		return ""
+	}
+	return msg.System.Action + "/" + msg.UserID
+}
+
+// skippedMessage は送信が追いつかずに捨てたメッセージの件数を知らせる通知。
+func skippedMessage(n int) *message {
+	return newSystemMessage(strconv.Itoa(n)+" messages were skipped because your connection could not keep up.",
+		systemEvent{Action: "messages_skipped", Reason: strconv.Itoa(n)})
+}
+
+// enqueue は c の送信バッファに msg を入れる。room.run を止めないよう、バッファが一杯でも待たない。
+// 一杯の場合はポリシーに従い、接続を切るべきときは false を返す。skipped は捨てたメッセージの件数。
+func (r *room) enqueue(c *client, msg *message) (ok bool, skipped int) {
+	select {
+	case c.send <- msg:
+		return true, 0
+	default:
+	}
+	if cap(c.send) < 2 {
+		// 通知を差し込む余地がないバッファでは切断するしかない
+		return false, 0
+	}
+	switch r.backpressure.Policy {
+	case SlowClientDropOldest:
+		return true, dropOldest(c, msg)
+	case SlowClientCoalesce:
+		if coalesce(c, msg) {
+			return true, 0
+		}
+		return true, dropOldest(c, msg)
+	default:
+		return false, 0
+	}
+}
+
+// dropOldest は通知と msg が入るまで古いメッセージを捨てる。
+// 通知は残したメッセージの前に置き、以前に差し込んだ通知の件数もまとめる。
+func dropOldest(c *client, msg *message) int {
+	skipped := 0
+	var kept []*message
+	for len(c.send) > 0 {
+		select {
+		case old := <-c.send:
+			if old.System != nil && old.System.Action == "messages_skipped" {
+				n, _ := strconv.Atoi(old.System.Reason)
+				skipped += n
+				continue
+			}
+			kept = append(kept, old)
+		default:
+			// write が先に読み出した
+		}
+	}
+	dropped := max(0, len(kept)-(cap(c.send)-2))
+	kept = kept[dropped:]
+	skipped += dropped
+	// 取り出した数より多くは戻さないので詰まらない
+	if skipped > 0 {
+		c.send <- skippedMessage(skipped)
+	}
+	for _, old := range kept {
+		c.send <- old
+	}
+	c.send <- msg
+	return dropped
+}
+
+// coalesce は送信待ちの置き換え可能なイベントを種類ごとに最新の 1 件だけ残し、msg が入れば true を返す。
+func coalesce(c *client, msg *message) bool {
+	key := coalesceKey(msg)
+	queued := make([]*message, 0, len(c.send))
+	for len(c.send) > 0 {
+		select {
+		case old := <-c.send:
+			queued = append(queued, old)
+		default:
+		}
+	}
+	latest := make(map[string]int)
+	for i, old := range queued {
+		if k := coalesceKey(old); k != "" {
+			latest[k] = i
+		}
+	}
+	for i, old := range queued {
+		k := coalesceKey(old)
+		if k != "" && (latest[k] != i || k == key) {
+			continue
+		}
+		// 取り出した数より多くは戻さないので詰まらない
+		c.send <- old
+	}
+	select {
+	case c.send <- msg:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func typingMessage(userID string) *message {
+	msg := newSystemMessage("", systemEvent{Action: "typing"})
+	msg.UserID = userID
+	return msg
+}
+
+// drain は送信バッファに溜まったメッセージを取り出す。
+func drain(c *client) []*message {
+	var msgs []*message
+	for len(c.send) > 0 {
+		msgs = append(msgs, <-c.send)
+	}
+	return msgs
+}
+
+func describe(msgs []*message) []string {
+	var out []string
+	for _, msg := range msgs {
+		switch {
+		case msg.System == nil:
+			out = append(out, msg.ID)
+		case msg.System.Action == "messages_skipped":
+			out = append(out, "skipped:"+msg.System.Reason)
+		default:
+			out = append(out, msg.System.Action+":"+msg.UserID)
+		}
+	}
+	return out
+}
+
+func TestRoom_SlowClientPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    SlowClientPolicy
+		queued    []*message
+		msgs      []*message
+		want      []string
+		wantAlive bool
+	}{
+		{
+			name:   "disconnect",
+			policy: SlowClientDisconnect,
+			queued: []*message{{ID: "m1"}, {ID: "m2"}, {ID: "m3"}, {ID: "m4"}},
+			msgs:   []*message{{ID: "m5"}},
+			want:   []string{"m1", "m2", "m3", "m4"},
+		},
+		{
+			name:      "drop oldest",
+			policy:    SlowClientDropOldest,
+			queued:    []*message{{ID: "m1"}, {ID: "m2"}, {ID: "m3"}, {ID: "m4"}},
+			msgs:      []*message{{ID: "m5"}, {ID: "m6"}},
+			want:      []string{"skipped:3", "m4", "m5", "m6"},
+			wantAlive: true,
+		},
+		{
+			name:      "coalesce typing",
+			policy:    SlowClientCoalesce,
+			queued:    []*message{typingMessage("u1"), {ID: "m1"}, typingMessage("u1"), typingMessage("u3")},
+			msgs:      []*message{typingMessage("u1")},
+			want:      []string{"m1", "typing:u3", "typing:u1"},
+			wantAlive: true,
+		},
+		{
+			name:      "coalesce falls back to drop oldest",
+			policy:    SlowClientCoalesce,
+			queued:    []*message{{ID: "m1"}, {ID: "m2"}, {ID: "m3"}, {ID: "m4"}},
+			msgs:      []*message{{ID: "m5"}},
+			want:      []string{"skipped:2", "m3", "m4", "m5"},
+			wantAlive: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRoom(UseAuthAvatar)
+			r.metrics = NewMetrics()
+			r.backpressure.Policy = tt.policy
+			s := newShards(r, 1)[0]
+			c := &client{send: make(chan *message, 4), room: r, userData: map[string]any{"id": "u2"}}
+			s.clients[c] = struct{}{}
+			for _, msg := range tt.queued {
+				c.send <- msg
+			}
+			for _, msg := range tt.msgs {
+				s.fanOut(msg)
+			}
+
+			_, alive := s.clients[c]
+			if alive != tt.wantAlive {
+				t.Fatalf("expected client alive %v, got %v", tt.wantAlive, alive)
+			}
+			if !alive && (c.closeCode != closeSlowConsumer || len(r.evicted) != 1) {
+				t.Errorf("expected close code %d and eviction, got %d, %v", closeSlowConsumer, c.closeCode, r.evicted)
+			}
+			if got := describe(drain(c)); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected queue %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoom_SlowClientMetrics(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	r.metrics = NewMetrics()
+	r.backpressure.Policy = SlowClientDropOldest
+	s := newShards(r, 1)[0]
+	c := &client{send: make(chan *message, 2), room: r, userData: map[string]any{"id": "u2"}}
+	s.clients[c] = struct{}{}
+	for i := range 5 {
+		s.fanOut(&message{ID: fmt.Sprintf("m%d", i)})
+	}
+	// 2 件でバッファが埋まり、以降は通知と最新のメッセージだけが残る
+	if got := testutil.ToFloat64(r.metrics.skippedMessages.WithLabelValues(defaultRoomID)); got != 4 {
+		t.Errorf("expected 4 skipped messages, got %v", got)
+	}
+	if got := testutil.ToFloat64(r.metrics.droppedClients.WithLabelValues(defaultRoomID)); got != 0 {
+		t.Errorf("expected no dropped clients, got %v", got)
+	}
+}
+
+func TestBackpressureConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  BackpressureConfig
+		wantErr bool
+	}{
+		{name: "default", config: defaultBackpressureConfig()},
+		{name: "coalesce", config: BackpressureConfig{Policy: SlowClientCoalesce, SendBuffer: 16}},
+		{name: "unknown policy", config: BackpressureConfig{Policy: "block", SendBuffer: 16}, wantErr: true},
+		{name: "tiny buffer", config: BackpressureConfig{Policy: SlowClientDropOldest, SendBuffer: 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// BenchmarkRoom_Broadcast は多数の接続への配信を計測する。1% の接続は送信バッファを読み出さない。
+func BenchmarkRoom_Broadcast(b *testing.B) {
+	for _, policy := range []SlowClientPolicy{SlowClientDisconnect, SlowClientDropOldest, SlowClientCoalesce} {
+		for _, n := range []int{1000, 5000} {
+			b.Run(fmt.Sprintf("%s/clients=%d", policy, n), func(b *testing.B) {
+				r := newRoom(UseAuthAvatar)
+				r.backpressure.Policy = policy
+				go r.run()
+				defer r.Stop()
+				ctx, cancel := context.WithCancel(context.Background())
+				var wg sync.WaitGroup
+				for i := range n {
+					// 同じユーザーの接続にして、参加のたびに presence を全員に配らない
+					c := &client{send: make(chan *message, 64), room: r, userData: map[string]any{"id": "u0"}}
+					r.join <- c
+					// 参加時の hello
+					<-c.send
+					if i%100 == 0 {
+						continue
+					}
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for {
+							select {
+							case <-ctx.Done():
+								return
+							case _, ok := <-c.send:
+								if !ok {
+									return
+								}
+							}
+						}
+					}()
+				}
+				syncRoom(r)
+				msg := &message{ID: "m", UserID: "u0", Message: "hello"}
+
+				b.ResetTimer()
+				for range b.N {
+					m := *msg
+					r.forward <- &m
+					r.waitShards()
+				}
+				b.StopTimer()
+				cancel()
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// BenchmarkRoom_BroadcastShards はシャードの数を変えて、全員が読み出している多数の接続への配信を計測する。
+// 1 回の操作は 1 メッセージを全員の send に入れるまで。shards=1 は一つの goroutine で配信していた以前の構成に相当する。
+// 既定のシャード数は GOMAXPROCS なので、-cpu と同じシャード数の結果を比べる。
+func BenchmarkRoom_BroadcastShards(b *testing.B) {
+	for _, n := range []int{1000, 10000, 50000} {
+		for _, shards := range []int{1, 4} {
+			b.Run(fmt.Sprintf("clients=%d/shards=%d", n, shards), func(b *testing.B) {
+				benchmarkBroadcast(b, n, shards)
+			})
+		}
+	}
+}
+
+func benchmarkBroadcast(b *testing.B, n, shards int) {
+	r := newRoom(UseAuthAvatar)
+	r.shards = newShards(r, shards)
+	go r.run()
+	defer r.Stop()
+
+	var received sync.WaitGroup
+	for range n {
+		// 同じユーザーの接続にして、参加のたびに presence を全員に配らない
+		c := &client{send: make(chan *message, 64), room: r, userData: map[string]any{"id": "u0"}}
+		r.join <- c
+		// 参加時の hello
+		<-c.send
+		go func() {
+			for msg := range c.send {
+				if !isAnnouncement(msg) {
+					received.Done()
+				}
+			}
+		}()
+	}
+	syncRoom(r)
+	msg := &message{ID: "m", UserID: "u0", Message: "hello", When: time.Now()}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		received.Add(n)
+		m := *msg
+		r.forward <- &m
+		received.Wait()
+	}
+}
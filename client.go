@@ -1,52 +1,376 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"sync"
 	"time"
 
+	"github.com/dchf12/chat/domain"
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 type client struct {
-	socket   *websocket.Conn
-	send     chan *message
-	room     *room
-	userData map[string]any
+	// transport はメッセージを書き込む接続（WebSocket または Server-Sent Events）。
+	transport transport
+	send      chan *message
+	room      *room
+	userData  map[string]any
+	// limit は接続ごとの送信レート制限。nil の場合は制限しない。
+	limit *tokenBucket
+	// conn は WebSocket 接続を受け付けたリクエストのスパン。メッセージのスパンからリンクする。
+	conn oteltrace.SpanContext
+	// done は write が終了すると閉じられる。シャットダウン時に送信バッファの書き出しを待つのに使う。
+	done chan struct{}
+	// closeCode は send が閉じられたときに送るクローズフレームのコード。0 の場合は通常の切断。
+	closeCode int
+	// resume は再接続であることを示す。参加時に since より後のメッセージを履歴から再送する。
+	resume bool
+	since  resumePoint
+	// lastTyping は最後に入力中の通知をルームに流した時刻。受信を処理する goroutine だけが触れる。
+	lastTyping time.Time
+	// shard はこの接続への送信を受け持つシャード。参加時に room.run が割り当てる。
+	shard *shard
+	// closeOnce は接続が閉じた理由を一度だけ記録する。最初に原因を見つけた側の理由を使う。
+	closeOnce sync.Once
 }
 
-func (c *client) read() {
-	defer func() { _ = c.socket.Close() }()
-	for {
-		var msg *message
-		if err := c.socket.ReadJSON(&msg); err == nil {
-			msg.When = time.Now()
-			name, ok := c.userData["name"].(string)
-			if !ok {
-				log.Printf("invalid userData: name is missing or not a string")
-				break
-			}
-			msg.Name = name
+// closeWriteWait はクローズフレームの書き込みを待つ時間。
+const closeWriteWait = time.Second
 
-			var err error
-			msg.AvatarURL, err = c.room.avatar.AvatarURL(c)
-			if err != nil {
-				log.Printf("failed to get avatar URL: %v", err)
-				continue
-			}
-			c.room.forward <- msg
-		} else {
+// 接続が閉じた理由。chat_websocket_closed_total のラベルに使う。
+const (
+	closeReasonClientClosed = "client_closed"
+	closeReasonPongTimeout  = "pong_timeout"
+	closeReasonTooLarge     = "message_too_large"
+	closeReasonReadError    = "read_error"
+	closeReasonInvalid      = "invalid_message"
+	closeReasonWriteTimeout = "write_timeout"
+	closeReasonWriteError   = "write_error"
+	closeReasonSlowClient   = "slow_client"
+	closeReasonDisconnected = "disconnected"
+	closeReasonShutdown     = "shutdown"
+)
+
+// ConnectionConfig は WebSocket 接続の死活監視とサイズ制限の設定。
+type ConnectionConfig struct {
+	// PingInterval ごとに ping を送る。PongWait より短くする。
+	PingInterval time.Duration
+	// PongWait の間に pong もメッセージも届かない接続は切断する。
+	PongWait time.Duration
+	// WriteWait は 1 回の書き込みを待つ時間。
+	WriteWait time.Duration
+	// MaxMessageSize はクライアントから受け取る 1 メッセージの上限バイト数。超えると切断する。
+	MaxMessageSize int64
+}
+
+func defaultConnectionConfig() ConnectionConfig {
+	return ConnectionConfig{
+		PingInterval:   30 * time.Second,
+		PongWait:       60 * time.Second,
+		WriteWait:      10 * time.Second,
+		MaxMessageSize: 16 << 10,
+	}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+func (c *ConnectionConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.PingInterval, "ws-ping-interval", c.PingInterval, "Interval between WebSocket pings. Must be shorter than ws-pong-wait.")
+	fs.DurationVar(&c.PongWait, "ws-pong-wait", c.PongWait, "Time to wait for a pong or message before a WebSocket connection is considered dead.")
+	fs.DurationVar(&c.WriteWait, "ws-write-wait", c.WriteWait, "Time allowed to write a single message to a WebSocket client.")
+	fs.Int64Var(&c.MaxMessageSize, "ws-max-message-size", c.MaxMessageSize, "Maximum size in bytes of a message received from a WebSocket client.")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c ConnectionConfig) Validate() error {
+	var errs []error
+	if c.PingInterval <= 0 || c.PongWait <= 0 || c.WriteWait <= 0 {
+		errs = append(errs, errors.New("ws-ping-interval, ws-pong-wait and ws-write-wait must be positive"))
+	}
+	if c.PingInterval >= c.PongWait {
+		errs = append(errs, fmt.Errorf("ws-ping-interval (%s) must be shorter than ws-pong-wait (%s)", c.PingInterval, c.PongWait))
+	}
+	if c.MaxMessageSize <= 0 {
+		errs = append(errs, fmt.Errorf("ws-max-message-size must be positive, got %d", c.MaxMessageSize))
+	}
+	return errors.Join(errs...)
+}
+
+// closed は接続が閉じた理由をメトリクスに記録する。2 回目以降の呼び出しは無視する。
+func (c *client) closed(reason string) {
+	c.closeOnce.Do(func() { c.room.metrics.connectionClosed(reason) })
+}
+
+// readCloseReason は読み込みエラーから接続が閉じた理由を判定する。
+func readCloseReason(err error) string {
+	var netErr net.Error
+	switch {
+	case websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived):
+		return closeReasonClientClosed
+	case errors.Is(err, websocket.ErrReadLimit):
+		return closeReasonTooLarge
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return closeReasonPongTimeout
+	default:
+		return closeReasonReadError
+	}
+}
+
+// writeCloseReason は書き込みエラーから接続が閉じた理由を判定する。
+func writeCloseReason(err error) string {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return closeReasonWriteTimeout
+	}
+	return closeReasonWriteError
+}
+
+// read は WebSocket から受信したメッセージをルームに転送する。
+func (c *client) read(ws *websocket.Conn) {
+	defer func() { _ = ws.Close() }()
+	cfg := c.room.connConfig
+	ws.SetReadLimit(cfg.MaxMessageSize)
+	// pong かメッセージが届くたびに期限を延ばし、応答のない接続は ReadMessage をタイムアウトさせる
+	extend := func() { _ = ws.SetReadDeadline(time.Now().Add(cfg.PongWait)) }
+	extend()
+	ws.SetPongHandler(func(string) error {
+		extend()
+		return nil
+	})
+	codec := codecFor(ws.Subprotocol())
+	// disconnected の後は write がソケットを閉じるまで受信したメッセージを捨てる
+	disconnected := false
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			c.closed(readCloseReason(err))
 			log.Printf("websocket read error: %v", err)
 			break
 		}
+		extend()
+		var msg *message
+		if err := codec.unmarshal(data, &msg); err != nil {
+			c.closed(closeReasonInvalid)
+			log.Printf("websocket decode error: %v", err)
+			break
+		}
+		if disconnected {
+			continue
+		}
+		if !c.handle(context.Background(), msg, &disconnected) {
+			break
+		}
+	}
+}
+
+// handle は受信したメッセージを chat.message.receive スパンの中で receive に渡す。
+func (c *client) handle(ctx context.Context, msg *message, disconnected *bool) bool {
+	// クライアントが traceparent を送ってきた場合はそのトレースに繋げる
+	msg.Trace = clientTrace(msg.Trace)
+	ctx, span := startSpan(extractTrace(ctx, msg), "chat.message.receive",
+		oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+		oteltrace.WithLinks(oteltrace.Link{SpanContext: c.conn}),
+		oteltrace.WithAttributes(attribute.String("chat.room", c.room.id), attribute.String("chat.user", c.userID())))
+	defer span.End()
+	return c.receive(ctx, msg, disconnected)
+}
+
+// receive は受信したメッセージを検査してルームに転送する。読み込みを続けられない場合は false を返す。
+func (c *client) receive(ctx context.Context, msg *message, disconnected *bool) bool {
+	if msg.System != nil && msg.System.Action == "typing" {
+		c.typing()
+		return true
+	}
+	rej, err := c.admit(ctx, msg)
+	switch {
+	case errors.Is(err, errUserDataInvalid):
+		return false
+	case err != nil:
+		return true
+	case rej == nil:
+	case rej.reason == dropRateDisconnect:
+		log.Printf("disconnecting user %s: repeated rate limit violations", c.userID())
+		c.room.sendTo(c.userID(), rej.notice, true)
+		*disconnected = true
+		return true
+	default:
+		if rej.notice != nil {
+			c.room.sendToClient(c, rej.notice)
+		}
+		return true
+	}
+	injectTrace(ctx, msg)
+	// 停止したルームには転送先がないため、読み込みをやめて接続を閉じさせる
+	select {
+	case c.room.forward <- msg:
+	case <-c.room.done:
+		return false
+	}
+	return true
+}
+
+// typingInterval より短い間隔で届いた入力中の通知はルームに流さない。
+const typingInterval = 2 * time.Second
+
+// typing は送信者が入力中であることをルームに知らせる。
+// メッセージを送れないユーザーの通知や、前の通知から間もない通知は黙って捨てる。
+func (c *client) typing() {
+	now := time.Now()
+	if now.Sub(c.lastTyping) < typingInterval {
+		return
+	}
+	if c.room.authorize(c, domain.PermSendMessage) != nil {
+		return
+	}
+	if _, muted := c.room.muted(c); muted {
+		return
+	}
+	c.lastTyping = now
+	name, _ := c.userData["name"].(string)
+	msg := newSystemMessage("", systemEvent{Action: "typing"})
+	msg.ID, msg.UserID, msg.Name = generateUUID(), c.userID(), name
+	select {
+	case c.room.forward <- msg:
+	case <-c.room.done:
+	}
+}
+
+// 受信したメッセージを受け付けなかった理由。スパンの chat.message.dropped 属性に記録する。
+const (
+	dropRateLimited    = "rate_limited"
+	dropRateDisconnect = "rate_limit_disconnect"
+	dropForbidden      = "forbidden"
+	dropMuted          = "muted"
+	dropFiltered       = "filtered"
+)
+
+// rejection は受け付けなかったメッセージの理由と、送信者に返す通知。
+type rejection struct {
+	reason string
+	// notice が nil の場合は送信者に知らせない
+	notice *message
+}
+
+// errUserDataInvalid は接続のユーザー情報にメッセージの送信者として必要な項目がないことを表す。
+var errUserDataInvalid = errors.New("invalid userData: name is missing or not a string")
+
+// admit は送信レート・権限・ミュート・フィルターを検査し、受け付ける場合は msg に ID や送信者を設定する。
+// WebSocket や Server-Sent Events の接続からのメッセージと API からの投稿で共通に使う。
+func (c *client) admit(ctx context.Context, msg *message) (*rejection, error) {
+	span := oteltrace.SpanFromContext(ctx)
+	reject := func(reason string, notice *message) (*rejection, error) {
+		span.SetAttributes(attribute.String("chat.message.dropped", reason))
+		return &rejection{reason: reason, notice: notice}, nil
+	}
+	switch d := c.room.allowMessage(c); d {
+	case rateLimited:
+		return reject(dropRateLimited, rateLimitMessage(d))
+	case rateDisconnect:
+		return reject(dropRateDisconnect, rateLimitMessage(d))
+	}
+	if err := c.room.authorize(c, domain.PermSendMessage); err != nil {
+		log.Printf("message dropped: %v", err)
+		return reject(dropForbidden, nil)
+	}
+	if s, muted := c.room.muted(c); muted {
+		return reject(dropMuted, sanctionMessage(s, c.room.id))
 	}
+	// クライアントが送った ID やシステム通知は信用しない
+	msg.ID, msg.UserID, msg.System, msg.EditedAt = generateUUID(), c.userID(), nil, nil
+	msg.When = time.Now()
+	span.SetAttributes(attribute.String("chat.message.id", msg.ID))
+	if reason, ok := c.room.filter(ctx, c, msg); !ok {
+		return reject(dropFiltered, filterRejectedMessage(reason))
+	}
+	name, ok := c.userData["name"].(string)
+	if !ok {
+		span.SetStatus(codes.Error, "name is missing")
+		log.Print(errUserDataInvalid)
+		return nil, errUserDataInvalid
+	}
+	msg.Name = name
+
+	var err error
+	msg.AvatarURL, err = c.room.avatar.AvatarURL(c)
+	if err != nil {
+		span.RecordError(err)
+		log.Printf("failed to get avatar URL: %v", err)
+		return nil, err
+	}
+	return nil, nil
+}
+
+// userID は接続しているユーザーの ID を返す。
+func (c *client) userID() string {
+	id, _ := c.userData["id"].(string)
+	return id
 }
 
 func (c *client) write() {
-	defer func() { _ = c.socket.Close() }()
-	for msg := range c.send {
-		if err := c.socket.WriteJSON(msg); err != nil {
-			log.Printf("websocket write error: %v", err)
-			break
+	defer func() {
+		_ = c.transport.close()
+		if c.done != nil {
+			close(c.done)
+		}
+	}()
+	cfg := c.room.connConfig
+	ping := time.NewTicker(cfg.PingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if !ok {
+				c.writeClose()
+				return
+			}
+			if err := c.writeMessage(msg); err != nil {
+				c.closed(writeCloseReason(err))
+				log.Printf("write error: %v", err)
+				return
+			}
+		case <-ping.C:
+			if err := c.transport.ping(); err != nil {
+				c.closed(writeCloseReason(err))
+				log.Printf("ping error: %v", err)
+				return
+			}
+		case <-c.transport.gone():
+			c.closed(closeReasonClientClosed)
+			return
 		}
 	}
 }
+
+// writeClose は send が閉じられたことをクローズコードで伝える。
+func (c *client) writeClose() {
+	// ルームが send を閉じた（退出・キック・シャットダウン・送信の遅延）ので、理由をクローズコードで伝える
+	code := c.closeCode
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+	c.transport.writeClose(code)
+}
+
+// writeMessage はメッセージを接続に書き込む。トレースコンテキストを持つメッセージは送信をスパンとして記録する。
+func (c *client) writeMessage(msg *message) error {
+	if len(msg.Trace) == 0 {
+		return c.transport.writeMessage(msg)
+	}
+	_, span := startSpan(extractTrace(context.Background(), msg), "chat.message.send",
+		oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+		oteltrace.WithAttributes(attribute.String("chat.room", c.room.id), attribute.String("chat.user", c.userID()), attribute.String("chat.message.id", msg.ID)))
+	defer span.End()
+	err := c.transport.writeMessage(msg)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "write failed")
+	}
+	return err
+}
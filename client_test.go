@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newHeartbeatRoom は短い ping 間隔と pong 待ち時間でルームを起動する。
+func newHeartbeatRoom(t *testing.T) (*room, *Metrics) {
+	t.Helper()
+	r := newRoom(UseAuthAvatar)
+	r.metrics = NewMetrics()
+	r.connConfig = ConnectionConfig{
+		PingInterval:   20 * time.Millisecond,
+		PongWait:       100 * time.Millisecond,
+		WriteWait:      100 * time.Millisecond,
+		MaxMessageSize: 256,
+	}
+	go r.run()
+	t.Cleanup(r.Stop)
+	return r, r.metrics
+}
+
+func waitClosed(t *testing.T, m *Metrics, reason string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(m.connsClosed.WithLabelValues(reason)) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected one connection closed with reason %s", reason)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestClient_DeadPeer(t *testing.T) {
+	r, m := newHeartbeatRoom(t)
+	srv := newRoomServer(t, echo.New(), r)
+
+	// 読み込みをしないクライアントは ping に pong を返さない
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	waitPresence(t, r, 1)
+
+	waitClosed(t, m, closeReasonPongTimeout)
+	waitPresence(t, r, 0)
+}
+
+func TestClient_PongKeepsAlive(t *testing.T) {
+	r, m := newHeartbeatRoom(t)
+	srv := newRoomServer(t, echo.New(), r)
+
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	// 読み込みを続けると既定の ping ハンドラーが pong を返す
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	waitPresence(t, r, 1)
+
+	time.Sleep(3 * r.connConfig.PongWait)
+	if users := r.presence.list(); len(users) != 1 {
+		t.Errorf("expected a responsive client to stay connected, got %v", users)
+	}
+	if got := testutil.ToFloat64(m.connsClosed.WithLabelValues(closeReasonPongTimeout)); got != 0 {
+		t.Errorf("expected no pong timeouts, got %v", got)
+	}
+}
+
+func TestClient_MessageTooLarge(t *testing.T) {
+	r, m := newHeartbeatRoom(t)
+	srv := newRoomServer(t, echo.New(), r)
+
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	if err := ws.WriteJSON(map[string]any{"Message": strings.Repeat("a", 1024)}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+			t.Errorf("expected close code %d, got %v", websocket.CloseMessageTooBig, err)
+		}
+		break
+	}
+	waitClosed(t, m, closeReasonTooLarge)
+}
+
+func TestConnectionConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*ConnectionConfig)
+		wantErr bool
+	}{
+		{name: "default", modify: func(*ConnectionConfig) {}},
+		{name: "ping not shorter than pong wait", modify: func(c *ConnectionConfig) { c.PingInterval = c.PongWait }, wantErr: true},
+		{name: "zero write wait", modify: func(c *ConnectionConfig) { c.WriteWait = 0 }, wantErr: true},
+		{name: "zero message size", modify: func(c *ConnectionConfig) { c.MaxMessageSize = 0 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConnectionConfig()
+			tt.modify(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClient_Typing(t *testing.T) {
+	m, r, _ := newModerationTest(t,
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "alice"},
+		domain.User{ID: "bob"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	alice := &client{send: make(chan *message, 8), room: r, userData: map[string]any{"id": "alice", "name": "alice"}}
+	r.join <- alice
+	bob := joinTestClient(r, "bob")
+	typing := func() {
+		t.Helper()
+		var disconnected bool
+		if !alice.receive(context.Background(), &message{System: &systemEvent{Action: "typing"}}, &disconnected) {
+			t.Fatal("expected typing to keep the connection")
+		}
+		syncRoom(r)
+	}
+
+	typing()
+	msg, _ := receive(t, bob)
+	if msg.System == nil || msg.System.Action != "typing" || msg.UserID != "alice" || msg.Name != "alice" || msg.Seq != 0 {
+		t.Fatalf("expected alice's typing event, got %+v", msg)
+	}
+	if msgs, _ := r.history.since(0); len(msgs) != 0 {
+		t.Errorf("typing must not enter history, got %d messages", len(msgs))
+	}
+
+	// 間隔が短すぎる通知は流さない
+	typing()
+	if n := pending(bob); n != 0 {
+		t.Errorf("expected repeated typing to be dropped, got %d messages", n)
+	}
+
+	// ミュート中のユーザーの通知は流さない
+	if _, err := m.Issue(context.Background(), users["mod"], users["alice"], domain.SanctionMute, defaultRoomID, "spam", time.Minute); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	alice.lastTyping = time.Time{}
+	typing()
+	if n := pending(bob); n != 0 {
+		t.Errorf("expected a muted user's typing to be dropped, got %d messages", n)
+	}
+}
+
+func TestClient_ReceiveAfterRoomStopped(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	c := joinTestClient(r, "u1")
+	r.Stop()
+
+	done := make(chan bool)
+	go func() {
+		var disconnected bool
+		c.receive(context.Background(), &message{System: &systemEvent{Action: "typing"}}, &disconnected)
+		done <- c.receive(context.Background(), &message{Message: "hello"}, &disconnected)
+	}()
+	select {
+	case keep := <-done:
+		if keep {
+			t.Error("expected the client to stop reading once the room has stopped")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive blocked after the room stopped")
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// WebSocket のサブプロトコル。Sec-WebSocket-Protocol で接続ごとにエンコーディングを選ぶ。
+// 指定がない場合は JSON を使う。
+const (
+	subprotocolJSON    = "chat.v1+json"
+	subprotocolMsgpack = "chat.v1+msgpack"
+)
+
+// codec は接続ごとのメッセージのエンコーディング。
+type codec interface {
+	// id は preparedFrames の添え字。
+	id() int
+	// messageType は WebSocket のフレームの種類（テキストまたはバイナリ）。
+	messageType() int
+	marshal(v any) ([]byte, error)
+	unmarshal(data []byte, v any) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) id() int                            { return 0 }
+func (jsonCodec) messageType() int                   { return websocket.TextMessage }
+func (jsonCodec) marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// msgpackCodec は MessagePack でエンコードする。フィールド名は JSON と揃えるため json タグを使う。
+type msgpackCodec struct{}
+
+func (msgpackCodec) id() int          { return 1 }
+func (msgpackCodec) messageType() int { return websocket.BinaryMessage }
+
+func (msgpackCodec) marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+// codecCount は preparedFrames が保持するエンコーディングの数。
+const codecCount = 2
+
+// codecFor はネゴシエーションしたサブプロトコルのエンコーディングを返す。
+func codecFor(subprotocol string) codec {
+	if subprotocol == subprotocolMsgpack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// preparedFrames はブロードキャストするメッセージをエンコーディングごとに一度だけエンコードしたフレーム。
+// 最初にそのエンコーディングで送る接続がエンコードし、以降の接続は共有する。
+type preparedFrames struct {
+	frames [codecCount]preparedFrame
+}
+
+type preparedFrame struct {
+	once  sync.Once
+	data  []byte
+	frame *websocket.PreparedMessage
+	err   error
+}
+
+func (p *preparedFrames) get(c codec, msg *message) (*websocket.PreparedMessage, error) {
+	f := p.encode(c, msg)
+	return f.frame, f.err
+}
+
+// data はエンコード済みのバイト列を返す。WebSocket 以外の接続が使う。
+func (p *preparedFrames) data(c codec, msg *message) ([]byte, error) {
+	f := p.encode(c, msg)
+	return f.data, f.err
+}
+
+func (p *preparedFrames) encode(c codec, msg *message) *preparedFrame {
+	f := &p.frames[c.id()]
+	f.once.Do(func() {
+		f.data, f.err = c.marshal(msg)
+		if f.err == nil {
+			f.frame, f.err = websocket.NewPreparedMessage(c.messageType(), f.data)
+		}
+	})
+	return f
+}
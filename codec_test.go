@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+func TestRoom_Subprotocol(t *testing.T) {
+	tests := []struct {
+		name        string
+		offered     []string
+		wantProto   string
+		wantType    int
+		wantCodec   codec
+		compression bool
+	}{
+		{name: "default json", wantType: websocket.TextMessage, wantCodec: jsonCodec{}},
+		{name: "json", offered: []string{subprotocolJSON}, wantProto: subprotocolJSON, wantType: websocket.TextMessage, wantCodec: jsonCodec{}},
+		{name: "msgpack", offered: []string{subprotocolMsgpack}, wantProto: subprotocolMsgpack, wantType: websocket.BinaryMessage, wantCodec: msgpackCodec{}},
+		{name: "msgpack compressed", offered: []string{"chat.v2", subprotocolMsgpack}, wantProto: subprotocolMsgpack, wantType: websocket.BinaryMessage, wantCodec: msgpackCodec{}, compression: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRoom(UseAuthAvatar)
+			go r.run()
+			t.Cleanup(r.Stop)
+			srv := newRoomServer(t, echo.New(), r)
+
+			dialer := &websocket.Dialer{Subprotocols: tt.offered, EnableCompression: tt.compression}
+			ws, resp, err := dialRoomWith(dialer, srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer func() { _ = ws.Close() }()
+			if ws.Subprotocol() != tt.wantProto {
+				t.Errorf("expected subprotocol %q, got %q", tt.wantProto, ws.Subprotocol())
+			}
+			if got := strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate"); got != tt.compression {
+				t.Errorf("expected permessage-deflate negotiated %v, got %q", tt.compression, resp.Header.Get("Sec-WebSocket-Extensions"))
+			}
+
+			data, err := tt.wantCodec.marshal(map[string]any{"Message": "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ws.WriteMessage(tt.wantCodec.messageType(), data); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			_ = ws.SetReadDeadline(time.Now().Add(time.Second))
+			var got message
+			// 参加時の hello や presence も同じ形式で届く
+			for got.ID == "" || isAnnouncement(&got) {
+				typ, data, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				if typ != tt.wantType {
+					t.Errorf("expected frame type %d, got %d", tt.wantType, typ)
+				}
+				got = message{}
+				if err := tt.wantCodec.unmarshal(data, &got); err != nil {
+					t.Fatalf("decode: %v", err)
+				}
+				if got.ID == "" && !isAnnouncement(&got) {
+					t.Fatalf("unexpected message %+v", got)
+				}
+			}
+			if got.Message != "hello" || got.Name != "alice" || got.Seq != 1 || got.When.IsZero() {
+				t.Errorf("unexpected message %+v", got)
+			}
+		})
+	}
+}
+
+func TestMsgpackCodec_SystemEvent(t *testing.T) {
+	c := msgpackCodec{}
+	data, err := c.marshal(newSystemMessage("kicked", systemEvent{Action: "kick", Reason: "spam"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// フィールド名は JSON と同じ
+	var raw map[string]any
+	if err := c.unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	system, ok := raw["System"].(map[string]any)
+	if !ok || system["action"] != "kick" || system["reason"] != "spam" {
+		t.Errorf("unexpected encoding %v", raw)
+	}
+	if _, ok := raw["ID"]; ok {
+		t.Errorf("omitempty fields should be omitted, got %v", raw)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnConfig は WebAuthn の Relying Party 設定。
+// フラグで指定でき、フラグの既定値は WEBAUTHN_* 環境変数から読み込む。
+type WebAuthnConfig struct {
+	RPID             string
+	RPDisplayName    string
+	RPOrigins        []string
+	Attestation      protocol.ConveyancePreference
+	UserVerification protocol.UserVerificationRequirement
+	// ResidentKey が required 以外の場合、Discoverable でないクレデンシャルも登録でき、
+	// それらはユーザー名を入力するログインでのみ使える。
+	ResidentKey protocol.ResidentKeyRequirement
+	Timeout     time.Duration
+
+	// MetadataPath はアテステーション検証に使う FIDO MDS BLOB ファイル。空なら検証しない。
+	MetadataPath string
+	// MetadataRootPath は BLOB の署名検証に使うルート証明書。空なら FIDO Alliance のルートを使う。
+	MetadataRootPath string
+	AllowedAAGUIDs   []string
+	DeniedAAGUIDs    []string
+}
+
+// defaultWebAuthnConfig はローカル開発用の設定を返す。
+func defaultWebAuthnConfig() WebAuthnConfig {
+	return WebAuthnConfig{
+		RPID:             "localhost",
+		RPDisplayName:    "ChatterBox",
+		RPOrigins:        []string{"http://localhost:8080"},
+		Attestation:      protocol.PreferNoAttestation,
+		UserVerification: protocol.VerificationPreferred,
+		ResidentKey:      protocol.ResidentKeyRequirementRequired,
+		Timeout:          5 * time.Minute,
+	}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+// 環境変数が設定されている場合はその値をフラグの既定値にする。
+func (c *WebAuthnConfig) RegisterFlags(fs *flag.FlagSet, getenv func(string) string) {
+	if v := getenv("WEBAUTHN_RP_ID"); v != "" {
+		c.RPID = v
+	}
+	if v := getenv("WEBAUTHN_RP_NAME"); v != "" {
+		c.RPDisplayName = v
+	}
+	if v := getenv("WEBAUTHN_RP_ORIGINS"); v != "" {
+		c.RPOrigins = splitList(v)
+	}
+	if v := getenv("WEBAUTHN_ATTESTATION"); v != "" {
+		c.Attestation = protocol.ConveyancePreference(v)
+	}
+	if v := getenv("WEBAUTHN_USER_VERIFICATION"); v != "" {
+		c.UserVerification = protocol.UserVerificationRequirement(v)
+	}
+	if v := getenv("WEBAUTHN_RESIDENT_KEY"); v != "" {
+		c.ResidentKey = protocol.ResidentKeyRequirement(v)
+	}
+	if v := getenv("WEBAUTHN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil {
+			c.Timeout = d
+		} else {
+			c.Timeout = 0 // Validate で不正値として報告させる
+		}
+	}
+	if v := getenv("WEBAUTHN_MDS_PATH"); v != "" {
+		c.MetadataPath = v
+	}
+	if v := getenv("WEBAUTHN_MDS_ROOT"); v != "" {
+		c.MetadataRootPath = v
+	}
+	if v := getenv("WEBAUTHN_ALLOWED_AAGUIDS"); v != "" {
+		c.AllowedAAGUIDs = splitList(v)
+	}
+	if v := getenv("WEBAUTHN_DENIED_AAGUIDS"); v != "" {
+		c.DeniedAAGUIDs = splitList(v)
+	}
+
+	fs.StringVar(&c.RPID, "rp-id", c.RPID, "WebAuthn relying party ID (the site's registrable domain). Env: WEBAUTHN_RP_ID")
+	fs.StringVar(&c.RPDisplayName, "rp-name", c.RPDisplayName, "WebAuthn relying party display name. Env: WEBAUTHN_RP_NAME")
+	fs.Var((*stringList)(&c.RPOrigins), "rp-origins", "Comma-separated list of allowed WebAuthn origins. Env: WEBAUTHN_RP_ORIGINS")
+	fs.Var((*conveyancePreference)(&c.Attestation), "webauthn-attestation", "Attestation conveyance preference: none, indirect, direct or enterprise. Env: WEBAUTHN_ATTESTATION")
+	fs.Var((*userVerification)(&c.UserVerification), "webauthn-user-verification", "User verification requirement: required, preferred or discouraged. Env: WEBAUTHN_USER_VERIFICATION")
+	fs.Var((*residentKey)(&c.ResidentKey), "webauthn-resident-key", "Resident key (discoverable credential) requirement: required, preferred or discouraged. Env: WEBAUTHN_RESIDENT_KEY")
+	fs.DurationVar(&c.Timeout, "webauthn-timeout", c.Timeout, "Timeout for WebAuthn ceremonies. Env: WEBAUTHN_TIMEOUT")
+	fs.StringVar(&c.MetadataPath, "webauthn-mds", c.MetadataPath, "Path to a FIDO Metadata Service BLOB used to verify attestation. Env: WEBAUTHN_MDS_PATH")
+	fs.StringVar(&c.MetadataRootPath, "webauthn-mds-root", c.MetadataRootPath, "Root certificate (PEM or DER) that signs the MDS BLOB; defaults to the FIDO Alliance root. Env: WEBAUTHN_MDS_ROOT")
+	fs.Var((*stringList)(&c.AllowedAAGUIDs), "webauthn-allow-aaguids", "Comma-separated AAGUIDs of authenticators allowed to register. Env: WEBAUTHN_ALLOWED_AAGUIDS")
+	fs.Var((*stringList)(&c.DeniedAAGUIDs), "webauthn-deny-aaguids", "Comma-separated AAGUIDs of authenticators refused at registration. Env: WEBAUTHN_DENIED_AAGUIDS")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c WebAuthnConfig) Validate() error {
+	var errs []error
+
+	rpID := strings.ToLower(c.RPID)
+	switch {
+	case rpID == "":
+		errs = append(errs, errors.New("rp-id is required"))
+	case strings.ContainsAny(rpID, ":/"):
+		errs = append(errs, fmt.Errorf("rp-id %q must be a bare domain without scheme, port or path", c.RPID))
+	}
+	if c.RPDisplayName == "" {
+		errs = append(errs, errors.New("rp-name is required"))
+	}
+	if len(c.RPOrigins) == 0 {
+		errs = append(errs, errors.New("at least one rp-origin is required"))
+	}
+	for _, origin := range c.RPOrigins {
+		if err := validateOrigin(origin, rpID); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch c.Attestation {
+	case protocol.PreferNoAttestation, protocol.PreferIndirectAttestation, protocol.PreferDirectAttestation, protocol.PreferEnterpriseAttestation:
+	default:
+		errs = append(errs, fmt.Errorf("unknown attestation preference %q", c.Attestation))
+	}
+	switch c.UserVerification {
+	case protocol.VerificationRequired, protocol.VerificationPreferred, protocol.VerificationDiscouraged:
+	default:
+		errs = append(errs, fmt.Errorf("unknown user verification requirement %q", c.UserVerification))
+	}
+	switch c.ResidentKey {
+	case protocol.ResidentKeyRequirementRequired, protocol.ResidentKeyRequirementPreferred, protocol.ResidentKeyRequirementDiscouraged:
+	default:
+		errs = append(errs, fmt.Errorf("unknown resident key requirement %q", c.ResidentKey))
+	}
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("webauthn-timeout must be positive, got %s", c.Timeout))
+	}
+
+	if _, err := c.AAGUIDPolicy(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(c.AllowedAAGUIDs) > 0 {
+		// 許可リストは検証済みのアテステーションがなければ意味を持たない
+		if c.Attestation == protocol.PreferNoAttestation {
+			errs = append(errs, errors.New("webauthn-allow-aaguids requires webauthn-attestation to be direct, indirect or enterprise"))
+		}
+		if c.MetadataPath == "" {
+			errs = append(errs, errors.New("webauthn-allow-aaguids requires webauthn-mds"))
+		}
+	}
+	if c.MetadataRootPath != "" && c.MetadataPath == "" {
+		errs = append(errs, errors.New("webauthn-mds-root requires webauthn-mds"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateOrigin は origin が RP ID のドメイン（またはサブドメイン）に属し、
+// https（localhost のみ http も可）であることを確認する。
+func validateOrigin(origin, rpID string) error {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("rp-origin %q is not a valid URL", origin)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("rp-origin %q must not contain a path, query or fragment", origin)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !isLoopbackHost(host) {
+			return fmt.Errorf("rp-origin %q must use https", origin)
+		}
+	default:
+		return fmt.Errorf("rp-origin %q must use https", origin)
+	}
+
+	if host != rpID && !strings.HasSuffix(host, "."+rpID) {
+		return fmt.Errorf("rp-origin %q does not belong to rp-id %q", origin, rpID)
+	}
+	return nil
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// WebAuthn は go-webauthn の設定に変換する。
+func (c WebAuthnConfig) WebAuthn() *webauthn.Config {
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    c.Timeout,
+		TimeoutUVD: c.Timeout,
+	}
+	origins := make([]string, len(c.RPOrigins))
+	for i, origin := range c.RPOrigins {
+		origins[i] = strings.TrimSuffix(origin, "/")
+	}
+	requireResidentKey := protocol.ResidentKeyNotRequired()
+	if c.ResidentKey == protocol.ResidentKeyRequirementRequired {
+		requireResidentKey = protocol.ResidentKeyRequired()
+	}
+	return &webauthn.Config{
+		RPID:                  strings.ToLower(c.RPID),
+		RPDisplayName:         c.RPDisplayName,
+		RPOrigins:             origins,
+		AttestationPreference: c.Attestation,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			RequireResidentKey: requireResidentKey,
+			ResidentKey:        c.ResidentKey,
+			UserVerification:   c.UserVerification,
+		},
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	}
+}
+
+// AAGUIDPolicy は許可・拒否リストから登録ポリシーを生成する。どちらも空なら nil を返す。
+func (c WebAuthnConfig) AAGUIDPolicy() (*AAGUIDPolicy, error) {
+	if len(c.AllowedAAGUIDs) == 0 && len(c.DeniedAAGUIDs) == 0 {
+		return nil, nil
+	}
+	return NewAAGUIDPolicy(c.AllowedAAGUIDs, c.DeniedAAGUIDs)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stringList はカンマ区切りのリストを受け取る flag.Value。
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+type conveyancePreference protocol.ConveyancePreference
+
+func (p *conveyancePreference) String() string {
+	if p == nil {
+		return ""
+	}
+	return string(*p)
+}
+
+func (p *conveyancePreference) Set(s string) error {
+	*p = conveyancePreference(s)
+	return nil
+}
+
+type userVerification protocol.UserVerificationRequirement
+
+func (v *userVerification) String() string {
+	if v == nil {
+		return ""
+	}
+	return string(*v)
+}
+
+func (v *userVerification) Set(s string) error {
+	*v = userVerification(s)
+	return nil
+}
+
+type residentKey protocol.ResidentKeyRequirement
+
+func (r *residentKey) String() string {
+	if r == nil {
+		return ""
+	}
+	return string(*r)
+}
+
+func (r *residentKey) Set(s string) error {
+	*r = residentKey(s)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+func TestWebAuthnConfig_Default_IsValid(t *testing.T) {
+	if err := defaultWebAuthnConfig().Validate(); err != nil {
+		t.Fatalf("default config should be valid: %v", err)
+	}
+}
+
+func TestWebAuthnConfig_RegisterFlags(t *testing.T) {
+	env := map[string]string{
+		"WEBAUTHN_RP_ID":      "chat.example.com",
+		"WEBAUTHN_RP_ORIGINS": "https://chat.example.com, https://www.chat.example.com",
+		"WEBAUTHN_TIMEOUT":    "2m",
+	}
+	cfg := defaultWebAuthnConfig()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cfg.RegisterFlags(fs, func(key string) string { return env[key] })
+
+	if err := fs.Parse([]string{"-rp-name", "Example Chat", "-webauthn-user-verification", "required"}); err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if cfg.RPID != "chat.example.com" {
+		t.Errorf("unexpected RPID: %s", cfg.RPID)
+	}
+	if cfg.RPDisplayName != "Example Chat" {
+		t.Errorf("unexpected RPDisplayName: %s", cfg.RPDisplayName)
+	}
+	if len(cfg.RPOrigins) != 2 || cfg.RPOrigins[1] != "https://www.chat.example.com" {
+		t.Errorf("unexpected RPOrigins: %v", cfg.RPOrigins)
+	}
+	if cfg.UserVerification != protocol.VerificationRequired {
+		t.Errorf("unexpected UserVerification: %s", cfg.UserVerification)
+	}
+	if cfg.Timeout != 2*time.Minute {
+		t.Errorf("unexpected Timeout: %s", cfg.Timeout)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("config should be valid: %v", err)
+	}
+}
+
+func TestWebAuthnConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*WebAuthnConfig)
+		wantErr string
+	}{
+		{
+			name:    "empty rp id",
+			modify:  func(c *WebAuthnConfig) { c.RPID = "" },
+			wantErr: "rp-id is required",
+		},
+		{
+			name:    "rp id with scheme",
+			modify:  func(c *WebAuthnConfig) { c.RPID = "https://example.com" },
+			wantErr: "bare domain",
+		},
+		{
+			name: "origin on another domain",
+			modify: func(c *WebAuthnConfig) {
+				c.RPID = "example.com"
+				c.RPOrigins = []string{"https://evil.example"}
+			},
+			wantErr: "does not belong to rp-id",
+		},
+		{
+			name: "lookalike suffix domain",
+			modify: func(c *WebAuthnConfig) {
+				c.RPID = "example.com"
+				c.RPOrigins = []string{"https://notexample.com"}
+			},
+			wantErr: "does not belong to rp-id",
+		},
+		{
+			name: "http on non-loopback host",
+			modify: func(c *WebAuthnConfig) {
+				c.RPID = "example.com"
+				c.RPOrigins = []string{"http://example.com"}
+			},
+			wantErr: "must use https",
+		},
+		{
+			name:    "origin with path",
+			modify:  func(c *WebAuthnConfig) { c.RPOrigins = []string{"http://localhost:8080/chat"} },
+			wantErr: "must not contain a path",
+		},
+		{
+			name:    "no origins",
+			modify:  func(c *WebAuthnConfig) { c.RPOrigins = nil },
+			wantErr: "at least one rp-origin",
+		},
+		{
+			name:    "unknown attestation",
+			modify:  func(c *WebAuthnConfig) { c.Attestation = "always" },
+			wantErr: "unknown attestation preference",
+		},
+		{
+			name:    "unknown user verification",
+			modify:  func(c *WebAuthnConfig) { c.UserVerification = "sometimes" },
+			wantErr: "unknown user verification",
+		},
+		{
+			name:    "non-positive timeout",
+			modify:  func(c *WebAuthnConfig) { c.Timeout = 0 },
+			wantErr: "must be positive",
+		},
+		{
+			name:    "unknown resident key requirement",
+			modify:  func(c *WebAuthnConfig) { c.ResidentKey = "sometimes" },
+			wantErr: "unknown resident key requirement",
+		},
+		{
+			name:    "invalid aaguid",
+			modify:  func(c *WebAuthnConfig) { c.DeniedAAGUIDs = []string{"not-a-uuid"} },
+			wantErr: "invalid AAGUID",
+		},
+		{
+			name: "allowlist without attestation",
+			modify: func(c *WebAuthnConfig) {
+				c.MetadataPath = "mds.jwt"
+				c.AllowedAAGUIDs = []string{"ee882879-721c-4913-9775-3dfcce97072a"}
+			},
+			wantErr: "requires webauthn-attestation",
+		},
+		{
+			name: "allowlist without metadata",
+			modify: func(c *WebAuthnConfig) {
+				c.Attestation = protocol.PreferDirectAttestation
+				c.AllowedAAGUIDs = []string{"ee882879-721c-4913-9775-3dfcce97072a"}
+			},
+			wantErr: "requires webauthn-mds",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultWebAuthnConfig()
+			tt.modify(&cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWebAuthnConfig_SubdomainOrigin(t *testing.T) {
+	cfg := defaultWebAuthnConfig()
+	cfg.RPID = "example.com"
+	cfg.RPOrigins = []string{"https://chat.example.com/"}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("subdomain origin should be valid: %v", err)
+	}
+	if got := cfg.WebAuthn().RPOrigins[0]; got != "https://chat.example.com" {
+		t.Errorf("expected trailing slash to be trimmed, got %q", got)
+	}
+}
+
+func TestFinishLogin_OriginMismatchRejected(t *testing.T) {
+	cfg := defaultWebAuthnConfig()
+	cfg.RPOrigins = []string{"http://localhost:8080"}
+	wa, err := webauthn.New(cfg.WebAuthn())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, _, _, auth := newLoginTestHandler(t, 0, ClonePolicyReject)
+	h.webAuthn = wa
+
+	for _, origin := range []string{"http://localhost:9999", "https://evil.example", "http://127.0.0.1:8080"} {
+		rec := loginWithAuthenticator(t, h, auth, origin)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("origin %s: expected status 400, got %d", origin, rec.Code)
+		}
+		if hasAuthCookie(rec) {
+			t.Errorf("origin %s: auth cookie must not be set", origin)
+		}
+	}
+
+	rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("allowed origin: expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWebAuthnConfig_ResidentKey(t *testing.T) {
+	cfg := defaultWebAuthnConfig()
+	if got := cfg.WebAuthn().AuthenticatorSelection; got.RequireResidentKey == nil || !*got.RequireResidentKey {
+		t.Errorf("resident key should be required by default, got %+v", got)
+	}
+
+	cfg.ResidentKey = protocol.ResidentKeyRequirementPreferred
+	got := cfg.WebAuthn().AuthenticatorSelection
+	if got.RequireResidentKey == nil || *got.RequireResidentKey {
+		t.Errorf("requireResidentKey should be false when preferred, got %+v", got)
+	}
+	if got.ResidentKey != protocol.ResidentKeyRequirementPreferred {
+		t.Errorf("unexpected residentKey: %s", got.ResidentKey)
+	}
+}
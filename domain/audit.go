@@ -0,0 +1,115 @@
+package domain
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrAuditChainBroken は監査ログのハッシュチェーンが途切れている（改ざんされた）ことを表す。
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// AuditEvent はセキュリティ上重要な出来事の記録。
+type AuditEvent struct {
+	// Seq は 1 から始まる記録順の連番。AuditLog が付与する。
+	Seq  uint64
+	Time time.Time
+	// Action は "auth.login" のように、対象の種類と操作をドットで区切った名前。
+	Action string
+	// ActorID は操作を行ったユーザーの ID。
+	ActorID string
+	// Target は操作対象（クレデンシャル ID、ユーザー ID 等）。
+	Target string
+	Detail map[string]string
+	// PrevHash は直前のイベントの Hash。最初のイベントでは空。AuditLog が付与する。
+	PrevHash string
+	// Hash は PrevHash とイベントの内容から計算した SHA-256 の16進表記。AuditLog が付与する。
+	Hash string
+}
+
+// ComputeHash は Hash 以外のフィールドからイベントのハッシュを計算する。
+func (e AuditEvent) ComputeHash() string {
+	// map のキーは json.Marshal がソートするため、同じ内容からは同じバイト列になる
+	payload, _ := json.Marshal(struct {
+		Seq      uint64            `json:"seq"`
+		Time     string            `json:"time"`
+		Action   string            `json:"action"`
+		ActorID  string            `json:"actor_id"`
+		Target   string            `json:"target"`
+		Detail   map[string]string `json:"detail"`
+		PrevHash string            `json:"prev_hash"`
+	}{e.Seq, e.Time.UTC().Format(time.RFC3339Nano), e.Action, e.ActorID, e.Target, e.Detail, e.PrevHash})
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAuditChain は連続したイベントのハッシュチェーンを検証する。
+// events は記録順で、途中から始まっていてもよい（最初のイベントの PrevHash は検証しない）。
+func VerifyAuditChain(events []AuditEvent) error {
+	for i, e := range events {
+		if e.Hash != e.ComputeHash() {
+			return fmt.Errorf("%w: event %d has been modified", ErrAuditChainBroken, e.Seq)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := events[i-1]
+		if e.Seq != prev.Seq+1 {
+			return fmt.Errorf("%w: event %d follows event %d", ErrAuditChainBroken, e.Seq, prev.Seq)
+		}
+		if e.PrevHash != prev.Hash {
+			return fmt.Errorf("%w: event %d does not link to event %d", ErrAuditChainBroken, e.Seq, prev.Seq)
+		}
+	}
+	return nil
+}
+
+// AuditQuery は監査ログの検索条件。ゼロ値の項目は条件にしない。
+type AuditQuery struct {
+	ActorID string
+	// Action は完全一致で比較する。"moderation." のように末尾が "." の場合は前方一致で比較する。
+	Action string
+	// Since 以降（含む）、Until より前（含まない）のイベントを返す。
+	Since time.Time
+	Until time.Time
+	// Limit が正の場合は、条件に一致する最新のイベントを最大 Limit 件返す。
+	Limit int
+}
+
+// Matches はイベントが Limit 以外の条件に一致するかを返す。
+func (q AuditQuery) Matches(e AuditEvent) bool {
+	if q.ActorID != "" && e.ActorID != q.ActorID {
+		return false
+	}
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			if !strings.HasPrefix(e.Action, q.Action) {
+				return false
+			}
+		} else if e.Action != q.Action {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog は追記専用の監査ログの永続化を抽象化する。
+// Record は Seq、PrevHash、Hash を付与してハッシュチェーンにつなぐ。記録したイベントは変更・削除できない。
+type AuditLog interface {
+	Record(ctx context.Context, event AuditEvent) error
+	// List は記録順にすべてのイベントを返す。
+	List(ctx context.Context) ([]AuditEvent, error)
+	// Query は条件に一致するイベントを記録順に返す。
+	Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error)
+}
@@ -0,0 +1,20 @@
+package domain
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrBrokerClosed は閉じた Broker を使おうとしたことを表す。
+var ErrBrokerClosed = errors.New("broker closed")
+
+// Broker は複数のサーバー間でルームのイベントを中継する pub/sub のバックプレーン。
+// 配信は at-most-once で、同じイベントが重複して届くこともあるため受信側で ID による重複排除を行う。
+type Broker interface {
+	// Publish は topic の購読者全員（自分自身を含む）に payload を送る。
+	Publish(ctx context.Context, topic string, payload []byte) error
+	// Subscribe は topic の購読を開始する。チャネルは ctx の終了か Broker を閉じたときに閉じられる。
+	Subscribe(ctx context.Context, topic string) (<-chan []byte, error)
+	// Close は購読をすべて終了し、接続を閉じる。
+	Close() error
+}
@@ -0,0 +1,63 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ReportStatus は通報の処理状況。
+type ReportStatus string
+
+const (
+	ReportOpen     ReportStatus = "open"
+	ReportResolved ReportStatus = "resolved"
+)
+
+// ErrReportNotFound は通報が存在しないことを表す。
+var ErrReportNotFound = errors.New("report not found")
+
+// ErrReportResolved は処理済みの通報を再び処理しようとしたことを表す。
+var ErrReportResolved = errors.New("report already resolved")
+
+// MessageSnapshot は通報時点のメッセージの内容。
+type MessageSnapshot struct {
+	ID     string
+	UserID string
+	Name   string
+	Text   string
+	When   time.Time
+}
+
+// Report はユーザーやメッセージに対する通報。
+type Report struct {
+	ID           string
+	RoomID       string
+	ReporterID   string
+	TargetUserID string
+	Reason       string
+	// Message はメッセージを通報した場合のスナップショット。ユーザーの通報では nil。
+	Message   *MessageSnapshot
+	Status    ReportStatus
+	CreatedAt time.Time
+
+	ResolvedBy string
+	ResolvedAt time.Time
+	// Resolution は処理内容（dismiss、delete、kick、mute、ban）。
+	Resolution string
+	// Note は処理したモデレーターのメモ。
+	Note string
+}
+
+// ReportRepository は通報の永続化を抽象化する。
+type ReportRepository interface {
+	Create(ctx context.Context, report Report) error
+	Get(ctx context.Context, id string) (Report, error)
+	// List はルームの通報を作成順に返す。status が空の場合はすべて返す。
+	List(ctx context.Context, roomID string, status ReportStatus) ([]Report, error)
+	// Resolve は未処理の通報を処理済みにする。処理済みの場合は ErrReportResolved を返す。
+	// 確認と更新を不可分に行い、同じ通報を同時に処理しようとしても成功するのは一つだけにする。
+	Resolve(ctx context.Context, id, resolvedBy, resolution, note string, at time.Time) (Report, error)
+	// Reopen は Resolve で処理済みにした通報を未処理に戻す。処理の適用に失敗したときに使う。
+	Reopen(ctx context.Context, id string) error
+}
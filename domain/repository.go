@@ -12,8 +12,44 @@ type UserRepository interface {
 	GetByID(ctx context.Context, id string) (User, error)
 	GetByWebAuthnID(ctx context.Context, webAuthnID []byte) (User, error)
 	GetByName(ctx context.Context, name string) (User, error)
-	AddCredential(ctx context.Context, userID string, cred webauthn.Credential) error
+	AddCredential(ctx context.Context, userID string, cred Credential) error
+	// UpdateCredential はログイン成功後の認証器の状態（SignCount 等）と最終使用日時を更新する。
+	// SignCount は保存済みの値より小さくしない。後退の検知はログイン時の検証で行い、
+	// ここでは同時に完了したログインが古い値で上書きしないことだけを保証する。
+	// CloneWarning は立てるだけで、ここでは解除しない。
 	UpdateCredential(ctx context.Context, userID string, cred webauthn.Credential) error
+	// SetCloneWarning はクレデンシャルの複製の疑いの印だけを変更する。
+	// ログインを拒否したときの記録と、ユーザーが印を解除するときに使う。
+	SetCloneWarning(ctx context.Context, userID string, credID []byte, warning bool) error
+	RenameCredential(ctx context.Context, userID string, credID []byte, nickname string) error
+	// DeleteCredential はクレデンシャルを削除する。ほかのパスキーも紐付けた外部 IdP アカウントもなく、
+	// ログインできなくなる場合は ErrLastLoginMethod を返す。確認と削除は不可分に行う。
+	DeleteCredential(ctx context.Context, userID string, credID []byte) error
+	// GetByIdentity は紐付け済みの外部 IdP アカウントからユーザーを取得する。
+	GetByIdentity(ctx context.Context, identity Identity) (User, error)
+	// LinkIdentity は外部 IdP アカウントをユーザーに紐付ける。
+	// 既に別のユーザーに紐付いている場合はエラーを返す。
+	LinkIdentity(ctx context.Context, userID string, identity Identity) error
+	// ListIdentities はユーザーに紐付いた外部 IdP アカウントを返す。
+	ListIdentities(ctx context.Context, userID string) ([]Identity, error)
+	// SetRecoveryCodes は回復コードを置き換える。以前のコードは使えなくなる。
+	SetRecoveryCodes(ctx context.Context, userID string, codes []RecoveryCode) error
+	// UseRecoveryCode はハッシュが一致する未使用の回復コードを使用済みにする。
+	// 該当するコードがない場合は ErrRecoveryCodeInvalid を返す。
+	UseRecoveryCode(ctx context.Context, userID string, hash []byte) error
+	// SetRole はサイト全体のロールを変更する。
+	SetRole(ctx context.Context, userID string, role Role) error
+	// PromoteIfNoAdmin は管理者が一人もいない場合に限り、ユーザーを管理者にする。
+	// 判定と変更は不可分に行い、昇格した場合は true を返す。
+	PromoteIfNoAdmin(ctx context.Context, userID string) (bool, error)
+}
+
+// RoomRoleRepository はルームごとのロールの上書きを管理する。
+type RoomRoleRepository interface {
+	SetRoomRole(ctx context.Context, roomID, userID string, role Role) error
+	DeleteRoomRole(ctx context.Context, roomID, userID string) error
+	// GetRoomRole は上書きされたロールを返す。上書きがない場合は空文字を返す。
+	GetRoomRole(ctx context.Context, roomID, userID string) (Role, error)
 }
 
 // SessionRepository は WebAuthn セレモニー中の SessionData を一時保存する。
@@ -23,3 +59,13 @@ type SessionRepository interface {
 	Get(ctx context.Context, key string) (webauthn.SessionData, error)
 	Delete(ctx context.Context, key string) error
 }
+
+// HealthChecker は疎通確認ができるリポジトリが実装する。/readyz で使う。
+type HealthChecker interface {
+	Ping(ctx context.Context) error
+}
+
+// Flusher は書き込みをバッファするリポジトリが実装する。シャットダウン時に呼び出す。
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
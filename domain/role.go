@@ -0,0 +1,91 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role はユーザーの権限レベル。
+// ゼロ値（未設定）は RoleMember として扱う。
+type Role string
+
+const (
+	RoleAdmin     Role = "admin"
+	RoleModerator Role = "moderator"
+	RoleMember    Role = "member"
+	RoleGuest     Role = "guest"
+)
+
+// Permission は操作ごとの権限。
+type Permission string
+
+const (
+	// PermSendMessage はルームへの投稿。
+	PermSendMessage Permission = "message.send"
+	// PermUploadAvatar はアバター画像のアップロード。
+	PermUploadAvatar Permission = "avatar.upload"
+	// PermManageAccount は自分のパスキーや回復コードの管理。
+	PermManageAccount Permission = "account.manage"
+	// PermModerate はキック・ミュート・BAN などのモデレーション操作。
+	PermModerate Permission = "room.moderate"
+	// PermGlobalBan はサイト全体の BAN とその取り消し。ルームのモデレーターには与えない。
+	PermGlobalBan Permission = "users.ban"
+	// PermManageRoles はロールの付与。
+	PermManageRoles Permission = "roles.manage"
+	// PermManageFilters はメッセージフィルター設定の再読み込み。
+	PermManageFilters Permission = "filters.manage"
+	// PermViewAudit は監査ログの閲覧とエクスポート。
+	PermViewAudit Permission = "audit.view"
+	// PermCreateRoom はルームの作成。ルームごとに goroutine やメトリクスのラベルが増えるためモデレーター以上に限る。
+	PermCreateRoom Permission = "room.create"
+)
+
+// ErrPermissionDenied は権限が不足していることを表す。
+var ErrPermissionDenied = errors.New("permission denied")
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin:     {PermSendMessage, PermUploadAvatar, PermManageAccount, PermModerate, PermGlobalBan, PermManageRoles, PermManageFilters, PermViewAudit, PermCreateRoom},
+	RoleModerator: {PermSendMessage, PermUploadAvatar, PermManageAccount, PermModerate, PermCreateRoom},
+	RoleMember:    {PermSendMessage, PermUploadAvatar, PermManageAccount},
+	RoleGuest:     {PermManageAccount},
+}
+
+// ParseRole は文字列を Role に変換する。
+func ParseRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleAdmin, RoleModerator, RoleMember, RoleGuest:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown role %q (want admin, moderator, member or guest)", s)
+	}
+}
+
+// OrDefault は未設定のロールを RoleMember にして返す。
+func (r Role) OrDefault() Role {
+	if r == "" {
+		return RoleMember
+	}
+	return r
+}
+
+// Can はロールが権限を持つかを返す。
+func (r Role) Can(p Permission) bool {
+	for _, perm := range rolePermissions[r.OrDefault()] {
+		if perm == p {
+			return true
+		}
+	}
+	return false
+}
+
+var roleRank = map[Role]int{
+	RoleGuest:     0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// Outranks はロールが other より上位かを返す。
+func (r Role) Outranks(other Role) bool {
+	return roleRank[r.OrDefault()] > roleRank[other.OrDefault()]
+}
@@ -0,0 +1,32 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRoomNotFound はルームが存在しないことを表す。
+var ErrRoomNotFound = errors.New("room not found")
+
+// ErrRoomExists は既に使われている ID でルームを作ろうとしたことを表す。
+var ErrRoomExists = errors.New("room already exists")
+
+// Room はチャットルーム。
+type Room struct {
+	ID   string
+	Name string
+	// CreatedBy は作成したユーザーの ID。起動時に用意するルームでは空。
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+// RoomRepository はルームの一覧を管理する。
+type RoomRepository interface {
+	// Create はルームを保存する。ID が既に使われている場合は ErrRoomExists を返す。
+	Create(ctx context.Context, room Room) error
+	// Get は ID でルームを取得する。存在しない場合は ErrRoomNotFound を返す。
+	Get(ctx context.Context, id string) (Room, error)
+	// List はすべてのルームを作成順に返す。
+	List(ctx context.Context) ([]Room, error)
+}
@@ -0,0 +1,54 @@
+package domain
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// SanctionKind はモデレーション操作の種類。
+type SanctionKind string
+
+const (
+	// SanctionKick はルームから切断する。有効期限までは再参加できない。
+	SanctionKick SanctionKind = "kick"
+	// SanctionMute はルームへの投稿を破棄する。
+	SanctionMute SanctionKind = "mute"
+	// SanctionBan はルームへの参加を拒否する。
+	SanctionBan SanctionKind = "ban"
+	// SanctionGlobalBan はサイト全体へのアクセスを拒否する。
+	SanctionGlobalBan SanctionKind = "global_ban"
+)
+
+// ErrSanctionNotFound は制裁が存在しないことを表す。
+var ErrSanctionNotFound = errors.New("sanction not found")
+
+// Sanction はユーザーに科したモデレーション操作。
+type Sanction struct {
+	ID     string
+	Kind   SanctionKind
+	UserID string
+	// RoomID はサイト全体の BAN では空。
+	RoomID    string
+	Reason    string
+	IssuedBy  string
+	CreatedAt time.Time
+	// ExpiresAt がゼロ値の場合は無期限。
+	ExpiresAt time.Time
+}
+
+// ActiveAt は時刻 t に制裁が有効かを返す。
+func (s Sanction) ActiveAt(t time.Time) bool {
+	return s.ExpiresAt.IsZero() || t.Before(s.ExpiresAt)
+}
+
+// SanctionRepository はモデレーション操作の永続化を抽象化する。
+type SanctionRepository interface {
+	Create(ctx context.Context, s Sanction) error
+	Get(ctx context.Context, id string) (Sanction, error)
+	Delete(ctx context.Context, id string) error
+	// Active は時刻 now に有効な制裁のうち、最も遅く終わるものを返す。
+	Active(ctx context.Context, userID, roomID string, kind SanctionKind, now time.Time) (Sanction, bool, error)
+	// ListActive はルームで有効な制裁を返す。roomID が空の場合はサイト全体の BAN を返す。
+	ListActive(ctx context.Context, roomID string, now time.Time) ([]Sanction, error)
+}
@@ -1,6 +1,10 @@
 package domain
 
 import (
+	"bytes"
+	"errors"
+	"time"
+
 	"github.com/go-webauthn/webauthn/webauthn"
 )
 
@@ -13,7 +17,48 @@ type User struct {
 	DisplayName string
 	Email       string
 	AvatarURL   string
-	Credentials []webauthn.Credential
+	// Role はサイト全体のロール。ルームごとの上書きは RoomRoleRepository で管理する。
+	Role        Role
+	Credentials []Credential
+	// RecoveryCodes はパスキーを失ったときに使うワンタイムの回復コード。ハッシュのみ保持する。
+	RecoveryCodes []RecoveryCode
+}
+
+// ErrLastLoginMethod はユーザーに残る最後のログイン手段を削除しようとしたことを表す。
+var ErrLastLoginMethod = errors.New("cannot delete the last login method")
+
+// Credential は登録済みパスキーと、管理画面で表示する付帯情報。
+// 複製の疑いは Authenticator.CloneWarning に保持する。
+type Credential struct {
+	webauthn.Credential
+	Nickname   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// ErrRecoveryCodeInvalid は回復コードが存在しないか使用済みであることを表す。
+var ErrRecoveryCodeInvalid = errors.New("invalid recovery code")
+
+// RecoveryCode は回復コードのハッシュと使用日時。
+type RecoveryCode struct {
+	Hash   []byte
+	UsedAt time.Time
+}
+
+// Used は回復コードが使用済みかを返す。
+func (c RecoveryCode) Used() bool {
+	return !c.UsedAt.IsZero()
+}
+
+// RemainingRecoveryCodes は未使用の回復コードの数を返す。
+func (u User) RemainingRecoveryCodes() int {
+	n := 0
+	for _, c := range u.RecoveryCodes {
+		if !c.Used() {
+			n++
+		}
+	}
+	return n
 }
 
 func (u User) WebAuthnID() []byte {
@@ -29,22 +74,51 @@ func (u User) WebAuthnDisplayName() string {
 }
 
 func (u User) WebAuthnCredentials() []webauthn.Credential {
-	return u.Credentials
+	creds := make([]webauthn.Credential, len(u.Credentials))
+	for i, c := range u.Credentials {
+		creds[i] = c.Credential
+	}
+	return creds
+}
+
+// Identity は外部 IdP（Google 等）のアカウントを表す。
+// Provider と Subject の組でユーザーに紐付けられる。
+type Identity struct {
+	Provider string
+	Subject  string
 }
 
 // WithCredential は新しいクレデンシャルを追加した新しい User を返す（不変性パターン）。
-func (u User) WithCredential(cred webauthn.Credential) User {
-	newCreds := make([]webauthn.Credential, len(u.Credentials), len(u.Credentials)+1)
+func (u User) WithCredential(cred Credential) User {
+	newCreds := make([]Credential, len(u.Credentials), len(u.Credentials)+1)
 	copy(newCreds, u.Credentials)
 	newCreds = append(newCreds, cred)
 
-	return User{
-		ID:          u.ID,
-		WebAuthnIDB: u.WebAuthnIDB,
-		Name:        u.Name,
-		DisplayName: u.DisplayName,
-		Email:       u.Email,
-		AvatarURL:   u.AvatarURL,
-		Credentials: newCreds,
+	newUser := u
+	newUser.Credentials = newCreds
+	return newUser
+}
+
+// WithoutCredential は指定したクレデンシャルを除いた新しい User を返す（不変性パターン）。
+func (u User) WithoutCredential(credID []byte) User {
+	newCreds := make([]Credential, 0, len(u.Credentials))
+	for _, c := range u.Credentials {
+		if !bytes.Equal(c.ID, credID) {
+			newCreds = append(newCreds, c)
+		}
+	}
+
+	newUser := u
+	newUser.Credentials = newCreds
+	return newUser
+}
+
+// FindCredential は ID が一致するクレデンシャルを返す。
+func (u User) FindCredential(credID []byte) (Credential, bool) {
+	for _, c := range u.Credentials {
+		if bytes.Equal(c.ID, credID) {
+			return c, true
+		}
 	}
+	return Credential{}, false
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// FilterVerdict はフィルターの判定。
+type FilterVerdict int
+
+const (
+	// FilterAllow はメッセージをそのまま次のフィルターに渡す。
+	FilterAllow FilterVerdict = iota
+	// FilterReject はメッセージを破棄し、以降のフィルターを実行しない。
+	FilterReject
+	// FilterRewrite は Text に書き換えたメッセージを次のフィルターに渡す。
+	FilterRewrite
+	// FilterFlag はメッセージを配信した上で、モデレーターが確認できるように記録する。
+	FilterFlag
+)
+
+// FilterInput はフィルターに渡すメッセージ。
+type FilterInput struct {
+	UserID string
+	RoomID string
+	Text   string
+	When   time.Time
+}
+
+// FilterResult はフィルターの判定結果。Reason は Reject と Flag で、Text は Rewrite で使う。
+type FilterResult struct {
+	Verdict FilterVerdict
+	Reason  string
+	Text    string
+}
+
+// MessageFilter は client.read から room.forward の間でメッセージを検査する。
+type MessageFilter interface {
+	Name() string
+	Filter(in FilterInput) FilterResult
+}
+
+// filterChain は順序付きのフィルターの列。
+type filterChain []MessageFilter
+
+// filterOutcome はフィルターの列をすべて通した結果。
+type filterOutcome struct {
+	Text     string
+	Rejected bool
+	Reason   string
+	// Flags は Flag を返したフィルターの名前と理由。
+	Flags []string
+}
+
+// Apply はフィルターを順に実行する。Reject されたらそこで止める。
+func (fc filterChain) Apply(in FilterInput) filterOutcome {
+	out := filterOutcome{Text: in.Text}
+	for _, f := range fc {
+		in.Text = out.Text
+		res := f.Filter(in)
+		switch res.Verdict {
+		case FilterReject:
+			out.Rejected, out.Reason = true, res.Reason
+			return out
+		case FilterRewrite:
+			out.Text = res.Text
+		case FilterFlag:
+			out.Flags = append(out.Flags, f.Name()+": "+res.Reason)
+		}
+	}
+	return out
+}
+
+// filterSpec は設定ファイル中のフィルター1つ分の設定。使う項目は type ごとに異なる。
+type filterSpec struct {
+	Type string `json:"type"`
+	// Action は違反時の動作。reject（既定）、flag のほか、profanity では mask、max_length では truncate を使える。
+	Action string `json:"action"`
+
+	// max_length
+	Max int `json:"max"`
+	// profanity
+	Words    []string `json:"words"`
+	Wordlist string   `json:"wordlist"`
+	// links
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+	// spam
+	Repeat int    `json:"repeat"`
+	Window string `json:"window"`
+}
+
+// filterConfig はフィルター設定ファイルの形式。
+// rooms にないルームには default のフィルターを使う。
+type filterConfig struct {
+	Default []filterSpec            `json:"default"`
+	Rooms   map[string][]filterSpec `json:"rooms"`
+}
+
+// FilterSet はルームごとのフィルターの列を保持し、設定ファイルから再読み込みできる。
+type FilterSet struct {
+	path     string
+	auditLog domain.AuditLog
+
+	mu       sync.RWMutex
+	fallback filterChain
+	rooms    map[string]filterChain
+}
+
+// LoadFilterSet は path の設定ファイルからフィルターを読み込む。
+func LoadFilterSet(path string) (*FilterSet, error) {
+	fs := &FilterSet{path: path}
+	if err := fs.Reload(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Reload は設定ファイルを読み直してフィルターを置き換える。
+// 設定が不正な場合は現在のフィルターを使い続ける。spam フィルターの履歴は引き継がない。
+func (fs *FilterSet) Reload() error {
+	data, err := os.ReadFile(fs.path)
+	if err != nil {
+		return fmt.Errorf("read filter config: %w", err)
+	}
+	var cfg filterConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parse filter config %s: %w", fs.path, err)
+	}
+
+	fallback, err := buildFilterChain(cfg.Default)
+	if err != nil {
+		return fmt.Errorf("default filters: %w", err)
+	}
+	rooms := make(map[string]filterChain, len(cfg.Rooms))
+	for roomID, specs := range cfg.Rooms {
+		chain, err := buildFilterChain(specs)
+		if err != nil {
+			return fmt.Errorf("filters for room %s: %w", roomID, err)
+		}
+		rooms[roomID] = chain
+	}
+
+	fs.mu.Lock()
+	fs.fallback, fs.rooms = fallback, rooms
+	fs.mu.Unlock()
+	return nil
+}
+
+// Apply はルームのフィルターを実行する。
+func (fs *FilterSet) Apply(in FilterInput) filterOutcome {
+	fs.mu.RLock()
+	chain, ok := fs.rooms[in.RoomID]
+	if !ok {
+		chain = fs.fallback
+	}
+	fs.mu.RUnlock()
+
+	out := chain.Apply(in)
+	for _, flag := range out.Flags {
+		fs.audit(domain.AuditEvent{
+			Action:  "message.flagged",
+			ActorID: in.UserID,
+			Target:  in.RoomID,
+			Detail:  map[string]string{"filter": flag, "message": out.Text},
+		})
+	}
+	return out
+}
+
+// ReloadHandler は設定ファイルを再読み込みする管理者用のハンドラー。
+func (fs *FilterSet) ReloadHandler(c echo.Context) error {
+	if err := fs.Reload(); err != nil {
+		log.Printf("failed to reload filters: %v", err)
+		return c.JSON(http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+	}
+	userData, _ := getAuthUserData(c)
+	actorID, _ := userData["id"].(string)
+	fs.audit(domain.AuditEvent{
+		Action:  "filters.reloaded",
+		ActorID: actorID,
+		Detail:  map[string]string{"path": fs.path},
+	})
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (fs *FilterSet) audit(event domain.AuditEvent) {
+	recordAudit(context.Background(), fs.auditLog, event)
+}
+
+func buildFilterChain(specs []filterSpec) (filterChain, error) {
+	chain := make(filterChain, 0, len(specs))
+	for i, spec := range specs {
+		f, err := newMessageFilter(spec)
+		if err != nil {
+			return nil, fmt.Errorf("filter #%d (%s): %w", i+1, spec.Type, err)
+		}
+		chain = append(chain, f)
+	}
+	return chain, nil
+}
+
+// newMessageFilter は組み込みフィルターを設定から生成する。
+func newMessageFilter(spec filterSpec) (MessageFilter, error) {
+	switch spec.Type {
+	case "max_length":
+		return newMaxLengthFilter(spec)
+	case "profanity":
+		return newProfanityFilter(spec)
+	case "links":
+		return newLinkFilter(spec)
+	case "spam":
+		return newSpamFilter(spec)
+	default:
+		return nil, fmt.Errorf("unknown filter type %q (want max_length, profanity, links or spam)", spec.Type)
+	}
+}
+
+// violation は違反時の判定を action に従って返す。
+func violation(action, reason string) FilterResult {
+	if action == "flag" {
+		return FilterResult{Verdict: FilterFlag, Reason: reason}
+	}
+	return FilterResult{Verdict: FilterReject, Reason: reason}
+}
+
+func parseAction(action string, extra ...string) (string, error) {
+	if action == "" {
+		return "reject", nil
+	}
+	for _, a := range append([]string{"reject", "flag"}, extra...) {
+		if action == a {
+			return action, nil
+		}
+	}
+	return "", fmt.Errorf("unknown action %q", action)
+}
+
+// maxLengthFilter は長すぎるメッセージを拒否するか切り詰める。
+type maxLengthFilter struct {
+	max    int
+	action string
+}
+
+func newMaxLengthFilter(spec filterSpec) (*maxLengthFilter, error) {
+	if spec.Max <= 0 {
+		return nil, errors.New("max must be positive")
+	}
+	action, err := parseAction(spec.Action, "truncate")
+	if err != nil {
+		return nil, err
+	}
+	return &maxLengthFilter{max: spec.Max, action: action}, nil
+}
+
+func (f *maxLengthFilter) Name() string { return "max_length" }
+
+func (f *maxLengthFilter) Filter(in FilterInput) FilterResult {
+	if utf8.RuneCountInString(in.Text) <= f.max {
+		return FilterResult{Verdict: FilterAllow}
+	}
+	if f.action == "truncate" {
+		return FilterResult{Verdict: FilterRewrite, Text: string([]rune(in.Text)[:f.max])}
+	}
+	return violation(f.action, fmt.Sprintf("message is longer than %d characters", f.max))
+}
+
+// profanityFilter は単語リストに一致する語を伏せ字にするか、メッセージを拒否する。
+type profanityFilter struct {
+	pattern *regexp.Regexp
+	action  string
+}
+
+func newProfanityFilter(spec filterSpec) (*profanityFilter, error) {
+	words := spec.Words
+	if spec.Wordlist != "" {
+		data, err := os.ReadFile(spec.Wordlist)
+		if err != nil {
+			return nil, fmt.Errorf("read wordlist: %w", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				words = append(words, line)
+			}
+		}
+	}
+	if len(words) == 0 {
+		return nil, errors.New("words or wordlist is required")
+	}
+	action, err := parseAction(spec.Action, "mask")
+	if err != nil {
+		return nil, err
+	}
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil, errors.New("words or wordlist is required")
+	}
+	// 長い語を先に試し、短い語が境界の判定で外れても長い語で一致できるようにする
+	slices.SortFunc(quoted, func(a, b string) int { return len(b) - len(a) })
+	// RE2 の \b は ASCII の単語境界しか扱わないため、境界は matches で確かめる
+	pattern, err := regexp.Compile(`(?i)(?:` + strings.Join(quoted, "|") + `)`)
+	if err != nil {
+		return nil, err
+	}
+	return &profanityFilter{pattern: pattern, action: action}, nil
+}
+
+func (f *profanityFilter) Name() string { return "profanity" }
+
+func (f *profanityFilter) Filter(in FilterInput) FilterResult {
+	found := f.matches(in.Text)
+	if len(found) == 0 {
+		return FilterResult{Verdict: FilterAllow}
+	}
+	if f.action == "mask" {
+		var b strings.Builder
+		last := 0
+		for _, m := range found {
+			b.WriteString(in.Text[last:m[0]])
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(in.Text[m[0]:m[1]])))
+			last = m[1]
+		}
+		b.WriteString(in.Text[last:])
+		return FilterResult{Verdict: FilterRewrite, Text: b.String()}
+	}
+	return violation(f.action, "message contains blocked words")
+}
+
+// matches は text 中で単語として現れる語の位置を返す。
+// 分かち書きしない日本語などの語は前後に文字が続いていても一致とする。
+func (f *profanityFilter) matches(text string) [][2]int {
+	var found [][2]int
+	for pos := 0; pos < len(text); {
+		loc := f.pattern.FindStringIndex(text[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[0], pos+loc[1]
+		first, size := utf8.DecodeRuneInString(text[start:end])
+		lastRune, _ := utf8.DecodeLastRuneInString(text[start:end])
+		before, _ := utf8.DecodeLastRuneInString(text[:start])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+		if (start > 0 && spacedWordRune(first) && wordRune(before)) ||
+			(end < len(text) && spacedWordRune(lastRune) && wordRune(after)) {
+			pos = start + size
+			continue
+		}
+		found = append(found, [2]int{start, end})
+		pos = end
+	}
+	return found
+}
+
+// wordRune は r が単語を構成する文字かを返す。
+func wordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// spacedWordRune は r が空白で語を区切る書記体系の文字かを返す。
+// 漢字や仮名は語の間に空白を置かないため、境界を求めない。
+func spacedWordRune(r rune) bool {
+	return wordRune(r) && !unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// linkPattern はメッセージ中のリンクを見つける。スキームのない www. 始まりも対象にする。
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+
+// linkFilter はリンク先のドメインを許可リスト・拒否リストで制限する。
+// 許可リストが空でない場合は、許可リストにないドメインへのリンクをすべて違反とする。
+type linkFilter struct {
+	allow  []string
+	deny   []string
+	action string
+}
+
+func newLinkFilter(spec filterSpec) (*linkFilter, error) {
+	if len(spec.Allow) == 0 && len(spec.Deny) == 0 {
+		return nil, errors.New("allow or deny is required")
+	}
+	action, err := parseAction(spec.Action)
+	if err != nil {
+		return nil, err
+	}
+	return &linkFilter{allow: normalizeDomains(spec.Allow), deny: normalizeDomains(spec.Deny), action: action}, nil
+}
+
+func (f *linkFilter) Name() string { return "links" }
+
+func (f *linkFilter) Filter(in FilterInput) FilterResult {
+	for _, link := range linkPattern.FindAllString(in.Text, -1) {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil || u.Hostname() == "" {
+			return violation(f.action, "message contains a malformed link")
+		}
+		host := strings.ToLower(u.Hostname())
+		if matchesDomain(host, f.deny) || (len(f.allow) > 0 && !matchesDomain(host, f.allow)) {
+			return violation(f.action, fmt.Sprintf("links to %s are not allowed", host))
+		}
+	}
+	return FilterResult{Verdict: FilterAllow}
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, d := range domains {
+		if d = strings.Trim(strings.ToLower(strings.TrimSpace(d)), "."); d != "" {
+			normalized = append(normalized, d)
+		}
+	}
+	return normalized
+}
+
+// matchesDomain は host が domains のいずれか、またはそのサブドメインかを返す。
+func matchesDomain(host string, domains []string) bool {
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// spamFilter は同じユーザーが window 内に同じメッセージを repeat 回以上送ることを禁じる。
+type spamFilter struct {
+	repeat int
+	window time.Duration
+	action string
+
+	mu     sync.Mutex
+	recent map[string][]recentMessage
+	// nextSweep を過ぎたら、送信の途絶えたユーザーの履歴もまとめて捨てる
+	nextSweep time.Time
+}
+
+type recentMessage struct {
+	text string
+	when time.Time
+}
+
+func newSpamFilter(spec filterSpec) (*spamFilter, error) {
+	if spec.Repeat < 2 {
+		return nil, errors.New("repeat must be at least 2")
+	}
+	window, err := time.ParseDuration(spec.Window)
+	if err != nil || window <= 0 {
+		return nil, fmt.Errorf("invalid window %q", spec.Window)
+	}
+	action, err := parseAction(spec.Action)
+	if err != nil {
+		return nil, err
+	}
+	return &spamFilter{repeat: spec.Repeat, window: window, action: action, recent: make(map[string][]recentMessage)}, nil
+}
+
+func (f *spamFilter) Name() string { return "spam" }
+
+func (f *spamFilter) Filter(in FilterInput) FilterResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !in.When.Before(f.nextSweep) {
+		for userID := range f.recent {
+			f.expire(userID, in.When)
+		}
+		f.nextSweep = in.When.Add(f.window)
+	}
+
+	text := strings.Join(strings.Fields(strings.ToLower(in.Text)), " ")
+	repeats := 1
+	for _, m := range f.expire(in.UserID, in.When) {
+		if m.text == text {
+			repeats++
+		}
+	}
+	f.recent[in.UserID] = append(f.recent[in.UserID], recentMessage{text: text, when: in.When})
+	if repeats >= f.repeat {
+		return violation(f.action, "the same message was sent too many times")
+	}
+	return FilterResult{Verdict: FilterAllow}
+}
+
+// expire は userID の履歴から window を過ぎたものを捨て、残りを返す。f.mu を保持して呼ぶ。
+func (f *spamFilter) expire(userID string, now time.Time) []recentMessage {
+	msgs := f.recent[userID]
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if now.Sub(m.when) < f.window {
+			kept = append(kept, m)
+		}
+	}
+	if len(kept) == 0 {
+		delete(f.recent, userID)
+		return nil
+	}
+	f.recent[userID] = kept
+	return kept
+}
+
+// filterRejectedMessage はフィルターで拒否されたことを送信者に知らせるイベントを作る。
+func filterRejectedMessage(reason string) *message {
+	return newSystemMessage("Your message was not delivered: "+reason, systemEvent{Action: "message_rejected", Reason: reason})
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/infra/memory"
+)
+
+func mustFilter(t *testing.T, spec filterSpec) MessageFilter {
+	t.Helper()
+	f, err := newMessageFilter(spec)
+	if err != nil {
+		t.Fatalf("newMessageFilter(%+v) failed: %v", spec, err)
+	}
+	return f
+}
+
+func TestBuiltinFilters(t *testing.T) {
+	tests := []struct {
+		name        string
+		spec        filterSpec
+		text        string
+		wantVerdict FilterVerdict
+		wantText    string
+	}{
+		{name: "short message", spec: filterSpec{Type: "max_length", Max: 5}, text: "hello", wantVerdict: FilterAllow},
+		{name: "long message", spec: filterSpec{Type: "max_length", Max: 5}, text: "hello!", wantVerdict: FilterReject},
+		{name: "truncate counts runes", spec: filterSpec{Type: "max_length", Max: 3, Action: "truncate"}, text: "こんにちは", wantVerdict: FilterRewrite, wantText: "こんに"},
+		{name: "profanity mask", spec: filterSpec{Type: "profanity", Words: []string{"darn"}, Action: "mask"}, text: "Darn it, darned", wantVerdict: FilterRewrite, wantText: "**** it, darned"},
+		{name: "profanity reject", spec: filterSpec{Type: "profanity", Words: []string{"darn"}}, text: "oh darn", wantVerdict: FilterReject},
+		{name: "profanity japanese", spec: filterSpec{Type: "profanity", Words: []string{"ばか"}, Action: "mask"}, text: "ばか お前はばかだ", wantVerdict: FilterRewrite, wantText: "** お前は**だ"},
+		{name: "profanity non-ascii boundary", spec: filterSpec{Type: "profanity", Words: []string{"merde"}, Action: "mask"}, text: "merde! émerde merde", wantVerdict: FilterRewrite, wantText: "*****! émerde *****"},
+		{name: "profanity flag", spec: filterSpec{Type: "profanity", Words: []string{"darn"}, Action: "flag"}, text: "oh darn", wantVerdict: FilterFlag},
+		{name: "denied domain", spec: filterSpec{Type: "links", Deny: []string{"evil.example"}}, text: "see https://cdn.evil.example/x", wantVerdict: FilterReject},
+		{name: "bare www link", spec: filterSpec{Type: "links", Deny: []string{"evil.example"}}, text: "see www.evil.example", wantVerdict: FilterReject},
+		{name: "other domain", spec: filterSpec{Type: "links", Deny: []string{"evil.example"}}, text: "see https://example.com", wantVerdict: FilterAllow},
+		{name: "allowed domain", spec: filterSpec{Type: "links", Allow: []string{"example.com"}}, text: "https://docs.example.com/a and http://example.com", wantVerdict: FilterAllow},
+		{name: "not in allowlist", spec: filterSpec{Type: "links", Allow: []string{"example.com"}}, text: "https://example.com.evil.example", wantVerdict: FilterReject},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := mustFilter(t, tt.spec).Filter(FilterInput{UserID: "u1", Text: tt.text})
+			if res.Verdict != tt.wantVerdict {
+				t.Fatalf("want verdict %d, got %+v", tt.wantVerdict, res)
+			}
+			if res.Text != tt.wantText {
+				t.Errorf("want text %q, got %q", tt.wantText, res.Text)
+			}
+		})
+	}
+}
+
+func TestSpamFilter(t *testing.T) {
+	f := mustFilter(t, filterSpec{Type: "spam", Repeat: 3, Window: "1m"})
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	send := func(userID, text string, at time.Duration) FilterVerdict {
+		return f.Filter(FilterInput{UserID: userID, Text: text, When: now.Add(at)}).Verdict
+	}
+
+	if send("u1", "buy now", 0) != FilterAllow || send("u1", "Buy  NOW", time.Second) != FilterAllow {
+		t.Fatal("first two repeats should be allowed")
+	}
+	if send("u2", "buy now", 2*time.Second) != FilterAllow {
+		t.Error("repeats are counted per user")
+	}
+	if got := send("u1", "buy now", 3*time.Second); got != FilterReject {
+		t.Errorf("third repeat should be rejected, got %d", got)
+	}
+	if got := send("u1", "buy now", 2*time.Minute); got != FilterAllow {
+		t.Errorf("repeats outside the window should be forgotten, got %d", got)
+	}
+	// 送信の途絶えたユーザーの履歴も定期的に捨てる
+	if _, ok := f.(*spamFilter).recent["u2"]; ok {
+		t.Error("history of idle users should be swept")
+	}
+}
+
+func TestNewMessageFilter_InvalidSpec(t *testing.T) {
+	for _, spec := range []filterSpec{
+		{Type: "unknown"},
+		{Type: "max_length"},
+		{Type: "max_length", Max: 10, Action: "mask"},
+		{Type: "profanity"},
+		{Type: "links"},
+		{Type: "spam", Repeat: 1, Window: "1m"},
+		{Type: "spam", Repeat: 3, Window: "soon"},
+	} {
+		if _, err := newMessageFilter(spec); err == nil {
+			t.Errorf("expected error for %+v", spec)
+		}
+	}
+}
+
+func TestFilterChain_Apply(t *testing.T) {
+	chain := filterChain{
+		mustFilter(t, filterSpec{Type: "profanity", Words: []string{"darn"}, Action: "mask"}),
+		mustFilter(t, filterSpec{Type: "links", Deny: []string{"evil.example"}, Action: "flag"}),
+		mustFilter(t, filterSpec{Type: "max_length", Max: 30}),
+	}
+
+	out := chain.Apply(FilterInput{Text: "darn https://evil.example"})
+	if out.Rejected || out.Text != "**** https://evil.example" {
+		t.Fatalf("unexpected outcome: %+v", out)
+	}
+	if len(out.Flags) != 1 || out.Flags[0] != "links: links to evil.example are not allowed" {
+		t.Errorf("unexpected flags: %v", out.Flags)
+	}
+
+	out = chain.Apply(FilterInput{Text: "this message is definitely far too long"})
+	if !out.Rejected || out.Reason == "" {
+		t.Errorf("long message should be rejected: %+v", out)
+	}
+}
+
+func writeFilterConfig(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilterSet_PerRoomAndReload(t *testing.T) {
+	dir := t.TempDir()
+	wordlist := filepath.Join(dir, "words.txt")
+	writeFilterConfig(t, wordlist, "# comment\ndarn\n")
+	path := filepath.Join(dir, "filters.json")
+	writeFilterConfig(t, path, `{
+		"default": [{"type": "max_length", "max": 10}],
+		"rooms": {"general": [{"type": "profanity", "wordlist": "`+wordlist+`", "action": "mask"}]}
+	}`)
+
+	fs, err := LoadFilterSet(path)
+	if err != nil {
+		t.Fatalf("LoadFilterSet failed: %v", err)
+	}
+	if out := fs.Apply(FilterInput{RoomID: "general", Text: "darn, a long message"}); out.Rejected || out.Text != "****, a long message" {
+		t.Errorf("room filters should apply: %+v", out)
+	}
+	if out := fs.Apply(FilterInput{RoomID: "other", Text: "darn, a long message"}); !out.Rejected {
+		t.Errorf("default filters should apply to other rooms: %+v", out)
+	}
+
+	writeFilterConfig(t, path, `{"rooms": {"general": [{"type": "nope"}]}}`)
+	if err := fs.Reload(); err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	if out := fs.Apply(FilterInput{RoomID: "general", Text: "darn"}); out.Text != "****" {
+		t.Errorf("invalid config must keep the current filters: %+v", out)
+	}
+
+	writeFilterConfig(t, path, `{"rooms": {"general": [{"type": "max_length", "max": 3}]}}`)
+	if err := fs.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if out := fs.Apply(FilterInput{RoomID: "general", Text: "darn"}); !out.Rejected {
+		t.Errorf("reloaded filters should apply: %+v", out)
+	}
+	if out := fs.Apply(FilterInput{RoomID: "other", Text: "a long message"}); out.Rejected {
+		t.Errorf("default chain was removed by reload: %+v", out)
+	}
+}
+
+func TestFilterSet_AuditsFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.json")
+	writeFilterConfig(t, path, `{"default": [{"type": "profanity", "words": ["darn"], "action": "flag"}]}`)
+	fs, err := LoadFilterSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auditLog := memory.NewAuditStore()
+	fs.auditLog = auditLog
+
+	if out := fs.Apply(FilterInput{UserID: "u1", RoomID: "general", Text: "darn"}); out.Rejected {
+		t.Fatalf("flagged message should be delivered: %+v", out)
+	}
+	events, _ := auditLog.List(context.Background())
+	if len(events) != 1 || events[0].Action != "message.flagged" || events[0].ActorID != "u1" {
+		t.Errorf("unexpected audit events: %+v", events)
+	}
+}
+
+func TestFilterSet_ReloadHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.json")
+	writeFilterConfig(t, path, `{}`)
+	fs, err := LoadFilterSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFilterConfig(t, path, `{"default": [{"type": "max_length"}]}`)
+	c, rec := newSignedInContext(http.MethodPost, "/admin/filters/reload", "", "admin")
+	if err := fs.ReloadHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422, got %d", rec.Code)
+	}
+
+	writeFilterConfig(t, path, `{"default": [{"type": "max_length", "max": 100}]}`)
+	c, rec = newSignedInContext(http.MethodPost, "/admin/filters/reload", "", "admin")
+	if err := fs.ReloadHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+}
+
+func TestRoom_Filter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filters.json")
+	writeFilterConfig(t, path, `{"default": [{"type": "profanity", "words": ["darn"], "action": "mask"}, {"type": "max_length", "max": 8}]}`)
+	r := newRoom(UseAuthAvatar)
+	c := &client{userData: map[string]any{"id": "u1"}}
+
+	msg := &message{Message: "oh darn"}
+	if _, ok := r.filter(context.Background(), c, msg); !ok || msg.Message != "oh darn" {
+		t.Errorf("room without filters should pass messages through: %+v", msg)
+	}
+
+	var err error
+	r.filters, err = LoadFilterSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.filter(context.Background(), c, msg); !ok || msg.Message != "oh ****" {
+		t.Errorf("message should be masked: %+v", msg)
+	}
+	if reason, ok := r.filter(context.Background(), c, &message{Message: "much too long"}); ok || reason == "" {
+		t.Error("long message should be rejected with a reason")
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// readinessTimeout は /readyz で各チェックを待つ時間。
+const readinessTimeout = 2 * time.Second
+
+// healthCheck は /readyz で実行する名前付きのチェック。
+type healthCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// Health は /healthz と /readyz を提供し、シャットダウン時に永続化ストアを書き出す。
+type Health struct {
+	checks   []healthCheck
+	flushers []namedFlusher
+	draining atomic.Bool
+}
+
+type namedFlusher struct {
+	name    string
+	flusher domain.Flusher
+}
+
+// NewHealth は Health を生成する。
+func NewHealth() *Health {
+	return &Health{}
+}
+
+// AddCheck は /readyz で実行するチェックを追加する。
+func (h *Health) AddCheck(name string, check func(context.Context) error) {
+	h.checks = append(h.checks, healthCheck{name: name, check: check})
+}
+
+// AddRepository はリポジトリが domain.HealthChecker を実装していれば /readyz のチェックに、
+// domain.Flusher を実装していればシャットダウン時の書き出し対象に加える。
+func (h *Health) AddRepository(name string, repo any) {
+	if hc, ok := repo.(domain.HealthChecker); ok {
+		h.AddCheck(name, hc.Ping)
+	}
+	if f, ok := repo.(domain.Flusher); ok {
+		h.flushers = append(h.flushers, namedFlusher{name: name, flusher: f})
+	}
+}
+
+// Liveness はプロセスが応答できることだけを返す。
+func (h *Health) Liveness(c echo.Context) error {
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Readiness はリポジトリ等のチェックを実行し、すべて成功した場合だけ 200 を返す。
+// シャットダウン中は新しい接続を受けないよう常に 503 を返す。
+func (h *Health) Readiness(c echo.Context) error {
+	if h.draining.Load() {
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{"status": "shutting_down"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	failed := make(map[string]string)
+	for _, hc := range h.checks {
+		if err := hc.check(ctx); err != nil {
+			failed[hc.name] = err.Error()
+		}
+	}
+	if len(failed) > 0 {
+		return c.JSON(http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "checks": failed})
+	}
+	return c.JSON(http.StatusOK, map[string]any{"status": "ok"})
+}
+
+// Drain は /readyz を失敗させ、ロードバランサーに新しい接続を送らないよう伝える。
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Flush はバッファしているリポジトリの内容を書き出す。
+func (h *Health) Flush(ctx context.Context) error {
+	var errs []error
+	for _, f := range h.flushers {
+		if err := f.flusher.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", f.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gracefulShutdown は新しい WebSocket の受け付けを止め、接続中のクライアントに再起動を伝えて
+// 送信バッファを書き出してから、ストアを書き出して echo を停止する。ctx の期限を過ぎた処理は打ち切る。
+func gracefulShutdown(ctx context.Context, e *echo.Echo, health *Health, rooms ...*room) {
+	health.Drain()
+	for _, r := range rooms {
+		if err := r.shutdown(ctx); err != nil {
+			log.Printf("room %s: clients did not drain before the deadline: %v", r.id, err)
+		}
+	}
+	if err := health.Flush(ctx); err != nil {
+		log.Printf("failed to flush stores: %v", err)
+	}
+	if err := e.Shutdown(ctx); err != nil {
+		log.Printf("failed to shut down HTTP server: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+// fakeStore は Ping と Flush の結果を指定できるリポジトリ。
+type fakeStore struct {
+	pingErr error
+	flushed bool
+}
+
+func (s *fakeStore) Ping(context.Context) error { return s.pingErr }
+
+func (s *fakeStore) Flush(context.Context) error {
+	s.flushed = true
+	return nil
+}
+
+func readiness(t *testing.T, h *Health) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/readyz", nil), rec)
+	if err := h.Readiness(c); err != nil {
+		t.Fatalf("Readiness: %v", err)
+	}
+	var body map[string]any
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	return rec.Code, body
+}
+
+func TestHealth_MemoryStores(t *testing.T) {
+	broker := memory.NewBroker()
+	h := NewHealth()
+	h.AddRepository("users", memory.NewUserStore())
+	h.AddRepository("sessions", memory.NewSessionStore())
+	h.AddRepository("audit", memory.NewAuditStore())
+	h.AddRepository("room_roles", memory.NewRoomRoleStore())
+	h.AddRepository("sanctions", memory.NewSanctionStore())
+	h.AddRepository("reports", memory.NewReportStore())
+	h.AddRepository("rooms", memory.NewRoomStore())
+	h.AddRepository("broker", broker)
+	if len(h.checks) != 8 || len(h.flushers) != 7 {
+		t.Fatalf("expected 8 checks and 7 flushers, got %d and %d", len(h.checks), len(h.flushers))
+	}
+
+	if code, body := readiness(t, h); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d %v", code, body)
+	}
+	if err := h.Flush(context.Background()); err != nil {
+		t.Errorf("Flush failed: %v", err)
+	}
+
+	_ = broker.Close()
+	code, body := readiness(t, h)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after the broker is closed, got %d", code)
+	}
+	if checks, _ := body["checks"].(map[string]any); len(checks) != 1 || checks["broker"] != domain.ErrBrokerClosed.Error() {
+		t.Errorf("expected only the broker to fail, got %v", body)
+	}
+}
+
+func TestHealth_Readiness(t *testing.T) {
+	store := &fakeStore{}
+	h := NewHealth()
+	h.AddRepository("users", store)
+	h.AddRepository("no_checks", struct{}{})
+
+	if code, _ := readiness(t, h); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d", code)
+	}
+
+	store.pingErr = errors.New("connection refused")
+	code, body := readiness(t, h)
+	if code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 when a repository is down, got %d", code)
+	}
+	if checks, _ := body["checks"].(map[string]any); checks["users"] != "connection refused" {
+		t.Errorf("expected failing check to be reported, got %v", body)
+	}
+
+	store.pingErr = nil
+	h.Drain()
+	if code, body := readiness(t, h); code != http.StatusServiceUnavailable || body["status"] != "shutting_down" {
+		t.Errorf("expected 503 while draining, got %d %v", code, body)
+	}
+
+	if err := h.Flush(context.Background()); err != nil || !store.flushed {
+		t.Errorf("expected store to be flushed, err = %v", err)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	t.Cleanup(r.Stop)
+	e := echo.New()
+	srv := newRoomServer(t, e, r)
+
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u1", "name": "alice"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	// 参加が処理されるまで待つ
+	r.sendTo("nobody", &message{}, false)
+
+	store := &fakeStore{}
+	health := NewHealth()
+	health.AddRepository("users", store)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	gracefulShutdown(ctx, e, health, r)
+
+	msg := readMessage(t, ws)
+	if msg.System == nil || msg.System.Action != "server_restarting" {
+		t.Errorf("expected server_restarting event, got %+v", msg)
+	}
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseServiceRestart) {
+		t.Errorf("expected service restart close frame, got %v", err)
+	}
+	if !store.flushed {
+		t.Error("expected stores to be flushed")
+	}
+
+	if _, resp, err := dialRoom(srv, map[string]any{"id": "u2", "name": "bob"}); err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected new WebSockets to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// recentMessageLimit はルームごとに保持する最近のメッセージの数。
+const recentMessageLimit = 200
+
+// messageHistory は通報時のスナップショットや削除、再接続時の再送のために最近のメッセージを保持する。
+// room.run 以外の goroutine からも参照するためロックで保護する。
+type messageHistory struct {
+	mu    sync.Mutex
+	limit int
+	msgs  []*message
+	// evicted は上限を超えて捨てたメッセージの最大のシーケンス番号。
+	evicted uint64
+}
+
+func newMessageHistory(limit int) *messageHistory {
+	return &messageHistory{limit: limit}
+}
+
+// add はメッセージを追加し、上限を超えた古いメッセージを捨てる。
+func (h *messageHistory) add(msg *message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.msgs = append(h.msgs, msg)
+	if over := len(h.msgs) - h.limit; over > 0 {
+		h.evicted = max(h.evicted, h.msgs[over-1].Seq)
+		h.msgs = append(h.msgs[:0], h.msgs[over:]...)
+	}
+}
+
+// since はシーケンス番号が seq より後のメッセージを古い順に返す。
+// その範囲のメッセージを既に捨てていて再送しきれない場合は false を返す。
+func (h *messageHistory) since(seq uint64) ([]*message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if seq < h.evicted {
+		return nil, false
+	}
+	var msgs []*message
+	for _, msg := range h.msgs {
+		if msg.Seq > seq {
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs, true
+}
+
+// before はシーケンス番号が seq より前（seq が 0 の場合は最新まで）のチャットメッセージを、
+// 新しいものから最大 limit 件選んで古い順に返す。more はそれより前のメッセージも履歴に残っていることを示す。
+func (h *messageHistory) before(seq uint64, limit int) (msgs []*message, more bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i := len(h.msgs) - 1; i >= 0; i-- {
+		msg := h.msgs[i]
+		if msg.System != nil || (seq != 0 && msg.Seq >= seq) {
+			continue
+		}
+		if len(msgs) == limit {
+			more = true
+			break
+		}
+		msgs = append(msgs, msg)
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs, more
+}
+
+// edit は ID のメッセージを本文を書き換えたコピーに置き換える。
+// 配信したメッセージは接続間で共有しているため、元のメッセージは書き換えない。
+func (h *messageHistory) edit(id, text string, at time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, msg := range h.msgs {
+		if msg.ID == id {
+			edited := *msg
+			edited.Message, edited.EditedAt, edited.frames = text, &at, nil
+			h.msgs[i] = &edited
+			return true
+		}
+	}
+	return false
+}
+
+// get は ID のメッセージのコピーを返す。
+func (h *messageHistory) get(id string) (message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, msg := range h.msgs {
+		if msg.ID == id {
+			return *msg, true
+		}
+	}
+	return message{}, false
+}
+
+// remove は ID のメッセージを取り除く。
+func (h *messageHistory) remove(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, msg := range h.msgs {
+		if msg.ID == id {
+			h.msgs = append(h.msgs[:i], h.msgs[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
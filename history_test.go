@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestMessageHistory_Since(t *testing.T) {
+	h := newMessageHistory(3)
+	for seq := uint64(1); seq <= 5; seq++ {
+		h.add(&message{Seq: seq})
+	}
+
+	tests := []struct {
+		since  uint64
+		want   int
+		wantOK bool
+	}{
+		{since: 0, wantOK: false},
+		{since: 1, wantOK: false},
+		{since: 2, want: 3, wantOK: true},
+		{since: 4, want: 1, wantOK: true},
+		{since: 5, want: 0, wantOK: true},
+	}
+	for _, tt := range tests {
+		msgs, ok := h.since(tt.since)
+		if ok != tt.wantOK || len(msgs) != tt.want {
+			t.Errorf("since(%d): expected %d messages ok=%v, got %d ok=%v", tt.since, tt.want, tt.wantOK, len(msgs), ok)
+		}
+		for i, msg := range msgs {
+			if msg.Seq != tt.since+uint64(i)+1 {
+				t.Errorf("since(%d): unexpected order %v", tt.since, msg.Seq)
+			}
+		}
+	}
+}
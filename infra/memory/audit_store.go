@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+// AuditStore はインメモリの AuditLog 実装。
+type AuditStore struct {
+	inProcess
+	mu     sync.RWMutex
+	events []domain.AuditEvent
+}
+
+// NewAuditStore は空の AuditStore を生成する。
+func NewAuditStore() *AuditStore {
+	return &AuditStore{}
+}
+
+// Record はイベントをハッシュチェーンの末尾に追加する。
+// 呼び出し側が指定した Seq、PrevHash、Hash は上書きする。
+func (s *AuditStore) Record(_ context.Context, event domain.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	// 記録後に呼び出し側が Detail を変更しても影響しないようにコピーする
+	event.Detail = maps.Clone(event.Detail)
+	event.Seq = uint64(len(s.events)) + 1
+	event.PrevHash = ""
+	if n := len(s.events); n > 0 {
+		event.PrevHash = s.events[n-1].Hash
+	}
+	event.Hash = event.ComputeHash()
+	s.events = append(s.events, event)
+	return nil
+}
+
+// List は記録順にイベントを返す。
+func (s *AuditStore) List(ctx context.Context) ([]domain.AuditEvent, error) {
+	return s.Query(ctx, domain.AuditQuery{})
+}
+
+// Query は条件に一致するイベントを記録順に返す。
+func (s *AuditStore) Query(_ context.Context, q domain.AuditQuery) ([]domain.AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var events []domain.AuditEvent
+	for _, event := range s.events {
+		if q.Matches(event) {
+			event.Detail = maps.Clone(event.Detail)
+			events = append(events, event)
+		}
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
@@ -0,0 +1,124 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestAuditStore_RecordAndList(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewAuditStore()
+
+	for _, action := range []string{"a", "b"} {
+		if err := store.Record(ctx, domain.AuditEvent{Action: action}); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+
+	events, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != "a" || events[1].Action != "b" {
+		t.Errorf("unexpected events: %v", events)
+	}
+}
+
+func TestAuditStore_HashChain(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewAuditStore()
+
+	detail := map[string]string{"ip": "192.0.2.1"}
+	for _, action := range []string{"auth.login", "avatar.uploaded", "auth.logout"} {
+		if err := store.Record(ctx, domain.AuditEvent{Action: action, ActorID: "u1", Detail: detail, Seq: 99, Hash: "forged"}); err != nil {
+			t.Fatalf("Record failed: %v", err)
+		}
+	}
+	detail["ip"] = "changed"
+
+	events, _ := store.List(ctx)
+	if events[0].Seq != 1 || events[0].PrevHash != "" || events[2].Seq != 3 || events[2].PrevHash != events[1].Hash {
+		t.Fatalf("unexpected chain: %+v", events)
+	}
+	if events[0].Detail["ip"] != "192.0.2.1" {
+		t.Error("recorded detail must not change with the caller's map")
+	}
+	if err := domain.VerifyAuditChain(events); err != nil {
+		t.Fatalf("VerifyAuditChain failed: %v", err)
+	}
+
+	tampered := append([]domain.AuditEvent(nil), events...)
+	tampered[1].ActorID = "u2"
+	if err := domain.VerifyAuditChain(tampered); !errors.Is(err, domain.ErrAuditChainBroken) {
+		t.Errorf("modified event should break the chain, got %v", err)
+	}
+	removed := []domain.AuditEvent{events[0], events[2]}
+	if err := domain.VerifyAuditChain(removed); !errors.Is(err, domain.ErrAuditChainBroken) {
+		t.Errorf("removed event should break the chain, got %v", err)
+	}
+	if err := domain.VerifyAuditChain(events[1:]); err != nil {
+		t.Errorf("a suffix of the chain should verify, got %v", err)
+	}
+}
+
+func TestAuditStore_Query(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewAuditStore()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, e := range []domain.AuditEvent{
+		{Action: "auth.login", ActorID: "u1"},
+		{Action: "moderation.kick", ActorID: "mod"},
+		{Action: "moderation.ban", ActorID: "mod"},
+		{Action: "auth.login", ActorID: "u2"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := store.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		query   domain.AuditQuery
+		wantSeq []uint64
+	}{
+		{name: "all", query: domain.AuditQuery{}, wantSeq: []uint64{1, 2, 3, 4}},
+		{name: "actor", query: domain.AuditQuery{ActorID: "mod"}, wantSeq: []uint64{2, 3}},
+		{name: "exact action", query: domain.AuditQuery{Action: "auth.login"}, wantSeq: []uint64{1, 4}},
+		{name: "action prefix", query: domain.AuditQuery{Action: "moderation."}, wantSeq: []uint64{2, 3}},
+		{name: "partial action is not a prefix", query: domain.AuditQuery{Action: "moderation"}, wantSeq: nil},
+		{name: "time range", query: domain.AuditQuery{Since: base.Add(time.Hour), Until: base.Add(3 * time.Hour)}, wantSeq: []uint64{2, 3}},
+		{name: "limit keeps latest", query: domain.AuditQuery{Limit: 2}, wantSeq: []uint64{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := store.Query(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			var got []uint64
+			for _, e := range events {
+				got = append(got, e.Seq)
+			}
+			if len(got) != len(tt.wantSeq) {
+				t.Fatalf("want %v, got %v", tt.wantSeq, got)
+			}
+			for i := range got {
+				if got[i] != tt.wantSeq[i] {
+					t.Fatalf("want %v, got %v", tt.wantSeq, got)
+				}
+			}
+		})
+	}
+}
+
+// interface compliance check
+var _ domain.AuditLog = (*AuditStore)(nil)
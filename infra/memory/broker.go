@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/dchf12/chat/domain"
+)
+
+// brokerBufferSize は購読者ごとに溜められるメッセージの数。溢れたメッセージは捨てる。
+const brokerBufferSize = 1024
+
+// Broker はプロセス内で完結する domain.Broker 実装。単一ノードでの運用とテストに使う。
+type Broker struct {
+	mu     sync.Mutex
+	subs   map[string][]chan []byte
+	closed bool
+}
+
+// NewBroker は購読者のいない Broker を生成する。
+func NewBroker() *Broker {
+	return &Broker{subs: make(map[string][]chan []byte)}
+}
+
+// Ping は Close されていれば domain.ErrBrokerClosed を返す。
+func (b *Broker) Ping(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return domain.ErrBrokerClosed
+	}
+	return ctx.Err()
+}
+
+// Publish は topic の購読者に payload のコピーを送る。バッファが一杯の購読者には届かない。
+func (b *Broker) Publish(_ context.Context, topic string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return domain.ErrBrokerClosed
+	}
+	for _, ch := range b.subs[topic] {
+		select {
+		case ch <- slices.Clone(payload):
+		default:
+		}
+	}
+	return nil
+}
+
+// Subscribe は topic の購読を開始する。
+func (b *Broker) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, domain.ErrBrokerClosed
+	}
+	ch := make(chan []byte, brokerBufferSize)
+	b.subs[topic] = append(b.subs[topic], ch)
+	go func() {
+		<-ctx.Done()
+		b.unsubscribe(topic, ch)
+	}()
+	return ch, nil
+}
+
+func (b *Broker) unsubscribe(topic string, ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := b.subs[topic]
+	if i := slices.Index(subs, ch); i >= 0 {
+		b.subs[topic] = slices.Delete(subs, i, i+1)
+		close(ch)
+	}
+}
+
+// Close はすべての購読チャネルを閉じる。
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	for topic, subs := range b.subs {
+		for _, ch := range subs {
+			close(ch)
+		}
+		delete(b.subs, topic)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func receivePayload(t *testing.T, ch <-chan []byte) ([]byte, bool) {
+	t.Helper()
+	select {
+	case p, ok := <-ch:
+		return p, ok
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for payload")
+		return nil, false
+	}
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	t.Parallel()
+	b := NewBroker()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a, err := b.Subscribe(ctx, "room:general")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	other, _ := b.Subscribe(ctx, "room:other")
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	c, _ := b.Subscribe(subCtx, "room:general")
+
+	payload := []byte("hello")
+	if err := b.Publish(ctx, "room:general", payload); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	payload[0] = 'j'
+	for _, ch := range []<-chan []byte{a, c} {
+		if got, _ := receivePayload(t, ch); string(got) != "hello" {
+			t.Errorf("expected hello, got %q", got)
+		}
+	}
+	select {
+	case p := <-other:
+		t.Errorf("other topic should not receive %q", p)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := receivePayload(t, c); ok {
+		t.Error("expected channel to close after unsubscribe")
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, ok := receivePayload(t, a); ok {
+		t.Error("expected channel to close with the broker")
+	}
+	if err := b.Publish(ctx, "room:general", payload); !errors.Is(err, domain.ErrBrokerClosed) {
+		t.Errorf("expected ErrBrokerClosed, got %v", err)
+	}
+}
+
+func TestBroker_Ping(t *testing.T) {
+	t.Parallel()
+	b := NewBroker()
+	if err := b.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	_ = b.Close()
+	if err := b.Ping(context.Background()); !errors.Is(err, domain.ErrBrokerClosed) {
+		t.Errorf("expected ErrBrokerClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+// ReportStore はインメモリの ReportRepository 実装。
+type ReportStore struct {
+	inProcess
+	mu      sync.RWMutex
+	reports map[string]domain.Report
+}
+
+// NewReportStore は空の ReportStore を生成する。
+func NewReportStore() *ReportStore {
+	return &ReportStore{
+		reports: make(map[string]domain.Report),
+	}
+}
+
+// Create は通報を保存する。
+func (s *ReportStore) Create(_ context.Context, report domain.Report) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.reports[report.ID]; exists {
+		return fmt.Errorf("report already exists: %s", report.ID)
+	}
+	s.reports[report.ID] = cloneReport(report)
+	return nil
+}
+
+// Get は ID で通報を取得する。
+func (s *ReportStore) Get(_ context.Context, id string) (domain.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report, ok := s.reports[id]
+	if !ok {
+		return domain.Report{}, fmt.Errorf("%w: %s", domain.ErrReportNotFound, id)
+	}
+	return cloneReport(report), nil
+}
+
+// List はルームの通報を作成順に返す。
+func (s *ReportStore) List(_ context.Context, roomID string, status domain.ReportStatus) ([]domain.Report, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var reports []domain.Report
+	for _, report := range s.reports {
+		if report.RoomID == roomID && (status == "" || report.Status == status) {
+			reports = append(reports, cloneReport(report))
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].CreatedAt.Before(reports[j].CreatedAt)
+	})
+	return reports, nil
+}
+
+// Resolve は未処理の通報を処理済みにする。
+func (s *ReportStore) Resolve(_ context.Context, id, resolvedBy, resolution, note string, at time.Time) (domain.Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.reports[id]
+	if !ok {
+		return domain.Report{}, fmt.Errorf("%w: %s", domain.ErrReportNotFound, id)
+	}
+	if report.Status == domain.ReportResolved {
+		return domain.Report{}, domain.ErrReportResolved
+	}
+	report.Status = domain.ReportResolved
+	report.ResolvedBy = resolvedBy
+	report.ResolvedAt = at
+	report.Resolution = resolution
+	report.Note = note
+	s.reports[id] = report
+	return cloneReport(report), nil
+}
+
+// Reopen は処理済みの通報を未処理に戻し、処理の記録を消す。
+func (s *ReportStore) Reopen(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report, ok := s.reports[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", domain.ErrReportNotFound, id)
+	}
+	report.Status = domain.ReportOpen
+	report.ResolvedBy = ""
+	report.ResolvedAt = time.Time{}
+	report.Resolution = ""
+	report.Note = ""
+	s.reports[id] = report
+	return nil
+}
+
+// cloneReport はスナップショットのポインタを共有しないようにコピーする。
+func cloneReport(report domain.Report) domain.Report {
+	if report.Message != nil {
+		snapshot := *report.Message
+		report.Message = &snapshot
+	}
+	return report
+}
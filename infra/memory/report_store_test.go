@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestReportStore_ListAndResolve(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewReportStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reports := []domain.Report{
+		{ID: "r1", RoomID: "general", Status: domain.ReportOpen, CreatedAt: now, Message: &domain.MessageSnapshot{ID: "m1", Text: "hi"}},
+		{ID: "r2", RoomID: "general", Status: domain.ReportOpen, CreatedAt: now.Add(time.Second)},
+		{ID: "r3", RoomID: "other", Status: domain.ReportOpen, CreatedAt: now},
+	}
+	for _, r := range reports {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	if err := store.Create(ctx, domain.Report{ID: "r1"}); err == nil {
+		t.Fatal("expected duplicate ID error")
+	}
+
+	got, err := store.Resolve(ctx, "r1", "mod", "delete", "spam", now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+	if got.Status != domain.ReportResolved || got.ResolvedBy != "mod" || got.Resolution != "delete" {
+		t.Errorf("unexpected resolved report: %+v", got)
+	}
+	if _, err := store.Resolve(ctx, "r1", "mod", "dismiss", "", now); !errors.Is(err, domain.ErrReportResolved) {
+		t.Errorf("want ErrReportResolved, got %v", err)
+	}
+	if _, err := store.Resolve(ctx, "missing", "mod", "dismiss", "", now); !errors.Is(err, domain.ErrReportNotFound) {
+		t.Errorf("want ErrReportNotFound, got %v", err)
+	}
+
+	open, _ := store.List(ctx, "general", domain.ReportOpen)
+	if len(open) != 1 || open[0].ID != "r2" {
+		t.Errorf("unexpected open reports: %+v", open)
+	}
+	all, _ := store.List(ctx, "general", "")
+	if len(all) != 2 || all[0].ID != "r1" {
+		t.Errorf("unexpected reports: %+v", all)
+	}
+
+	all[0].Message.Text = "changed"
+	if r, _ := store.Get(ctx, "r1"); r.Message.Text != "hi" {
+		t.Error("snapshot must not be shared with callers")
+	}
+}
+
+func TestReportStore_Reopen(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewReportStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := store.Create(ctx, domain.Report{ID: "r1", RoomID: "general", Status: domain.ReportOpen, CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Resolve(ctx, "r1", "mod", "ban", "spam", now); err != nil {
+		t.Fatalf("Resolve failed: %v", err)
+	}
+
+	if err := store.Reopen(ctx, "r1"); err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	got, _ := store.Get(ctx, "r1")
+	if got.Status != domain.ReportOpen || got.ResolvedBy != "" || got.Resolution != "" || !got.ResolvedAt.IsZero() {
+		t.Errorf("expected the report to be open again, got %+v", got)
+	}
+	// 戻した通報は再び処理できる
+	if _, err := store.Resolve(ctx, "r1", "mod2", "dismiss", "", now); err != nil {
+		t.Errorf("Resolve after Reopen failed: %v", err)
+	}
+	if err := store.Reopen(ctx, "missing"); !errors.Is(err, domain.ErrReportNotFound) {
+		t.Errorf("want ErrReportNotFound, got %v", err)
+	}
+}
+
+// interface compliance check
+var _ domain.ReportRepository = (*ReportStore)(nil)
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dchf12/chat/domain"
+)
+
+type roomMember struct {
+	roomID string
+	userID string
+}
+
+// RoomRoleStore はインメモリの RoomRoleRepository 実装。
+type RoomRoleStore struct {
+	inProcess
+	mu    sync.RWMutex
+	roles map[roomMember]domain.Role
+}
+
+// NewRoomRoleStore は空の RoomRoleStore を生成する。
+func NewRoomRoleStore() *RoomRoleStore {
+	return &RoomRoleStore{
+		roles: make(map[roomMember]domain.Role),
+	}
+}
+
+// SetRoomRole はルームでのロールを上書きする。
+func (s *RoomRoleStore) SetRoomRole(_ context.Context, roomID, userID string, role domain.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.roles[roomMember{roomID: roomID, userID: userID}] = role
+	return nil
+}
+
+// DeleteRoomRole はルームでのロールの上書きを解除する。
+func (s *RoomRoleStore) DeleteRoomRole(_ context.Context, roomID, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.roles, roomMember{roomID: roomID, userID: userID})
+	return nil
+}
+
+// GetRoomRole はルームで上書きされたロールを返す。上書きがなければ空文字を返す。
+func (s *RoomRoleStore) GetRoomRole(_ context.Context, roomID, userID string) (domain.Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.roles[roomMember{roomID: roomID, userID: userID}], nil
+}
@@ -0,0 +1,36 @@
+package memory
+
+import (
+	"context"
+	"testing"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestRoomRoleStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewRoomRoleStore()
+
+	if err := store.SetRoomRole(ctx, "general", "u1", domain.RoleModerator); err != nil {
+		t.Fatalf("SetRoomRole failed: %v", err)
+	}
+
+	got, err := store.GetRoomRole(ctx, "general", "u1")
+	if err != nil || got != domain.RoleModerator {
+		t.Fatalf("want moderator, got %q, %v", got, err)
+	}
+	if got, _ := store.GetRoomRole(ctx, "other", "u1"); got != "" {
+		t.Errorf("override must be scoped to the room, got %q", got)
+	}
+
+	if err := store.DeleteRoomRole(ctx, "general", "u1"); err != nil {
+		t.Fatalf("DeleteRoomRole failed: %v", err)
+	}
+	if got, _ := store.GetRoomRole(ctx, "general", "u1"); got != "" {
+		t.Errorf("override should be removed, got %q", got)
+	}
+}
+
+// interface compliance check
+var _ domain.RoomRoleRepository = (*RoomRoleStore)(nil)
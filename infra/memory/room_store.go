@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dchf12/chat/domain"
+)
+
+// RoomStore はインメモリの RoomRepository 実装。
+type RoomStore struct {
+	inProcess
+	mu    sync.RWMutex
+	rooms map[string]domain.Room
+}
+
+// NewRoomStore は空の RoomStore を生成する。
+func NewRoomStore() *RoomStore {
+	return &RoomStore{
+		rooms: make(map[string]domain.Room),
+	}
+}
+
+// Create はルームを保存する。
+func (s *RoomStore) Create(_ context.Context, room domain.Room) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.rooms[room.ID]; exists {
+		return fmt.Errorf("%w: %s", domain.ErrRoomExists, room.ID)
+	}
+	s.rooms[room.ID] = room
+	return nil
+}
+
+// Get は ID でルームを取得する。
+func (s *RoomStore) Get(_ context.Context, id string) (domain.Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.rooms[id]
+	if !ok {
+		return domain.Room{}, fmt.Errorf("%w: %s", domain.ErrRoomNotFound, id)
+	}
+	return room, nil
+}
+
+// List はすべてのルームを作成順に返す。
+func (s *RoomStore) List(_ context.Context) ([]domain.Room, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]domain.Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].CreatedAt.Equal(rooms[j].CreatedAt) {
+			return rooms[i].ID < rooms[j].ID
+		}
+		return rooms[i].CreatedAt.Before(rooms[j].CreatedAt)
+	})
+	return rooms, nil
+}
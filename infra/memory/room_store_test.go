@@ -0,0 +1,46 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestRoomStore_CreateAndList(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewRoomStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	rooms := []domain.Room{
+		{ID: "random", Name: "Random", CreatedAt: now.Add(time.Minute)},
+		{ID: "general", Name: "General", CreatedAt: now},
+	}
+	for _, r := range rooms {
+		if err := store.Create(ctx, r); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	if err := store.Create(ctx, domain.Room{ID: "general"}); !errors.Is(err, domain.ErrRoomExists) {
+		t.Errorf("want ErrRoomExists, got %v", err)
+	}
+
+	got, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(got) != 2 || got[0].ID != "general" || got[1].ID != "random" {
+		t.Errorf("expected rooms in creation order, got %+v", got)
+	}
+
+	room, err := store.Get(ctx, "random")
+	if err != nil || room.Name != "Random" {
+		t.Errorf("unexpected room %+v, err %v", room, err)
+	}
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, domain.ErrRoomNotFound) {
+		t.Errorf("want ErrRoomNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+// SanctionStore はインメモリの SanctionRepository 実装。
+type SanctionStore struct {
+	inProcess
+	mu        sync.RWMutex
+	sanctions map[string]domain.Sanction
+}
+
+// NewSanctionStore は空の SanctionStore を生成する。
+func NewSanctionStore() *SanctionStore {
+	return &SanctionStore{
+		sanctions: make(map[string]domain.Sanction),
+	}
+}
+
+// Create は制裁を保存する。
+func (s *SanctionStore) Create(_ context.Context, sanction domain.Sanction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.sanctions[sanction.ID]; exists {
+		return fmt.Errorf("sanction already exists: %s", sanction.ID)
+	}
+	s.sanctions[sanction.ID] = sanction
+	return nil
+}
+
+// Get は ID で制裁を取得する。
+func (s *SanctionStore) Get(_ context.Context, id string) (domain.Sanction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sanction, ok := s.sanctions[id]
+	if !ok {
+		return domain.Sanction{}, fmt.Errorf("%w: %s", domain.ErrSanctionNotFound, id)
+	}
+	return sanction, nil
+}
+
+// Delete は制裁を取り消す。
+func (s *SanctionStore) Delete(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.sanctions[id]; !ok {
+		return fmt.Errorf("%w: %s", domain.ErrSanctionNotFound, id)
+	}
+	delete(s.sanctions, id)
+	return nil
+}
+
+// Active は有効な制裁のうち最も遅く終わるものを返す。期限切れの制裁はここで削除する。
+func (s *SanctionStore) Active(_ context.Context, userID, roomID string, kind domain.SanctionKind, now time.Time) (domain.Sanction, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		found  domain.Sanction
+		active bool
+	)
+	for id, sanction := range s.sanctions {
+		if !sanction.ActiveAt(now) {
+			delete(s.sanctions, id)
+			continue
+		}
+		if sanction.UserID != userID || sanction.RoomID != roomID || sanction.Kind != kind {
+			continue
+		}
+		if !active || outlasts(sanction, found) {
+			found, active = sanction, true
+		}
+	}
+	return found, active, nil
+}
+
+// ListActive はルームで有効な制裁を作成順に返す。
+func (s *SanctionStore) ListActive(_ context.Context, roomID string, now time.Time) ([]domain.Sanction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var sanctions []domain.Sanction
+	for _, sanction := range s.sanctions {
+		if sanction.RoomID == roomID && sanction.ActiveAt(now) {
+			sanctions = append(sanctions, sanction)
+		}
+	}
+	sort.Slice(sanctions, func(i, j int) bool {
+		return sanctions[i].CreatedAt.Before(sanctions[j].CreatedAt)
+	})
+	return sanctions, nil
+}
+
+// outlasts は a が b より遅く終わるかを返す。無期限の制裁が最も遅い。
+func outlasts(a, b domain.Sanction) bool {
+	if b.ExpiresAt.IsZero() {
+		return false
+	}
+	return a.ExpiresAt.IsZero() || a.ExpiresAt.After(b.ExpiresAt)
+}
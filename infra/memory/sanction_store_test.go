@@ -0,0 +1,78 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestSanctionStore_Active(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewSanctionStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	sanctions := []domain.Sanction{
+		{ID: "s1", Kind: domain.SanctionMute, UserID: "u1", RoomID: "general", ExpiresAt: now.Add(time.Minute)},
+		{ID: "s2", Kind: domain.SanctionMute, UserID: "u1", RoomID: "general", ExpiresAt: now.Add(time.Hour)},
+		{ID: "s3", Kind: domain.SanctionBan, UserID: "u1", RoomID: "other"},
+		{ID: "s4", Kind: domain.SanctionMute, UserID: "u2", RoomID: "general", ExpiresAt: now.Add(-time.Second)},
+	}
+	for _, s := range sanctions {
+		if err := store.Create(ctx, s); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+
+	got, ok, err := store.Active(ctx, "u1", "general", domain.SanctionMute, now)
+	if err != nil || !ok || got.ID != "s2" {
+		t.Fatalf("want the longest mute s2, got %+v, %v, %v", got, ok, err)
+	}
+	if _, ok, _ := store.Active(ctx, "u1", "general", domain.SanctionBan, now); ok {
+		t.Error("ban in another room must not apply")
+	}
+	if _, ok, _ := store.Active(ctx, "u2", "general", domain.SanctionMute, now); ok {
+		t.Error("expired mute must not apply")
+	}
+	if _, err := store.Get(ctx, "s4"); !errors.Is(err, domain.ErrSanctionNotFound) {
+		t.Errorf("expired sanction should be pruned, got %v", err)
+	}
+}
+
+func TestSanctionStore_ListActiveAndDelete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewSanctionStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, id := range []string{"s1", "s2"} {
+		s := domain.Sanction{ID: id, Kind: domain.SanctionBan, UserID: id, RoomID: "general", CreatedAt: now.Add(time.Duration(i) * time.Second)}
+		if err := store.Create(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Create(ctx, domain.Sanction{ID: "s1"}); err == nil {
+		t.Fatal("expected duplicate ID error")
+	}
+
+	list, err := store.ListActive(ctx, "general", now)
+	if err != nil || len(list) != 2 || list[0].ID != "s1" {
+		t.Fatalf("unexpected list: %+v, %v", list, err)
+	}
+
+	if err := store.Delete(ctx, "s1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := store.Delete(ctx, "s1"); !errors.Is(err, domain.ErrSanctionNotFound) {
+		t.Errorf("want ErrSanctionNotFound, got %v", err)
+	}
+	if list, _ := store.ListActive(ctx, "general", now); len(list) != 1 {
+		t.Errorf("want 1 sanction after delete, got %d", len(list))
+	}
+}
+
+// interface compliance check
+var _ domain.SanctionRepository = (*SanctionStore)(nil)
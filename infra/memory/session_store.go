@@ -18,6 +18,7 @@ type sessionEntry struct {
 
 // SessionStore はインメモリの SessionRepository 実装。
 type SessionStore struct {
+	inProcess
 	mu       sync.RWMutex
 	sessions map[string]sessionEntry
 }
@@ -29,14 +30,26 @@ func NewSessionStore() *SessionStore {
 	}
 }
 
-// Save はセッションデータを保存する。TTL は 60 秒。
+// Save はセッションデータを保存する。有効期限は session.Expires で、未設定の場合は 60 秒。
+// 自動入力のログインは完了しないことが多いため、保存のたびに期限切れのセッションを削除する。
 func (s *SessionStore) Save(_ context.Context, key string, session webauthn.SessionData) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	now := time.Now()
+	for k, entry := range s.sessions {
+		if now.After(entry.expiresAt) {
+			delete(s.sessions, k)
+		}
+	}
+
+	expiresAt := session.Expires
+	if expiresAt.IsZero() {
+		expiresAt = now.Add(sessionTTL)
+	}
 	s.sessions[key] = sessionEntry{
 		data:      session,
-		expiresAt: time.Now().Add(sessionTTL),
+		expiresAt: expiresAt,
 	}
 	return nil
 }
@@ -107,5 +107,44 @@ func TestSessionStore_Delete(t *testing.T) {
 	}
 }
 
+func TestSessionStore_Save_UsesSessionExpiry(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewSessionStore()
+
+	expires := time.Now().Add(5 * time.Minute)
+	if err := store.Save(ctx, "s1", webauthn.SessionData{Challenge: "long", Expires: expires}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.RLock()
+	got := store.sessions["s1"].expiresAt
+	store.mu.RUnlock()
+	if !got.Equal(expires) {
+		t.Errorf("want expiry %v, got %v", expires, got)
+	}
+}
+
+func TestSessionStore_Save_PrunesExpired(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewSessionStore()
+
+	past := time.Now().Add(-time.Second)
+	if err := store.Save(ctx, "stale", webauthn.SessionData{Challenge: "stale", Expires: past}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(ctx, "fresh", webauthn.SessionData{Challenge: "fresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.RLock()
+	_, ok := store.sessions["stale"]
+	store.mu.RUnlock()
+	if ok {
+		t.Error("expired session should be pruned on Save")
+	}
+}
+
 // interface compliance check
 var _ domain.SessionRepository = (*SessionStore)(nil)
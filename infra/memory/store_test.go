@@ -0,0 +1,45 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestStores_HealthAndFlush(t *testing.T) {
+	t.Parallel()
+	stores := map[string]any{
+		"users":      NewUserStore(),
+		"sessions":   NewSessionStore(),
+		"audit":      NewAuditStore(),
+		"room_roles": NewRoomRoleStore(),
+		"sanctions":  NewSanctionStore(),
+		"reports":    NewReportStore(),
+		"rooms":      NewRoomStore(),
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, s := range stores {
+		hc, ok := s.(domain.HealthChecker)
+		if !ok {
+			t.Errorf("%s: expected to implement domain.HealthChecker", name)
+			continue
+		}
+		f, ok := s.(domain.Flusher)
+		if !ok {
+			t.Errorf("%s: expected to implement domain.Flusher", name)
+			continue
+		}
+		if err := hc.Ping(context.Background()); err != nil {
+			t.Errorf("%s: Ping failed: %v", name, err)
+		}
+		if err := f.Flush(context.Background()); err != nil {
+			t.Errorf("%s: Flush failed: %v", name, err)
+		}
+		if err := hc.Ping(canceled); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: expected Ping to report the canceled context, got %v", name, err)
+		}
+	}
+}
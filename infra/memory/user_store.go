@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/dchf12/chat/domain"
 	"github.com/go-webauthn/webauthn/webauthn"
@@ -12,14 +13,17 @@ import (
 
 // UserStore はインメモリの UserRepository 実装。
 type UserStore struct {
-	mu    sync.RWMutex
-	users map[string]domain.User
+	inProcess
+	mu         sync.RWMutex
+	users      map[string]domain.User
+	identities map[domain.Identity]string // identity -> user ID
 }
 
 // NewUserStore は空の UserStore を生成する。
 func NewUserStore() *UserStore {
 	return &UserStore{
-		users: make(map[string]domain.User),
+		users:      make(map[string]domain.User),
+		identities: make(map[domain.Identity]string),
 	}
 }
 
@@ -76,7 +80,7 @@ func (s *UserStore) GetByName(_ context.Context, name string) (domain.User, erro
 }
 
 // AddCredential はユーザーにクレデンシャルを追加する（不変性パターン）。
-func (s *UserStore) AddCredential(_ context.Context, userID string, cred webauthn.Credential) error {
+func (s *UserStore) AddCredential(_ context.Context, userID string, cred domain.Credential) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -88,7 +92,8 @@ func (s *UserStore) AddCredential(_ context.Context, userID string, cred webauth
 	return nil
 }
 
-// UpdateCredential はクレデンシャルの SignCount を更新する。
+// UpdateCredential はクレデンシャルの SignCount とバックアップ状態、最終使用日時を更新する。
+// SignCount は保存済みの値より大きいときだけ更新する。
 func (s *UserStore) UpdateCredential(_ context.Context, userID string, cred webauthn.Credential) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -100,10 +105,194 @@ func (s *UserStore) UpdateCredential(_ context.Context, userID string, cred weba
 
 	for i, c := range user.Credentials {
 		if bytes.Equal(c.ID, cred.ID) {
-			user.Credentials[i].Authenticator.SignCount = cred.Authenticator.SignCount
+			user.Credentials[i].Authenticator.SignCount = max(c.Authenticator.SignCount, cred.Authenticator.SignCount)
+			user.Credentials[i].Authenticator.CloneWarning = c.Authenticator.CloneWarning || cred.Authenticator.CloneWarning
+			user.Credentials[i].Flags.BackupState = cred.Flags.BackupState
+			user.Credentials[i].LastUsedAt = time.Now()
 			s.users[userID] = user
 			return nil
 		}
 	}
 	return fmt.Errorf("credential not found: %s", cred.ID)
 }
+
+// SetCloneWarning はクレデンシャルの CloneWarning を変更する。
+func (s *UserStore) SetCloneWarning(_ context.Context, userID string, credID []byte, warning bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+
+	for i, c := range user.Credentials {
+		if bytes.Equal(c.ID, credID) {
+			user.Credentials[i].Authenticator.CloneWarning = warning
+			s.users[userID] = user
+			return nil
+		}
+	}
+	return fmt.Errorf("credential not found: %s", credID)
+}
+
+// RenameCredential はクレデンシャルのニックネームを変更する。
+func (s *UserStore) RenameCredential(_ context.Context, userID string, credID []byte, nickname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+
+	for i, c := range user.Credentials {
+		if bytes.Equal(c.ID, credID) {
+			user.Credentials[i].Nickname = nickname
+			s.users[userID] = user
+			return nil
+		}
+	}
+	return fmt.Errorf("credential not found: %s", credID)
+}
+
+// DeleteCredential はクレデンシャルを削除する（不変性パターン）。
+func (s *UserStore) DeleteCredential(_ context.Context, userID string, credID []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	if _, ok := user.FindCredential(credID); !ok {
+		return fmt.Errorf("credential not found: %s", credID)
+	}
+	methods := len(user.Credentials)
+	for _, owner := range s.identities {
+		if owner == userID {
+			methods++
+		}
+	}
+	if methods <= 1 {
+		return domain.ErrLastLoginMethod
+	}
+	s.users[userID] = user.WithoutCredential(credID)
+	return nil
+}
+
+// GetByIdentity は紐付け済みの外部 IdP アカウントからユーザーを取得する。
+func (s *UserStore) GetByIdentity(_ context.Context, identity domain.Identity) (domain.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userID, ok := s.identities[identity]
+	if !ok {
+		return domain.User{}, fmt.Errorf("identity not linked: %s/%s", identity.Provider, identity.Subject)
+	}
+	user, ok := s.users[userID]
+	if !ok {
+		return domain.User{}, fmt.Errorf("user not found: %s", userID)
+	}
+	return user, nil
+}
+
+// LinkIdentity は外部 IdP アカウントをユーザーに紐付ける。同じユーザーへの再紐付けは成功扱い。
+func (s *UserStore) LinkIdentity(_ context.Context, userID string, identity domain.Identity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	if owner, ok := s.identities[identity]; ok && owner != userID {
+		return fmt.Errorf("identity %s/%s is linked to another user", identity.Provider, identity.Subject)
+	}
+	s.identities[identity] = userID
+	return nil
+}
+
+// ListIdentities はユーザーに紐付いた外部 IdP アカウントを返す。
+func (s *UserStore) ListIdentities(_ context.Context, userID string) ([]domain.Identity, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.users[userID]; !ok {
+		return nil, fmt.Errorf("user not found: %s", userID)
+	}
+	var identities []domain.Identity
+	for identity, owner := range s.identities {
+		if owner == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+// SetRecoveryCodes は回復コードを置き換える。
+func (s *UserStore) SetRecoveryCodes(_ context.Context, userID string, codes []domain.RecoveryCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	user.RecoveryCodes = append([]domain.RecoveryCode(nil), codes...)
+	s.users[userID] = user
+	return nil
+}
+
+// UseRecoveryCode は未使用の回復コードを使用済みにする。
+func (s *UserStore) UseRecoveryCode(_ context.Context, userID string, hash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	for i, c := range user.RecoveryCodes {
+		if !c.Used() && bytes.Equal(c.Hash, hash) {
+			codes := append([]domain.RecoveryCode(nil), user.RecoveryCodes...)
+			codes[i].UsedAt = time.Now()
+			user.RecoveryCodes = codes
+			s.users[userID] = user
+			return nil
+		}
+	}
+	return domain.ErrRecoveryCodeInvalid
+}
+
+// SetRole はサイト全体のロールを変更する。
+func (s *UserStore) SetRole(_ context.Context, userID string, role domain.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	user.Role = role
+	s.users[userID] = user
+	return nil
+}
+
+// PromoteIfNoAdmin は管理者がいない場合にユーザーを管理者にする。
+func (s *UserStore) PromoteIfNoAdmin(_ context.Context, userID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return false, fmt.Errorf("user not found: %s", userID)
+	}
+	for _, u := range s.users {
+		if u.Role == domain.RoleAdmin {
+			return false, nil
+		}
+	}
+	user.Role = domain.RoleAdmin
+	s.users[userID] = user
+	return true, nil
+}
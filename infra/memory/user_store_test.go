@@ -2,6 +2,8 @@ package memory
 
 import (
 	"context"
+	"errors"
+	"sync"
 	"testing"
 
 	"github.com/dchf12/chat/domain"
@@ -125,7 +127,7 @@ func TestUserStore_AddCredential(t *testing.T) {
 			SignCount: 0,
 		},
 	}
-	if err := store.AddCredential(ctx, "u1", cred); err != nil {
+	if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: cred}); err != nil {
 		t.Fatalf("AddCredential failed: %v", err)
 	}
 
@@ -143,7 +145,7 @@ func TestUserStore_AddCredential_UserNotFound(t *testing.T) {
 	ctx := context.Background()
 	store := NewUserStore()
 
-	err := store.AddCredential(ctx, "missing", webauthn.Credential{})
+	err := store.AddCredential(ctx, "missing", domain.Credential{})
 	if err == nil {
 		t.Fatal("expected not found error")
 	}
@@ -166,7 +168,7 @@ func TestUserStore_UpdateCredential(t *testing.T) {
 			SignCount: 0,
 		},
 	}
-	if err := store.AddCredential(ctx, "u1", cred); err != nil {
+	if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: cred}); err != nil {
 		t.Fatal(err)
 	}
 
@@ -184,6 +186,96 @@ func TestUserStore_UpdateCredential(t *testing.T) {
 	if got.Credentials[0].Authenticator.SignCount != 5 {
 		t.Errorf("want SignCount 5, got %d", got.Credentials[0].Authenticator.SignCount)
 	}
+	if got.Credentials[0].LastUsedAt.IsZero() {
+		t.Error("want LastUsedAt to be set")
+	}
+}
+
+func TestUserStore_UpdateCredential_SignCountRegression(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	cred := webauthn.Credential{
+		ID:            []byte("cred1"),
+		Authenticator: webauthn.Authenticator{SignCount: 10},
+	}
+	if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: cred}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同時に完了したログインの古い値で巻き戻さない
+	cred.Authenticator.SignCount = 3
+	if err := store.UpdateCredential(ctx, "u1", cred); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := store.GetByID(ctx, "u1")
+	if got.Credentials[0].Authenticator.SignCount != 10 {
+		t.Errorf("want SignCount to stay 10, got %d", got.Credentials[0].Authenticator.SignCount)
+	}
+}
+
+func TestUserStore_UpdateCredential_CloneWarningIsSticky(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	cred := webauthn.Credential{
+		ID:            []byte("cred1"),
+		Authenticator: webauthn.Authenticator{SignCount: 1},
+	}
+	if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: cred}); err != nil {
+		t.Fatal(err)
+	}
+
+	cred.Authenticator.CloneWarning = true
+	if err := store.UpdateCredential(ctx, "u1", cred); err != nil {
+		t.Fatal(err)
+	}
+	cred.Authenticator.SignCount = 2
+	cred.Authenticator.CloneWarning = false
+	if err := store.UpdateCredential(ctx, "u1", cred); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := store.GetByID(ctx, "u1")
+	if !got.Credentials[0].Authenticator.CloneWarning {
+		t.Error("want CloneWarning to remain set")
+	}
+}
+
+func TestUserStore_SetCloneWarning(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	cred := webauthn.Credential{ID: []byte("cred1"), Authenticator: webauthn.Authenticator{SignCount: 4}}
+	if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: cred}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, warning := range []bool{true, false} {
+		if err := store.SetCloneWarning(ctx, "u1", cred.ID, warning); err != nil {
+			t.Fatalf("SetCloneWarning(%v) failed: %v", warning, err)
+		}
+		got, _ := store.GetByID(ctx, "u1")
+		if a := got.Credentials[0].Authenticator; a.CloneWarning != warning || a.SignCount != 4 {
+			t.Errorf("want only CloneWarning set to %v, got %+v", warning, a)
+		}
+	}
+	if err := store.SetCloneWarning(ctx, "u1", []byte("missing"), true); err == nil {
+		t.Fatal("expected credential not found error")
+	}
 }
 
 func TestUserStore_UpdateCredential_NotFound(t *testing.T) {
@@ -207,5 +299,277 @@ func TestUserStore_UpdateCredential_NotFound(t *testing.T) {
 	}
 }
 
+func TestUserStore_LinkIdentity(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := domain.Identity{Provider: "google", Subject: "sub-1"}
+	if err := store.LinkIdentity(ctx, "u1", identity); err != nil {
+		t.Fatalf("LinkIdentity failed: %v", err)
+	}
+
+	got, err := store.GetByIdentity(ctx, identity)
+	if err != nil {
+		t.Fatalf("GetByIdentity failed: %v", err)
+	}
+	if got.ID != "u1" {
+		t.Errorf("want ID u1, got %s", got.ID)
+	}
+
+	identities, err := store.ListIdentities(ctx, "u1")
+	if err != nil {
+		t.Fatalf("ListIdentities failed: %v", err)
+	}
+	if len(identities) != 1 || identities[0] != identity {
+		t.Errorf("want [%v], got %v", identity, identities)
+	}
+}
+
+func TestUserStore_LinkIdentity_OwnedByAnotherUser(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Create(ctx, testUser("u2", "bob")); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := domain.Identity{Provider: "google", Subject: "sub-1"}
+	if err := store.LinkIdentity(ctx, "u1", identity); err != nil {
+		t.Fatal(err)
+	}
+	// relinking to the same user is idempotent
+	if err := store.LinkIdentity(ctx, "u1", identity); err != nil {
+		t.Fatalf("relink to same user failed: %v", err)
+	}
+	if err := store.LinkIdentity(ctx, "u2", identity); err == nil {
+		t.Fatal("expected error when identity is linked to another user")
+	}
+}
+
+func TestUserStore_GetByIdentity_NotFound(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	_, err := store.GetByIdentity(ctx, domain.Identity{Provider: "google", Subject: "missing"})
+	if err == nil {
+		t.Fatal("expected not found error")
+	}
+}
+
+func TestUserStore_RenameCredential(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	cred := domain.Credential{Credential: webauthn.Credential{ID: []byte("cred1")}}
+	if err := store.AddCredential(ctx, "u1", cred); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.RenameCredential(ctx, "u1", []byte("cred1"), "laptop"); err != nil {
+		t.Fatalf("RenameCredential failed: %v", err)
+	}
+
+	got, _ := store.GetByID(ctx, "u1")
+	if got.Credentials[0].Nickname != "laptop" {
+		t.Errorf("want nickname laptop, got %s", got.Credentials[0].Nickname)
+	}
+
+	if err := store.RenameCredential(ctx, "u1", []byte("missing"), "x"); err == nil {
+		t.Fatal("expected credential not found error")
+	}
+}
+
+func TestUserStore_DeleteCredential(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"cred1", "cred2"} {
+		cred := domain.Credential{Credential: webauthn.Credential{ID: []byte(id)}}
+		if err := store.AddCredential(ctx, "u1", cred); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.DeleteCredential(ctx, "u1", []byte("cred1")); err != nil {
+		t.Fatalf("DeleteCredential failed: %v", err)
+	}
+
+	got, _ := store.GetByID(ctx, "u1")
+	if len(got.Credentials) != 1 || string(got.Credentials[0].ID) != "cred2" {
+		t.Fatalf("want only cred2 left, got %v", got.Credentials)
+	}
+
+	if err := store.DeleteCredential(ctx, "u1", []byte("cred1")); err == nil {
+		t.Fatal("expected credential not found error")
+	}
+
+	// 最後のログイン手段は残す
+	if err := store.DeleteCredential(ctx, "u1", []byte("cred2")); !errors.Is(err, domain.ErrLastLoginMethod) {
+		t.Fatalf("want ErrLastLoginMethod, got %v", err)
+	}
+	if err := store.LinkIdentity(ctx, "u1", domain.Identity{Provider: "google", Subject: "sub"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteCredential(ctx, "u1", []byte("cred2")); err != nil {
+		t.Errorf("expected the linked account to allow deleting the last passkey, got %v", err)
+	}
+}
+
+func TestUserStore_DeleteCredentialConcurrently(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{"cred1", "cred2"}
+	for _, id := range ids {
+		if err := store.AddCredential(ctx, "u1", domain.Credential{Credential: webauthn.Credential{ID: []byte(id)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errs := make(chan error, len(ids))
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- store.DeleteCredential(ctx, "u1", []byte(id))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	refused := 0
+	for err := range errs {
+		if errors.Is(err, domain.ErrLastLoginMethod) {
+			refused++
+		} else if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if got, _ := store.GetByID(ctx, "u1"); refused != 1 || len(got.Credentials) != 1 {
+		t.Errorf("expected one passkey to remain, got %d refused and %v", refused, got.Credentials)
+	}
+}
+
+func TestUserStore_UseRecoveryCode(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	codes := []domain.RecoveryCode{{Hash: []byte("hash1")}, {Hash: []byte("hash2")}}
+	if err := store.SetRecoveryCodes(ctx, "u1", codes); err != nil {
+		t.Fatalf("SetRecoveryCodes failed: %v", err)
+	}
+
+	if err := store.UseRecoveryCode(ctx, "u1", []byte("hash1")); err != nil {
+		t.Fatalf("UseRecoveryCode failed: %v", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "u1", []byte("hash1")); !errors.Is(err, domain.ErrRecoveryCodeInvalid) {
+		t.Fatalf("want ErrRecoveryCodeInvalid for a used code, got %v", err)
+	}
+	if err := store.UseRecoveryCode(ctx, "u1", []byte("unknown")); !errors.Is(err, domain.ErrRecoveryCodeInvalid) {
+		t.Fatalf("want ErrRecoveryCodeInvalid for an unknown code, got %v", err)
+	}
+
+	got, _ := store.GetByID(ctx, "u1")
+	if n := got.RemainingRecoveryCodes(); n != 1 {
+		t.Errorf("want 1 remaining code, got %d", n)
+	}
+	if codes[0].Used() {
+		t.Error("caller's slice must not be modified")
+	}
+}
+
+func TestUserStore_SetRecoveryCodes_ReplacesOldCodes(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRecoveryCodes(ctx, "u1", []domain.RecoveryCode{{Hash: []byte("old")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRecoveryCodes(ctx, "u1", []domain.RecoveryCode{{Hash: []byte("new")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.UseRecoveryCode(ctx, "u1", []byte("old")); !errors.Is(err, domain.ErrRecoveryCodeInvalid) {
+		t.Fatalf("old code must be invalidated, got %v", err)
+	}
+	if err := store.SetRecoveryCodes(ctx, "missing", nil); err == nil {
+		t.Fatal("expected user not found error")
+	}
+}
+
+func TestUserStore_SetRole(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	if err := store.Create(ctx, testUser("u1", "alice")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetRole(ctx, "u1", domain.RoleModerator); err != nil {
+		t.Fatalf("SetRole failed: %v", err)
+	}
+	got, _ := store.GetByID(ctx, "u1")
+	if got.Role != domain.RoleModerator {
+		t.Errorf("want moderator, got %q", got.Role)
+	}
+	if err := store.SetRole(ctx, "missing", domain.RoleAdmin); err == nil {
+		t.Fatal("expected user not found error")
+	}
+}
+
+func TestUserStore_PromoteIfNoAdmin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	store := NewUserStore()
+
+	for _, u := range []domain.User{testUser("u1", "alice"), testUser("u2", "bob")} {
+		if err := store.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	promoted, err := store.PromoteIfNoAdmin(ctx, "u1")
+	if err != nil || !promoted {
+		t.Fatalf("first promotion should succeed, got %v, %v", promoted, err)
+	}
+	promoted, err = store.PromoteIfNoAdmin(ctx, "u2")
+	if err != nil || promoted {
+		t.Fatalf("second promotion should be skipped, got %v, %v", promoted, err)
+	}
+	got, _ := store.GetByID(ctx, "u2")
+	if got.Role == domain.RoleAdmin {
+		t.Error("u2 must not become admin")
+	}
+}
+
 // interface compliance check
 var _ domain.UserRepository = (*UserStore)(nil)
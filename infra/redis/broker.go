@@ -0,0 +1,114 @@
+// Package redis は Redis を使ったインフラ実装を提供する。
+package redis
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dchf12/chat/domain"
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// Broker は Redis の pub/sub を使う domain.Broker 実装。複数のサーバーでルームを共有するのに使う。
+type Broker struct {
+	client *goredis.Client
+
+	mu     sync.Mutex
+	subs   map[*goredis.PubSub]struct{}
+	closed bool
+}
+
+// NewBroker は addr の Redis に接続する Broker を生成する。接続は最初の操作時に確立される。
+func NewBroker(addr string) *Broker {
+	return NewBrokerWithClient(goredis.NewClient(&goredis.Options{Addr: addr}))
+}
+
+// NewBrokerWithClient は設定済みのクライアントを使う Broker を生成する。Close でクライアントも閉じる。
+func NewBrokerWithClient(client *goredis.Client) *Broker {
+	return &Broker{client: client, subs: make(map[*goredis.PubSub]struct{})}
+}
+
+// Ping は Redis との疎通を確認する。
+func (b *Broker) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+// Publish は topic のチャンネルに payload を送る。
+func (b *Broker) Publish(ctx context.Context, topic string, payload []byte) error {
+	if b.isClosed() {
+		return domain.ErrBrokerClosed
+	}
+	return b.client.Publish(ctx, topic, payload).Err()
+}
+
+// Subscribe は topic のチャンネルを購読する。購読が確立してから返す。
+func (b *Broker) Subscribe(ctx context.Context, topic string) (<-chan []byte, error) {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil, domain.ErrBrokerClosed
+	}
+	ps := b.client.Subscribe(ctx, topic)
+	b.subs[ps] = struct{}{}
+	b.mu.Unlock()
+
+	// 購読の確認を待ち、直後の Publish を取りこぼさないようにする
+	if _, err := ps.Receive(ctx); err != nil {
+		b.release(ps)
+		return nil, err
+	}
+
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer b.release(ps)
+		msgs := ps.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				select {
+				case out <- []byte(msg.Payload):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (b *Broker) release(ps *goredis.PubSub) {
+	b.mu.Lock()
+	delete(b.subs, ps)
+	b.mu.Unlock()
+	_ = ps.Close()
+}
+
+func (b *Broker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close はすべての購読を終了し、Redis との接続を閉じる。
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	subs := b.subs
+	b.subs = make(map[*goredis.PubSub]struct{})
+	b.mu.Unlock()
+
+	for ps := range subs {
+		_ = ps.Close()
+	}
+	return b.client.Close()
+}
@@ -0,0 +1,69 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dchf12/chat/domain"
+)
+
+func receivePayload(t *testing.T, ch <-chan []byte) ([]byte, bool) {
+	t.Helper()
+	select {
+	case p, ok := <-ch:
+		return p, ok
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for payload")
+		return nil, false
+	}
+}
+
+func TestBroker_PublishSubscribe(t *testing.T) {
+	srv := miniredis.RunT(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 別々のサーバーを想定して Broker を二つ作る
+	node1, node2 := NewBroker(srv.Addr()), NewBroker(srv.Addr())
+	defer func() { _ = node2.Close() }()
+	if err := node1.Ping(ctx); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+
+	sub1, err := node1.Subscribe(ctx, "room:general")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	sub2, err := node2.Subscribe(subCtx, "room:general")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if err := node1.Publish(ctx, "room:general", []byte("hello")); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	for _, ch := range []<-chan []byte{sub1, sub2} {
+		if got, _ := receivePayload(t, ch); string(got) != "hello" {
+			t.Errorf("expected hello, got %q", got)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := receivePayload(t, sub2); ok {
+		t.Error("expected channel to close after unsubscribe")
+	}
+
+	if err := node1.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, ok := receivePayload(t, sub1); ok {
+		t.Error("expected channel to close with the broker")
+	}
+	if err := node1.Publish(ctx, "room:general", nil); !errors.Is(err, domain.ErrBrokerClosed) {
+		t.Errorf("expected ErrBrokerClosed, got %v", err)
+	}
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"html/template"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/dchf12/chat/domain"
 	"github.com/dchf12/chat/infra/memory"
 	"github.com/dchf12/chat/trace"
-	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -28,61 +34,250 @@ var avatars Avatar = UseAuthAvatar
 
 func main() {
 	var addr = flag.String("addr", ":8080", "The addr of the application.")
+	var bootstrapAdmin = flag.String("admin", "", "Email of the user to make admin when they sign up through an OAuth provider that has verified the address. If empty, the first registered user becomes admin.")
+	var filterPath = flag.String("filters", "", "Path to the JSON message filter configuration. Reloaded on SIGHUP or POST /admin/filters/reload. If empty, messages are not filtered.")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 15*time.Second, "Time allowed on SIGTERM for clients to drain and the HTTP server to stop.")
+	var brokerKind = flag.String("broker", "memory", "Pub/sub backplane that relays room events between servers: memory or redis.")
+	var redisAddr = flag.String("redis-addr", "localhost:6379", "Redis host:port used by the redis broker.")
+	var apiTokenTTL = flag.Duration("api-token-ttl", 24*time.Hour, "Lifetime of bearer tokens issued by POST /api/v1/tokens.")
+	var maxRooms = flag.Int("max-rooms", defaultMaxRooms, "Maximum number of rooms, including the default room, that can exist before POST /api/v1/rooms is refused.")
+	var clonePolicy = flag.String("passkey-clone-policy", string(ClonePolicyReject), "Action on passkey sign-count regression: reject, flag or notify.")
+	wconfig := defaultWebAuthnConfig()
+	wconfig.RegisterFlags(flag.CommandLine, os.Getenv)
+	rateConfig := defaultRateLimitConfig()
+	rateConfig.RegisterFlags(flag.CommandLine)
+	connConfig := defaultConnectionConfig()
+	connConfig.RegisterFlags(flag.CommandLine)
+	backpressureConfig := defaultBackpressureConfig()
+	backpressureConfig.RegisterFlags(flag.CommandLine)
+	traceConfig := trace.DefaultConfig()
+	traceConfig.RegisterFlags(flag.CommandLine)
+	telemetryConfig := defaultTelemetryConfig()
+	telemetryConfig.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
+	if err := wconfig.Validate(); err != nil {
+		log.Fatalf("invalid WebAuthn configuration: %v", err)
+	}
+	if err := rateConfig.Validate(); err != nil {
+		log.Fatalf("invalid rate limit configuration: %v", err)
+	}
+	if err := connConfig.Validate(); err != nil {
+		log.Fatalf("invalid WebSocket connection configuration: %v", err)
+	}
+	if err := backpressureConfig.Validate(); err != nil {
+		log.Fatalf("invalid slow client configuration: %v", err)
+	}
+	if *apiTokenTTL <= 0 {
+		log.Fatalf("api-token-ttl must be positive, got %s", *apiTokenTTL)
+	}
+	if *bootstrapAdmin != "" && !strings.Contains(*bootstrapAdmin, "@") {
+		log.Fatalf("admin must be an email address, got %q", *bootstrapAdmin)
+	}
+	if *maxRooms < 1 {
+		log.Fatalf("max-rooms must be at least 1, got %d", *maxRooms)
+	}
+	tracer, traceCloser, err := traceConfig.Open()
+	if err != nil {
+		log.Fatalf("invalid trace configuration: %v", err)
+	}
+	defer func() { _ = traceCloser.Close() }()
+	if err := telemetryConfig.Validate(); err != nil {
+		log.Fatalf("invalid OpenTelemetry configuration: %v", err)
+	}
+	shutdownTelemetry, err := setupTelemetry(context.Background(), telemetryConfig)
+	if err != nil {
+		log.Fatalf("failed to set up OpenTelemetry: %v", err)
+	}
+	defer func() { _ = shutdownTelemetry(context.Background()) }()
+
+	policy, err := ParseClonePolicy(*clonePolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	e := echo.New()
 
+	metrics := NewMetrics()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
+	e.Use(metrics.Middleware())
+	e.Use(TracingMiddleware())
 
 	e.Renderer = &TemplateRenderer{
 		templates: template.Must(template.ParseGlob("templates/*.html")),
 	}
 
-	r := newRoom(avatars)
-	r.tracer = trace.New(os.Stdout)
-	go r.run()
-
 	// WebAuthn 初期化
-	wconfig := &webauthn.Config{
-		RPID:          "localhost",
-		RPDisplayName: "ChatterBox",
-		RPOrigins:     []string{"http://localhost:8080"},
-		AuthenticatorSelection: protocol.AuthenticatorSelection{
-			RequireResidentKey: protocol.ResidentKeyRequired(),
-			UserVerification:   protocol.VerificationPreferred,
-		},
-	}
-	wa, err := webauthn.New(wconfig)
+	waConfig := wconfig.WebAuthn()
+	aaguidPolicy, err := wconfig.AAGUIDPolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if wconfig.MetadataPath != "" {
+		// 許可リストがある場合は MDS に載っていない認証器を受け付けない
+		waConfig.MDS, err = loadMetadataProvider(wconfig.MetadataPath, wconfig.MetadataRootPath, len(wconfig.AllowedAAGUIDs) > 0)
+		if err != nil {
+			log.Fatalf("failed to load FIDO metadata: %v", err)
+		}
+	}
+	wa, err := webauthn.New(waConfig)
 	if err != nil {
 		log.Fatalf("failed to initialize WebAuthn: %v", err)
 	}
 
 	userRepo := memory.NewUserStore()
 	sessionRepo := memory.NewSessionStore()
+	auditLog := memory.NewAuditStore()
+	roomRoleRepo := memory.NewRoomRoleStore()
+	sanctionRepo := memory.NewSanctionStore()
+	reportRepo := memory.NewReportStore()
+	roomRepo := memory.NewRoomStore()
+	health := NewHealth()
+	health.AddRepository("users", userRepo)
+	health.AddRepository("sessions", sessionRepo)
+	health.AddRepository("audit", auditLog)
+	health.AddRepository("room_roles", roomRoleRepo)
+	health.AddRepository("sanctions", sanctionRepo)
+	health.AddRepository("reports", reportRepo)
+	health.AddRepository("rooms", roomRepo)
+	access := NewAccessControl(userRepo, roomRoleRepo)
+	access.auditLog = auditLog
+	access.bootstrapAdmin = *bootstrapAdmin
 	passkeyHandler := NewPasskeyHandler(wa, userRepo, sessionRepo)
+	passkeyHandler.auditLog = auditLog
+	passkeyHandler.clonePolicy = policy
+	passkeyHandler.aaguidPolicy = aaguidPolicy
+	passkeyHandler.access = access
+	passkeyHandler.metrics = metrics
+	oauthHandler := NewOAuthHandler(userRepo)
+	oauthHandler.access = access
+	oauthHandler.auditLog = auditLog
+	oauthHandler.metrics = metrics
+	auditHandler := NewAuditHandler(auditLog)
+
+	broker, err := openBroker(*brokerKind, *redisAddr)
+	if err != nil {
+		log.Fatalf("invalid broker configuration: %v", err)
+	}
+	defer func() { _ = broker.Close() }()
+	health.AddRepository("broker", broker)
+
+	r := newRoom(avatars)
+	r.broker = broker
+	r.tracer = tracer
+	r.metrics = metrics
+	r.access = access
+	r.limiter = newMessageLimiter(rateConfig)
+	r.connConfig = connConfig
+	r.backpressure = backpressureConfig
+	if *filterPath != "" {
+		r.filters, err = LoadFilterSet(*filterPath)
+		if err != nil {
+			log.Fatalf("failed to load message filters: %v", err)
+		}
+		r.filters.auditLog = auditLog
+		go reloadFiltersOnSignal(r.filters)
+	}
+	moderation := NewModeration(sanctionRepo, access, r)
+	moderation.auditLog = auditLog
+	r.moderation = moderation
+	reports := NewReportQueue(reportRepo, moderation)
+	reports.auditLog = auditLog
+	if err := seedRooms(context.Background(), roomRepo, r); err != nil {
+		log.Fatalf("failed to register rooms: %v", err)
+	}
+	// API で作成したルームもキックや通知の送り先になるよう、Moderation と同じ一覧を使う
+	rooms := moderation.rooms
+	api := NewAPI(rooms, roomRepo, access)
+	api.bans = moderation
+	api.auditLog = auditLog
+	api.tokenTTL = *apiTokenTTL
+	api.maxRooms = *maxRooms
+	api.broker = broker
+	if err := api.FollowRooms(context.Background()); err != nil {
+		// 受け取れなくてもこのサーバーで作成したルームは動かす
+		log.Printf("failed to follow rooms created on other servers: %v", err)
+	}
+	go r.run()
 
 	authGroup := e.Group("")
-	authGroup.Use(AuthMiddleware())
+	authGroup.Use(AuthMiddleware(moderation))
 	authGroup.GET("/", renderTemplate("chat.html"))
-	authGroup.POST("/uploader", uploaderHandler)
+	authGroup.POST("/uploader", uploaderHandler(auditLog, metrics), access.Require(domain.PermUploadAvatar))
 	authGroup.GET("/upload", renderTemplate("upload.html"))
+	authGroup.GET("/settings", renderTemplate("settings.html"))
+	authGroup.GET("/passkey/credentials", passkeyHandler.ListCredentials)
+	authGroup.PATCH("/passkey/credentials/:id", passkeyHandler.RenameCredential, access.Require(domain.PermManageAccount))
+	authGroup.DELETE("/passkey/credentials/:id", passkeyHandler.DeleteCredential, access.Require(domain.PermManageAccount))
+	authGroup.DELETE("/passkey/credentials/:id/clone-warning", passkeyHandler.ClearCloneWarning, access.Require(domain.PermManageAccount))
+	authGroup.GET("/passkey/recovery-codes", passkeyHandler.RecoveryCodeStatus)
+	authGroup.POST("/passkey/recovery-codes", passkeyHandler.RegenerateRecoveryCodes, access.Require(domain.PermManageAccount))
+	authGroup.PUT("/admin/users/:id/role", access.SetUserRole, access.Require(domain.PermManageRoles))
+	authGroup.PUT("/rooms/:room/roles/:id", access.SetRoomRole, access.Require(domain.PermManageRoles))
+	authGroup.DELETE("/rooms/:room/roles/:id", access.DeleteRoomRole, access.Require(domain.PermManageRoles))
+	authGroup.POST("/rooms/:room/kicks", moderation.Sanction(domain.SanctionKick), access.Require(domain.PermModerate))
+	authGroup.POST("/rooms/:room/mutes", moderation.Sanction(domain.SanctionMute), access.Require(domain.PermModerate))
+	authGroup.POST("/rooms/:room/bans", moderation.Sanction(domain.SanctionBan), access.Require(domain.PermModerate))
+	authGroup.GET("/rooms/:room/sanctions", moderation.ListSanctions, access.Require(domain.PermModerate))
+	authGroup.DELETE("/rooms/:room/sanctions/:id", moderation.RevokeSanction, access.Require(domain.PermModerate))
+	authGroup.POST("/admin/bans", moderation.Sanction(domain.SanctionGlobalBan), access.Require(domain.PermGlobalBan))
+	authGroup.GET("/admin/bans", moderation.ListSanctions, access.Require(domain.PermModerate))
+	authGroup.DELETE("/admin/bans/:id", moderation.RevokeSanction, access.Require(domain.PermGlobalBan))
+	authGroup.GET("/admin/audit", auditHandler.Query, access.Require(domain.PermViewAudit))
+	authGroup.GET("/admin/audit/export", auditHandler.Export, access.Require(domain.PermViewAudit))
+	authGroup.GET("/admin/audit/verify", auditHandler.Verify, access.Require(domain.PermViewAudit))
+	authGroup.GET("/moderation", renderTemplate("reports.html"))
+	authGroup.GET("/rooms/:room/presence", r.PresenceHandler)
+	authGroup.POST("/rooms/:room/reports", reports.Create, access.Require(domain.PermSendMessage))
+	authGroup.GET("/rooms/:room/reports", reports.List, access.Require(domain.PermModerate))
+	authGroup.POST("/rooms/:room/reports/:id/resolve", reports.Resolve, access.Require(domain.PermModerate))
+	if r.filters != nil {
+		authGroup.POST("/admin/filters/reload", r.filters.ReloadHandler, access.Require(domain.PermManageFilters))
+	}
 
 	e.GET("/login", renderTemplate("login.html"))
-	e.GET("/auth/:action/:provider", loginHandler)
-	e.GET("/logout", logoutHandler)
+	e.GET("/auth/:action/:provider", oauthHandler.Auth)
+	e.GET("/logout", logoutHandler(auditLog))
 
 	// Passkey routes
-	e.POST("/passkey/register", passkeyHandler.BeginRegistration)
-	e.POST("/passkey/register/finish", passkeyHandler.FinishRegistration)
+	// ログイン中のパスキー追加は、ほかのアカウント操作と同じ確認を通す
+	accountSession := SignedInMiddleware(AuthMiddleware(moderation), access.Require(domain.PermManageAccount))
+	e.POST("/passkey/register", passkeyHandler.BeginRegistration, accountSession)
+	e.POST("/passkey/register/finish", passkeyHandler.FinishRegistration, accountSession)
 	e.POST("/passkey/login", passkeyHandler.BeginLogin)
 	e.POST("/passkey/login/finish", passkeyHandler.FinishLogin)
+	e.POST("/passkey/recover", passkeyHandler.Recover)
 
+	e.GET("/metrics", metrics.Handler())
+	e.GET("/healthz", health.Liveness)
+	e.GET("/readyz", health.Readiness)
 	e.Static("/avatars", "avatars")
-	e.GET("/room", r.WebSocketHandler)
+	e.GET("/room", rooms.route((*room).WebSocketHandler))
+	// WebSocket の接続を張れないクライアント向けのフォールバック
+	e.GET("/room/events", rooms.route((*room).EventsHandler))
+	e.POST("/room/messages", rooms.route((*room).MessagesHandler))
+	api.Register(e)
 
-	e.Logger.Info("Start the web server. Port:", *addr)
-	e.Logger.Fatal(e.Start(*addr))
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serverErr := make(chan error, 1)
+	go func() {
+		e.Logger.Info("Start the web server. Port:", *addr)
+		if err := e.Start(*addr); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+
+	log.Printf("shutting down (timeout %s)", *shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	gracefulShutdown(shutdownCtx, e, health, rooms.list()...)
 }
 
 func renderTemplate(templateName string) echo.HandlerFunc {
@@ -97,7 +292,32 @@ func renderTemplate(templateName string) echo.HandlerFunc {
 	}
 }
 
-func logoutHandler(c echo.Context) error {
-	clearAuthCookie(c)
-	return c.Redirect(http.StatusTemporaryRedirect, "/")
+// reloadFiltersOnSignal は SIGHUP を受けるたびにメッセージフィルターを再読み込みする。
+func reloadFiltersOnSignal(filters *FilterSet) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		if err := filters.Reload(); err != nil {
+			log.Printf("failed to reload message filters: %v", err)
+			continue
+		}
+		log.Printf("message filters reloaded")
+	}
+}
+
+// logoutHandler は認証Cookieを削除し、ログイン中だった場合は監査ログに記録する。
+func logoutHandler(auditLog domain.AuditLog) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if userData, err := getAuthUserData(c); err == nil {
+			userID, _ := userData["id"].(string)
+			recordAudit(c.Request().Context(), auditLog, domain.AuditEvent{
+				Action:  "auth.logout",
+				ActorID: userID,
+				Target:  userID,
+				Detail:  map[string]string{"ip": c.RealIP()},
+			})
+		}
+		clearAuthCookie(c)
+		return c.Redirect(http.StatusTemporaryRedirect, "/")
+	}
 }
@@ -3,8 +3,44 @@ package main
 import "time"
 
 type message struct {
+	// ID と UserID はサーバーが付与する。通報や削除の対象を指定するのに使う。
+	ID     string `json:",omitempty"`
+	UserID string `json:",omitempty"`
+	// Seq はルーム全体に配信したメッセージにサーバーが振る通し番号。再接続時に since で指定して取りこぼしを再送させる。
+	Seq       uint64 `json:",omitempty"`
 	Name      string
 	Message   string
 	When      time.Time
 	AvatarURL string
+	// EditedAt は送信者が本文を編集した日時。編集されていない場合は nil。
+	EditedAt *time.Time `json:",omitempty"`
+	// System はサーバーからの通知。通常のチャットメッセージでは nil。
+	System *systemEvent `json:",omitempty"`
+	// Trace は W3C Trace Context（traceparent 等）。受信から各クライアントへの送信までを一つのトレースで追える。
+	Trace map[string]string `json:",omitempty"`
+
+	// frames はルーム全体に配信するときにエンコーディングごとに一度だけ作るフレーム。すべての接続で共有する。
+	frames *preparedFrames
+}
+
+// prepare はメッセージを接続ごとに使い回せるフレームとして送れるようにする。
+// 配信を始めた後はフィールドを書き換えない。
+func (m *message) prepare() {
+	m.frames = &preparedFrames{}
+}
+
+// systemEvent はモデレーション等で特定のユーザーに送る通知。
+type systemEvent struct {
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MessageID string     `json:"message_id,omitempty"`
+	ReportID  string     `json:"report_id,omitempty"`
+	// Node は hello と resync_required で、シーケンス番号を振っているサーバーを伝える。
+	Node string `json:"node,omitempty"`
+}
+
+// newSystemMessage はサーバーからの通知メッセージを作る。
+func newSystemMessage(text string, event systemEvent) *message {
+	return &message{Name: "system", Message: text, When: time.Now(), System: &event}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics は Prometheus 形式で公開するサーバーのメトリクス。
+// nil の Metrics のメソッドは何もしないため、テストや未設定時はそのまま渡せる。
+type Metrics struct {
+	registry         *prometheus.Registry
+	roomClients      *prometheus.GaugeVec
+	messagesIn       *prometheus.CounterVec
+	messagesOut      *prometheus.CounterVec
+	droppedClients   *prometheus.CounterVec
+	skippedMessages  *prometheus.CounterVec
+	broadcastLatency *prometheus.HistogramVec
+	upgradeFailures  prometheus.Counter
+	connsClosed      *prometheus.CounterVec
+	logins           *prometheus.CounterVec
+	uploadBytes      prometheus.Counter
+	httpDuration     *prometheus.HistogramVec
+}
+
+// NewMetrics はメトリクスを専用のレジストリに登録して生成する。
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		roomClients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chat_room_clients",
+			Help: "Number of WebSocket clients connected to a room.",
+		}, []string{"room"}),
+		messagesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_received_total",
+			Help: "Chat messages received from clients in a room.",
+		}, []string{"room"}),
+		messagesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_sent_total",
+			Help: "Messages queued for delivery to individual clients.",
+		}, []string{"room"}),
+		droppedClients: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_slow_clients_dropped_total",
+			Help: "Clients disconnected because their send buffer was full.",
+		}, []string{"room"}),
+		skippedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_skipped_total",
+			Help: "Messages discarded from slow clients' send buffers by the drop_oldest or coalesce policy.",
+		}, []string{"room"}),
+		broadcastLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chat_broadcast_duration_seconds",
+			Help:    "Time taken by one broadcast shard to fan a message out to its clients in a room.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"room"}),
+		upgradeFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_websocket_upgrade_failures_total",
+			Help: "WebSocket upgrade requests that failed.",
+		}),
+		connsClosed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_websocket_closed_total",
+			Help: "WebSocket connections closed, by reason (client_closed, pong_timeout, message_too_large, write_timeout, slow_client, disconnected, shutdown, ...).",
+		}, []string{"reason"}),
+		logins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_logins_total",
+			Help: "Login attempts by method (oauth, passkey) and result (success, failure).",
+		}, []string{"method", "result"}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "chat_upload_bytes_total",
+			Help: "Bytes of avatar images stored by uploads.",
+		}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by method, route and status code.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "route", "code"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.roomClients,
+		m.messagesIn,
+		m.messagesOut,
+		m.droppedClients,
+		m.skippedMessages,
+		m.broadcastLatency,
+		m.upgradeFailures,
+		m.connsClosed,
+		m.logins,
+		m.uploadBytes,
+		m.httpDuration,
+	)
+	return m
+}
+
+// Handler は /metrics のハンドラーを返す。
+func (m *Metrics) Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware は HTTP リクエストの処理時間を計測する。
+// ラベルにはパスそのものではなくルート定義（/rooms/:room/reports など）を使い、系列数を抑える。
+func (m *Metrics) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			status := c.Response().Status
+			if err != nil {
+				// エラーハンドラーが応答を書く前なので、返されたエラーからステータスを決める
+				status = http.StatusInternalServerError
+				if he, ok := err.(*echo.HTTPError); ok {
+					status = he.Code
+				}
+			}
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			m.httpDuration.WithLabelValues(c.Request().Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+			return err
+		}
+	}
+}
+
+func (m *Metrics) setRoomClients(room string, n int) {
+	if m == nil {
+		return
+	}
+	m.roomClients.WithLabelValues(room).Set(float64(n))
+}
+
+func (m *Metrics) messageReceived(room string) {
+	if m == nil {
+		return
+	}
+	m.messagesIn.WithLabelValues(room).Inc()
+}
+
+// broadcast はメッセージ 1 件の配信結果を記録する。
+func (m *Metrics) broadcast(room string, sent, dropped int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.messagesOut.WithLabelValues(room).Add(float64(sent))
+	m.droppedClients.WithLabelValues(room).Add(float64(dropped))
+	m.broadcastLatency.WithLabelValues(room).Observe(d.Seconds())
+}
+
+// messagesSkipped は送信が追いつかない接続のために捨てたメッセージを記録する。
+func (m *Metrics) messagesSkipped(room string, n int) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.skippedMessages.WithLabelValues(room).Add(float64(n))
+}
+
+func (m *Metrics) upgradeFailed() {
+	if m == nil {
+		return
+	}
+	m.upgradeFailures.Inc()
+}
+
+// connectionClosed は WebSocket 接続が閉じられた理由を記録する。
+func (m *Metrics) connectionClosed(reason string) {
+	if m == nil {
+		return
+	}
+	m.connsClosed.WithLabelValues(reason).Inc()
+}
+
+// login はログインの成否を記録する。method は oauth または passkey。
+func (m *Metrics) login(method string, ok bool) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if !ok {
+		result = "failure"
+	}
+	m.logins.WithLabelValues(method, result).Inc()
+}
+
+func (m *Metrics) uploaded(bytes int) {
+	if m == nil {
+		return
+	}
+	m.uploadBytes.Add(float64(bytes))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics_Room(t *testing.T) {
+	m := NewMetrics()
+	r := newRoom(UseAuthAvatar)
+	r.metrics = m
+	go r.run()
+	t.Cleanup(r.Stop)
+
+	fast := joinTestClient(r, "u1")
+	// バッファのない send は常に詰まっているので、送信時に切断される。
+	// 同じユーザーの 2 つ目の接続にして、参加の presence で切断されないようにする
+	slow := &client{send: make(chan *message), room: r, userData: map[string]any{"id": "u1"}}
+	r.join <- slow
+	// join の処理が終わるまで待つ
+	r.sendTo("nobody", &message{}, false)
+	if got := testutil.ToFloat64(m.roomClients.WithLabelValues(defaultRoomID)); got != 2 {
+		t.Fatalf("expected 2 clients, got %v", got)
+	}
+
+	r.forward <- &message{ID: "m1", UserID: "u1", Message: "hello"}
+	receive(t, fast)
+	r.deleteMessage("m1")
+	receive(t, fast)
+	// シャードでの配信の記録と、切断した接続の取り除きを待つ
+	syncRoom(r)
+
+	if got := testutil.ToFloat64(m.messagesIn.WithLabelValues(defaultRoomID)); got != 1 {
+		t.Errorf("system messages should not count as received, got %v", got)
+	}
+	// u1 の presence、メッセージ、削除通知
+	if got := testutil.ToFloat64(m.messagesOut.WithLabelValues(defaultRoomID)); got != 3 {
+		t.Errorf("expected 3 deliveries, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.droppedClients.WithLabelValues(defaultRoomID)); got != 1 {
+		t.Errorf("expected 1 dropped client, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.roomClients.WithLabelValues(defaultRoomID)); got != 1 {
+		t.Errorf("expected 1 client after drop, got %v", got)
+	}
+	if got := testutil.CollectAndCount(m.broadcastLatency); got != 1 {
+		t.Errorf("expected one latency series, got %d", got)
+	}
+}
+
+func TestMetrics_Login(t *testing.T) {
+	h, _, _, auth := newLoginTestHandler(t, 5, ClonePolicyReject)
+	h.metrics = NewMetrics()
+	auth.signCount = 6
+	if rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	// 巻き戻った署名カウンターは reject ポリシーでログイン失敗になる
+	if rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if got := testutil.ToFloat64(h.metrics.logins.WithLabelValues("passkey", "success")); got != 1 {
+		t.Errorf("expected 1 successful login, got %v", got)
+	}
+	if got := testutil.ToFloat64(h.metrics.logins.WithLabelValues("passkey", "failure")); got != 1 {
+		t.Errorf("expected 1 failed login, got %v", got)
+	}
+}
+
+func TestMetrics_HTTPAndHandler(t *testing.T) {
+	m := NewMetrics()
+	e := echo.New()
+	e.Use(m.Middleware())
+	e.GET("/rooms/:room/reports", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+	e.GET("/metrics", m.Handler())
+
+	for _, path := range []string{"/rooms/a/reports", "/rooms/b/reports", "/missing"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := testutil.CollectAndCount(m.httpDuration); got != 2 {
+		t.Errorf("expected route and not-found series, got %d", got)
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`http_request_duration_seconds_count{code="204",method="GET",route="/rooms/:room/reports"} 2`,
+		"chat_websocket_upgrade_failures_total 0",
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected /metrics to contain %q", want)
+		}
+	}
+}
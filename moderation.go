@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	errSanctionSelf = errors.New("cannot sanction yourself")
+	errRoomNotFound = errors.New("room not found")
+)
+
+// Moderation はキック・ミュート・BAN を管理する。
+// 制裁はすべて理由と有効期限を持ち、監査ログに記録され、対象ユーザーに通知される。
+type Moderation struct {
+	sanctions domain.SanctionRepository
+	access    *AccessControl
+	auditLog  domain.AuditLog
+	rooms     *roomRegistry
+	now       func() time.Time
+}
+
+// NewModeration は Moderation を生成する。rooms はキックや通知の送り先になる。
+func NewModeration(sr domain.SanctionRepository, access *AccessControl, rooms ...*room) *Moderation {
+	m := &Moderation{
+		sanctions: sr,
+		access:    access,
+		rooms:     newRoomRegistry(rooms...),
+		now:       time.Now,
+	}
+	return m
+}
+
+// Issue は制裁を科す。actor は対象より上位のロールでなければならない。
+// duration が 0 の場合は無期限（キックの場合は再参加の待ち時間なし）。
+func (m *Moderation) Issue(ctx context.Context, actor, target domain.User, kind domain.SanctionKind, roomID, reason string, duration time.Duration) (domain.Sanction, error) {
+	if actor.ID == target.ID {
+		return domain.Sanction{}, errSanctionSelf
+	}
+	if kind != domain.SanctionGlobalBan {
+		if _, ok := m.rooms.get(roomID); !ok {
+			return domain.Sanction{}, errRoomNotFound
+		}
+	}
+	actorRole, err := m.access.RoleIn(ctx, actor, roomID)
+	if err != nil {
+		return domain.Sanction{}, err
+	}
+	targetRole, err := m.access.RoleIn(ctx, target, roomID)
+	if err != nil {
+		return domain.Sanction{}, err
+	}
+	if !actorRole.Outranks(targetRole) {
+		return domain.Sanction{}, domain.ErrPermissionDenied
+	}
+
+	now := m.now()
+	s := domain.Sanction{
+		ID:        generateUUID(),
+		Kind:      kind,
+		UserID:    target.ID,
+		RoomID:    roomID,
+		Reason:    reason,
+		IssuedBy:  actor.ID,
+		CreatedAt: now,
+	}
+	if duration > 0 {
+		s.ExpiresAt = now.Add(duration)
+	} else if kind == domain.SanctionKick {
+		s.ExpiresAt = now
+	}
+	if err := m.sanctions.Create(ctx, s); err != nil {
+		return domain.Sanction{}, err
+	}
+
+	m.audit(ctx, domain.AuditEvent{
+		Action:  "moderation." + string(kind),
+		ActorID: actor.ID,
+		Target:  target.ID,
+		Detail:  sanctionDetail(s),
+	})
+	m.deliver(s)
+	return s, nil
+}
+
+// Revoke は制裁を取り消す。roomID が制裁のルームと一致しない場合は見つからない扱いにする。
+// actor は制裁を科したユーザーと同等以上のロールでなければならない。
+func (m *Moderation) Revoke(ctx context.Context, actor domain.User, id, roomID string) error {
+	s, err := m.sanctions.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if s.RoomID != roomID {
+		return domain.ErrSanctionNotFound
+	}
+	actorRole, err := m.access.RoleIn(ctx, actor, roomID)
+	if err != nil {
+		return err
+	}
+	// 科したユーザーが削除されている場合は、管理者の制裁とみなして取り消しを管理者に限る
+	issuerRole := domain.RoleAdmin
+	if issuer, err := m.access.userRepo.GetByID(ctx, s.IssuedBy); err == nil {
+		if issuerRole, err = m.access.RoleIn(ctx, issuer, roomID); err != nil {
+			return err
+		}
+	}
+	if issuerRole.Outranks(actorRole) {
+		return domain.ErrPermissionDenied
+	}
+	if err := m.sanctions.Delete(ctx, id); err != nil {
+		return err
+	}
+	m.audit(ctx, domain.AuditEvent{
+		Action:  "moderation.revoke",
+		ActorID: actor.ID,
+		Target:  s.UserID,
+		Detail:  sanctionDetail(s),
+	})
+	if r, ok := m.rooms.get(s.RoomID); ok && s.Kind == domain.SanctionMute {
+		r.sendTo(s.UserID, newSystemMessage(fmt.Sprintf("Your mute in #%s has been lifted.", s.RoomID), systemEvent{Action: "unmute"}), false)
+	}
+	return nil
+}
+
+// deliver は対象ユーザーに通知し、必要に応じて接続を切る。
+func (m *Moderation) deliver(s domain.Sanction) {
+	switch s.Kind {
+	case domain.SanctionGlobalBan:
+		for _, r := range m.rooms.list() {
+			r.sendTo(s.UserID, sanctionMessage(s, r.id), true)
+		}
+	case domain.SanctionMute:
+		if r, ok := m.rooms.get(s.RoomID); ok {
+			r.sendTo(s.UserID, sanctionMessage(s, s.RoomID), false)
+		}
+	default:
+		if r, ok := m.rooms.get(s.RoomID); ok {
+			r.sendTo(s.UserID, sanctionMessage(s, s.RoomID), true)
+		}
+	}
+}
+
+// active は有効な制裁を返す。ストアのエラーは記録した上で制裁なしとして扱う。
+func (m *Moderation) active(ctx context.Context, userID, roomID string, kind domain.SanctionKind) (domain.Sanction, bool) {
+	s, ok, err := m.sanctions.Active(ctx, userID, roomID, kind, m.now())
+	if err != nil {
+		log.Printf("failed to look up %s sanction for user %s: %v", kind, userID, err)
+		return domain.Sanction{}, false
+	}
+	return s, ok
+}
+
+// GlobalBan はサイト全体の BAN を返す。
+func (m *Moderation) GlobalBan(ctx context.Context, userID string) (domain.Sanction, bool) {
+	return m.active(ctx, userID, "", domain.SanctionGlobalBan)
+}
+
+// joinBlocked はルームへの参加を拒否する制裁を返す。
+func (m *Moderation) joinBlocked(ctx context.Context, userID, roomID string) (domain.Sanction, bool) {
+	if s, ok := m.GlobalBan(ctx, userID); ok {
+		return s, true
+	}
+	for _, kind := range []domain.SanctionKind{domain.SanctionBan, domain.SanctionKick} {
+		if s, ok := m.active(ctx, userID, roomID, kind); ok {
+			return s, true
+		}
+	}
+	return domain.Sanction{}, false
+}
+
+type sanctionRequest struct {
+	UserID   string `json:"user_id"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+type sanctionResponse struct {
+	ID        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	UserID    string     `json:"user_id"`
+	RoomID    string     `json:"room_id,omitempty"`
+	Reason    string     `json:"reason"`
+	IssuedBy  string     `json:"issued_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newSanctionResponse(s domain.Sanction) sanctionResponse {
+	resp := sanctionResponse{
+		ID:        s.ID,
+		Kind:      string(s.Kind),
+		UserID:    s.UserID,
+		RoomID:    s.RoomID,
+		Reason:    s.Reason,
+		IssuedBy:  s.IssuedBy,
+		CreatedAt: s.CreatedAt,
+	}
+	if !s.ExpiresAt.IsZero() {
+		expiresAt := s.ExpiresAt
+		resp.ExpiresAt = &expiresAt
+	}
+	return resp
+}
+
+// Sanction は制裁を科すハンドラーを返す。ルームの制裁は :room のルームに科す。
+// duration は Go の time.ParseDuration 形式（"10m" 等）で、省略すると無期限になる。
+func (m *Moderation) Sanction(kind domain.SanctionKind) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		actor, err := currentUser(c, m.access.userRepo)
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		}
+		var req sanctionRequest
+		if err := c.Bind(&req); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		}
+		reason := strings.TrimSpace(req.Reason)
+		if reason == "" {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "reason is required"})
+		}
+		duration, err := parseSanctionDuration(req.Duration)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+		}
+
+		ctx := c.Request().Context()
+		target, err := m.access.userRepo.GetByID(ctx, req.UserID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+		s, err := m.Issue(ctx, actor, target, kind, c.Param("room"), reason, duration)
+		if err != nil {
+			return sanctionError(c, err)
+		}
+		return c.JSON(http.StatusCreated, newSanctionResponse(s))
+	}
+}
+
+// parseSanctionDuration は Go の time.ParseDuration 形式の期間を解釈する。空の場合は 0（無期限）。
+func parseSanctionDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %s", s)
+	}
+	return d, nil
+}
+
+// sanctionError は Issue のエラーをレスポンスにする。
+func sanctionError(c echo.Context, err error) error {
+	switch {
+	case errors.Is(err, errSanctionSelf):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, errRoomNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, domain.ErrPermissionDenied):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "cannot moderate a user with an equal or higher role"})
+	default:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save sanction"})
+	}
+}
+
+// ListSanctions は :room のルームで有効な制裁を返す。:room がない場合はサイト全体の BAN を返す。
+func (m *Moderation) ListSanctions(c echo.Context) error {
+	sanctions, err := m.sanctions.ListActive(c.Request().Context(), c.Param("room"), m.now())
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list sanctions"})
+	}
+	resp := make([]sanctionResponse, 0, len(sanctions))
+	for _, s := range sanctions {
+		resp = append(resp, newSanctionResponse(s))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// RevokeSanction は制裁を取り消す。
+func (m *Moderation) RevokeSanction(c echo.Context) error {
+	actor, err := currentUser(c, m.access.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	err = m.Revoke(c.Request().Context(), actor, c.Param("id"), c.Param("room"))
+	switch {
+	case errors.Is(err, domain.ErrSanctionNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "sanction not found"})
+	case errors.Is(err, domain.ErrPermissionDenied):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "cannot revoke a sanction issued by a higher role"})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to revoke sanction"})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (m *Moderation) audit(ctx context.Context, event domain.AuditEvent) {
+	recordAudit(ctx, m.auditLog, event)
+}
+
+func sanctionDetail(s domain.Sanction) map[string]string {
+	detail := map[string]string{
+		"sanction_id": s.ID,
+		"reason":      s.Reason,
+		"expires_at":  "never",
+	}
+	if s.RoomID != "" {
+		detail["room"] = s.RoomID
+	}
+	if !s.ExpiresAt.IsZero() {
+		detail["expires_at"] = s.ExpiresAt.UTC().Format(time.RFC3339)
+	}
+	return detail
+}
+
+// describeSanction は制裁の内容を対象ユーザー向けの文にする。
+func describeSanction(s domain.Sanction, roomID string) string {
+	var text string
+	switch s.Kind {
+	case domain.SanctionKick:
+		text = fmt.Sprintf("You were kicked from #%s: %s", roomID, s.Reason)
+		if s.ExpiresAt.After(s.CreatedAt) {
+			text += fmt.Sprintf(" You can rejoin after %s.", s.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+		return text
+	case domain.SanctionMute:
+		text = fmt.Sprintf("You are muted in #%s: %s", roomID, s.Reason)
+	case domain.SanctionBan:
+		text = fmt.Sprintf("You are banned from #%s: %s", roomID, s.Reason)
+	default:
+		text = fmt.Sprintf("Your account is suspended: %s", s.Reason)
+	}
+	if s.ExpiresAt.IsZero() {
+		return text + " (permanent)"
+	}
+	return text + fmt.Sprintf(" (until %s)", s.ExpiresAt.UTC().Format(time.RFC3339))
+}
+
+// sanctionMessage は制裁を対象ユーザーに知らせるシステムメッセージを作る。
+func sanctionMessage(s domain.Sanction, roomID string) *message {
+	event := systemEvent{Action: string(s.Kind), Reason: s.Reason}
+	if !s.ExpiresAt.IsZero() {
+		expiresAt := s.ExpiresAt
+		event.ExpiresAt = &expiresAt
+	}
+	return newSystemMessage(describeSanction(s, roomID), event)
+}
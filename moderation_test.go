@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/labstack/echo/v4"
+)
+
+func newModerationTest(t *testing.T, users ...domain.User) (*Moderation, *room, *memory.AuditStore) {
+	t.Helper()
+	access, _, auditLog := newAccessTestControl(users...)
+	r := newRoom(UseAuthAvatar)
+	r.access = access
+	m := NewModeration(memory.NewSanctionStore(), access, r)
+	m.auditLog = auditLog
+	r.moderation = m
+	go r.run()
+	t.Cleanup(r.Stop)
+	return m, r, auditLog
+}
+
+// joinTestClient はソケットを持たないクライアントをルームに参加させ、参加時の hello を読み捨てる。
+func joinTestClient(r *room, userID string) *client {
+	c := &client{send: make(chan *message, 8), room: r, userData: map[string]any{"id": userID}}
+	r.join <- c
+	<-c.send
+	return c
+}
+
+// pending は c に届いている hello や presence 以外のメッセージの数を返す。
+func pending(c *client) int {
+	n := 0
+	for len(c.send) > 0 {
+		if !isAnnouncement(<-c.send) {
+			n++
+		}
+	}
+	return n
+}
+
+// receive は presence を読み飛ばして c に届いた次のメッセージを返す。
+func receive(t *testing.T, c *client) (*message, bool) {
+	t.Helper()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			if ok && isAnnouncement(msg) {
+				continue
+			}
+			return msg, ok
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+			return nil, false
+		}
+	}
+}
+
+func TestModeration_Issue_RoleHierarchy(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newModerationTest(t,
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "mod2", Role: domain.RoleModerator},
+		domain.User{ID: "member"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+
+	tests := []struct {
+		name    string
+		actor   string
+		target  string
+		roomID  string
+		wantErr error
+	}{
+		{name: "moderator mutes member", actor: "mod", target: "member", roomID: defaultRoomID},
+		{name: "moderator cannot mute moderator", actor: "mod", target: "mod2", roomID: defaultRoomID, wantErr: domain.ErrPermissionDenied},
+		{name: "moderator cannot mute admin", actor: "mod", target: "admin", roomID: defaultRoomID, wantErr: domain.ErrPermissionDenied},
+		{name: "admin mutes moderator", actor: "admin", target: "mod", roomID: defaultRoomID},
+		{name: "self", actor: "admin", target: "admin", roomID: defaultRoomID, wantErr: errSanctionSelf},
+		{name: "unknown room", actor: "admin", target: "member", roomID: "other", wantErr: errRoomNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := m.Issue(ctx, users[tt.actor], users[tt.target], domain.SanctionMute, tt.roomID, "spam", time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("want %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestModeration_Mute(t *testing.T) {
+	ctx := context.Background()
+	m, r, auditLog := newModerationTest(t,
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "member"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	c := joinTestClient(r, "member")
+
+	s, err := m.Issue(ctx, users["mod"], users["member"], domain.SanctionMute, defaultRoomID, "flooding", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	msg, ok := receive(t, c)
+	if !ok || msg.System == nil || msg.System.Action != "mute" || msg.System.Reason != "flooding" || msg.System.ExpiresAt == nil {
+		t.Fatalf("unexpected notification: %+v", msg)
+	}
+	if _, muted := r.muted(c); !muted {
+		t.Error("member should be muted")
+	}
+
+	m.now = func() time.Time { return s.ExpiresAt }
+	if _, muted := r.muted(c); muted {
+		t.Error("mute should expire")
+	}
+
+	events, _ := auditLog.List(ctx)
+	if len(events) != 1 || events[0].Action != "moderation.mute" || events[0].Detail["reason"] != "flooding" || events[0].Detail["expires_at"] == "never" {
+		t.Errorf("unexpected audit events: %+v", events)
+	}
+}
+
+func TestModeration_KickAndBan(t *testing.T) {
+	ctx := context.Background()
+	m, r, _ := newModerationTest(t,
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "member"},
+		domain.User{ID: "bystander"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	first := joinTestClient(r, "member")
+	second := joinTestClient(r, "member")
+	other := joinTestClient(r, "bystander")
+
+	if _, err := m.Issue(ctx, users["mod"], users["member"], domain.SanctionKick, defaultRoomID, "off topic", 0); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	for _, c := range []*client{first, second} {
+		msg, ok := receive(t, c)
+		if !ok || msg.System == nil || msg.System.Action != "kick" {
+			t.Fatalf("unexpected notification: %+v", msg)
+		}
+		if _, ok := receive(t, c); ok {
+			t.Error("kicked client should be disconnected")
+		}
+	}
+	if pending(other) != 0 {
+		t.Error("bystander must not be notified")
+	}
+	if _, blocked := r.joinBlocked(first.userData); blocked {
+		t.Error("kick without duration should allow rejoining")
+	}
+	// キックで閉じた send を leave で二重に閉じない
+	r.leave <- first
+
+	ban, err := m.Issue(ctx, users["mod"], users["member"], domain.SanctionBan, defaultRoomID, "abuse", 0)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if s, blocked := r.joinBlocked(first.userData); !blocked || s.ID != ban.ID {
+		t.Errorf("banned user should be blocked, got %+v, %v", s, blocked)
+	}
+	if err := m.Revoke(ctx, users["mod"], ban.ID, "other"); !errors.Is(err, domain.ErrSanctionNotFound) {
+		t.Errorf("revoke from another room should fail, got %v", err)
+	}
+	if err := m.Revoke(ctx, users["mod"], ban.ID, defaultRoomID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, blocked := r.joinBlocked(first.userData); blocked {
+		t.Error("revoked ban should not block")
+	}
+}
+
+func TestAuthMiddleware_GlobalBan(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newModerationTest(t,
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "member"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	if _, err := m.Issue(ctx, users["admin"], users["member"], domain.SanctionGlobalBan, "", "spam bot", 0); err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		userID     string
+		wantStatus int
+	}{
+		{userID: "member", wantStatus: http.StatusForbidden},
+		{userID: "admin", wantStatus: http.StatusOK},
+	} {
+		c, rec := newSignedInContext(http.MethodGet, "/", "", tt.userID)
+		handler := AuthMiddleware(m)(func(c echo.Context) error {
+			return c.String(http.StatusOK, "ok")
+		})
+		if err := handler(c); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.userID, tt.wantStatus, rec.Code)
+		}
+	}
+}
+
+func TestModeration_RevokeRequiresIssuerRank(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newModerationTest(t,
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "mod2", Role: domain.RoleModerator},
+		domain.User{ID: "member"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	globalBan, err := m.Issue(ctx, users["admin"], users["member"], domain.SanctionGlobalBan, "", "spam bot", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mute, err := m.Issue(ctx, users["mod2"], users["member"], domain.SanctionMute, defaultRoomID, "spam", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoke := func(actor, id, roomID string) int {
+		target := "/admin/bans/" + id
+		if roomID != "" {
+			target = "/rooms/" + roomID + "/sanctions/" + id
+		}
+		c, rec := newSignedInContext(http.MethodDelete, target, "", actor)
+		c.SetParamNames("room", "id")
+		c.SetParamValues(roomID, id)
+		if err := m.RevokeSanction(c); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return rec.Code
+	}
+	if code := revoke("mod", globalBan.ID, ""); code != http.StatusForbidden {
+		t.Errorf("moderator must not lift an admin's global ban, got %d", code)
+	}
+	if _, banned := m.GlobalBan(ctx, "member"); !banned {
+		t.Error("global ban should remain in force")
+	}
+	// 同じロールのモデレーター同士は互いの制裁を取り消せる
+	if code := revoke("mod", mute.ID, defaultRoomID); code != http.StatusNoContent {
+		t.Errorf("moderator should lift another moderator's mute, got %d", code)
+	}
+	if code := revoke("admin", globalBan.ID, ""); code != http.StatusNoContent {
+		t.Errorf("admin should lift the global ban, got %d", code)
+	}
+}
+
+func TestSignedInMiddleware_Registration(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newModerationTest(t,
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "member"},
+		domain.User{ID: "guest", Role: domain.RoleGuest},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	if _, err := m.Issue(ctx, users["admin"], users["member"], domain.SanctionGlobalBan, "", "spam bot", 0); err != nil {
+		t.Fatal(err)
+	}
+	mw := SignedInMiddleware(AuthMiddleware(m), m.access.Require(domain.PermManageAccount))
+	handler := mw(func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	})
+
+	for _, tt := range []struct {
+		name       string
+		userID     string
+		wantStatus int
+	}{
+		// 新規登録は Cookie なしで通す
+		{name: "anonymous", wantStatus: http.StatusOK},
+		{name: "signed in", userID: "guest", wantStatus: http.StatusOK},
+		{name: "globally banned", userID: "member", wantStatus: http.StatusForbidden},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				c   echo.Context
+				rec *httptest.ResponseRecorder
+			)
+			if tt.userID == "" {
+				rec = httptest.NewRecorder()
+				c = echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/passkey/register", nil), rec)
+			} else {
+				c, rec = newSignedInContext(http.MethodPost, "/passkey/register", "", tt.userID)
+			}
+			if err := handler(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestModeration_SanctionHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "mute", body: `{"user_id":"member","reason":"spam","duration":"10m"}`, wantStatus: http.StatusCreated},
+		{name: "missing reason", body: `{"user_id":"member","duration":"10m"}`, wantStatus: http.StatusBadRequest},
+		{name: "invalid duration", body: `{"user_id":"member","reason":"spam","duration":"soon"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown user", body: `{"user_id":"ghost","reason":"spam"}`, wantStatus: http.StatusNotFound},
+		{name: "higher role", body: `{"user_id":"admin","reason":"spam"}`, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _, _ := newModerationTest(t,
+				domain.User{ID: "admin", Role: domain.RoleAdmin},
+				domain.User{ID: "mod", Role: domain.RoleModerator},
+				domain.User{ID: "member"},
+			)
+			c, rec := newSignedInContext(http.MethodPost, "/rooms/general/mutes", tt.body, "mod")
+			c.SetParamNames("room")
+			c.SetParamValues(defaultRoomID)
+
+			if err := m.Sanction(domain.SanctionMute)(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestModeration_ListSanctions(t *testing.T) {
+	ctx := context.Background()
+	m, _, _ := newModerationTest(t,
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "member"},
+	)
+	users := m.access.userRepo.(*mockUserRepo).users
+	if _, err := m.Issue(ctx, users["admin"], users["member"], domain.SanctionBan, defaultRoomID, "abuse", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/admin/bans", nil), rec)
+	if err := m.ListSanctions(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Body.String() != "[]\n" {
+		t.Errorf("room bans must not be listed as global bans: %s", rec.Body.String())
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// openAPIVersion は API の版。互換性を保った変更ではマイナー版を上げる。
+const openAPIVersion = "1.0.0"
+
+// OpenAPI は API の OpenAPI 3 ドキュメントを返す。
+func (a *API) OpenAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPIDocument(a.routes()))
+}
+
+// openAPIDocument はルートの定義から OpenAPI 3 のドキュメントを生成する。
+// 本文の型のスキーマは json タグからリフレクションで作る。
+func openAPIDocument(routes []apiRoute) map[string]any {
+	schemas := map[string]any{"Error": schemaOf(reflect.TypeOf(errorResponse{}), nil)}
+	paths := map[string]any{}
+	for _, rt := range routes {
+		path, params := openAPIPath(rt.path)
+		for _, q := range rt.query {
+			params = append(params, map[string]any{
+				"name": q.name, "in": "query", "description": q.description, "schema": map[string]any{"type": q.kind},
+			})
+		}
+		op := map[string]any{
+			"operationId": rt.operationID,
+			"summary":     rt.summary,
+			"responses":   openAPIResponses(rt, schemas),
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if rt.request != nil {
+			op["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{echo.MIMEApplicationJSON: map[string]any{"schema": schemaOf(reflect.TypeOf(rt.request), schemas)}},
+			}
+		}
+		if rt.public {
+			op["security"] = []any{}
+		}
+		item, _ := paths[path].(map[string]any)
+		if item == nil {
+			item = map[string]any{}
+			paths[path] = item
+		}
+		item[strings.ToLower(rt.method)] = op
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Chat API",
+			"version":     openAPIVersion,
+			"description": "JSON API for rooms, messages and users. Authenticate with the session cookie or with a bearer token from POST /tokens.",
+		},
+		"servers": []any{map[string]any{"url": apiPrefix}},
+		"paths":   paths,
+		"security": []any{
+			map[string]any{"cookieAuth": []any{}},
+			map[string]any{"bearerAuth": []any{}},
+		},
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"cookieAuth": map[string]any{"type": "apiKey", "in": "cookie", "name": "auth"},
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// openAPIPath は echo のパス（/rooms/:room）を OpenAPI のパス（/rooms/{room}）とパスパラメーターに変換する。
+func openAPIPath(path string) (string, []any) {
+	var params []any
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if name, ok := strings.CutPrefix(seg, ":"); ok {
+			segments[i] = "{" + name + "}"
+			params = append(params, map[string]any{
+				"name": name, "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+			})
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func openAPIResponses(rt apiRoute, schemas map[string]any) map[string]any {
+	ok := map[string]any{"description": http.StatusText(rt.status)}
+	if rt.response != nil {
+		ok["content"] = map[string]any{echo.MIMEApplicationJSON: map[string]any{"schema": schemaOf(reflect.TypeOf(rt.response), schemas)}}
+	}
+	errorContent := map[string]any{echo.MIMEApplicationJSON: map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}}}
+	return map[string]any{
+		strconv.Itoa(rt.status): ok,
+		"default":               map[string]any{"description": "Error", "content": errorContent},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf は t の JSON エンコードに対応するスキーマを返す。
+// 構造体は schemas に登録して参照を返す。schemas が nil の場合は構造体のスキーマをそのまま返す。
+func schemaOf(t reflect.Type, schemas map[string]any) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]any{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]any{"type": "number"}
+	case t.Kind() == reflect.Slice:
+		return map[string]any{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case t.Kind() != reflect.Struct:
+		return map[string]any{}
+	}
+
+	name := schemaName(t)
+	if schemas != nil {
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return structSchema(t, schemas)
+}
+
+func structSchema(t reflect.Type, schemas map[string]any) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaName は roomResponse を Room、createRoomRequest を CreateRoomRequest のようにスキーマの名前にする。
+func schemaName(t reflect.Type) string {
+	name := strings.TrimSuffix(t.Name(), "Response")
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dchf12/chat/domain"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	_, e, _, _ := newAPITest(t, domain.User{ID: "alice", Name: "alice"})
+	rec := serveAPI(e, http.MethodGet, "/openapi.json", "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var doc struct {
+		OpenAPI    string
+		Paths      map[string]map[string]map[string]any
+		Components struct {
+			Schemas map[string]any
+		}
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("failed to decode document: %v", err)
+	}
+	if doc.OpenAPI != "3.0.3" {
+		t.Errorf("unexpected openapi version %q", doc.OpenAPI)
+	}
+
+	// すべてのルートが記載されている
+	for _, rt := range (&API{}).routes() {
+		path, _ := openAPIPath(rt.path)
+		op, ok := doc.Paths[path][strings.ToLower(rt.method)]
+		if !ok {
+			t.Errorf("%s %s is missing", rt.method, path)
+			continue
+		}
+		if op["operationId"] != rt.operationID {
+			t.Errorf("%s %s: unexpected operationId %v", rt.method, path, op["operationId"])
+		}
+		if _, ok := op["responses"].(map[string]any)[strconv.Itoa(rt.status)]; !ok {
+			t.Errorf("%s %s: response %d is missing", rt.method, path, rt.status)
+		}
+	}
+
+	// 参照先のスキーマがすべて定義されている
+	for _, m := range regexp.MustCompile(`"#/components/schemas/(\w+)"`).FindAllStringSubmatch(rec.Body.String(), -1) {
+		if _, ok := doc.Components.Schemas[m[1]]; !ok {
+			t.Errorf("schema %s is referenced but not defined", m[1])
+		}
+	}
+	for _, name := range []string{"Error", "Room", "Message", "MessagePage", "User", "Token"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is missing", name)
+		}
+	}
+}
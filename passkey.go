@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/dchf12/chat/domain"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 // PasskeyHandler は WebAuthn パスキー認証のハンドラー。
@@ -21,15 +29,57 @@ type PasskeyHandler struct {
 	webAuthn    *webauthn.WebAuthn
 	userRepo    domain.UserRepository
 	sessionRepo domain.SessionRepository
-	pending     sync.Map // map[challenge]domain.User
+	pending     sync.Map // map[challenge]pendingRegistration
+	auditLog    domain.AuditLog
+	clonePolicy ClonePolicy
+	// aaguidPolicy が nil の場合は認証器を制限しない
+	aaguidPolicy *AAGUIDPolicy
+	// 回復ログインの試行回数制限
+	recoveryUserLimiter *attemptLimiter
+	recoveryIPLimiter   *attemptLimiter
+	// access が設定されている場合は新規ユーザーに管理者のブートストラップを適用する
+	access *AccessControl
+	// metrics が nil の場合はログインの成否を記録しない
+	metrics *Metrics
+}
+
+// ClonePolicy は SignCount の後退（認証器の複製の疑い）を検知したときの動作。
+type ClonePolicy string
+
+const (
+	// ClonePolicyReject はログインを拒否する。ゼロ値もこの扱い。
+	ClonePolicyReject ClonePolicy = "reject"
+	// ClonePolicyFlag はクレデンシャルに印を付けた上でログインを許可する。
+	ClonePolicyFlag ClonePolicy = "flag"
+	// ClonePolicyNotify は印を付け、ログイン応答でユーザーに警告する。
+	ClonePolicyNotify ClonePolicy = "notify"
+)
+
+// ParseClonePolicy は文字列を ClonePolicy に変換する。
+func ParseClonePolicy(s string) (ClonePolicy, error) {
+	switch p := ClonePolicy(s); p {
+	case ClonePolicyReject, ClonePolicyFlag, ClonePolicyNotify:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown clone policy %q (want reject, flag or notify)", s)
+	}
+}
+
+// pendingRegistration は登録セレモニー中のユーザー。
+// existing が true の場合はログイン中のユーザーへのパスキー追加を表す。
+type pendingRegistration struct {
+	user     domain.User
+	existing bool
 }
 
 // NewPasskeyHandler は PasskeyHandler を生成する。
 func NewPasskeyHandler(wa *webauthn.WebAuthn, ur domain.UserRepository, sr domain.SessionRepository) *PasskeyHandler {
 	return &PasskeyHandler{
-		webAuthn:    wa,
-		userRepo:    ur,
-		sessionRepo: sr,
+		webAuthn:            wa,
+		userRepo:            ur,
+		sessionRepo:         sr,
+		recoveryUserLimiter: newAttemptLimiter(recoveryAttemptsPerUser, recoveryAttemptWindow),
+		recoveryIPLimiter:   newAttemptLimiter(recoveryAttemptsPerIP, recoveryAttemptWindow),
 	}
 }
 
@@ -39,7 +89,14 @@ type registerRequest struct {
 }
 
 // BeginRegistration はパスキー登録を開始する。
+// ログイン中の場合は新規ユーザーを作らず、現在のアカウントにパスキーを追加する。
 func (h *PasskeyHandler) BeginRegistration(c echo.Context) error {
+	defer startHandlerSpan(c, "passkey.begin_registration")()
+	ctx := c.Request().Context()
+	if user, err := currentUser(c, h.userRepo); err == nil {
+		return h.beginRegistration(c, pendingRegistration{user: user, existing: true})
+	}
+
 	var req registerRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
@@ -52,7 +109,6 @@ func (h *PasskeyHandler) BeginRegistration(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "username must be 50 characters or less"})
 	}
 
-	ctx := c.Request().Context()
 	if _, err := h.userRepo.GetByName(ctx, req.Username); err == nil {
 		return c.JSON(http.StatusConflict, map[string]string{"error": "username already exists"})
 	}
@@ -69,34 +125,34 @@ func (h *PasskeyHandler) BeginRegistration(c echo.Context) error {
 		DisplayName: req.DisplayName,
 	}
 
-	options, session, err := h.webAuthn.BeginRegistration(
-		user,
-		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
-	)
+	return h.beginRegistration(c, pendingRegistration{user: user})
+}
+
+func (h *PasskeyHandler) beginRegistration(c echo.Context, reg pendingRegistration) error {
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(reg.user.Credentials))
+	for _, cred := range reg.user.Credentials {
+		exclusions = append(exclusions, cred.Descriptor())
+	}
+
+	options, session, err := h.webAuthn.BeginRegistration(reg.user, webauthn.WithExclusions(exclusions))
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to begin registration: %v", err)})
 	}
 
+	ctx := c.Request().Context()
 	if err := h.sessionRepo.Save(ctx, session.Challenge, *session); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save session"})
 	}
-	h.pending.Store(session.Challenge, user)
+	h.pending.Store(session.Challenge, reg)
 
-	c.SetCookie(&http.Cookie{
-		Name:     "webauthn_session",
-		Value:    session.Challenge,
-		MaxAge:   60,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		Secure:   c.IsTLS(),
-	})
+	setSessionCookie(c, session)
 
 	return c.JSON(http.StatusOK, options)
 }
 
 // FinishRegistration はパスキー登録を完了する。
 func (h *PasskeyHandler) FinishRegistration(c echo.Context) error {
+	defer startHandlerSpan(c, "passkey.finish_registration")()
 	cookie, err := c.Cookie("webauthn_session")
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "session cookie not found"})
@@ -108,61 +164,145 @@ func (h *PasskeyHandler) FinishRegistration(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "session not found"})
 	}
 
-	pendingUser, ok := h.pending.LoadAndDelete(cookie.Value)
+	pending, ok := h.pending.LoadAndDelete(cookie.Value)
 	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "registration context not found"})
 	}
-	user, ok := pendingUser.(domain.User)
+	reg, ok := pending.(pendingRegistration)
 	if !ok {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "invalid registration context"})
 	}
+	user := reg.user
 
 	credential, err := h.webAuthn.FinishRegistration(user, session, c.Request())
 	if err != nil {
+		oteltrace.SpanFromContext(ctx).RecordError(err)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("failed to finish registration: %v", err)})
 	}
+	if h.aaguidPolicy != nil {
+		if err := h.aaguidPolicy.Check(*credential); err != nil {
+			h.recordRegistrationRejected(ctx, user, *credential, err)
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "this authenticator is not allowed to register"})
+		}
+	}
 
-	if err := h.userRepo.Create(ctx, user); err != nil {
-		return c.JSON(http.StatusConflict, map[string]string{"error": "username already exists"})
+	// 新規アカウントには回復コードを発行する。平文は登録完了時のレスポンスでのみ返す。
+	var recoveryCodes []string
+	if !reg.existing {
+		plain, hashed, err := newRecoveryCodes()
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to generate recovery codes"})
+		}
+		recoveryCodes = plain
+		user.RecoveryCodes = hashed
+		if err := h.userRepo.Create(ctx, user); err != nil {
+			return c.JSON(http.StatusConflict, map[string]string{"error": "username already exists"})
+		}
+		bootstrapRole(ctx, h.access, user, "")
 	}
 
-	if err := h.userRepo.AddCredential(ctx, user.ID, *credential); err != nil {
+	cred := domain.Credential{
+		Credential: *credential,
+		Nickname:   authenticatorName(credential.Authenticator.AAGUID),
+		CreatedAt:  time.Now(),
+	}
+	if err := h.userRepo.AddCredential(ctx, user.ID, cred); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save credential"})
 	}
+	h.audit(ctx, domain.AuditEvent{
+		Action:  "passkey.registered",
+		ActorID: user.ID,
+		Target:  base64.RawURLEncoding.EncodeToString(credential.ID),
+		Detail: map[string]string{
+			"authenticator": cred.Nickname,
+			"new_account":   strconv.FormatBool(!reg.existing),
+			"ip":            c.RealIP(),
+		},
+	})
 
 	deleteCookie(c, "webauthn_session")
+	// 回復セッションは新しいパスキーの登録で通常のセッションに戻る
 	setAuthCookie(c, user)
 
-	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	resp := map[string]any{"status": "ok"}
+	if recoveryCodes != nil {
+		resp["recovery_codes"] = recoveryCodes
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+type loginRequest struct {
+	Username  string `json:"username"`
+	Mediation string `json:"mediation"`
 }
 
 // BeginLogin はパスキーログインを開始する。
+// ユーザー名を指定した場合は、そのユーザーのクレデンシャルを allowCredentials に列挙する
+// （Discoverable でないクレデンシャル向け）。ユーザーが存在しないかパスキーを持たない場合も、
+// ユーザー名の有無を推測されないよう架空のクレデンシャルで同じ形の応答を返す。
+// 指定しない場合は Discoverable ログインになり、
+// mediation に "conditional" を指定するとフォームの自動入力から認証できる。
 func (h *PasskeyHandler) BeginLogin(c echo.Context) error {
-	options, session, err := h.webAuthn.BeginDiscoverableLogin()
+	defer startHandlerSpan(c, "passkey.begin_login")()
+	var req loginRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+
+	ctx := c.Request().Context()
+	oteltrace.SpanFromContext(ctx).SetAttributes(attribute.Bool("passkey.discoverable", strings.TrimSpace(req.Username) == ""))
+	var (
+		options *protocol.CredentialAssertion
+		session *webauthn.SessionData
+		err     error
+	)
+	switch username := strings.TrimSpace(req.Username); {
+	case username != "":
+		user, err := h.userRepo.GetByName(ctx, username)
+		if err != nil || len(user.Credentials) == 0 {
+			user = decoyLoginUser(username)
+		}
+		options, session, err = h.webAuthn.BeginLogin(user)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to begin login: %v", err)})
+		}
+	case protocol.CredentialMediationRequirement(req.Mediation) == protocol.MediationConditional:
+		options, session, err = h.webAuthn.BeginDiscoverableMediatedLogin(protocol.MediationConditional)
+	default:
+		options, session, err = h.webAuthn.BeginDiscoverableLogin()
+	}
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to begin login: %v", err)})
 	}
 
-	ctx := c.Request().Context()
 	if err := h.sessionRepo.Save(ctx, session.Challenge, *session); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save session"})
 	}
 
-	c.SetCookie(&http.Cookie{
-		Name:     "webauthn_session",
-		Value:    session.Challenge,
-		MaxAge:   60,
-		HttpOnly: true,
-		SameSite: http.SameSiteStrictMode,
-		Path:     "/",
-		Secure:   c.IsTLS(),
-	})
+	setSessionCookie(c, session)
 
 	return c.JSON(http.StatusOK, options)
 }
 
+// decoyLoginUser はパスキーを持たないユーザー名に対して BeginLogin に渡す架空のユーザーを返す。
+// ID はユーザー名とサーバーの秘密鍵から導くため、同じユーザー名には毎回同じ allowCredentials を返す。
+// どのユーザーの WebAuthn ID とも一致しないので、このセッションでのログインは FinishLogin で失敗する。
+func decoyLoginUser(username string) domain.User {
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, getAuthSecret())
+		mac.Write([]byte(label + "\x00" + username))
+		return mac.Sum(nil)
+	}
+	return domain.User{
+		WebAuthnIDB: derive("decoy-user"),
+		Name:        username,
+		Credentials: []domain.Credential{{Credential: webauthn.Credential{ID: derive("decoy-credential")}}},
+	}
+}
+
 // FinishLogin はパスキーログインを完了する。
 func (h *PasskeyHandler) FinishLogin(c echo.Context) error {
+	defer startHandlerSpan(c, "passkey.finish_login")()
 	cookie, err := c.Cookie("webauthn_session")
 	if err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "session cookie not found"})
@@ -174,18 +314,47 @@ func (h *PasskeyHandler) FinishLogin(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "session not found"})
 	}
 
-	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
-		return h.userRepo.GetByWebAuthnID(ctx, userHandle)
+	span := oteltrace.SpanFromContext(ctx)
+	var (
+		domainUser domain.User
+		credential *webauthn.Credential
+	)
+	assertion, err := protocol.ParseCredentialRequestResponse(c.Request())
+	if err == nil {
+		domainUser, credential, err = h.finishLogin(ctx, session, assertion)
 	}
-
-	user, credential, err := h.webAuthn.FinishPasskeyLogin(handler, session, c.Request())
 	if err != nil {
+		span.RecordError(err)
+		// Discoverable ログインではユーザーを特定できないため ActorID は空になる
+		h.audit(ctx, domain.AuditEvent{
+			Action:  "auth.login_failed",
+			ActorID: domainUser.ID,
+			Target:  domainUser.ID,
+			Detail:  map[string]string{"method": "passkey", "ip": c.RealIP(), "error": err.Error()},
+		})
+		h.metrics.login("passkey", false)
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("failed to finish login: %v", err)})
 	}
 
-	domainUser, ok := user.(domain.User)
-	if !ok {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "unexpected user type"})
+	span.SetAttributes(attribute.String("enduser.id", domainUser.ID))
+	resp := map[string]string{"status": "ok"}
+	// 保存済みの CloneWarning は過去のログインの結果なので、ポリシーは今回の SignCount だけで判断する
+	if received := assertion.Response.AuthenticatorData.Counter; signCountRegressed(domainUser, credential.ID, received) {
+		span.AddEvent("passkey.clone_warning")
+		h.recordCloneWarning(ctx, domainUser, *credential, received)
+		switch h.clonePolicy {
+		case ClonePolicyFlag:
+		case ClonePolicyNotify:
+			resp["warning"] = "This passkey may have been cloned. Review your passkeys in Settings."
+		default:
+			// 拒否したログインでは認証器の状態を更新せず、設定画面に出す印だけを付ける
+			if err := h.userRepo.SetCloneWarning(ctx, domainUser.ID, credential.ID, true); err != nil {
+				c.Logger().Warnf("failed to flag credential: %v", err)
+			}
+			deleteCookie(c, "webauthn_session")
+			h.metrics.login("passkey", false)
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": "this passkey has been disabled because it may have been cloned"})
+		}
 	}
 
 	if err := h.userRepo.UpdateCredential(ctx, domainUser.ID, *credential); err != nil {
@@ -193,13 +362,88 @@ func (h *PasskeyHandler) FinishLogin(c echo.Context) error {
 	}
 
 	deleteCookie(c, "webauthn_session")
+	h.audit(ctx, domain.AuditEvent{
+		Action:  "auth.login",
+		ActorID: domainUser.ID,
+		Target:  base64.RawURLEncoding.EncodeToString(credential.ID),
+		Detail:  map[string]string{"method": "passkey", "ip": c.RealIP()},
+	})
+	h.metrics.login("passkey", true)
 	setAuthCookie(c, domainUser)
 
-	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+	return c.JSON(http.StatusOK, resp)
+}
+
+// finishLogin はセッションの種類に応じてアサーションを検証する。
+// ユーザー名を指定したログインではセッションに WebAuthn ID が記録されている。
+func (h *PasskeyHandler) finishLogin(ctx context.Context, session webauthn.SessionData, assertion *protocol.ParsedCredentialAssertionData) (domain.User, *webauthn.Credential, error) {
+	if len(session.UserID) > 0 {
+		user, err := h.userRepo.GetByWebAuthnID(ctx, session.UserID)
+		if err != nil {
+			return domain.User{}, nil, err
+		}
+		credential, err := h.webAuthn.ValidateLogin(user, session, assertion)
+		return user, credential, err
+	}
+
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		return h.userRepo.GetByWebAuthnID(ctx, userHandle)
+	}
+	user, credential, err := h.webAuthn.ValidatePasskeyLogin(handler, session, assertion)
+	if err != nil {
+		return domain.User{}, nil, err
+	}
+	domainUser, ok := user.(domain.User)
+	if !ok {
+		return domain.User{}, nil, fmt.Errorf("unexpected user type %T", user)
+	}
+	return domainUser, credential, nil
+}
+
+// signCountRegressed は認証器が送ってきた SignCount が保存済みの値から進んでいないかを返す。
+// 両方が 0 の場合は SignCount を実装しない認証器なので後退とみなさない。
+func signCountRegressed(user domain.User, credID []byte, received uint32) bool {
+	stored, ok := user.FindCredential(credID)
+	if !ok {
+		return false
+	}
+	count := stored.Authenticator.SignCount
+	return received <= count && (received != 0 || count != 0)
+}
+
+// recordCloneWarning は SignCount の後退を監査ログに記録する。
+// 後退を検知すると go-webauthn は cred の SignCount を保存済みの値のまま返すため、
+// 認証器が送ってきた値は received として別に受け取る。
+func (h *PasskeyHandler) recordCloneWarning(ctx context.Context, user domain.User, cred webauthn.Credential, received uint32) {
+	policy := h.clonePolicy
+	if policy == "" {
+		policy = ClonePolicyReject
+	}
+	h.audit(ctx, domain.AuditEvent{
+		Action:  "passkey.clone_warning",
+		ActorID: user.ID,
+		Target:  base64.RawURLEncoding.EncodeToString(cred.ID),
+		Detail: map[string]string{
+			"policy":              string(policy),
+			"stored_sign_count":   strconv.FormatUint(uint64(cred.Authenticator.SignCount), 10),
+			"received_sign_count": strconv.FormatUint(uint64(received), 10),
+		},
+	})
+}
+
+// audit は監査ログにイベントを記録する。監査ログ未設定時は何もしない。
+func (h *PasskeyHandler) audit(ctx context.Context, event domain.AuditEvent) {
+	recordAudit(ctx, h.auditLog, event)
 }
 
-// setAuthCookie は認証Cookieを設定する（OAuth の handleCallback と同じ形式）。
+// setAuthCookie は認証Cookieを設定する。OAuth とパスキーのどちらでログインしても
+// 同じ domain.User から値を作るため、userid と avatar_url はログイン方法によらず一致する。
 func setAuthCookie(c echo.Context, user domain.User) {
+	setAuthCookieValue(c, authUserData(user))
+}
+
+// authUserData は auth Cookie に保存するユーザー情報を返す。
+func authUserData(user domain.User) map[string]any {
 	m := md5.New()
 	_, _ = io.WriteString(m, strings.ToLower(user.Email))
 	userID := fmt.Sprintf("%x", m.Sum(nil))
@@ -213,11 +457,30 @@ func setAuthCookie(c echo.Context, user domain.User) {
 		avatarURL = fmt.Sprintf("https://www.gravatar.com/avatar/%s?d=mp", userID)
 	}
 
-	setAuthCookieValue(c, map[string]any{
+	return map[string]any{
+		"id":         user.ID,
 		"userid":     userID,
 		"name":       user.DisplayName,
 		"avatar_url": avatarURL,
 		"email":      user.Email,
+	}
+}
+
+// setSessionCookie はセレモニー中のチャレンジを Cookie に保存する。
+// 自動入力（Conditional UI）はユーザーが選ぶまで待つため、有効期限はセッションのタイムアウトに合わせる。
+func setSessionCookie(c echo.Context, session *webauthn.SessionData) {
+	maxAge := 60
+	if !session.Expires.IsZero() {
+		maxAge = int(time.Until(session.Expires).Seconds())
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     "webauthn_session",
+		Value:    session.Challenge,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Path:     "/",
+		Secure:   c.IsTLS(),
 	})
 }
 
@@ -239,5 +502,10 @@ func generateUUID() string {
 	_, _ = rand.Read(uuid)
 	uuid[6] = (uuid[6] & 0x0f) | 0x40
 	uuid[8] = (uuid[8] & 0x3f) | 0x80
-	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:])
+	return formatUUID(uuid)
+}
+
+// formatUUID は16バイトを UUID 表記の文字列にする。
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
 }
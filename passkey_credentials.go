@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+const maxCredentialNicknameLength = 50
+
+// knownAuthenticators は AAGUID から認証器名を引くための表。
+// 出典: https://github.com/passkeydeveloper/passkey-authenticator-aaguids
+var knownAuthenticators = map[string]string{
+	"fbfc3007-154e-4ecc-8c0b-6e020557d7bd": "iCloud Keychain",
+	"dd4ec289-e01d-41c9-bb89-70fa845d4bf2": "iCloud Keychain (Managed)",
+	"ea9b8d66-4d01-1d21-3ce4-b6b48cb575d4": "Google Password Manager",
+	"adce0002-35bc-c60a-648b-0b25f1f05503": "Chrome on Mac",
+	"08987058-cadc-4b81-b6e1-30de50dcbe96": "Windows Hello",
+	"9ddd1817-af5a-4672-a2b9-3e3dd95000a9": "Windows Hello",
+	"6028b017-b1d4-4c02-b4b3-afcdafc96bb2": "Windows Hello",
+	"bada5566-a7aa-401f-bd96-45619a55120d": "1Password",
+	"d548826e-79b4-db40-a3d8-11116f7e8349": "Bitwarden",
+	"531126d6-e717-415c-9320-3d9aa6981239": "Dashlane",
+	"53414d53-554e-4700-0000-000000000000": "Samsung Pass",
+	"cb69481e-8ff7-4039-93ec-0a2729a154a8": "YubiKey 5 Series",
+	"ee882879-721c-4913-9775-3dfcce97072a": "YubiKey 5 Series with NFC",
+}
+
+// authenticatorName は AAGUID から認証器名を返す。不明な場合は汎用名を返す。
+func authenticatorName(aaguid []byte) string {
+	if name, ok := knownAuthenticators[formatAAGUID(aaguid)]; ok {
+		return name
+	}
+	return "Passkey"
+}
+
+// formatAAGUID は AAGUID を UUID 表記の文字列にする。
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	return formatUUID(aaguid)
+}
+
+type credentialResponse struct {
+	ID                string     `json:"id"`
+	Nickname          string     `json:"nickname"`
+	AuthenticatorName string     `json:"authenticator_name"`
+	AAGUID            string     `json:"aaguid"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty"`
+	BackupEligible    bool       `json:"backup_eligible"`
+	BackedUp          bool       `json:"backed_up"`
+	CloneWarning      bool       `json:"clone_warning"`
+}
+
+func newCredentialResponse(cred domain.Credential) credentialResponse {
+	resp := credentialResponse{
+		ID:                base64.RawURLEncoding.EncodeToString(cred.ID),
+		Nickname:          cred.Nickname,
+		AuthenticatorName: authenticatorName(cred.Authenticator.AAGUID),
+		AAGUID:            formatAAGUID(cred.Authenticator.AAGUID),
+		CreatedAt:         cred.CreatedAt,
+		BackupEligible:    cred.Flags.BackupEligible,
+		BackedUp:          cred.Flags.BackupState,
+		CloneWarning:      cred.Authenticator.CloneWarning,
+	}
+	if !cred.LastUsedAt.IsZero() {
+		lastUsed := cred.LastUsedAt
+		resp.LastUsedAt = &lastUsed
+	}
+	return resp
+}
+
+type renameCredentialRequest struct {
+	Nickname string `json:"nickname"`
+}
+
+// ListCredentials はログイン中ユーザーの登録済みパスキーを返す。
+func (h *PasskeyHandler) ListCredentials(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+
+	creds := make([]credentialResponse, 0, len(user.Credentials))
+	for _, cred := range user.Credentials {
+		creds = append(creds, newCredentialResponse(cred))
+	}
+	return c.JSON(http.StatusOK, creds)
+}
+
+// RenameCredential はパスキーのニックネームを変更する。
+func (h *PasskeyHandler) RenameCredential(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	credID, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid credential id"})
+	}
+
+	var req renameCredentialRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+	nickname := strings.TrimSpace(req.Nickname)
+	if nickname == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "nickname is required"})
+	}
+	if len(nickname) > maxCredentialNicknameLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "nickname must be 50 characters or less"})
+	}
+
+	if err := h.userRepo.RenameCredential(c.Request().Context(), user.ID, credID, nickname); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "credential not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ClearCloneWarning はパスキーに付いた複製の疑いの印を解除する。
+// ユーザーが自分の認証器によるものと確認した後に使う。
+func (h *PasskeyHandler) ClearCloneWarning(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	credID, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid credential id"})
+	}
+
+	if err := h.userRepo.SetCloneWarning(c.Request().Context(), user.ID, credID, false); err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "credential not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// DeleteCredential はパスキーを削除する。
+// ログイン手段（パスキーと外部 IdP アカウント）が最後の1つになる削除は拒否する。
+func (h *PasskeyHandler) DeleteCredential(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	credID, err := base64.RawURLEncoding.DecodeString(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid credential id"})
+	}
+	if _, ok := user.FindCredential(credID); !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "credential not found"})
+	}
+
+	// 最後のログイン手段かどうかはリポジトリが削除と同時に確かめる。
+	// 別のリクエストで同時に削除しても、両方が残りがあると判断して成功することはない
+	err = h.userRepo.DeleteCredential(c.Request().Context(), user.ID, credID)
+	switch {
+	case errors.Is(err, domain.ErrLastLoginMethod):
+		return c.JSON(http.StatusConflict, map[string]string{"error": "cannot delete your last login method"})
+	case err != nil:
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "credential not found"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
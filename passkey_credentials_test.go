@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/labstack/echo/v4"
+)
+
+func newSignedInContext(method, target, body, userID string) (echo.Context, *httptest.ResponseRecorder) {
+	e := echo.New()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.AddCookie(&http.Cookie{
+		Name:  "auth",
+		Value: makeAuthCookieValue(map[string]any{"id": userID, "name": userID}),
+	})
+	rec := httptest.NewRecorder()
+	return e.NewContext(req, rec), rec
+}
+
+func newCredentialTestHandler(creds ...string) (*PasskeyHandler, *mockUserRepo) {
+	userRepo := newMockUserRepo()
+	user := domain.User{ID: "u1", WebAuthnIDB: []byte("u1"), Name: "alice"}
+	for _, id := range creds {
+		user = user.WithCredential(domain.Credential{
+			Credential: webauthn.Credential{
+				ID: []byte(id),
+				Authenticator: webauthn.Authenticator{
+					AAGUID: []byte{0xfb, 0xfc, 0x30, 0x07, 0x15, 0x4e, 0x4e, 0xcc, 0x8c, 0x0b, 0x6e, 0x02, 0x05, 0x57, 0xd7, 0xbd},
+				},
+			},
+			Nickname:  id,
+			CreatedAt: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+	}
+	userRepo.users[user.ID] = user
+	return NewPasskeyHandler(nil, userRepo, newMockSessionRepo()), userRepo
+}
+
+func TestListCredentials(t *testing.T) {
+	h, _ := newCredentialTestHandler("cred1")
+	c, rec := newSignedInContext(http.MethodGet, "/passkey/credentials", "", "u1")
+
+	if err := h.ListCredentials(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+
+	var got []credentialResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 credential, got %d", len(got))
+	}
+	if got[0].ID != base64.RawURLEncoding.EncodeToString([]byte("cred1")) {
+		t.Errorf("unexpected id: %s", got[0].ID)
+	}
+	if got[0].AuthenticatorName != "iCloud Keychain" {
+		t.Errorf("expected authenticator name 'iCloud Keychain', got %q", got[0].AuthenticatorName)
+	}
+	if got[0].LastUsedAt != nil {
+		t.Errorf("expected no last_used_at, got %v", got[0].LastUsedAt)
+	}
+}
+
+func TestListCredentials_Unauthorized(t *testing.T) {
+	h, _ := newCredentialTestHandler("cred1")
+	c, rec := newSignedInContext(http.MethodGet, "/passkey/credentials", "", "unknown")
+
+	if err := h.ListCredentials(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d", rec.Code)
+	}
+}
+
+func TestRenameCredential(t *testing.T) {
+	h, userRepo := newCredentialTestHandler("cred1")
+	id := base64.RawURLEncoding.EncodeToString([]byte("cred1"))
+	c, rec := newSignedInContext(http.MethodPatch, "/passkey/credentials/"+id, `{"nickname":" Work laptop "}`, "u1")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.RenameCredential(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if got := userRepo.users["u1"].Credentials[0].Nickname; got != "Work laptop" {
+		t.Errorf("expected nickname 'Work laptop', got %q", got)
+	}
+}
+
+func TestClearCloneWarning(t *testing.T) {
+	h, userRepo := newCredentialTestHandler("cred1")
+	cred := userRepo.users["u1"].Credentials[0]
+	cred.Authenticator.CloneWarning = true
+	userRepo.users["u1"] = userRepo.users["u1"].WithoutCredential(cred.ID).WithCredential(cred)
+
+	for _, tt := range []struct {
+		id         string
+		wantStatus int
+	}{
+		{id: base64.RawURLEncoding.EncodeToString([]byte("cred1")), wantStatus: http.StatusOK},
+		{id: base64.RawURLEncoding.EncodeToString([]byte("missing")), wantStatus: http.StatusNotFound},
+	} {
+		c, rec := newSignedInContext(http.MethodDelete, "/passkey/credentials/"+tt.id+"/clone-warning", "", "u1")
+		c.SetParamNames("id")
+		c.SetParamValues(tt.id)
+		if err := h.ClearCloneWarning(c); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Code != tt.wantStatus {
+			t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+		}
+	}
+	if userRepo.users["u1"].Credentials[0].Authenticator.CloneWarning {
+		t.Error("expected clone warning to be cleared")
+	}
+}
+
+func TestDeleteCredential_RefusesLastLoginMethod(t *testing.T) {
+	h, userRepo := newCredentialTestHandler("cred1")
+	id := base64.RawURLEncoding.EncodeToString([]byte("cred1"))
+	c, rec := newSignedInContext(http.MethodDelete, "/passkey/credentials/"+id, "", "u1")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.DeleteCredential(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("expected status 409, got %d", rec.Code)
+	}
+	if len(userRepo.users["u1"].Credentials) != 1 {
+		t.Error("last credential should not be deleted")
+	}
+}
+
+func TestDeleteCredential_AllowedWithLinkedIdentity(t *testing.T) {
+	h, userRepo := newCredentialTestHandler("cred1")
+	userRepo.identities[domain.Identity{Provider: "google", Subject: "sub"}] = "u1"
+	id := base64.RawURLEncoding.EncodeToString([]byte("cred1"))
+	c, rec := newSignedInContext(http.MethodDelete, "/passkey/credentials/"+id, "", "u1")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.DeleteCredential(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if len(userRepo.users["u1"].Credentials) != 0 {
+		t.Error("credential should be deleted")
+	}
+}
+
+func TestDeleteCredential_OneOfMany(t *testing.T) {
+	h, userRepo := newCredentialTestHandler("cred1", "cred2")
+	id := base64.RawURLEncoding.EncodeToString([]byte("cred2"))
+	c, rec := newSignedInContext(http.MethodDelete, "/passkey/credentials/"+id, "", "u1")
+	c.SetParamNames("id")
+	c.SetParamValues(id)
+
+	if err := h.DeleteCredential(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	creds := userRepo.users["u1"].Credentials
+	if len(creds) != 1 || string(creds[0].ID) != "cred1" {
+		t.Errorf("expected only cred1 left, got %v", creds)
+	}
+}
@@ -2,14 +2,25 @@ package main
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/labstack/echo/v4"
 )
@@ -17,11 +28,15 @@ import (
 // --- Mock Repositories ---
 
 type mockUserRepo struct {
-	users map[string]domain.User
+	users      map[string]domain.User
+	identities map[domain.Identity]string
 }
 
 func newMockUserRepo() *mockUserRepo {
-	return &mockUserRepo{users: make(map[string]domain.User)}
+	return &mockUserRepo{
+		users:      make(map[string]domain.User),
+		identities: make(map[domain.Identity]string),
+	}
 }
 
 func (m *mockUserRepo) Create(_ context.Context, user domain.User) error {
@@ -56,7 +71,7 @@ func (m *mockUserRepo) GetByName(_ context.Context, name string) (domain.User, e
 	return domain.User{}, echo.NewHTTPError(http.StatusNotFound, "user not found")
 }
 
-func (m *mockUserRepo) AddCredential(_ context.Context, userID string, cred webauthn.Credential) error {
+func (m *mockUserRepo) AddCredential(_ context.Context, userID string, cred domain.Credential) error {
 	if u, ok := m.users[userID]; ok {
 		u.Credentials = append(u.Credentials, cred)
 		m.users[userID] = u
@@ -68,7 +83,8 @@ func (m *mockUserRepo) UpdateCredential(_ context.Context, userID string, cred w
 	if u, ok := m.users[userID]; ok {
 		for i, c := range u.Credentials {
 			if string(c.ID) == string(cred.ID) {
-				u.Credentials[i] = cred
+				u.Credentials[i].Credential = cred
+				u.Credentials[i].LastUsedAt = time.Now()
 				m.users[userID] = u
 				return nil
 			}
@@ -77,6 +93,122 @@ func (m *mockUserRepo) UpdateCredential(_ context.Context, userID string, cred w
 	return nil
 }
 
+func (m *mockUserRepo) SetCloneWarning(_ context.Context, userID string, credID []byte, warning bool) error {
+	if u, ok := m.users[userID]; ok {
+		for i, c := range u.Credentials {
+			if string(c.ID) == string(credID) {
+				u.Credentials[i].Authenticator.CloneWarning = warning
+				m.users[userID] = u
+				return nil
+			}
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "credential not found")
+}
+
+func (m *mockUserRepo) RenameCredential(_ context.Context, userID string, credID []byte, nickname string) error {
+	if u, ok := m.users[userID]; ok {
+		for i, c := range u.Credentials {
+			if string(c.ID) == string(credID) {
+				u.Credentials[i].Nickname = nickname
+				m.users[userID] = u
+				return nil
+			}
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "credential not found")
+}
+
+func (m *mockUserRepo) DeleteCredential(_ context.Context, userID string, credID []byte) error {
+	if u, ok := m.users[userID]; ok {
+		if _, found := u.FindCredential(credID); found {
+			methods := len(u.Credentials)
+			for _, owner := range m.identities {
+				if owner == userID {
+					methods++
+				}
+			}
+			if methods <= 1 {
+				return domain.ErrLastLoginMethod
+			}
+			m.users[userID] = u.WithoutCredential(credID)
+			return nil
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound, "credential not found")
+}
+
+func (m *mockUserRepo) GetByIdentity(_ context.Context, identity domain.Identity) (domain.User, error) {
+	if id, ok := m.identities[identity]; ok {
+		return m.users[id], nil
+	}
+	return domain.User{}, echo.NewHTTPError(http.StatusNotFound, "identity not linked")
+}
+
+func (m *mockUserRepo) LinkIdentity(_ context.Context, userID string, identity domain.Identity) error {
+	if owner, ok := m.identities[identity]; ok && owner != userID {
+		return echo.NewHTTPError(http.StatusConflict, "identity linked to another user")
+	}
+	m.identities[identity] = userID
+	return nil
+}
+
+func (m *mockUserRepo) ListIdentities(_ context.Context, userID string) ([]domain.Identity, error) {
+	var identities []domain.Identity
+	for identity, owner := range m.identities {
+		if owner == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (m *mockUserRepo) SetRecoveryCodes(_ context.Context, userID string, codes []domain.RecoveryCode) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	user.RecoveryCodes = codes
+	m.users[userID] = user
+	return nil
+}
+
+func (m *mockUserRepo) UseRecoveryCode(_ context.Context, userID string, hash []byte) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	for i, c := range user.RecoveryCodes {
+		if !c.Used() && string(c.Hash) == string(hash) {
+			user.RecoveryCodes[i].UsedAt = time.Now()
+			return nil
+		}
+	}
+	return domain.ErrRecoveryCodeInvalid
+}
+
+func (m *mockUserRepo) SetRole(_ context.Context, userID string, role domain.Role) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, "user not found")
+	}
+	user.Role = role
+	m.users[userID] = user
+	return nil
+}
+
+func (m *mockUserRepo) PromoteIfNoAdmin(ctx context.Context, userID string) (bool, error) {
+	for _, u := range m.users {
+		if u.Role == domain.RoleAdmin {
+			return false, nil
+		}
+	}
+	if err := m.SetRole(ctx, userID, domain.RoleAdmin); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 type mockSessionRepo struct {
 	sessions map[string]webauthn.SessionData
 }
@@ -300,3 +432,484 @@ func TestGenerateUUID(t *testing.T) {
 		t.Error("two generated UUIDs should be different")
 	}
 }
+
+func TestBeginRegistration_SignedInAttachesToExistingUser(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/passkey/register", strings.NewReader(`{}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.AddCookie(&http.Cookie{
+		Name:  "auth",
+		Value: makeAuthCookieValue(map[string]any{"id": "google-user", "name": "Alice"}),
+	})
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	wa, _ := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Test",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:8080"},
+	})
+
+	userRepo := newMockUserRepo()
+	userRepo.users["google-user"] = domain.User{
+		ID:          "google-user",
+		WebAuthnIDB: make([]byte, 64),
+		Name:        "alice@example.com",
+		DisplayName: "Alice",
+		Email:       "alice@example.com",
+	}
+
+	h := NewPasskeyHandler(wa, userRepo, newMockSessionRepo())
+	if err := h.BeginRegistration(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var reg pendingRegistration
+	h.pending.Range(func(_, v any) bool {
+		reg = v.(pendingRegistration)
+		return false
+	})
+	if !reg.existing || reg.user.ID != "google-user" {
+		t.Errorf("expected pending registration for existing user, got %+v", reg)
+	}
+}
+
+func TestSetAuthCookie_IncludesUserID(t *testing.T) {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+
+	setAuthCookie(c, domain.User{ID: "test-id", WebAuthnIDB: make([]byte, 64)})
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name != "auth" {
+			continue
+		}
+		decoded, err := parseAuthCookieValue(cookie.Value)
+		if err != nil {
+			t.Fatalf("failed to parse auth cookie: %v", err)
+		}
+		if decoded["id"] != "test-id" {
+			t.Errorf("expected id 'test-id', got %v", decoded["id"])
+		}
+		return
+	}
+	t.Fatal("auth cookie not found")
+}
+
+// --- Software Authenticator ---
+
+// testAuthenticator は ES256 で署名するソフトウェア認証器。
+// FinishLogin を実際の検証ロジックで通すために使う。
+type testAuthenticator struct {
+	key        *ecdsa.PrivateKey
+	credID     []byte
+	userHandle []byte
+	signCount  uint32
+}
+
+func newTestAuthenticator(t *testing.T, userHandle []byte) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return &testAuthenticator{key: key, credID: []byte("test-credential"), userHandle: userHandle}
+}
+
+// credential はサーバーに保存されるクレデンシャルを返す。
+func (a *testAuthenticator) credential(t *testing.T, storedSignCount uint32) domain.Credential {
+	t.Helper()
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		t.Fatalf("failed to convert public key: %v", err)
+	}
+	raw := pub.Bytes() // 0x04 || X || Y
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: raw[1:33],
+		YCoord: raw[33:],
+	})
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+	return domain.Credential{
+		Credential: webauthn.Credential{
+			ID:            a.credID,
+			PublicKey:     publicKey,
+			Authenticator: webauthn.Authenticator{SignCount: storedSignCount},
+		},
+	}
+}
+
+// assertion は navigator.credentials.get() の結果に相当する JSON を返す。
+func (a *testAuthenticator) assertion(t *testing.T, challenge, origin, rpID string) string {
+	t.Helper()
+	clientData, _ := json.Marshal(map[string]string{
+		"type":      "webauthn.get",
+		"challenge": challenge,
+		"origin":    origin,
+	})
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := make([]byte, 0, 37)
+	authData = append(authData, rpIDHash[:]...)
+	authData = append(authData, 0x05) // UP | UV
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	body, _ := json.Marshal(map[string]any{
+		"id":    enc(a.credID),
+		"rawId": enc(a.credID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"authenticatorData": enc(authData),
+			"clientDataJSON":    enc(clientData),
+			"signature":         enc(sig),
+			"userHandle":        enc(a.userHandle),
+		},
+	})
+	return string(body)
+}
+
+// loginWithAuthenticator は BeginLogin から FinishLogin までを実行し、FinishLogin のレスポンスを返す。
+func loginWithAuthenticator(t *testing.T, h *PasskeyHandler, auth *testAuthenticator, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	return loginWithRequest(t, h, auth, origin, "")
+}
+
+// loginWithRequest は BeginLogin に body を送ってログインする。
+func loginWithRequest(t *testing.T, h *PasskeyHandler, auth *testAuthenticator, origin, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	e := echo.New()
+
+	beginReq := httptest.NewRequest(http.MethodPost, "/passkey/login", strings.NewReader(body))
+	beginReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	beginRec := httptest.NewRecorder()
+	if err := h.BeginLogin(e.NewContext(beginReq, beginRec)); err != nil {
+		t.Fatalf("BeginLogin failed: %v", err)
+	}
+	var options struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(beginRec.Body.Bytes(), &options); err != nil {
+		t.Fatalf("failed to decode login options: %v", err)
+	}
+
+	assertion := auth.assertion(t, options.PublicKey.Challenge, origin, "localhost")
+	finishReq := httptest.NewRequest(http.MethodPost, "/passkey/login/finish", strings.NewReader(assertion))
+	finishReq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for _, cookie := range beginRec.Result().Cookies() {
+		finishReq.AddCookie(cookie)
+	}
+	finishRec := httptest.NewRecorder()
+	if err := h.FinishLogin(e.NewContext(finishReq, finishRec)); err != nil {
+		t.Fatalf("FinishLogin failed: %v", err)
+	}
+	return finishRec
+}
+
+func newLoginTestHandler(t *testing.T, storedSignCount uint32, policy ClonePolicy) (*PasskeyHandler, *mockUserRepo, *memory.AuditStore, *testAuthenticator) {
+	t.Helper()
+	wa, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: "Test",
+		RPID:          "localhost",
+		RPOrigins:     []string{"http://localhost:8080"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webAuthnID := []byte(strings.Repeat("u1", 32))
+	auth := newTestAuthenticator(t, webAuthnID)
+	userRepo := newMockUserRepo()
+	userRepo.users["u1"] = domain.User{
+		ID:          "u1",
+		WebAuthnIDB: webAuthnID,
+		Name:        "alice",
+		DisplayName: "Alice",
+	}.WithCredential(auth.credential(t, storedSignCount))
+
+	auditLog := memory.NewAuditStore()
+	h := NewPasskeyHandler(wa, userRepo, newMockSessionRepo())
+	h.auditLog = auditLog
+	h.clonePolicy = policy
+	return h, userRepo, auditLog, auth
+}
+
+func hasAuthCookie(rec *httptest.ResponseRecorder) bool {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "auth" && cookie.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFinishLogin_SignCountIncrease(t *testing.T) {
+	h, userRepo, auditLog, auth := newLoginTestHandler(t, 5, ClonePolicyReject)
+	auth.signCount = 6
+
+	rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !hasAuthCookie(rec) {
+		t.Error("expected auth cookie to be set")
+	}
+	if got := userRepo.users["u1"].Credentials[0].Authenticator.SignCount; got != 6 {
+		t.Errorf("expected stored sign count 6, got %d", got)
+	}
+	if events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "passkey.clone_warning"}); len(events) != 0 {
+		t.Errorf("expected no clone warning audit events, got %v", events)
+	}
+	events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "auth.login"})
+	if len(events) != 1 || events[0].ActorID != "u1" || events[0].Detail["method"] != "passkey" {
+		t.Errorf("expected one passkey login audit event, got %v", events)
+	}
+}
+
+func TestFinishLogin_ZeroSignCountIsNotRegression(t *testing.T) {
+	h, _, auditLog, auth := newLoginTestHandler(t, 0, ClonePolicyReject)
+
+	rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "passkey.clone_warning"}); len(events) != 0 {
+		t.Errorf("expected no clone warning audit events, got %v", events)
+	}
+}
+
+func TestFinishLogin_SignCountRegression(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      ClonePolicy
+		wantStatus  int
+		wantCookie  bool
+		wantWarning bool
+	}{
+		{name: "default rejects", policy: "", wantStatus: http.StatusUnauthorized},
+		{name: "reject", policy: ClonePolicyReject, wantStatus: http.StatusUnauthorized},
+		{name: "flag", policy: ClonePolicyFlag, wantStatus: http.StatusOK, wantCookie: true},
+		{name: "notify", policy: ClonePolicyNotify, wantStatus: http.StatusOK, wantCookie: true, wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, userRepo, auditLog, auth := newLoginTestHandler(t, 10, tt.policy)
+			auth.signCount = 3
+
+			rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+			if got := hasAuthCookie(rec); got != tt.wantCookie {
+				t.Errorf("auth cookie set = %v, want %v", got, tt.wantCookie)
+			}
+
+			var body map[string]string
+			_ = json.Unmarshal(rec.Body.Bytes(), &body)
+			if got := body["warning"] != ""; got != tt.wantWarning {
+				t.Errorf("warning present = %v, want %v", got, tt.wantWarning)
+			}
+
+			stored := userRepo.users["u1"].Credentials[0].Authenticator
+			if !stored.CloneWarning {
+				t.Error("expected credential to be flagged")
+			}
+			if stored.SignCount != 10 {
+				t.Errorf("expected stored sign count to stay 10, got %d", stored.SignCount)
+			}
+			// 拒否したログインは使用日時に残さない
+			if used := !userRepo.users["u1"].Credentials[0].LastUsedAt.IsZero(); used != tt.wantCookie {
+				t.Errorf("credential marked as used = %v, want %v", used, tt.wantCookie)
+			}
+
+			events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "passkey.clone_warning"})
+			if len(events) != 1 || events[0].ActorID != "u1" {
+				t.Fatalf("expected one clone warning audit event, got %v", events)
+			}
+			if events[0].Detail["stored_sign_count"] != "10" || events[0].Detail["received_sign_count"] != "3" {
+				t.Errorf("expected stored and received sign counts in audit detail, got %v", events[0].Detail)
+			}
+		})
+	}
+}
+
+func TestFinishLogin_FlaggedCredentialWithIncreasingSignCount(t *testing.T) {
+	h, userRepo, auditLog, auth := newLoginTestHandler(t, 5, ClonePolicyNotify)
+	cred := userRepo.users["u1"].Credentials[0]
+	cred.Authenticator.CloneWarning = true
+	userRepo.users["u1"] = userRepo.users["u1"].WithoutCredential(cred.ID).WithCredential(cred)
+	auth.signCount = 6
+
+	// 以前の後退で付いた印だけでは警告もポリシーの適用もしない
+	rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var body map[string]string
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	if body["warning"] != "" {
+		t.Errorf("expected no warning, got %q", body["warning"])
+	}
+	if events, _ := auditLog.Query(context.Background(), domain.AuditQuery{Action: "passkey.clone_warning"}); len(events) != 0 {
+		t.Errorf("expected no clone warning audit events, got %v", events)
+	}
+	stored := userRepo.users["u1"].Credentials[0].Authenticator
+	if !stored.CloneWarning || stored.SignCount != 6 {
+		t.Errorf("expected the flag to stay until cleared and the count to advance, got %+v", stored)
+	}
+}
+
+func TestFinishLogin_EqualNonZeroSignCountIsRegression(t *testing.T) {
+	h, _, _, auth := newLoginTestHandler(t, 7, ClonePolicyReject)
+	auth.signCount = 7
+
+	rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected status 401, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestParseClonePolicy(t *testing.T) {
+	for _, s := range []string{"reject", "flag", "notify"} {
+		if _, err := ParseClonePolicy(s); err != nil {
+			t.Errorf("ParseClonePolicy(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseClonePolicy("ignore"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
+func TestBeginLogin_UsernameFirst(t *testing.T) {
+	h, _, _, auth := newLoginTestHandler(t, 0, ClonePolicyReject)
+	req := httptest.NewRequest(http.MethodPost, "/passkey/login", strings.NewReader(`{"username":"alice"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	if err := h.BeginLogin(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var options struct {
+		PublicKey struct {
+			AllowCredentials []struct {
+				ID string `json:"id"`
+			} `json:"allowCredentials"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+		t.Fatalf("failed to decode options: %v", err)
+	}
+	allowed := options.PublicKey.AllowCredentials
+	if len(allowed) != 1 || allowed[0].ID != base64.RawURLEncoding.EncodeToString(auth.credID) {
+		t.Errorf("expected allowCredentials to list the user's credential, got %+v", allowed)
+	}
+}
+
+func TestBeginLogin_UnknownUsername(t *testing.T) {
+	h, _, _, auth := newLoginTestHandler(t, 0, ClonePolicyReject)
+
+	// ユーザー名の有無が分からないよう、存在するユーザーと同じ形の応答を毎回同じ内容で返す
+	var first string
+	for range 2 {
+		req := httptest.NewRequest(http.MethodPost, "/passkey/login", strings.NewReader(`{"username":"mallory"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		if err := h.BeginLogin(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		var options struct {
+			PublicKey struct {
+				AllowCredentials []struct {
+					ID string `json:"id"`
+				} `json:"allowCredentials"`
+			} `json:"publicKey"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+			t.Fatalf("failed to decode options: %v", err)
+		}
+		allowed := options.PublicKey.AllowCredentials
+		if len(allowed) != 1 || allowed[0].ID == base64.RawURLEncoding.EncodeToString(auth.credID) {
+			t.Fatalf("expected one decoy credential, got %+v", allowed)
+		}
+		if first == "" {
+			first = allowed[0].ID
+		} else if allowed[0].ID != first {
+			t.Errorf("decoy credential should be stable, got %s and %s", first, allowed[0].ID)
+		}
+	}
+
+	if rec := loginWithRequest(t, h, auth, "http://localhost:8080", `{"username":"mallory"}`); rec.Code == http.StatusOK {
+		t.Error("login with a decoy session must fail")
+	}
+}
+
+func TestBeginLogin_ConditionalMediation(t *testing.T) {
+	h, _, _, _ := newLoginTestHandler(t, 0, ClonePolicyReject)
+	req := httptest.NewRequest(http.MethodPost, "/passkey/login", strings.NewReader(`{"mediation":"conditional"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+
+	if err := h.BeginLogin(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var options struct {
+		Mediation string `json:"mediation"`
+		PublicKey struct {
+			AllowCredentials []any `json:"allowCredentials"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &options); err != nil {
+		t.Fatalf("failed to decode options: %v", err)
+	}
+	if options.Mediation != "conditional" {
+		t.Errorf("expected mediation conditional, got %q", options.Mediation)
+	}
+	if len(options.PublicKey.AllowCredentials) != 0 {
+		t.Error("conditional login must not list credentials")
+	}
+}
+
+func TestFinishLogin_UsernameFirstWithoutUserHandle(t *testing.T) {
+	h, _, _, auth := newLoginTestHandler(t, 0, ClonePolicyReject)
+	// Discoverable でないクレデンシャルはアサーションに userHandle を含まない
+	auth.userHandle = nil
+
+	rec := loginWithRequest(t, h, auth, "http://localhost:8080", `{"username":"alice"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if !hasAuthCookie(rec) {
+		t.Error("expected auth cookie to be set")
+	}
+
+	rec = loginWithAuthenticator(t, h, auth, "http://localhost:8080")
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("discoverable login without userHandle: expected status 400, got %d", rec.Code)
+	}
+}
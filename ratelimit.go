@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig はチャットメッセージの送信レート制限。
+// 接続ごとのバケットと、同じユーザーの全接続（タブ）で共有するバケットの両方を満たす必要がある。
+type RateLimitConfig struct {
+	ConnBurst int
+	// ConnRate は接続ごとのバケットに1秒あたり補充するトークン数。
+	ConnRate  float64
+	UserBurst int
+	UserRate  float64
+	// StrikeWindow 内に MaxStrikes 回制限を超えたユーザーは切断する。0 の場合は切断しない。
+	MaxStrikes   int
+	StrikeWindow time.Duration
+}
+
+// defaultRateLimitConfig は通常の会話を妨げない程度の制限を返す。
+func defaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		ConnBurst:    10,
+		ConnRate:     2,
+		UserBurst:    20,
+		UserRate:     4,
+		MaxStrikes:   5,
+		StrikeWindow: time.Minute,
+	}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+func (c *RateLimitConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.IntVar(&c.ConnBurst, "msg-burst", c.ConnBurst, "Messages a single connection may send in a burst.")
+	fs.Float64Var(&c.ConnRate, "msg-rate", c.ConnRate, "Messages per second refilled to a single connection's burst.")
+	fs.IntVar(&c.UserBurst, "user-msg-burst", c.UserBurst, "Messages a user may send in a burst across all connections.")
+	fs.Float64Var(&c.UserRate, "user-msg-rate", c.UserRate, "Messages per second refilled to a user's burst across all connections.")
+	fs.IntVar(&c.MaxStrikes, "rate-limit-strikes", c.MaxStrikes, "Rate limit violations within rate-limit-window before the user is disconnected; 0 never disconnects.")
+	fs.DurationVar(&c.StrikeWindow, "rate-limit-window", c.StrikeWindow, "Window in which rate limit violations are counted.")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c RateLimitConfig) Validate() error {
+	var errs []error
+	if c.ConnBurst < 1 || c.UserBurst < 1 {
+		errs = append(errs, errors.New("msg-burst and user-msg-burst must be at least 1"))
+	}
+	if c.ConnRate <= 0 || c.UserRate <= 0 {
+		errs = append(errs, errors.New("msg-rate and user-msg-rate must be positive"))
+	}
+	if c.MaxStrikes < 0 {
+		errs = append(errs, fmt.Errorf("rate-limit-strikes must not be negative, got %d", c.MaxStrikes))
+	}
+	if c.MaxStrikes > 0 && c.StrikeWindow <= 0 {
+		errs = append(errs, fmt.Errorf("rate-limit-window must be positive, got %s", c.StrikeWindow))
+	}
+	return errors.Join(errs...)
+}
+
+// tokenBucket は burst 個まで貯まり、rate 個/秒で補充されるトークンバケット。
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time, burst int, rate float64) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+	b.last = now
+}
+
+// rateDecision はメッセージを受け付けるかの判定結果。
+type rateDecision int
+
+const (
+	rateAllowed rateDecision = iota
+	// rateLimited はメッセージを破棄し、送信者にエラーを返す。
+	rateLimited
+	// rateDisconnect は制限を繰り返し超えたユーザーを切断する。
+	rateDisconnect
+)
+
+// limiterPruneInterval は messageLimiter が不要になったユーザーを探す間隔。
+const limiterPruneInterval = time.Minute
+
+// messageLimiter はメッセージ送信を接続ごと・ユーザーごとに制限する。
+type messageLimiter struct {
+	mu    sync.Mutex
+	cfg   RateLimitConfig
+	users map[string]*userRate
+	now   func() time.Time
+	// nextPrune までは users を走査しない。送信のたびに全ユーザーを調べるとロックが長くなる
+	nextPrune time.Time
+}
+
+type userRate struct {
+	bucket  *tokenBucket
+	strikes attemptWindow
+}
+
+func newMessageLimiter(cfg RateLimitConfig) *messageLimiter {
+	return &messageLimiter{
+		cfg:   cfg,
+		users: make(map[string]*userRate),
+		now:   time.Now,
+	}
+}
+
+// connBucket は新しい接続用のバケットを返す。
+func (l *messageLimiter) connBucket() *tokenBucket {
+	return newTokenBucket(l.cfg.ConnBurst, l.now())
+}
+
+// Allow は接続 conn からのメッセージ1件を判定する。
+// どちらかのバケットが空の場合は、どちらのトークンも消費しない。
+func (l *messageLimiter) Allow(conn *tokenBucket, userID string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if !now.Before(l.nextPrune) {
+		l.prune(now)
+		l.nextPrune = now.Add(limiterPruneInterval)
+	}
+
+	u, ok := l.users[userID]
+	if !ok {
+		u = &userRate{bucket: newTokenBucket(l.cfg.UserBurst, now)}
+		l.users[userID] = u
+	}
+	conn.refill(now, l.cfg.ConnBurst, l.cfg.ConnRate)
+	u.bucket.refill(now, l.cfg.UserBurst, l.cfg.UserRate)
+	if conn.tokens >= 1 && u.bucket.tokens >= 1 {
+		conn.tokens--
+		u.bucket.tokens--
+		return rateAllowed
+	}
+
+	if l.cfg.MaxStrikes == 0 {
+		return rateLimited
+	}
+	if u.strikes.count == 0 || now.Sub(u.strikes.start) >= l.cfg.StrikeWindow {
+		u.strikes = attemptWindow{start: now}
+	}
+	u.strikes.count++
+	if u.strikes.count >= l.cfg.MaxStrikes {
+		// 再接続した直後に切断されないように数え直す
+		u.strikes = attemptWindow{}
+		return rateDisconnect
+	}
+	return rateLimited
+}
+
+// prune はバケットが満タンに戻り、違反も残っていないユーザーを忘れる。
+func (l *messageLimiter) prune(now time.Time) {
+	for id, u := range l.users {
+		missing := float64(l.cfg.UserBurst) - u.bucket.tokens
+		if now.Sub(u.bucket.last).Seconds()*l.cfg.UserRate < missing {
+			continue
+		}
+		if u.strikes.count > 0 && now.Sub(u.strikes.start) < l.cfg.StrikeWindow {
+			continue
+		}
+		delete(l.users, id)
+	}
+}
+
+// rateLimitMessage は制限を超えた送信者に送るエラーイベントを作る。
+func rateLimitMessage(d rateDecision) *message {
+	if d == rateDisconnect {
+		return newSystemMessage("You were disconnected for repeatedly sending messages too fast.", systemEvent{Action: "rate_limit_disconnect"})
+	}
+	return newSystemMessage("You are sending messages too fast. Your message was not delivered.", systemEvent{Action: "rate_limited"})
+}
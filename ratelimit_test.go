@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+)
+
+func newTestMessageLimiter(cfg RateLimitConfig) (*messageLimiter, *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newMessageLimiter(cfg)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestMessageLimiter_ConnBurstAndRefill(t *testing.T) {
+	l, now := newTestMessageLimiter(RateLimitConfig{ConnBurst: 3, ConnRate: 1, UserBurst: 100, UserRate: 100})
+	conn := l.connBucket()
+
+	for i := 0; i < 3; i++ {
+		if d := l.Allow(conn, "u1"); d != rateAllowed {
+			t.Fatalf("message %d within burst should be allowed, got %d", i+1, d)
+		}
+	}
+	if d := l.Allow(conn, "u1"); d != rateLimited {
+		t.Fatalf("message beyond burst should be limited, got %d", d)
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if d := l.Allow(conn, "u1"); d != rateLimited {
+		t.Errorf("half a token must not be enough, got %d", d)
+	}
+	*now = now.Add(500 * time.Millisecond)
+	if d := l.Allow(conn, "u1"); d != rateAllowed {
+		t.Errorf("refilled token should be allowed, got %d", d)
+	}
+
+	// 別の接続は独立したバケットを持つ
+	if d := l.Allow(l.connBucket(), "u1"); d != rateAllowed {
+		t.Errorf("new connection should have its own burst, got %d", d)
+	}
+}
+
+func TestMessageLimiter_UserSharedAcrossConnections(t *testing.T) {
+	l, now := newTestMessageLimiter(RateLimitConfig{ConnBurst: 10, ConnRate: 10, UserBurst: 4, UserRate: 1})
+	tab1, tab2 := l.connBucket(), l.connBucket()
+
+	for i := 0; i < 2; i++ {
+		if l.Allow(tab1, "u1") != rateAllowed || l.Allow(tab2, "u1") != rateAllowed {
+			t.Fatalf("round %d should be within the user's burst", i+1)
+		}
+	}
+	if d := l.Allow(tab2, "u1"); d != rateLimited {
+		t.Fatalf("user burst is shared across tabs, got %d", d)
+	}
+	if tab2.tokens != 8 {
+		t.Errorf("limited message must not consume the connection's token, got %v", tab2.tokens)
+	}
+	if d := l.Allow(l.connBucket(), "u2"); d != rateAllowed {
+		t.Errorf("other users are not affected, got %d", d)
+	}
+
+	*now = now.Add(time.Second)
+	if d := l.Allow(tab1, "u1"); d != rateAllowed {
+		t.Errorf("refilled user token should be allowed, got %d", d)
+	}
+}
+
+func TestMessageLimiter_DisconnectRepeatOffenders(t *testing.T) {
+	l, now := newTestMessageLimiter(RateLimitConfig{ConnBurst: 1, ConnRate: 0.001, UserBurst: 1, UserRate: 0.001, MaxStrikes: 3, StrikeWindow: time.Minute})
+	conn := l.connBucket()
+	l.Allow(conn, "u1")
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow(conn, "u1"); d != rateLimited {
+			t.Fatalf("strike %d should only be limited, got %d", i+1, d)
+		}
+	}
+	*now = now.Add(2 * time.Minute)
+	if d := l.Allow(conn, "u1"); d != rateLimited {
+		t.Fatalf("strikes outside the window should be forgotten, got %d", d)
+	}
+	l.Allow(conn, "u1")
+	if d := l.Allow(conn, "u1"); d != rateDisconnect {
+		t.Fatalf("third strike within the window should disconnect, got %d", d)
+	}
+	if d := l.Allow(conn, "u1"); d != rateLimited {
+		t.Errorf("strikes should reset after a disconnect, got %d", d)
+	}
+}
+
+func TestMessageLimiter_PrunesIdleUsers(t *testing.T) {
+	l, now := newTestMessageLimiter(RateLimitConfig{ConnBurst: 5, ConnRate: 1, UserBurst: 5, UserRate: 0.1, MaxStrikes: 3, StrikeWindow: time.Minute})
+	l.Allow(l.connBucket(), "u1")
+	if len(l.users) != 1 {
+		t.Fatalf("want 1 tracked user, got %d", len(l.users))
+	}
+
+	*now = now.Add(time.Second)
+	l.Allow(l.connBucket(), "u2")
+	if _, ok := l.users["u1"]; !ok {
+		t.Error("user with a partially empty bucket must be kept")
+	}
+	// 走査は limiterPruneInterval ごとに行う
+	*now = now.Add(9 * time.Second)
+	l.Allow(l.connBucket(), "u2")
+	if _, ok := l.users["u1"]; !ok {
+		t.Error("users should not be scanned before the prune interval")
+	}
+	*now = now.Add(limiterPruneInterval)
+	l.Allow(l.connBucket(), "u2")
+	if _, ok := l.users["u1"]; ok {
+		t.Error("user with a refilled bucket should be pruned")
+	}
+}
+
+func TestRateLimitConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+	}{
+		{name: "defaults", args: nil},
+		{name: "custom", args: []string{"-msg-burst=3", "-msg-rate=0.5", "-rate-limit-strikes=0", "-rate-limit-window=0s"}},
+		{name: "zero burst", args: []string{"-user-msg-burst=0"}, wantErr: true},
+		{name: "zero rate", args: []string{"-msg-rate=0"}, wantErr: true},
+		{name: "negative strikes", args: []string{"-rate-limit-strikes=-1"}, wantErr: true},
+		{name: "strikes without window", args: []string{"-rate-limit-window=0s"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultRateLimitConfig()
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			cfg.RegisterFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRoom_AllowMessage(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	c := &client{userData: map[string]any{"id": "u1"}}
+	if d := r.allowMessage(c); d != rateAllowed {
+		t.Errorf("room without a limiter should allow, got %d", d)
+	}
+
+	r.limiter, _ = newTestMessageLimiter(RateLimitConfig{ConnBurst: 1, ConnRate: 1, UserBurst: 1, UserRate: 1})
+	c.limit = r.limiter.connBucket()
+	if d := r.allowMessage(c); d != rateAllowed {
+		t.Errorf("first message should be allowed, got %d", d)
+	}
+	if d := r.allowMessage(c); d != rateLimited {
+		t.Errorf("second message should be limited, got %d", d)
+	}
+	if msg := rateLimitMessage(rateLimited); msg.System == nil || msg.System.Action != "rate_limited" {
+		t.Errorf("unexpected error event: %+v", msg)
+	}
+}
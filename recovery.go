@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10 // 80 ビット
+
+	// 回復ログインの試行回数の上限。ユーザー名と IP アドレスのそれぞれで数える。
+	recoveryAttemptsPerUser = 5
+	recoveryAttemptsPerIP   = 20
+	recoveryAttemptWindow   = 15 * time.Minute
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCodes は表示用の回復コードと、保存用のハッシュを生成する。
+func newRecoveryCodes() ([]string, []domain.RecoveryCode, error) {
+	plain := make([]string, recoveryCodeCount)
+	hashed := make([]domain.RecoveryCode, recoveryCodeCount)
+	for i := range plain {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		plain[i] = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+		hashed[i] = domain.RecoveryCode{Hash: hashRecoveryCode(plain[i])}
+	}
+	return plain, hashed, nil
+}
+
+// hashRecoveryCode は区切り文字と大文字小文字を無視して回復コードをハッシュ化する。
+// コードは十分なエントロピーを持つランダム値なので、低速なハッシュは使わない。
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(normalized))
+	return sum[:]
+}
+
+// attemptLimiter はキーごとに一定時間内の試行回数を制限する。
+type attemptLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	attempts map[string]attemptWindow
+	now      func() time.Time
+}
+
+type attemptWindow struct {
+	start time.Time
+	count int
+}
+
+func newAttemptLimiter(limit int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		limit:    limit,
+		window:   window,
+		attempts: make(map[string]attemptWindow),
+		now:      time.Now,
+	}
+}
+
+// Allow は試行を1回数え、上限を超えた場合は false と再試行までの時間を返す。
+func (l *attemptLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	for k, w := range l.attempts {
+		if now.Sub(w.start) >= l.window {
+			delete(l.attempts, k)
+		}
+	}
+
+	w, ok := l.attempts[key]
+	if !ok {
+		w = attemptWindow{start: now}
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	l.attempts[key] = w
+	return true, 0
+}
+
+type recoverRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+}
+
+// Recover は回復コードでログインする。使ったコードは無効になり、
+// 新しいパスキーを登録するまで設定画面以外にはアクセスできない。
+func (h *PasskeyHandler) Recover(c echo.Context) error {
+	defer startHandlerSpan(c, "passkey.recover")()
+	var req recoverRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+	username := strings.TrimSpace(req.Username)
+	if username == "" || strings.TrimSpace(req.Code) == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "username and recovery code are required"})
+	}
+
+	for _, check := range []struct {
+		limiter *attemptLimiter
+		key     string
+	}{
+		{h.recoveryIPLimiter, c.RealIP()},
+		{h.recoveryUserLimiter, strings.ToLower(username)},
+	} {
+		if ok, retryAfter := check.limiter.Allow(check.key); !ok {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+			return c.JSON(http.StatusTooManyRequests, map[string]string{"error": "too many recovery attempts, try again later"})
+		}
+	}
+
+	ctx := c.Request().Context()
+	user, err := h.userRepo.GetByName(ctx, username)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid username or recovery code"})
+	}
+	if err := h.userRepo.UseRecoveryCode(ctx, user.ID, hashRecoveryCode(req.Code)); err != nil {
+		if !errors.Is(err, domain.ErrRecoveryCodeInvalid) {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to verify recovery code"})
+		}
+		h.audit(ctx, domain.AuditEvent{Action: "account.recovery_failed", ActorID: user.ID, Target: user.ID})
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "invalid username or recovery code"})
+	}
+
+	h.audit(ctx, domain.AuditEvent{
+		Action:  "account.recovered",
+		ActorID: user.ID,
+		Target:  user.ID,
+		Detail:  map[string]string{"remaining_codes": strconv.Itoa(user.RemainingRecoveryCodes() - 1)},
+	})
+
+	userData := authUserData(user)
+	userData["recovery"] = true
+	setAuthCookieValue(c, userData)
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok", "redirect": "/settings"})
+}
+
+// RecoveryCodeStatus は未使用の回復コードの数を返す。
+func (h *PasskeyHandler) RecoveryCodeStatus(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	return c.JSON(http.StatusOK, map[string]int{"remaining": user.RemainingRecoveryCodes()})
+}
+
+// RegenerateRecoveryCodes は回復コードを作り直す。以前のコードは使えなくなる。
+func (h *PasskeyHandler) RegenerateRecoveryCodes(c echo.Context) error {
+	user, err := currentUser(c, h.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to generate recovery codes"})
+	}
+	ctx := c.Request().Context()
+	if err := h.userRepo.SetRecoveryCodes(ctx, user.ID, hashed); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save recovery codes"})
+	}
+	h.audit(ctx, domain.AuditEvent{Action: "account.recovery_codes_regenerated", ActorID: user.ID, Target: user.ID})
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": plain})
+}
+
+// isRecoverySession は回復コードでログインし、まだ新しいパスキーを登録していないセッションかを返す。
+func isRecoverySession(userData map[string]any) bool {
+	recovery, _ := userData["recovery"].(bool)
+	return recovery
+}
+
+// allowedDuringRecovery は回復セッションでアクセスできるパスかを返す。
+// 新しいパスキーを登録するまでは、パスキーの削除や回復コードの再発行もできない。
+func allowedDuringRecovery(path string) bool {
+	switch path {
+	case "/settings", "/passkey/register", "/passkey/register/finish":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func TestHashRecoveryCode_IgnoresFormatting(t *testing.T) {
+	want := hashRecoveryCode("abcd-efgh-ijkl-mnop")
+	for _, input := range []string{"ABCD-EFGH-IJKL-MNOP", "abcdefghijklmnop", " abcd efgh ijkl mnop "} {
+		if !bytes.Equal(hashRecoveryCode(input), want) {
+			t.Errorf("hash of %q should match", input)
+		}
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatalf("newRecoveryCodes failed: %v", err)
+	}
+	if len(plain) != recoveryCodeCount || len(hashed) != recoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d/%d", recoveryCodeCount, len(plain), len(hashed))
+	}
+	seen := make(map[string]bool)
+	for i, code := range plain {
+		if seen[code] {
+			t.Errorf("duplicate code %s", code)
+		}
+		seen[code] = true
+		if len(code) != 19 || strings.Count(code, "-") != 3 {
+			t.Errorf("unexpected code format: %s", code)
+		}
+		if !bytes.Equal(hashed[i].Hash, hashRecoveryCode(code)) {
+			t.Errorf("hash mismatch for code %d", i)
+		}
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newAttemptLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("alice"); !ok {
+			t.Fatalf("attempt %d should be allowed", i+1)
+		}
+	}
+	ok, retryAfter := l.Allow("alice")
+	if ok {
+		t.Fatal("third attempt should be limited")
+	}
+	if retryAfter != time.Minute {
+		t.Errorf("expected retry after 1m, got %s", retryAfter)
+	}
+	if ok, _ := l.Allow("bob"); !ok {
+		t.Error("other keys should not be limited")
+	}
+
+	now = now.Add(time.Minute)
+	if ok, _ := l.Allow("alice"); !ok {
+		t.Error("limit should reset after the window")
+	}
+}
+
+func newRecoveryTestHandler(t *testing.T) (*PasskeyHandler, *mockUserRepo, []string) {
+	t.Helper()
+	plain, hashed, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	userRepo := newMockUserRepo()
+	userRepo.users["u1"] = domain.User{
+		ID:            "u1",
+		WebAuthnIDB:   []byte(strings.Repeat("u1", 32)),
+		Name:          "alice",
+		DisplayName:   "Alice",
+		RecoveryCodes: hashed,
+	}
+	return NewPasskeyHandler(nil, userRepo, newMockSessionRepo()), userRepo, plain
+}
+
+func recoverWithCode(t *testing.T, h *PasskeyHandler, username, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	body, _ := json.Marshal(recoverRequest{Username: username, Code: code})
+	req := httptest.NewRequest(http.MethodPost, "/passkey/recover", bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	if err := h.Recover(echo.New().NewContext(req, rec)); err != nil {
+		t.Fatalf("Recover failed: %v", err)
+	}
+	return rec
+}
+
+func TestRecover(t *testing.T) {
+	h, userRepo, codes := newRecoveryTestHandler(t)
+
+	rec := recoverWithCode(t, h, "alice", strings.ToUpper(codes[0]))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var userData map[string]any
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "auth" {
+			var err error
+			if userData, err = parseAuthCookieValue(cookie.Value); err != nil {
+				t.Fatalf("failed to parse auth cookie: %v", err)
+			}
+		}
+	}
+	if userData["id"] != "u1" {
+		t.Errorf("expected auth cookie for u1, got %v", userData)
+	}
+	if !isRecoverySession(userData) {
+		t.Error("expected a recovery session")
+	}
+	if n := userRepo.users["u1"].RemainingRecoveryCodes(); n != recoveryCodeCount-1 {
+		t.Errorf("expected %d remaining codes, got %d", recoveryCodeCount-1, n)
+	}
+
+	if rec := recoverWithCode(t, h, "alice", codes[0]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reusing a code: expected status 401, got %d", rec.Code)
+	}
+}
+
+func TestRecover_InvalidCredentials(t *testing.T) {
+	h, _, codes := newRecoveryTestHandler(t)
+
+	tests := []struct {
+		name, username, code string
+		wantStatus           int
+	}{
+		{name: "wrong code", username: "alice", code: "aaaa-bbbb-cccc-dddd", wantStatus: http.StatusUnauthorized},
+		{name: "unknown user", username: "mallory", code: codes[0], wantStatus: http.StatusUnauthorized},
+		{name: "missing code", username: "alice", code: "", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := recoverWithCode(t, h, tt.username, tt.code)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if hasAuthCookie(rec) {
+				t.Error("auth cookie must not be set")
+			}
+		})
+	}
+}
+
+func TestRecover_RateLimited(t *testing.T) {
+	h, userRepo, codes := newRecoveryTestHandler(t)
+
+	for i := 0; i < recoveryAttemptsPerUser; i++ {
+		if rec := recoverWithCode(t, h, "alice", "aaaa-bbbb-cccc-dddd"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status 401, got %d", i+1, rec.Code)
+		}
+	}
+
+	rec := recoverWithCode(t, h, "Alice", codes[0])
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+	if n := userRepo.users["u1"].RemainingRecoveryCodes(); n != recoveryCodeCount {
+		t.Error("a rate-limited attempt must not consume a code")
+	}
+}
+
+func TestAuthMiddleware_RecoverySession(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{method: http.MethodGet, path: "/", want: http.StatusTemporaryRedirect},
+		{method: http.MethodGet, path: "/upload", want: http.StatusTemporaryRedirect},
+		{method: http.MethodGet, path: "/settings", want: http.StatusOK},
+		{method: http.MethodPost, path: "/passkey/register", want: http.StatusOK},
+		{method: http.MethodPost, path: "/passkey/register/finish", want: http.StatusOK},
+		{method: http.MethodGet, path: "/passkey/credentials", want: http.StatusTemporaryRedirect},
+		// 新しいパスキーを登録する前に既存のパスキーや回復コードを変更させない
+		{method: http.MethodDelete, path: "/passkey/credentials/:id", want: http.StatusForbidden},
+		{method: http.MethodPatch, path: "/passkey/credentials/:id", want: http.StatusForbidden},
+		{method: http.MethodDelete, path: "/passkey/credentials/:id/clone-warning", want: http.StatusForbidden},
+		{method: http.MethodPost, path: "/passkey/recovery-codes", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			e := echo.New()
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			req.AddCookie(&http.Cookie{
+				Name:  "auth",
+				Value: makeAuthCookieValue(map[string]any{"id": "u1", "name": "Alice", "recovery": true}),
+			})
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetPath(tt.path)
+
+			called := false
+			handler := AuthMiddleware(nil)(func(c echo.Context) error {
+				called = true
+				return c.String(http.StatusOK, "ok")
+			})
+			if err := handler(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if rec.Code != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, rec.Code)
+			}
+			if tt.want == http.StatusTemporaryRedirect && rec.Header().Get("Location") != "/settings" {
+				t.Errorf("expected redirect to /settings, got %q", rec.Header().Get("Location"))
+			}
+			if called != (tt.want == http.StatusOK) {
+				t.Errorf("expected handler called=%v", tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestFinishRegistration_IssuesRecoveryCodes(t *testing.T) {
+	h, userRepo, _ := newRegistrationTestHandler(t, nil)
+
+	rec := registerWithAuthenticator(t, h, "none", uuid.Nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodeCount, len(resp.RecoveryCodes))
+	}
+
+	var user domain.User
+	for _, u := range userRepo.users {
+		user = u
+	}
+	if len(user.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d stored codes, got %d", recoveryCodeCount, len(user.RecoveryCodes))
+	}
+	for i, code := range resp.RecoveryCodes {
+		if bytes.Contains(user.RecoveryCodes[i].Hash, []byte(code)) || !bytes.Equal(user.RecoveryCodes[i].Hash, hashRecoveryCode(code)) {
+			t.Errorf("code %d must be stored only as its hash", i)
+		}
+	}
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	h, userRepo, oldCodes := newRecoveryTestHandler(t)
+	c, rec := newSignedInContext(http.MethodPost, "/passkey/recovery-codes", "", "u1")
+
+	if err := h.RegenerateRecoveryCodes(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	var resp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(resp.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", recoveryCodeCount, len(resp.RecoveryCodes))
+	}
+
+	if rec := recoverWithCode(t, h, "alice", oldCodes[0]); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old code should be invalid, got status %d", rec.Code)
+	}
+	if rec := recoverWithCode(t, h, "alice", resp.RecoveryCodes[0]); rec.Code != http.StatusOK {
+		t.Errorf("new code should work, got status %d", rec.Code)
+	}
+	if n := userRepo.users["u1"].RemainingRecoveryCodes(); n != recoveryCodeCount-1 {
+		t.Errorf("expected %d remaining codes, got %d", recoveryCodeCount-1, n)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// maxReportReasonLength は通報理由の最大文字数。
+const maxReportReasonLength = 1000
+
+// reportResolutions は通報を処理するときに選べる操作。dismiss 以外は対応するモデレーション操作を行う。
+var reportResolutions = map[string]domain.SanctionKind{
+	"dismiss": "",
+	"delete":  "",
+	"kick":    domain.SanctionKick,
+	"mute":    domain.SanctionMute,
+	"ban":     domain.SanctionBan,
+}
+
+// ReportQueue はメッセージやユーザーの通報を受け付け、モデレーターの処理キューとして提供する。
+type ReportQueue struct {
+	reports    domain.ReportRepository
+	moderation *Moderation
+	auditLog   domain.AuditLog
+	now        func() time.Time
+}
+
+// NewReportQueue は ReportQueue を生成する。キック等の処理には moderation を使う。
+func NewReportQueue(rr domain.ReportRepository, moderation *Moderation) *ReportQueue {
+	return &ReportQueue{
+		reports:    rr,
+		moderation: moderation,
+		now:        time.Now,
+	}
+}
+
+type reportRequest struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Reason    string `json:"reason"`
+}
+
+type resolveReportRequest struct {
+	Action   string `json:"action"`
+	Note     string `json:"note"`
+	Duration string `json:"duration"`
+}
+
+type messageSnapshotResponse struct {
+	ID     string    `json:"id"`
+	UserID string    `json:"user_id"`
+	Name   string    `json:"name"`
+	Text   string    `json:"text"`
+	When   time.Time `json:"when"`
+}
+
+type reportResponse struct {
+	ID           string                   `json:"id"`
+	RoomID       string                   `json:"room_id"`
+	ReporterID   string                   `json:"reporter_id"`
+	TargetUserID string                   `json:"target_user_id"`
+	Reason       string                   `json:"reason"`
+	Message      *messageSnapshotResponse `json:"message,omitempty"`
+	Status       string                   `json:"status"`
+	CreatedAt    time.Time                `json:"created_at"`
+	ResolvedBy   string                   `json:"resolved_by,omitempty"`
+	ResolvedAt   *time.Time               `json:"resolved_at,omitempty"`
+	Resolution   string                   `json:"resolution,omitempty"`
+	Note         string                   `json:"note,omitempty"`
+}
+
+func newReportResponse(r domain.Report) reportResponse {
+	resp := reportResponse{
+		ID:           r.ID,
+		RoomID:       r.RoomID,
+		ReporterID:   r.ReporterID,
+		TargetUserID: r.TargetUserID,
+		Reason:       r.Reason,
+		Status:       string(r.Status),
+		CreatedAt:    r.CreatedAt,
+		ResolvedBy:   r.ResolvedBy,
+		Resolution:   r.Resolution,
+		Note:         r.Note,
+	}
+	if r.Message != nil {
+		resp.Message = &messageSnapshotResponse{
+			ID:     r.Message.ID,
+			UserID: r.Message.UserID,
+			Name:   r.Message.Name,
+			Text:   r.Message.Text,
+			When:   r.Message.When,
+		}
+	}
+	if !r.ResolvedAt.IsZero() {
+		resolvedAt := r.ResolvedAt
+		resp.ResolvedAt = &resolvedAt
+	}
+	return resp
+}
+
+// Create はメッセージまたはユーザーを通報する。
+// message_id を指定した場合は、サーバーが保持しているメッセージの内容をスナップショットとして保存する。
+func (q *ReportQueue) Create(c echo.Context) error {
+	reporter, err := currentUser(c, q.moderation.access.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	var req reportRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" || utf8.RuneCountInString(reason) > maxReportReasonLength {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("reason is required and must be at most %d characters", maxReportReasonLength)})
+	}
+
+	ctx := c.Request().Context()
+	roomID := c.Param("room")
+	r, ok := q.moderation.rooms.get(roomID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": errRoomNotFound.Error()})
+	}
+
+	report := domain.Report{
+		ID:         generateUUID(),
+		RoomID:     roomID,
+		ReporterID: reporter.ID,
+		Reason:     reason,
+		Status:     domain.ReportOpen,
+		CreatedAt:  q.now(),
+	}
+	switch {
+	case req.MessageID != "":
+		msg, ok := r.history.get(req.MessageID)
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "message not found"})
+		}
+		report.TargetUserID = msg.UserID
+		report.Message = &domain.MessageSnapshot{ID: msg.ID, UserID: msg.UserID, Name: msg.Name, Text: msg.Message, When: msg.When}
+	case req.UserID != "":
+		target, err := q.moderation.access.userRepo.GetByID(ctx, req.UserID)
+		if err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+		report.TargetUserID = target.ID
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "message_id or user_id is required"})
+	}
+	if report.TargetUserID == reporter.ID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "cannot report yourself"})
+	}
+
+	if err := q.reports.Create(ctx, report); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to save report"})
+	}
+	q.audit(ctx, domain.AuditEvent{
+		Action:  "report.created",
+		ActorID: reporter.ID,
+		Target:  report.TargetUserID,
+		Detail:  map[string]string{"report_id": report.ID, "room": roomID, "reason": reason},
+	})
+	r.sendToModerators(newSystemMessage(
+		fmt.Sprintf("New report in #%s: %s", roomID, reason),
+		systemEvent{Action: "report_created", Reason: reason, ReportID: report.ID, MessageID: req.MessageID},
+	))
+	return c.JSON(http.StatusCreated, newReportResponse(report))
+}
+
+// List はルームの通報を返す。?status=open または resolved で絞り込める。
+func (q *ReportQueue) List(c echo.Context) error {
+	status := domain.ReportStatus(c.QueryParam("status"))
+	switch status {
+	case "", domain.ReportOpen, domain.ReportResolved:
+	default:
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "status must be open or resolved"})
+	}
+	reports, err := q.reports.List(c.Request().Context(), c.Param("room"), status)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to list reports"})
+	}
+	resp := make([]reportResponse, 0, len(reports))
+	for _, r := range reports {
+		resp = append(resp, newReportResponse(r))
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Resolve は通報を処理済みにし、action に応じてメッセージの削除やキック・ミュート・BAN を行う。
+// モデレーション操作の理由には note を、空の場合は通報理由を使う。
+func (q *ReportQueue) Resolve(c echo.Context) error {
+	actor, err := currentUser(c, q.moderation.access.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	var req resolveReportRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+	}
+	kind, ok := reportResolutions[req.Action]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "action must be dismiss, delete, kick, mute or ban"})
+	}
+	duration, err := parseSanctionDuration(req.Duration)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "invalid duration"})
+	}
+
+	ctx := c.Request().Context()
+	roomID := c.Param("room")
+	report, err := q.reports.Get(ctx, c.Param("id"))
+	if err != nil || report.RoomID != roomID {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "report not found"})
+	}
+	if report.Status == domain.ReportResolved {
+		return c.JSON(http.StatusConflict, map[string]string{"error": domain.ErrReportResolved.Error()})
+	}
+	note := strings.TrimSpace(req.Note)
+	reason := note
+	if reason == "" {
+		reason = report.Reason
+	}
+
+	// 処理の対象を先に確かめ、通報を確保する前に返せる誤りは返す
+	var r *room
+	var target domain.User
+	switch {
+	case req.Action == "delete":
+		if report.Message == nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "report has no message to delete"})
+		}
+		if r, ok = q.moderation.rooms.get(roomID); !ok {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": errRoomNotFound.Error()})
+		}
+	case kind != "":
+		if target, err = q.moderation.access.userRepo.GetByID(ctx, report.TargetUserID); err != nil {
+			return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+		}
+	}
+
+	// 処理済みへの更新で通報を確保してから適用し、同時に処理した他のモデレーターと二重に制裁しない
+	report, err = q.reports.Resolve(ctx, report.ID, actor.ID, req.Action, note, q.now())
+	switch {
+	case errors.Is(err, domain.ErrReportResolved):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to resolve report"})
+	}
+	switch {
+	case req.Action == "delete":
+		r.deleteMessage(report.Message.ID)
+	case kind != "":
+		if _, err := q.moderation.Issue(ctx, actor, target, kind, roomID, reason, duration); err != nil {
+			// 適用できなかった通報は他のモデレーターが処理できるよう未処理に戻す
+			if rerr := q.reports.Reopen(ctx, report.ID); rerr != nil {
+				log.Printf("failed to reopen report %s: %v", report.ID, rerr)
+			}
+			return sanctionError(c, err)
+		}
+	}
+	q.audit(ctx, domain.AuditEvent{
+		Action:  "report.resolved",
+		ActorID: actor.ID,
+		Target:  report.TargetUserID,
+		Detail:  map[string]string{"report_id": report.ID, "room": roomID, "resolution": req.Action},
+	})
+	return c.JSON(http.StatusOK, newReportResponse(report))
+}
+
+func (q *ReportQueue) audit(ctx context.Context, event domain.AuditEvent) {
+	recordAudit(ctx, q.auditLog, event)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+)
+
+func newReportTestQueue(t *testing.T) (*ReportQueue, *room, *memory.AuditStore) {
+	t.Helper()
+	m, r, auditLog := newModerationTest(t,
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "alice"},
+		domain.User{ID: "bob"},
+	)
+	q := NewReportQueue(memory.NewReportStore(), m)
+	q.auditLog = auditLog
+	r.history.add(&message{ID: "m1", UserID: "bob", Name: "bob", Message: "rude words", When: time.Now()})
+	return q, r, auditLog
+}
+
+func createTestReport(t *testing.T, q *ReportQueue, reporter, body string) reportResponse {
+	t.Helper()
+	c, rec := newSignedInContext(http.MethodPost, "/rooms/general/reports", body, reporter)
+	c.SetParamNames("room")
+	c.SetParamValues(defaultRoomID)
+	if err := q.Create(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp reportResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func resolveTestReport(t *testing.T, q *ReportQueue, id, body string) int {
+	t.Helper()
+	c, rec := newSignedInContext(http.MethodPost, "/rooms/general/reports/"+id+"/resolve", body, "mod")
+	c.SetParamNames("room", "id")
+	c.SetParamValues(defaultRoomID, id)
+	if err := q.Resolve(c); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code
+}
+
+func TestReportQueue_CreateMessageReport(t *testing.T) {
+	q, r, auditLog := newReportTestQueue(t)
+	mod := joinTestClient(r, "mod")
+	member := joinTestClient(r, "alice")
+
+	resp := createTestReport(t, q, "alice", `{"message_id":"m1","reason":"harassment"}`)
+	if resp.TargetUserID != "bob" || resp.Status != "open" || resp.Message == nil || resp.Message.Text != "rude words" {
+		t.Errorf("unexpected report: %+v", resp)
+	}
+
+	msg, ok := receive(t, mod)
+	if !ok || msg.System == nil || msg.System.Action != "report_created" || msg.System.ReportID != resp.ID {
+		t.Errorf("moderator should be notified: %+v", msg)
+	}
+	if pending(member) != 0 {
+		t.Error("members must not be notified of reports")
+	}
+
+	events, _ := auditLog.List(context.Background())
+	if len(events) != 1 || events[0].Action != "report.created" || events[0].ActorID != "alice" {
+		t.Errorf("unexpected audit events: %+v", events)
+	}
+}
+
+func TestReportQueue_CreateInvalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		reporter   string
+		body       string
+		wantStatus int
+	}{
+		{name: "missing reason", reporter: "alice", body: `{"user_id":"bob"}`, wantStatus: http.StatusBadRequest},
+		{name: "missing target", reporter: "alice", body: `{"reason":"spam"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown message", reporter: "alice", body: `{"message_id":"m2","reason":"spam"}`, wantStatus: http.StatusNotFound},
+		{name: "unknown user", reporter: "alice", body: `{"user_id":"ghost","reason":"spam"}`, wantStatus: http.StatusNotFound},
+		{name: "own message", reporter: "bob", body: `{"message_id":"m1","reason":"spam"}`, wantStatus: http.StatusBadRequest},
+		{name: "user report", reporter: "alice", body: `{"user_id":"bob","reason":"spam"}`, wantStatus: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, _, _ := newReportTestQueue(t)
+			c, rec := newSignedInContext(http.MethodPost, "/rooms/general/reports", tt.body, tt.reporter)
+			c.SetParamNames("room")
+			c.SetParamValues(defaultRoomID)
+			if err := q.Create(c); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tt.wantStatus, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestReportQueue_ResolveDelete(t *testing.T) {
+	q, r, _ := newReportTestQueue(t)
+	report := createTestReport(t, q, "alice", `{"message_id":"m1","reason":"harassment"}`)
+	viewer := joinTestClient(r, "alice")
+
+	if code := resolveTestReport(t, q, report.ID, `{"action":"delete","note":"removed"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	msg, ok := receive(t, viewer)
+	if !ok || msg.System == nil || msg.System.Action != "message_deleted" || msg.System.MessageID != "m1" {
+		t.Errorf("participants should be told to remove the message: %+v", msg)
+	}
+	if _, ok := r.history.get("m1"); ok {
+		t.Error("message should be removed from history")
+	}
+	if code := resolveTestReport(t, q, report.ID, `{"action":"dismiss"}`); code != http.StatusConflict {
+		t.Errorf("resolving twice should conflict, got %d", code)
+	}
+
+	got, _ := q.reports.Get(context.Background(), report.ID)
+	if got.Status != domain.ReportResolved || got.Resolution != "delete" || got.ResolvedBy != "mod" || got.Note != "removed" {
+		t.Errorf("unexpected resolved report: %+v", got)
+	}
+}
+
+func TestReportQueue_ResolveMute(t *testing.T) {
+	q, r, auditLog := newReportTestQueue(t)
+	report := createTestReport(t, q, "alice", `{"user_id":"bob","reason":"flooding"}`)
+
+	if code := resolveTestReport(t, q, report.ID, `{"action":"mute","duration":"soon"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid duration should be rejected, got %d", code)
+	}
+	if code := resolveTestReport(t, q, report.ID, `{"action":"delete"}`); code != http.StatusBadRequest {
+		t.Errorf("user reports have no message to delete, got %d", code)
+	}
+	if code := resolveTestReport(t, q, report.ID, `{"action":"mute","duration":"10m"}`); code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", code)
+	}
+	s, muted := r.moderation.active(context.Background(), "bob", defaultRoomID, domain.SanctionMute)
+	if !muted || s.Reason != "flooding" {
+		t.Errorf("bob should be muted with the report reason, got %+v, %v", s, muted)
+	}
+
+	events, _ := auditLog.List(context.Background())
+	var actions []string
+	for _, e := range events {
+		actions = append(actions, e.Action)
+	}
+	if len(actions) != 3 || actions[1] != "moderation.mute" || actions[2] != "report.resolved" {
+		t.Errorf("unexpected audit actions: %v", actions)
+	}
+}
+
+// barrierReports は 2 件の Get が揃うまでどちらも返さず、二人のモデレーターが同じ通報を同時に開いた状況を作る。
+type barrierReports struct {
+	domain.ReportRepository
+	arrived sync.WaitGroup
+}
+
+func (b *barrierReports) Get(ctx context.Context, id string) (domain.Report, error) {
+	report, err := b.ReportRepository.Get(ctx, id)
+	b.arrived.Done()
+	b.arrived.Wait()
+	return report, err
+}
+
+func TestReportQueue_ResolveConcurrently(t *testing.T) {
+	q, _, auditLog := newReportTestQueue(t)
+	report := createTestReport(t, q, "alice", `{"user_id":"bob","reason":"flooding"}`)
+	barrier := &barrierReports{ReportRepository: q.reports}
+	barrier.arrived.Add(2)
+	q.reports = barrier
+
+	codes := make(chan int, 2)
+	var wg sync.WaitGroup
+	for _, body := range []string{`{"action":"mute","duration":"10m"}`, `{"action":"kick"}`} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- resolveTestReport(t, q, report.ID, body)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	got := map[int]int{}
+	for code := range codes {
+		got[code]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusConflict] != 1 {
+		t.Errorf("expected one 200 and one 409, got %v", got)
+	}
+
+	events, _ := auditLog.List(context.Background())
+	sanctions := 0
+	for _, e := range events {
+		if strings.HasPrefix(e.Action, "moderation.") {
+			sanctions++
+		}
+	}
+	if sanctions != 1 {
+		t.Errorf("expected bob to be sanctioned once, got %d", sanctions)
+	}
+}
+
+func TestReportQueue_ResolveFailureReopens(t *testing.T) {
+	q, _, _ := newReportTestQueue(t)
+	report := createTestReport(t, q, "alice", `{"user_id":"mod","reason":"abuse"}`)
+
+	// モデレーターは自分を制裁できない
+	if code := resolveTestReport(t, q, report.ID, `{"action":"ban"}`); code == http.StatusOK {
+		t.Fatal("expected the ban to fail")
+	}
+	got, err := q.reports.Get(context.Background(), report.ID)
+	if err != nil || got.Status != domain.ReportOpen || got.ResolvedBy != "" {
+		t.Fatalf("expected the report to stay open, got %+v, %v", got, err)
+	}
+	if code := resolveTestReport(t, q, report.ID, `{"action":"dismiss"}`); code != http.StatusOK {
+		t.Errorf("expected the reopened report to be resolvable, got %d", code)
+	}
+}
+
+func TestReportQueue_List(t *testing.T) {
+	q, _, _ := newReportTestQueue(t)
+	first := createTestReport(t, q, "alice", `{"user_id":"bob","reason":"one"}`)
+	createTestReport(t, q, "alice", `{"user_id":"bob","reason":"two"}`)
+	resolveTestReport(t, q, first.ID, `{"action":"dismiss"}`)
+
+	for _, tt := range []struct {
+		status     string
+		wantStatus int
+		wantCount  int
+	}{
+		{status: "open", wantStatus: http.StatusOK, wantCount: 1},
+		{status: "resolved", wantStatus: http.StatusOK, wantCount: 1},
+		{status: "", wantStatus: http.StatusOK, wantCount: 2},
+		{status: "closed", wantStatus: http.StatusBadRequest},
+	} {
+		c, rec := newSignedInContext(http.MethodGet, "/rooms/general/reports?status="+tt.status, "", "mod")
+		c.SetParamNames("room")
+		c.SetParamValues(defaultRoomID)
+		if err := q.List(c); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%q: expected status %d, got %d", tt.status, tt.wantStatus, rec.Code)
+			continue
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+		var reports []reportResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &reports); err != nil {
+			t.Fatal(err)
+		}
+		if len(reports) != tt.wantCount {
+			t.Errorf("%q: want %d reports, got %d", tt.status, tt.wantCount, len(reports))
+		}
+	}
+}
+
+func TestMessageHistory(t *testing.T) {
+	h := newMessageHistory(2)
+	for _, id := range []string{"m1", "m2", "m3"} {
+		h.add(&message{ID: id})
+	}
+	if _, ok := h.get("m1"); ok {
+		t.Error("oldest message should be evicted")
+	}
+	if _, ok := h.get("m3"); !ok {
+		t.Error("newest message should be kept")
+	}
+	if !h.remove("m2") || h.remove("m2") {
+		t.Error("remove should report whether the message existed")
+	}
+}
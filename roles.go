@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// defaultRoomID は唯一のチャットルームの ID。ルームごとのロールの上書きに使う。
+const defaultRoomID = "general"
+
+// AccessControl はロールに基づく認可とロールの管理を行う。
+type AccessControl struct {
+	userRepo  domain.UserRepository
+	roomRoles domain.RoomRoleRepository
+	auditLog  domain.AuditLog
+	// bootstrapAdmin が設定されている場合は、OAuth の IdP が確認したこのメールアドレスのユーザーを
+	// 登録時に管理者にする。ユーザー名は登録する人が自由に選べるため照合しない。
+	// 未設定の場合は管理者がいない状態で最初に登録したユーザーを管理者にする。
+	bootstrapAdmin string
+}
+
+// NewAccessControl は AccessControl を生成する。
+func NewAccessControl(ur domain.UserRepository, rr domain.RoomRoleRepository) *AccessControl {
+	return &AccessControl{userRepo: ur, roomRoles: rr}
+}
+
+// RoleIn はルームでのユーザーのロールを返す。roomID が空の場合はサイト全体のロールを返す。
+// 管理者はルームの上書きの対象にならない。
+func (a *AccessControl) RoleIn(ctx context.Context, user domain.User, roomID string) (domain.Role, error) {
+	role := user.Role.OrDefault()
+	if roomID == "" || role == domain.RoleAdmin {
+		return role, nil
+	}
+	override, err := a.roomRoles.GetRoomRole(ctx, roomID, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if override != "" {
+		return override, nil
+	}
+	return role, nil
+}
+
+// Authorize はユーザーがルームで権限を持たない場合に domain.ErrPermissionDenied を返す。
+func (a *AccessControl) Authorize(ctx context.Context, userID, roomID string, perm domain.Permission) error {
+	user, err := a.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	role, err := a.RoleIn(ctx, user, roomID)
+	if err != nil {
+		return err
+	}
+	if !role.Can(perm) {
+		return domain.ErrPermissionDenied
+	}
+	return nil
+}
+
+// Require は権限を持つユーザーだけを通すミドルウェア。AuthMiddleware の後に使う。
+// パスに :room がある場合はそのルームでのロールで判定する。
+func (a *AccessControl) Require(perm domain.Permission) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, err := currentUser(c, a.userRepo)
+			if err != nil {
+				return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			}
+			role, err := a.RoleIn(c.Request().Context(), user, c.Param("room"))
+			if err != nil {
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to resolve role"})
+			}
+			if !role.Can(perm) {
+				return c.JSON(http.StatusForbidden, map[string]string{"error": "permission denied"})
+			}
+			return next(c)
+		}
+	}
+}
+
+// Bootstrap は登録直後のユーザーを必要に応じて管理者にする。
+// verifiedEmail は IdP が確認済みのメールアドレス。パスキーで登録したユーザーなど、確認していない場合は空にする。
+func (a *AccessControl) Bootstrap(ctx context.Context, user domain.User, verifiedEmail string) error {
+	if a.bootstrapAdmin != "" {
+		if verifiedEmail == "" || !strings.EqualFold(verifiedEmail, a.bootstrapAdmin) {
+			return nil
+		}
+		if err := a.userRepo.SetRole(ctx, user.ID, domain.RoleAdmin); err != nil {
+			return err
+		}
+	} else {
+		promoted, err := a.userRepo.PromoteIfNoAdmin(ctx, user.ID)
+		if err != nil || !promoted {
+			return err
+		}
+	}
+	a.audit(ctx, domain.AuditEvent{
+		Action:  "role.bootstrap",
+		ActorID: user.ID,
+		Target:  user.ID,
+		Detail:  map[string]string{"role": string(domain.RoleAdmin)},
+	})
+	return nil
+}
+
+type roleRequest struct {
+	Role string `json:"role"`
+}
+
+// SetUserRole はユーザーのサイト全体のロールを変更する。
+// 管理者が自分自身を降格して管理者不在になるのを防ぐため、自分のロールは変更できない。
+func (a *AccessControl) SetUserRole(c echo.Context) error {
+	actor, err := currentUser(c, a.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	role, ok := bindRole(c)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be admin, moderator, member or guest"})
+	}
+	ctx := c.Request().Context()
+	target, err := a.userRepo.GetByID(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	if target.ID == actor.ID {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "cannot change your own role"})
+	}
+	if err := a.userRepo.SetRole(ctx, target.ID, role); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update role"})
+	}
+	a.audit(ctx, domain.AuditEvent{
+		Action:  "role.changed",
+		ActorID: actor.ID,
+		Target:  target.ID,
+		Detail:  map[string]string{"role": string(role), "previous": string(target.Role.OrDefault())},
+	})
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok", "role": string(role)})
+}
+
+// SetRoomRole はルームでのユーザーのロールを上書きする。管理者はルーム単位では付与できない。
+func (a *AccessControl) SetRoomRole(c echo.Context) error {
+	actor, err := currentUser(c, a.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	role, ok := bindRole(c)
+	if !ok || role == domain.RoleAdmin {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "role must be moderator, member or guest"})
+	}
+	ctx := c.Request().Context()
+	target, err := a.userRepo.GetByID(ctx, c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "user not found"})
+	}
+	roomID := c.Param("room")
+	if err := a.roomRoles.SetRoomRole(ctx, roomID, target.ID, role); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to update room role"})
+	}
+	a.audit(ctx, domain.AuditEvent{
+		Action:  "room_role.changed",
+		ActorID: actor.ID,
+		Target:  target.ID,
+		Detail:  map[string]string{"room": roomID, "role": string(role)},
+	})
+	return c.JSON(http.StatusOK, map[string]string{"status": "ok", "role": string(role)})
+}
+
+// DeleteRoomRole はルームでのロールの上書きを解除する。
+func (a *AccessControl) DeleteRoomRole(c echo.Context) error {
+	actor, err := currentUser(c, a.userRepo)
+	if err != nil {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+	}
+	ctx := c.Request().Context()
+	roomID, targetID := c.Param("room"), c.Param("id")
+	if err := a.roomRoles.DeleteRoomRole(ctx, roomID, targetID); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "failed to remove room role"})
+	}
+	a.audit(ctx, domain.AuditEvent{
+		Action:  "room_role.removed",
+		ActorID: actor.ID,
+		Target:  targetID,
+		Detail:  map[string]string{"room": roomID},
+	})
+	return c.NoContent(http.StatusNoContent)
+}
+
+func bindRole(c echo.Context) (domain.Role, bool) {
+	var req roleRequest
+	if err := c.Bind(&req); err != nil {
+		return "", false
+	}
+	role, err := domain.ParseRole(strings.TrimSpace(req.Role))
+	return role, err == nil
+}
+
+func (a *AccessControl) audit(ctx context.Context, event domain.AuditEvent) {
+	recordAudit(ctx, a.auditLog, event)
+}
+
+// bootstrapRole は新規ユーザーに Bootstrap を適用する。失敗してもユーザー作成は取り消さない。
+func bootstrapRole(ctx context.Context, access *AccessControl, user domain.User, verifiedEmail string) {
+	if access == nil {
+		return
+	}
+	if err := access.Bootstrap(ctx, user, verifiedEmail); err != nil {
+		log.Printf("failed to bootstrap role for user %s: %v", user.ID, err)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/dchf12/chat/infra/memory"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+func newAccessTestControl(users ...domain.User) (*AccessControl, *mockUserRepo, *memory.AuditStore) {
+	userRepo := newMockUserRepo()
+	for _, u := range users {
+		userRepo.users[u.ID] = u
+	}
+	auditLog := memory.NewAuditStore()
+	access := NewAccessControl(userRepo, memory.NewRoomRoleStore())
+	access.auditLog = auditLog
+	return access, userRepo, auditLog
+}
+
+func TestAccessControl_RoleIn(t *testing.T) {
+	ctx := context.Background()
+	access, _, _ := newAccessTestControl()
+	member := domain.User{ID: "u1"}
+	admin := domain.User{ID: "u2", Role: domain.RoleAdmin}
+	_ = access.roomRoles.SetRoomRole(ctx, defaultRoomID, "u1", domain.RoleGuest)
+	_ = access.roomRoles.SetRoomRole(ctx, defaultRoomID, "u2", domain.RoleGuest)
+
+	tests := []struct {
+		name   string
+		user   domain.User
+		roomID string
+		want   domain.Role
+	}{
+		{name: "global role defaults to member", user: member, roomID: "", want: domain.RoleMember},
+		{name: "room override applies", user: member, roomID: defaultRoomID, want: domain.RoleGuest},
+		{name: "override is scoped to the room", user: member, roomID: "other", want: domain.RoleMember},
+		{name: "admin is not overridden", user: admin, roomID: defaultRoomID, want: domain.RoleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := access.RoleIn(ctx, tt.user, tt.roomID)
+			if err != nil {
+				t.Fatalf("RoleIn failed: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAccessControl_Require(t *testing.T) {
+	access, _, _ := newAccessTestControl(
+		domain.User{ID: "member"},
+		domain.User{ID: "guest", Role: domain.RoleGuest},
+		domain.User{ID: "room-mod"},
+		domain.User{ID: "mod", Role: domain.RoleModerator},
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+	)
+	_ = access.roomRoles.SetRoomRole(context.Background(), defaultRoomID, "room-mod", domain.RoleModerator)
+
+	tests := []struct {
+		name       string
+		userID     string
+		perm       domain.Permission
+		room       string
+		wantStatus int
+	}{
+		{name: "member can upload", userID: "member", perm: domain.PermUploadAvatar, wantStatus: http.StatusOK},
+		{name: "guest cannot upload", userID: "guest", perm: domain.PermUploadAvatar, wantStatus: http.StatusForbidden},
+		{name: "member cannot manage roles", userID: "member", perm: domain.PermManageRoles, wantStatus: http.StatusForbidden},
+		{name: "room moderator can moderate the room", userID: "room-mod", perm: domain.PermModerate, room: defaultRoomID, wantStatus: http.StatusOK},
+		{name: "room moderator cannot moderate elsewhere", userID: "room-mod", perm: domain.PermModerate, room: "other", wantStatus: http.StatusForbidden},
+		{name: "moderator cannot ban globally", userID: "mod", perm: domain.PermGlobalBan, wantStatus: http.StatusForbidden},
+		{name: "admin can ban globally", userID: "admin", perm: domain.PermGlobalBan, wantStatus: http.StatusOK},
+		{name: "unknown user", userID: "ghost", perm: domain.PermUploadAvatar, wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newSignedInContext(http.MethodPost, "/", "", tt.userID)
+			if tt.room != "" {
+				c.SetParamNames("room")
+				c.SetParamValues(tt.room)
+			}
+			handler := access.Require(tt.perm)(func(c echo.Context) error {
+				return c.String(http.StatusOK, "ok")
+			})
+			if err := handler(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Errorf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAccessControl_Bootstrap_FirstUser(t *testing.T) {
+	ctx := context.Background()
+	access, userRepo, auditLog := newAccessTestControl(domain.User{ID: "u1"}, domain.User{ID: "u2"})
+
+	for _, id := range []string{"u1", "u2"} {
+		if err := access.Bootstrap(ctx, userRepo.users[id], ""); err != nil {
+			t.Fatalf("Bootstrap failed: %v", err)
+		}
+	}
+	if userRepo.users["u1"].Role != domain.RoleAdmin {
+		t.Error("first user should become admin")
+	}
+	if userRepo.users["u2"].Role == domain.RoleAdmin {
+		t.Error("second user must not become admin")
+	}
+	events, _ := auditLog.List(ctx)
+	if len(events) != 1 || events[0].Action != "role.bootstrap" || events[0].Target != "u1" {
+		t.Errorf("unexpected audit events: %+v", events)
+	}
+}
+
+func TestAccessControl_Bootstrap_ConfiguredAdmin(t *testing.T) {
+	ctx := context.Background()
+	access, userRepo, _ := newAccessTestControl(
+		// パスキーの登録ではユーザー名を自由に選べるため、管理者のメールアドレスと同じ名前でも昇格しない
+		domain.User{ID: "u1", Name: "owner@example.com"},
+		domain.User{ID: "u2", Name: "owner@example.com", Email: "owner@example.com"},
+		domain.User{ID: "u3", Name: "google:123", Email: "Owner@example.com"},
+	)
+	access.bootstrapAdmin = "owner@example.com"
+
+	tests := []struct {
+		id            string
+		verifiedEmail string
+		wantAdmin     bool
+	}{
+		{id: "u1", verifiedEmail: "", wantAdmin: false},
+		{id: "u2", verifiedEmail: "", wantAdmin: false},
+		{id: "u3", verifiedEmail: "Owner@example.com", wantAdmin: true},
+	}
+	for _, tt := range tests {
+		if err := access.Bootstrap(ctx, userRepo.users[tt.id], tt.verifiedEmail); err != nil {
+			t.Fatalf("Bootstrap failed: %v", err)
+		}
+		if got := userRepo.users[tt.id].Role == domain.RoleAdmin; got != tt.wantAdmin {
+			t.Errorf("%s: expected admin=%v, got role %q", tt.id, tt.wantAdmin, userRepo.users[tt.id].Role)
+		}
+	}
+}
+
+func TestFinishRegistration_BootstrapsAdmin(t *testing.T) {
+	h, userRepo, _ := newRegistrationTestHandler(t, nil)
+	h.access = NewAccessControl(userRepo, memory.NewRoomRoleStore())
+
+	if rec := registerWithAuthenticator(t, h, "none", uuid.Nil); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	user, err := userRepo.GetByName(context.Background(), "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != domain.RoleAdmin {
+		t.Errorf("first registered user should be admin, got %q", user.Role)
+	}
+}
+
+func TestSetUserRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+		wantRole   domain.Role
+	}{
+		{name: "promote to moderator", target: "u2", body: `{"role":"moderator"}`, wantStatus: http.StatusOK, wantRole: domain.RoleModerator},
+		{name: "unknown role", target: "u2", body: `{"role":"owner"}`, wantStatus: http.StatusBadRequest, wantRole: ""},
+		{name: "own role", target: "admin", body: `{"role":"member"}`, wantStatus: http.StatusBadRequest, wantRole: domain.RoleAdmin},
+		{name: "unknown user", target: "ghost", body: `{"role":"guest"}`, wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			access, userRepo, _ := newAccessTestControl(
+				domain.User{ID: "admin", Role: domain.RoleAdmin},
+				domain.User{ID: "u2"},
+			)
+			c, rec := newSignedInContext(http.MethodPut, "/admin/users/"+tt.target+"/role", tt.body, "admin")
+			c.SetParamNames("id")
+			c.SetParamValues(tt.target)
+
+			if err := access.SetUserRole(c); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, rec.Code)
+			}
+			if u, ok := userRepo.users[tt.target]; ok && u.Role != tt.wantRole {
+				t.Errorf("want role %q, got %q", tt.wantRole, u.Role)
+			}
+		})
+	}
+}
+
+func TestSetRoomRole(t *testing.T) {
+	ctx := context.Background()
+	access, _, auditLog := newAccessTestControl(
+		domain.User{ID: "admin", Role: domain.RoleAdmin},
+		domain.User{ID: "u2"},
+	)
+
+	for _, tt := range []struct {
+		body       string
+		wantStatus int
+	}{
+		{body: `{"role":"admin"}`, wantStatus: http.StatusBadRequest},
+		{body: `{"role":"moderator"}`, wantStatus: http.StatusOK},
+	} {
+		c, rec := newSignedInContext(http.MethodPut, "/rooms/general/roles/u2", tt.body, "admin")
+		c.SetParamNames("room", "id")
+		c.SetParamValues(defaultRoomID, "u2")
+		if err := access.SetRoomRole(c); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: expected status %d, got %d", tt.body, tt.wantStatus, rec.Code)
+		}
+	}
+
+	if got, _ := access.roomRoles.GetRoomRole(ctx, defaultRoomID, "u2"); got != domain.RoleModerator {
+		t.Errorf("want room moderator, got %q", got)
+	}
+	events, _ := auditLog.List(ctx)
+	if len(events) != 1 || events[0].Action != "room_role.changed" || events[0].Detail["room"] != defaultRoomID {
+		t.Errorf("unexpected audit events: %+v", events)
+	}
+
+	c, rec := newSignedInContext(http.MethodDelete, "/rooms/general/roles/u2", "", "admin")
+	c.SetParamNames("room", "id")
+	c.SetParamValues(defaultRoomID, "u2")
+	if err := access.DeleteRoomRole(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", rec.Code)
+	}
+	if got, _ := access.roomRoles.GetRoomRole(ctx, defaultRoomID, "u2"); got != "" {
+		t.Errorf("override should be removed, got %q", got)
+	}
+}
+
+func TestRoom_Authorize(t *testing.T) {
+	access, _, _ := newAccessTestControl(
+		domain.User{ID: "member"},
+		domain.User{ID: "guest", Role: domain.RoleGuest},
+	)
+	r := newRoom(UseAuthAvatar)
+	r.access = access
+
+	if err := r.authorize(&client{userData: map[string]any{"id": "member"}}, domain.PermSendMessage); err != nil {
+		t.Errorf("member should be able to send: %v", err)
+	}
+	err := r.authorize(&client{userData: map[string]any{"id": "guest"}}, domain.PermSendMessage)
+	if !errors.Is(err, domain.ErrPermissionDenied) {
+		t.Errorf("guest should not be able to send, got %v", err)
+	}
+}
@@ -1,102 +1,619 @@
 package main
 
 import (
+	"context"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/dchf12/chat/domain"
 	"github.com/dchf12/chat/trace"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	EnableCompression: true,
+	// クライアントが指定したもののうち、この順で最初に一致したものを使う
+	Subprotocols: []string{subprotocolJSON, subprotocolMsgpack},
 	CheckOrigin: func(r *http.Request) bool {
 		return isAllowedWebSocketOrigin(r)
 	},
 }
 
 type room struct {
+	id      string
 	forward chan *message
 	join    chan *client
 	leave   chan *client
+	direct  chan directedMessage
 	clients map[*client]struct{}
-	tracer  trace.Tracer
-	avatar  Avatar
-	done    chan struct{}
+	history *messageHistory
+	// seq は最後に配信したメッセージのシーケンス番号。room.run だけが更新する。
+	// 番号はサーバーごとに振るため、再接続の since は node と組にして扱う。
+	seq uint64
+	// tracer が nil の場合はトレースしない
+	tracer *trace.Tracer
+	avatar Avatar
+	done   chan struct{}
+	// access が nil の場合は認可を行わない
+	access *AccessControl
+	// moderation が nil の場合はキック・ミュート・BAN を確認しない
+	moderation *Moderation
+	// limiter が nil の場合は送信レートを制限しない
+	limiter *messageLimiter
+	// filters が nil の場合はメッセージを検査しない
+	filters *FilterSet
+	// metrics が nil の場合はメトリクスを記録しない
+	metrics *Metrics
+	// backpressure は送信が追いつかない接続の扱い。
+	backpressure BackpressureConfig
+	// connConfig は接続ごとの ping 間隔、読み書きの期限、受信サイズの上限。
+	connConfig ConnectionConfig
+	// closing はシャットダウン中であることを示す。新しい接続は受け付けない。
+	closing  atomic.Bool
+	closeAll chan chan []*client
+	stopOnce sync.Once
+	// broker が nil の場合は他のサーバーとイベントを中継しない
+	broker domain.Broker
+	// node はバックプレーン上でこのサーバーを識別する ID。
+	node     string
+	inbound  chan envelope
+	outbox   chan []byte
+	seen     *dedupSet
+	presence *presenceTable
+	// presenceInterval はこのサーバーにいる接続の一覧を他のサーバーに送る間隔。
+	presenceInterval time.Duration
+	// streams は Server-Sent Events で受信している接続。POST で送られたメッセージの送信元を引く。
+	streams *streamTable
+	// shards は接続を分担して配信する。joined は次の接続を割り当てるシャードを決める。
+	shards      []*shard
+	joined      int
+	evictMu     sync.Mutex
+	evicted     []*client
+	evictSignal chan struct{}
+}
+
+// directedMessage は特定のクライアントだけに送るメッセージ。
+// client が設定されていればその接続に、perm が設定されていればその権限を持つ接続に、
+// どちらもなければ userID のすべての接続に送る。
+type directedMessage struct {
+	userID     string
+	client     *client
+	perm       domain.Permission
+	msg        *message
+	disconnect bool
 }
 
 func newRoom(avatar Avatar) *room {
-	return &room{
-		forward: make(chan *message),
-		join:    make(chan *client),
-		leave:   make(chan *client),
-		clients: make(map[*client]struct{}),
-		avatar:  avatar,
-		done:    make(chan struct{}),
+	r := &room{
+		id:               defaultRoomID,
+		forward:          make(chan *message),
+		join:             make(chan *client),
+		leave:            make(chan *client),
+		direct:           make(chan directedMessage),
+		closeAll:         make(chan chan []*client),
+		clients:          make(map[*client]struct{}),
+		history:          newMessageHistory(recentMessageLimit),
+		connConfig:       defaultConnectionConfig(),
+		backpressure:     defaultBackpressureConfig(),
+		avatar:           avatar,
+		done:             make(chan struct{}),
+		node:             generateUUID(),
+		inbound:          make(chan envelope),
+		outbox:           make(chan []byte, backplaneBufferSize),
+		seen:             newDedupSet(dedupWindow),
+		presence:         newPresenceTable(),
+		presenceInterval: defaultPresenceInterval,
+		streams:          newStreamTable(),
+		evictSignal:      make(chan struct{}, 1),
 	}
+	r.shards = newShards(r, 0)
+	return r
+}
+
+// sibling は r と同じ依存と設定で id のルームを生成する。API で作成したルームに使う。
+func (r *room) sibling(id string) *room {
+	s := newRoom(r.avatar)
+	s.id = id
+	s.node = r.node
+	s.broker = r.broker
+	s.tracer = r.tracer
+	s.metrics = r.metrics
+	s.access = r.access
+	s.moderation = r.moderation
+	s.limiter = r.limiter
+	s.filters = r.filters
+	s.connConfig = r.connConfig
+	s.backpressure = r.backpressure
+	s.presenceInterval = r.presenceInterval
+	s.shards = newShards(s, len(r.shards))
+	return s
 }
 
 func (r *room) run() {
+	ctx := context.Background()
+	// heartbeat はバックプレーンを使わない場合は nil のまま
+	var heartbeat <-chan time.Time
+	if r.broker != nil {
+		if err := r.startBackplane(); err != nil {
+			// 購読できなくてもこのサーバーの接続だけでルームは動かす
+			r.tracer.Error(ctx, trace.Event{Name: "backplane.subscribe_failed", Room: r.id,
+				Attrs: []slog.Attr{slog.String("error", err.Error())}})
+		}
+		ticker := time.NewTicker(r.presenceInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+	for _, s := range r.shards {
+		go s.run()
+	}
 	for {
+		// シャードが切断した接続を先に取り除き、以降の宛先やプレゼンスに含めない
+		r.removeEvicted()
 		select {
 		case <-r.done:
 			return
+		case <-r.evictSignal:
 		case client := <-r.join:
+			client.shard = r.shards[r.joined%len(r.shards)]
+			r.joined++
 			r.clients[client] = struct{}{}
-			r.tracer.Trace("新規クライアントが参加しました")
+			r.dispatch(client, shardOp{kind: shardAdd, msgs: r.replay(client)})
+			if r.closing.Load() {
+				// シャットダウンの開始と行き違いで参加したクライアントもすぐに閉じる
+				r.closeClient(client, restartMessage())
+				continue
+			}
+			r.setPresence(client, true)
+			r.metrics.setRoomClients(r.id, len(r.clients))
+			r.tracer.Info(ctx, trace.Event{Name: "client.joined", Room: r.id, User: client.userID(),
+				Attrs: []slog.Attr{slog.Int("clients", len(r.clients))}})
 		case client := <-r.leave:
-			delete(r.clients, client)
-			close(client.send)
-			r.tracer.Trace("クライアントが退出しました")
-		case msg := <-r.forward:
-			r.tracer.Trace("メッセージを受信しました: ", msg.Message)
+			// キックや送信失敗で既に取り除かれている場合は send を二重に閉じない
+			if _, ok := r.clients[client]; ok {
+				r.unregister(client)
+			}
+			r.metrics.setRoomClients(r.id, len(r.clients))
+			r.tracer.Info(ctx, trace.Event{Name: "client.left", Room: r.id, User: client.userID(),
+				Attrs: []slog.Attr{slog.Int("clients", len(r.clients))}})
+		case reply := <-r.closeAll:
+			msg := restartMessage()
+			closed := make([]*client, 0, len(r.clients))
 			for client := range r.clients {
-				select {
-				case client.send <- msg:
-					r.tracer.Trace(" -- クライアントに送信されました")
-				default:
-					delete(r.clients, client)
-					close(client.send)
-					r.tracer.Trace(" -- 送信に失敗しました。クライアントをクリーンアップします")
+				r.closeClient(client, msg)
+				closed = append(closed, client)
+			}
+			// 呼び出し元が send の書き出しを待てるよう、シャードが閉じ終えてから返す
+			r.waitShards()
+			r.metrics.setRoomClients(r.id, 0)
+			r.tracer.Info(ctx, trace.Event{Name: "room.closed", Room: r.id, Attrs: []slog.Attr{slog.Int("clients", len(closed))}})
+			reply <- closed
+		case d := <-r.direct:
+			if d.client == nil {
+				// ユーザーや権限が宛先の場合は他のサーバーにいる接続にも届ける
+				r.publish(envelope{Kind: envelopeDirect, Message: d.msg, UserID: d.userID, Perm: d.perm, Disconnect: d.disconnect})
+			}
+			r.deliver(ctx, d)
+		case env := <-r.inbound:
+			r.receiveEnvelope(ctx, env)
+		case <-heartbeat:
+			r.heartbeat()
+		case msg := <-r.forward:
+			if msg.System == nil {
+				r.metrics.messageReceived(r.id)
+			}
+			r.broadcast(ctx, msg)
+			r.publish(envelope{ID: msg.ID, Kind: envelopeMessage, Message: msg})
+		}
+	}
+}
+
+// deliver は directedMessage をこのサーバーにいる宛先の接続に送る。
+func (r *room) deliver(ctx context.Context, d directedMessage) {
+	for client := range r.clients {
+		if !r.addressed(d, client) {
+			continue
+		}
+		if !d.disconnect {
+			r.dispatch(client, shardOp{kind: shardDirect, msg: d.msg})
+			continue
+		}
+		r.leaveRoom(client)
+		r.dispatch(client, shardOp{kind: shardDirect, msg: d.msg, disconnect: true, reason: closeReasonDisconnected})
+		r.metrics.setRoomClients(r.id, len(r.clients))
+		r.tracer.Info(ctx, trace.Event{Name: "client.disconnected", Room: r.id, User: client.userID()})
+	}
+}
+
+// broadcast はメッセージを一度だけエンコードし、このサーバーにいるすべての接続への配信をシャードに任せる。
+func (r *room) broadcast(ctx context.Context, msg *message) {
+	mctx, span := startSpan(extractTrace(ctx, msg), "chat.message.broadcast",
+		oteltrace.WithAttributes(attribute.String("chat.room", r.id), attribute.String("chat.message.id", msg.ID)))
+	if len(msg.Trace) > 0 {
+		// 各クライアントへの送信スパンをこのスパンの子にする
+		injectTrace(mctx, msg)
+	}
+	r.tracer.Debug(ctx, trace.Event{Name: "message.received", Room: r.id, User: msg.UserID, MessageID: msg.ID})
+	if msg.System != nil {
+		switch msg.System.Action {
+		case "message_deleted":
+			// 他のサーバーで削除されたメッセージもこのサーバーの履歴から消す
+			r.history.remove(msg.System.MessageID)
+		case "message_edited":
+			r.history.edit(msg.System.MessageID, msg.Message, msg.When)
+		}
+	}
+	if msg.System != nil && ephemeralActions[msg.System.Action] {
+		// 入力中表示などは後から受け取っても意味がないので、番号を振らず履歴にも残さない
+		msg.prepare()
+	} else {
+		// 番号はサーバーごとに振るため、他のサーバーから届いたメッセージも振り直す
+		r.seq++
+		msg.Seq = r.seq
+		// 履歴に入れると他の goroutine から読まれるため、その前に書き換えを済ませる
+		msg.prepare()
+		// 削除通知も履歴に残し、再接続したクライアントの画面からも消せるようにする
+		r.history.add(msg)
+	}
+	start := time.Now()
+	r.fanOut(msg)
+	elapsed := time.Since(start)
+	span.SetAttributes(attribute.Int("chat.recipients", len(r.clients)), attribute.Int("chat.shards", len(r.shards)))
+	span.End()
+	r.tracer.Debug(ctx, trace.Event{Name: "message.broadcast", Room: r.id, User: msg.UserID, MessageID: msg.ID,
+		Duration: elapsed, Attrs: []slog.Attr{slog.Int("recipients", len(r.clients))}})
+}
+
+// fanOut は準備済みの msg をすべてのシャードに渡し、このサーバーにいるすべての接続に送らせる。
+func (r *room) fanOut(msg *message) {
+	for _, s := range r.shards {
+		select {
+		case s.ops <- shardOp{kind: shardBroadcast, msg: msg}:
+		case <-r.done:
+		}
+	}
+}
+
+// replay は参加したクライアントに最初に送るメッセージを返す。
+// 現在のシーケンス番号を伝える hello に続けて、再接続の場合は since より後のメッセージを履歴から再送する。
+// 履歴から再送しきれない場合は、hello の代わりに再同期が必要なことを伝える通知だけを返す。
+func (r *room) replay(c *client) []*message {
+	if !c.resume {
+		return []*message{r.helloMessage()}
+	}
+	msgs, ok := r.history.since(c.since.seq)
+	// 別のサーバーや再起動前のサーバーが振った番号は、このサーバーの番号と比べられない
+	if c.since.node != r.node || !ok || c.since.seq > r.seq || len(msgs) >= cap(c.send) {
+		msg := resyncMessage()
+		msg.System.Node, msg.Seq = r.node, r.seq
+		return []*message{msg}
+	}
+	return append([]*message{r.helloMessage()}, msgs...)
+}
+
+// helloMessage は参加したクライアントに、次の再接続で since に使う番号の起点を伝える。
+func (r *room) helloMessage() *message {
+	msg := newSystemMessage("", systemEvent{Action: "hello", Node: r.node})
+	msg.Seq = r.seq
+	return msg
+}
+
+// resyncMessage は取りこぼしを再送できなかったクライアントへの通知。
+func resyncMessage() *message {
+	return newSystemMessage("Some messages could not be recovered. Reload the page to see the full conversation.", systemEvent{Action: "resync_required"})
+}
+
+// unregister はクライアントをルームから取り除き、担当のシャードに send を閉じさせる。
+func (r *room) unregister(c *client) {
+	r.leaveRoom(c)
+	r.dispatch(c, shardOp{kind: shardRemove})
+}
+
+// leaveRoom はクライアントをルームの参加者とプレゼンスから取り除く。
+func (r *room) leaveRoom(c *client) {
+	delete(r.clients, c)
+	r.setPresence(c, false)
+}
+
+// setPresence は接続の参加・退出をプレゼンスに反映し、他のサーバーに知らせる。
+func (r *room) setPresence(c *client, joined bool) {
+	name, _ := c.userData["name"].(string)
+	r.announcePresence(r.presence.update(r.node, c.userID(), name, joined))
+	r.publish(envelope{Kind: envelopePresence, UserID: c.userID(), Name: name, Joined: joined})
+}
+
+// announcePresence はユーザーが接続し始めたことや、すべての接続が切れたことをこのサーバーの接続に知らせる。
+// 他のサーバーはそれぞれのプレゼンスから同じ通知を作るので、バックプレーンには流さない。
+func (r *room) announcePresence(changes []presenceChange) {
+	// シャットダウンで全員を切断するときに、残っている接続へ一人ずつ知らせない
+	if r.closing.Load() {
+		return
+	}
+	for _, ch := range changes {
+		msg := presenceMessage(ch)
+		msg.prepare()
+		r.fanOut(msg)
+	}
+}
+
+// presenceMessage は presenceChange を、そのユーザーを送信者とする一時的なイベントにする。
+func presenceMessage(ch presenceChange) *message {
+	state := "offline"
+	if ch.online {
+		state = "online"
+	}
+	msg := newSystemMessage("", systemEvent{Action: "presence", Reason: state})
+	msg.ID, msg.UserID, msg.Name = generateUUID(), ch.userID, ch.name
+	return msg
+}
+
+// authorize はクライアントがこのルームで権限を持つかを確認する。
+func (r *room) authorize(c *client, perm domain.Permission) error {
+	if r.access == nil {
+		return nil
+	}
+	return r.access.Authorize(context.Background(), c.userID(), r.id, perm)
+}
+
+// joinBlocked は BAN やキック直後のユーザーの参加を拒否する。
+func (r *room) joinBlocked(userData map[string]any) (domain.Sanction, bool) {
+	if r.moderation == nil {
+		return domain.Sanction{}, false
+	}
+	userID, _ := userData["id"].(string)
+	return r.moderation.joinBlocked(context.Background(), userID, r.id)
+}
+
+// muted はクライアントのユーザーがこのルームでミュートされているかを返す。
+func (r *room) muted(c *client) (domain.Sanction, bool) {
+	if r.moderation == nil {
+		return domain.Sanction{}, false
+	}
+	return r.moderation.active(context.Background(), c.userID(), r.id, domain.SanctionMute)
+}
+
+// allowMessage はクライアントからのメッセージが送信レートの制限内かを判定する。
+func (r *room) allowMessage(c *client) rateDecision {
+	if r.limiter == nil || c.limit == nil {
+		return rateAllowed
+	}
+	return r.limiter.Allow(c.limit, c.userID())
+}
+
+// filter はルームのフィルターを適用して msg.Message を書き換える。
+// 拒否された場合は理由と false を返す。
+func (r *room) filter(ctx context.Context, c *client, msg *message) (string, bool) {
+	if r.filters == nil {
+		return "", true
+	}
+	_, span := startSpan(ctx, "chat.message.filter", oteltrace.WithAttributes(attribute.String("chat.room", r.id)))
+	defer span.End()
+	out := r.filters.Apply(FilterInput{UserID: c.userID(), RoomID: r.id, Text: msg.Message, When: msg.When})
+	if out.Rejected {
+		span.SetAttributes(attribute.String("chat.filter.reject_reason", out.Reason))
+		return out.Reason, false
+	}
+	msg.Message = out.Text
+	return "", true
+}
+
+// addressed はクライアントが directedMessage の宛先かを返す。
+func (r *room) addressed(d directedMessage, c *client) bool {
+	switch {
+	case d.client != nil:
+		return c == d.client
+	case d.perm != "":
+		return r.authorize(c, d.perm) == nil
+	default:
+		return c.userID() == d.userID
+	}
+}
+
+// sendTo はユーザーの接続にメッセージを送り、disconnect が true なら切断する。
+func (r *room) sendTo(userID string, msg *message, disconnect bool) {
+	r.sendDirect(directedMessage{userID: userID, msg: msg, disconnect: disconnect})
+}
+
+// sendToClient は一つの接続だけにメッセージを送る。
+func (r *room) sendToClient(c *client, msg *message) {
+	r.sendDirect(directedMessage{client: c, msg: msg})
+}
+
+// sendToModerators はこのルームをモデレートできる接続にメッセージを送る。
+func (r *room) sendToModerators(msg *message) {
+	r.sendDirect(directedMessage{perm: domain.PermModerate, msg: msg})
+}
+
+// deleteMessage は履歴からメッセージを消し、参加者の画面からも消すように通知する。
+func (r *room) deleteMessage(id string) {
+	r.history.remove(id)
+	msg := newSystemMessage("A message was removed by a moderator.", systemEvent{Action: "message_deleted", MessageID: id})
+	select {
+	case r.forward <- msg:
+	case <-r.done:
+	}
+}
+
+// editMessage は履歴のメッセージの本文を書き換え、参加者の画面の表示も書き換えるように通知する。
+// 通知の Message が新しい本文になる。
+func (r *room) editMessage(id, text string) {
+	msg := newSystemMessage(text, systemEvent{Action: "message_edited", MessageID: id})
+	select {
+	case r.forward <- msg:
+	case <-r.done:
+	}
+}
+
+func (r *room) sendDirect(d directedMessage) {
+	select {
+	case r.direct <- d:
+	case <-r.done:
+	}
+}
+
+// closeClient は最後のメッセージを送ってからクライアントの send を閉じる。
+// write は残りのメッセージを書き出し、サーバー再起動を示すクローズフレームを送って接続を閉じる。
+func (r *room) closeClient(c *client, msg *message) {
+	r.leaveRoom(c)
+	r.dispatch(c, shardOp{kind: shardDirect, msg: msg, disconnect: true, closeCode: websocket.CloseServiceRestart, reason: closeReasonShutdown})
+}
+
+// restartMessage はシャットダウン時にクライアントに送る通知。
+func restartMessage() *message {
+	return newSystemMessage("The server is restarting. Please reconnect in a moment.", systemEvent{Action: "server_restarting"})
+}
+
+// shutdown は新しい接続の受け付けを止め、すべてのクライアントに再起動を伝えて切断する。
+// 各クライアントの送信バッファが書き出されるまで待ち、ctx の期限を過ぎた場合は残りの接続を強制的に閉じる。
+func (r *room) shutdown(ctx context.Context) error {
+	r.closing.Store(true)
+	defer r.Stop()
+
+	reply := make(chan []*client, 1)
+	select {
+	case r.closeAll <- reply:
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	clients := <-reply
+	for _, c := range clients {
+		if c.done == nil {
+			continue
+		}
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			for _, c := range clients {
+				if c.transport != nil {
+					_ = c.transport.close()
 				}
 			}
+			return ctx.Err()
 		}
 	}
+	return nil
 }
 
 func (r *room) Stop() {
-	close(r.done)
+	r.stopOnce.Do(func() { close(r.done) })
 }
 
 func (r *room) WebSocketHandler(c echo.Context) error {
+	span := oteltrace.SpanFromContext(c.Request().Context())
+	span.SetAttributes(attribute.String("chat.room", r.id))
+	if r.closing.Load() {
+		return c.String(http.StatusServiceUnavailable, "server is shutting down")
+	}
+	// since は再接続したクライアントが最後に受け取ったメッセージの位置（"<node>:<seq>"）
+	since, resume, err := parseSince(c.QueryParam("since"))
+	if err != nil {
+		return c.String(http.StatusBadRequest, "since must be <node>:<sequence number>")
+	}
 	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
+		r.metrics.upgradeFailed()
+		span.RecordError(err)
 		return err
 	}
 
-	userData, err := getAuthUserData(c)
-	if err != nil {
+	userData, denied := connectingUser(c)
+	if denied != "" {
 		_ = ws.Close()
-		return c.String(http.StatusForbidden, "Cookieの取得に失敗しました")
+		return c.String(http.StatusForbidden, denied)
+	}
+
+	if s, blocked := r.joinBlocked(userData); blocked {
+		_ = ws.WriteJSON(sanctionMessage(s, r.id))
+		_ = ws.Close()
+		return nil
 	}
 
 	client := &client{
-		socket:   ws,
-		send:     make(chan *message, 256),
-		room:     r,
-		userData: userData,
+		transport: &wsTransport{conn: ws, writeWait: r.connConfig.WriteWait},
+		send:      make(chan *message, r.backpressure.SendBuffer),
+		room:      r,
+		userData:  userData,
+		conn:      span.SpanContext(),
+		done:      make(chan struct{}),
+		resume:    resume,
+		since:     since,
+	}
+	span.SetAttributes(attribute.String("chat.user", client.userID()))
+	if r.limiter != nil {
+		client.limit = r.limiter.connBucket()
 	}
-	r.join <- client
-	defer func() { r.leave <- client }()
+	select {
+	case r.join <- client:
+	case <-r.done:
+		_ = ws.Close()
+		return nil
+	}
+	defer func() {
+		select {
+		case r.leave <- client:
+		case <-r.done:
+		}
+	}()
 	go client.write()
-	client.read()
+	client.read(ws)
+	// 理由を判定できないまま読み込みを終えた場合
+	client.closed(closeReasonReadError)
 
 	return nil
 }
 
+// connectingUser はルームに接続するユーザーを認証する。拒否する場合は理由を返す。
+// WebSocket と Server-Sent Events の接続で共通に使う。
+func connectingUser(c echo.Context) (map[string]any, string) {
+	userData, err := getAuthUserData(c)
+	if err != nil {
+		return nil, "Cookieの取得に失敗しました"
+	}
+	if isRecoverySession(userData) {
+		return nil, "新しいパスキーを登録してください"
+	}
+	return userData, ""
+}
+
+// resumePoint は再接続したクライアントが最後に受け取ったメッセージ。
+// シーケンス番号はサーバーごとに振るため、番号を振ったサーバーの node と組にする。
+type resumePoint struct {
+	node string
+	seq  uint64
+}
+
+// String は since パラメーターや SSE のイベント ID に使う "<node>:<seq>" の形式を返す。
+func (p resumePoint) String() string {
+	return p.node + ":" + strconv.FormatUint(p.seq, 10)
+}
+
+// parseSince は再接続したクライアントの since（"<node>:<seq>"）を解釈する。空文字列の場合は再接続ではない。
+// node のない番号だけの値も受け付けるが、どのサーバーの番号か分からないため再同期を求めることになる。
+func parseSince(s string) (since resumePoint, resume bool, err error) {
+	if s == "" {
+		return resumePoint{}, false, nil
+	}
+	node, seq, found := strings.Cut(s, ":")
+	if !found {
+		node, seq = "", s
+	}
+	since.node = node
+	since.seq, err = strconv.ParseUint(seq, 10, 64)
+	return since, err == nil, err
+}
+
 func isAllowedWebSocketOrigin(r *http.Request) bool {
 	origin := r.Header.Get("Origin")
 	if origin == "" {
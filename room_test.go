@@ -2,10 +2,48 @@ package main
 
 import (
 	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+
+	"github.com/dchf12/chat/trace"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
 )
 
+// newRoomServer は e の /room で r の WebSocket を受け付けるテストサーバーを起動する。
+func newRoomServer(t *testing.T, e *echo.Echo, r *room) *httptest.Server {
+	t.Helper()
+	e.GET("/room", r.WebSocketHandler)
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// syncRoom は room.run とすべてのシャードがそれまでのイベントを処理し終えるまで待つ。
+func syncRoom(r *room) {
+	r.sendTo("nobody", &message{}, false)
+	r.waitShards()
+	// シャードが切断した接続を room.run が取り除くのを待つ
+	r.sendTo("nobody", &message{}, false)
+}
+
+// dialRoom は userData のユーザーとしてテストサーバーの /room に接続する。
+func dialRoom(srv *httptest.Server, userData map[string]any) (*websocket.Conn, *http.Response, error) {
+	return dialRoomWith(websocket.DefaultDialer, srv, userData)
+}
+
+// dialRoomWith はサブプロトコルなどを設定した dialer で /room に接続する。
+func dialRoomWith(dialer *websocket.Dialer, srv *httptest.Server, userData map[string]any) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	header.Set("Origin", srv.URL)
+	header.Set("Cookie", "auth="+makeAuthCookieValue(userData))
+	return dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/room", header)
+}
+
 func TestIsAllowedWebSocketOrigin_SameHostHTTP(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://localhost:8080/room", nil)
 	req.Host = "localhost:8080"
@@ -36,3 +74,142 @@ func TestIsAllowedWebSocketOrigin_HTTPSRequiredOnTLS(t *testing.T) {
 		t.Fatal("expected non-https origin to be denied for TLS requests")
 	}
 }
+
+func TestRoom_Trace(t *testing.T) {
+	sink := trace.NewRingBuffer(16, slog.LevelDebug)
+	r := newRoom(UseAuthAvatar)
+	r.tracer = trace.New(sink)
+	go r.run()
+	t.Cleanup(r.Stop)
+
+	c := joinTestClient(r, "u1")
+	r.forward <- &message{ID: "m1", UserID: "u1", Message: "hello"}
+	receive(t, c)
+	r.leave <- c
+	// leave の処理が終わるまで待つ
+	r.sendTo("u1", &message{}, false)
+
+	var events []string
+	for _, rec := range sink.Records() {
+		events = append(events, rec.Event)
+		if rec.Attrs["room"] != defaultRoomID {
+			t.Errorf("%s: expected room attr, got %v", rec.Event, rec.Attrs)
+		}
+	}
+	want := []string{"client.joined", "message.received", "message.broadcast", "client.left"}
+	if len(events) != len(want) {
+		t.Fatalf("expected events %v, got %v", want, events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("expected events %v, got %v", want, events)
+		}
+	}
+	broadcast := sink.Records()[2]
+	if broadcast.Attrs["message_id"] != "m1" || broadcast.Attrs["recipients"] != int64(1) {
+		t.Errorf("unexpected broadcast attrs %v", broadcast.Attrs)
+	}
+}
+
+func TestRoom_Resume(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	r.history = newMessageHistory(3)
+	go r.run()
+	t.Cleanup(r.Stop)
+	for i := range 5 {
+		r.forward <- &message{ID: fmt.Sprintf("m%d", i+1), UserID: "u1", Message: "hello"}
+	}
+
+	tests := []struct {
+		name       string
+		since      string
+		wantSeqs   []uint64
+		wantResync bool
+	}{
+		{name: "new connection"},
+		{name: "gap in history", since: r.node + ":3", wantSeqs: []uint64{4, 5}},
+		{name: "oldest kept", since: r.node + ":2", wantSeqs: []uint64{3, 4, 5}},
+		{name: "up to date", since: r.node + ":5"},
+		{name: "gap evicted", since: r.node + ":1", wantResync: true},
+		{name: "unknown sequence", since: r.node + ":9", wantResync: true},
+		// 番号はサーバーごとに振るため、他のサーバーの番号では再送しない
+		{name: "other server", since: "other:3", wantResync: true},
+		{name: "no server", since: "3", wantResync: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			since, resume, err := parseSince(tt.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &client{send: make(chan *message, 8), room: r, userData: map[string]any{"id": "u2"}, resume: resume, since: since}
+			r.join <- c
+			// join の処理が終わるまで待つ
+			syncRoom(r)
+			t.Cleanup(func() { r.leave <- c })
+
+			var seqs []uint64
+			var first string
+			for len(c.send) > 0 {
+				msg := <-c.send
+				if msg.System != nil && msg.System.Action == "presence" {
+					continue
+				}
+				if msg.System != nil && (msg.System.Action == "hello" || msg.System.Action == "resync_required") {
+					if first == "" {
+						first = msg.System.Action
+					}
+					// 次の再接続の起点として現在の番号とサーバーを伝える
+					if msg.Seq != 5 || msg.System.Node != r.node {
+						t.Errorf("expected %s to carry the current position, got %d on %q", msg.System.Action, msg.Seq, msg.System.Node)
+					}
+					continue
+				}
+				seqs = append(seqs, msg.Seq)
+			}
+			want := "hello"
+			if tt.wantResync {
+				want = "resync_required"
+			}
+			if first != want {
+				t.Errorf("expected %s first, got %q", want, first)
+			}
+			if fmt.Sprint(seqs) != fmt.Sprint(tt.wantSeqs) {
+				t.Errorf("expected replay %v, got %v", tt.wantSeqs, seqs)
+			}
+		})
+	}
+}
+
+func TestRoom_ResumeInvalidSince(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	e := echo.New()
+	rec := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/room?since=latest", nil), rec)
+	if err := r.WebSocketHandler(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", rec.Code)
+	}
+}
+
+// 履歴に入ったメッセージは通報や API の goroutine から読まれる。-race で書き換えがないことを確かめる。
+func TestRoom_HistoryReadDuringBroadcast(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	t.Cleanup(r.Stop)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			r.history.get(fmt.Sprintf("m%d", i))
+		}
+	}()
+	for i := range 100 {
+		r.forward <- &message{ID: fmt.Sprintf("m%d", i), UserID: "u1", Message: "hello"}
+	}
+	<-done
+	syncRoom(r)
+}
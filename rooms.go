@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/dchf12/chat/domain"
+	"github.com/labstack/echo/v4"
+)
+
+// roomRegistry はこのサーバーで動いているルーム。ルームを作成すると増える。
+type roomRegistry struct {
+	mu    sync.RWMutex
+	rooms map[string]*room
+}
+
+func newRoomRegistry(rooms ...*room) *roomRegistry {
+	g := &roomRegistry{rooms: make(map[string]*room)}
+	for _, r := range rooms {
+		g.rooms[r.id] = r
+	}
+	return g
+}
+
+func (g *roomRegistry) get(id string) (*room, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	r, ok := g.rooms[id]
+	return r, ok
+}
+
+// add はルームを登録する。既に同じ ID のルームがある場合は false を返す。
+func (g *roomRegistry) add(r *room) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.rooms[r.id]; ok {
+		return false
+	}
+	g.rooms[r.id] = r
+	return true
+}
+
+// list は ID 順にルームを返す。
+func (g *roomRegistry) list() []*room {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	rooms := make([]*room, 0, len(g.rooms))
+	for _, r := range g.rooms {
+		rooms = append(rooms, r)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].id < rooms[j].id })
+	return rooms
+}
+
+// route は ?room= のルーム（省略時は既定のルーム）で h を呼び出すハンドラーを返す。
+func (g *roomRegistry) route(h func(*room, echo.Context) error) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.QueryParam("room")
+		if id == "" {
+			id = defaultRoomID
+		}
+		r, ok := g.get(id)
+		if !ok {
+			return c.String(http.StatusNotFound, errRoomNotFound.Error())
+		}
+		return h(r, c)
+	}
+}
+
+// roomsTopic はルームの作成をサーバー間で知らせる Broker のトピック。
+const roomsTopic = "chat:rooms"
+
+// roomAnnouncement はバックプレーンで中継するルームの作成。
+type roomAnnouncement struct {
+	// Node は発行したサーバー。自分が発行したものは受信時に無視する。
+	Node  string        `json:"node"`
+	Rooms []domain.Room `json:"rooms,omitempty"`
+	// Sync はあとから起動したサーバーが、既存のルームを知らせるよう他のサーバーに求めていることを示す。
+	Sync bool `json:"sync,omitempty"`
+}
+
+// startRoom は既定のルームと同じ設定で id のルームを動かす。既に動いている場合は何もしない。
+func (a *API) startRoom(id string) {
+	template, ok := a.rooms.get(defaultRoomID)
+	if !ok {
+		return
+	}
+	r := template.sibling(id)
+	if a.rooms.add(r) {
+		go r.run()
+	}
+}
+
+// FollowRooms は他のサーバーが作成したルームを受け取り、このサーバーでも動かす。
+// 購読を始めたら既存のルームを問い合わせるため、あとから起動したサーバーも同じルームを持つ。
+func (a *API) FollowRooms(ctx context.Context) error {
+	if a.broker == nil {
+		return nil
+	}
+	events, err := a.broker.Subscribe(ctx, roomsTopic)
+	if err != nil {
+		return err
+	}
+	go a.receiveRooms(ctx, events)
+	a.publishRooms(ctx, roomAnnouncement{Sync: true})
+	return nil
+}
+
+func (a *API) receiveRooms(ctx context.Context, events <-chan []byte) {
+	for payload := range events {
+		var ann roomAnnouncement
+		if err := json.Unmarshal(payload, &ann); err != nil {
+			log.Printf("invalid room announcement: %v", err)
+			continue
+		}
+		if ann.Node == a.node {
+			continue
+		}
+		if ann.Sync {
+			rooms, err := a.roomRepo.List(ctx)
+			if err != nil {
+				log.Printf("failed to list rooms: %v", err)
+				continue
+			}
+			a.announceRooms(ctx, rooms...)
+			continue
+		}
+		for _, room := range ann.Rooms {
+			if err := a.roomRepo.Create(ctx, room); err != nil && !errors.Is(err, domain.ErrRoomExists) {
+				log.Printf("failed to register room %s: %v", room.ID, err)
+				continue
+			}
+			a.startRoom(room.ID)
+		}
+	}
+}
+
+// announceRooms はルームを他のサーバーに知らせる。
+func (a *API) announceRooms(ctx context.Context, rooms ...domain.Room) {
+	a.publishRooms(ctx, roomAnnouncement{Rooms: rooms})
+}
+
+func (a *API) publishRooms(ctx context.Context, ann roomAnnouncement) {
+	if a.broker == nil {
+		return
+	}
+	ann.Node = a.node
+	payload, err := json.Marshal(ann)
+	if err != nil {
+		return
+	}
+	if err := a.broker.Publish(ctx, roomsTopic, payload); err != nil {
+		log.Printf("failed to announce rooms: %v", err)
+	}
+}
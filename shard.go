@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+
+	"github.com/dchf12/chat/trace"
+)
+
+// shardQueueSize はシャードごとに溜められる操作の数。溢れると room.run が空くのを待つ。
+const shardQueueSize = 4096
+
+type shardOpKind int
+
+const (
+	// shardAdd は接続を受け持ち、msgs（再接続時の再送）を送る。
+	shardAdd shardOpKind = iota
+	// shardRemove は接続の send を閉じる。
+	shardRemove
+	// shardBroadcast は msg を受け持つすべての接続に送る。
+	shardBroadcast
+	// shardDirect は msg を一つの接続に送り、disconnect なら send を閉じる。
+	shardDirect
+	// shardBarrier はそれまでの操作を終えたら done を閉じる。
+	shardBarrier
+)
+
+type shardOp struct {
+	kind       shardOpKind
+	client     *client
+	msg        *message
+	msgs       []*message
+	disconnect bool
+	// closeCode と reason は disconnect で閉じるときのクローズコードとメトリクスの理由。
+	closeCode int
+	reason    string
+	done      chan struct{}
+}
+
+// shard はルームの接続の一部を受け持ち、配信を並列に行う。
+// 受け持つ接続の send への書き込みと close はすべてシャードの goroutine で行うため、
+// 閉じた send に書き込むことはない。参加・退出の管理は room.run が行う。
+type shard struct {
+	room    *room
+	ops     chan shardOp
+	clients map[*client]struct{}
+}
+
+// newShards は n 個のシャードを生成する。n が 0 以下の場合は GOMAXPROCS 個にする。
+func newShards(r *room, n int) []*shard {
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	shards := make([]*shard, n)
+	for i := range shards {
+		shards[i] = &shard{room: r, ops: make(chan shardOp, shardQueueSize), clients: make(map[*client]struct{})}
+	}
+	return shards
+}
+
+func (s *shard) run() {
+	for {
+		select {
+		case <-s.room.done:
+			return
+		case op := <-s.ops:
+			s.apply(op)
+		}
+	}
+}
+
+func (s *shard) apply(op shardOp) {
+	c := op.client
+	switch op.kind {
+	case shardAdd:
+		s.clients[c] = struct{}{}
+		for _, msg := range op.msgs {
+			select {
+			case c.send <- msg:
+			default:
+			}
+		}
+	case shardRemove:
+		s.remove(c)
+	case shardDirect:
+		if _, ok := s.clients[c]; !ok {
+			return
+		}
+		select {
+		case c.send <- op.msg:
+		default:
+		}
+		if op.disconnect {
+			// write は send に残ったメッセージを書き出してから接続を閉じる
+			if op.closeCode != 0 {
+				c.closeCode = op.closeCode
+			}
+			c.closed(op.reason)
+			s.remove(c)
+		}
+	case shardBroadcast:
+		s.fanOut(op.msg)
+	case shardBarrier:
+		close(op.done)
+	}
+}
+
+// remove は受け持っている接続の send を閉じる。既に閉じた接続は何もしない。
+func (s *shard) remove(c *client) {
+	if _, ok := s.clients[c]; !ok {
+		return
+	}
+	delete(s.clients, c)
+	close(c.send)
+}
+
+// fanOut は msg を受け持つすべての接続に送る。送信が追いつかず切断した接続は room.run に知らせる。
+func (s *shard) fanOut(msg *message) {
+	r := s.room
+	ctx := context.Background()
+	start := time.Now()
+	sent, dropped, skipped := 0, 0, 0
+	for c := range s.clients {
+		ok, n := r.enqueue(c, msg)
+		if ok {
+			sent++
+			skipped += n
+			continue
+		}
+		c.closeCode = closeSlowConsumer
+		c.closed(closeReasonSlowClient)
+		s.remove(c)
+		r.evict(c)
+		dropped++
+		r.tracer.Warn(ctx, trace.Event{Name: "client.dropped", Room: r.id, User: c.userID(), MessageID: msg.ID,
+			Attrs: []slog.Attr{slog.String("reason", "send buffer full")}})
+	}
+	r.metrics.broadcast(r.id, sent, dropped, time.Since(start))
+	r.metrics.messagesSkipped(r.id, skipped)
+}
+
+// dispatch は接続を受け持つシャードに操作を渡す。
+func (r *room) dispatch(c *client, op shardOp) {
+	op.client = c
+	select {
+	case c.shard.ops <- op:
+	case <-r.done:
+	}
+}
+
+// waitShards はすべてのシャードがそれまでに渡した操作を終えるまで待つ。
+func (r *room) waitShards() {
+	for _, s := range r.shards {
+		done := make(chan struct{})
+		select {
+		case s.ops <- shardOp{kind: shardBarrier, done: done}:
+		case <-r.done:
+			return
+		}
+		select {
+		case <-done:
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// evict はシャードが切断した接続を room.run に知らせる。シャードを止めないよう待たない。
+func (r *room) evict(c *client) {
+	r.evictMu.Lock()
+	r.evicted = append(r.evicted, c)
+	r.evictMu.Unlock()
+	select {
+	case r.evictSignal <- struct{}{}:
+	default:
+	}
+}
+
+// removeEvicted はシャードが切断した接続をルームから取り除く。room.run から呼び出す。
+func (r *room) removeEvicted() {
+	r.evictMu.Lock()
+	evicted := r.evicted
+	r.evicted = nil
+	r.evictMu.Unlock()
+	if len(evicted) == 0 {
+		return
+	}
+	for _, c := range evicted {
+		if _, ok := r.clients[c]; ok {
+			delete(r.clients, c)
+			r.setPresence(c, false)
+		}
+	}
+	r.metrics.setRoomClients(r.id, len(r.clients))
+}
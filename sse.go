@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// sseTransport は Server-Sent Events の接続。WebSocket の接続を張れないクライアントが受信に使う。
+// メッセージのシーケンス番号を since の形式でイベントの ID にするので、EventSource が再接続時に送る
+// Last-Event-ID から取りこぼしたメッセージを再送できる。
+type sseTransport struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	writeWait time.Duration
+	// node はシーケンス番号を振っているサーバー。イベントの ID に含める。
+	node string
+	// done はクライアントが切断するか close が呼ばれると閉じられる。
+	done     chan struct{}
+	doneOnce sync.Once
+	// finished はハンドラーが終了したことを示す。以降はレスポンスに触れない。
+	mu       sync.Mutex
+	finished bool
+}
+
+func newSSETransport(w http.ResponseWriter, node string, writeWait time.Duration) *sseTransport {
+	return &sseTransport{w: w, rc: http.NewResponseController(w), node: node, writeWait: writeWait, done: make(chan struct{})}
+}
+
+// writeEvent はイベントを 1 件書き込んで送り出す。data は改行を含まない JSON。id が空の場合は ID を付けない。
+func (t *sseTransport) writeEvent(event, id string, data []byte) error {
+	var b bytes.Buffer
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return t.write(b.Bytes())
+}
+
+func (t *sseTransport) write(p []byte) error {
+	_ = t.rc.SetWriteDeadline(time.Now().Add(t.writeWait))
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) writeMessage(msg *message) error {
+	var data []byte
+	var err error
+	if msg.frames != nil {
+		data, err = msg.frames.data(jsonCodec{}, msg)
+	} else {
+		data, err = json.Marshal(msg)
+	}
+	if err != nil {
+		return err
+	}
+	return t.writeEvent("", t.eventID(msg), data)
+}
+
+// eventID はメッセージを受け取ったあとに再接続するときの since を返す。
+// 番号のないキックなどの通知では、Last-Event-ID を変えないよう空を返す。
+func (t *sseTransport) eventID(msg *message) string {
+	if msg.Seq == 0 && (msg.System == nil || msg.System.Node == "") {
+		return ""
+	}
+	return resumePoint{node: t.node, seq: msg.Seq}.String()
+}
+
+// ping はコメント行を送る。プロキシにアイドルの接続を切られないようにする役目もある。
+func (t *sseTransport) ping() error {
+	return t.write([]byte(": ping\n\n"))
+}
+
+// writeClose は close イベントでクローズコードを伝える。EventSource は自動で再接続するため、
+// クライアントはこのイベントを受け取ったら再接続するかどうかを自分で決める。
+func (t *sseTransport) writeClose(code int) {
+	data, _ := json.Marshal(map[string]int{"code": code})
+	_ = t.writeEvent("close", "", data)
+}
+
+// close は書き込み中であれば期限を過ぎさせて中断させる。
+func (t *sseTransport) close() error {
+	t.doneOnce.Do(func() { close(t.done) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.finished {
+		return nil
+	}
+	return t.rc.SetWriteDeadline(time.Now())
+}
+
+func (t *sseTransport) gone() <-chan struct{} { return t.done }
+
+// finish はハンドラーの終了を記録する。ハンドラーが戻る前に呼び出す。
+func (t *sseTransport) finish() {
+	t.mu.Lock()
+	t.finished = true
+	t.mu.Unlock()
+	t.doneOnce.Do(func() { close(t.done) })
+}
+
+// sseStream は Server-Sent Events で受信している接続。
+type sseStream struct {
+	client *client
+	// mu は同じストリームへの POST を順に処理する。
+	mu sync.Mutex
+	// disconnected の後は POST されたメッセージを受け付けない
+	disconnected bool
+}
+
+// streamTable はストリームの ID から接続を引く表。
+type streamTable struct {
+	mu      sync.Mutex
+	streams map[string]*sseStream
+}
+
+func newStreamTable() *streamTable {
+	return &streamTable{streams: make(map[string]*sseStream)}
+}
+
+func (t *streamTable) add(c *client) string {
+	id := generateUUID()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streams[id] = &sseStream{client: c}
+	return id
+}
+
+func (t *streamTable) get(id string) *sseStream {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[id]
+}
+
+func (t *streamTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, id)
+}
+
+// EventsHandler は Server-Sent Events でルームのメッセージを配信する。
+// 最初に ready イベントでストリームの ID を送り、クライアントはその ID を付けて MessagesHandler に送信する。
+func (r *room) EventsHandler(c echo.Context) error {
+	span := oteltrace.SpanFromContext(c.Request().Context())
+	span.SetAttributes(attribute.String("chat.room", r.id))
+	if r.closing.Load() {
+		return c.String(http.StatusServiceUnavailable, "server is shutting down")
+	}
+	// EventSource は再接続時に最後に受け取ったイベントの ID を Last-Event-ID で送ってくる
+	rawSince := c.QueryParam("since")
+	if id := c.Request().Header.Get("Last-Event-ID"); id != "" {
+		rawSince = id
+	}
+	since, resume, err := parseSince(rawSince)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "since must be <node>:<sequence number>")
+	}
+	userData, denied := connectingUser(c)
+	if denied != "" {
+		return c.String(http.StatusForbidden, denied)
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	// nginx などのプロキシにバッファリングさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	t := newSSETransport(res, r.node, r.connConfig.WriteWait)
+	defer t.finish()
+
+	if s, blocked := r.joinBlocked(userData); blocked {
+		_ = t.writeMessage(sanctionMessage(s, r.id))
+		return nil
+	}
+
+	client := &client{
+		transport: t,
+		send:      make(chan *message, r.backpressure.SendBuffer),
+		room:      r,
+		userData:  userData,
+		conn:      span.SpanContext(),
+		done:      make(chan struct{}),
+		resume:    resume,
+		since:     since,
+	}
+	span.SetAttributes(attribute.String("chat.user", client.userID()))
+	if r.limiter != nil {
+		client.limit = r.limiter.connBucket()
+	}
+	stream := r.streams.add(client)
+	defer r.streams.remove(stream)
+	ready, _ := json.Marshal(map[string]string{"stream": stream})
+	if err := t.writeEvent("ready", "", ready); err != nil {
+		return nil
+	}
+
+	select {
+	case r.join <- client:
+	case <-r.done:
+		return nil
+	}
+	defer func() {
+		select {
+		case r.leave <- client:
+		case <-r.done:
+		}
+	}()
+	go func() {
+		select {
+		case <-c.Request().Context().Done():
+			_ = t.close()
+		case <-t.done:
+		}
+	}()
+	client.write()
+	return nil
+}
+
+// MessagesHandler は Server-Sent Events で受信しているクライアントからのメッセージを受け付ける。
+// 本文は WebSocket で送るメッセージと同じ JSON で、?stream= に ready イベントで受け取った ID を指定する。
+// 拒否や制限の通知はストリームに届く。
+func (r *room) MessagesHandler(c echo.Context) error {
+	if r.closing.Load() {
+		return c.String(http.StatusServiceUnavailable, "server is shutting down")
+	}
+	// Cookie で認証するので、他のサイトからのフォーム送信を受け付けない
+	if !isAllowedWebSocketOrigin(c.Request()) {
+		return c.String(http.StatusForbidden, "origin not allowed")
+	}
+	userData, denied := connectingUser(c)
+	if denied != "" {
+		return c.String(http.StatusForbidden, denied)
+	}
+	stream := r.streams.get(c.QueryParam("stream"))
+	// 他のユーザーのストリームは存在しないものとして扱う
+	if userID, _ := userData["id"].(string); stream == nil || stream.client.userID() != userID {
+		return c.String(http.StatusNotFound, "stream not found")
+	}
+
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, r.connConfig.MaxMessageSize)
+	var msg *message
+	if err := json.NewDecoder(body).Decode(&msg); err != nil || msg == nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return c.String(http.StatusRequestEntityTooLarge, "message too large")
+		}
+		return c.String(http.StatusBadRequest, "invalid message")
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if stream.disconnected {
+		return c.String(http.StatusGone, "stream is closing")
+	}
+	if !stream.client.handle(c.Request().Context(), msg, &stream.disconnected) {
+		// WebSocket で読み込みを終える場合と同じく接続を閉じる
+		_ = stream.client.transport.close()
+		return c.String(http.StatusBadRequest, "invalid user")
+	}
+	return c.NoContent(http.StatusAccepted)
+}
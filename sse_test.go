@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// newStreamServer は WebSocket と Server-Sent Events の両方で r に接続できるテストサーバーを起動する。
+func newStreamServer(t *testing.T, r *room) *httptest.Server {
+	t.Helper()
+	e := echo.New()
+	e.GET("/room/events", r.EventsHandler)
+	e.POST("/room/messages", r.MessagesHandler)
+	return newRoomServer(t, e, r)
+}
+
+// sseEvent は Server-Sent Events の 1 件のイベント。
+type sseEvent struct {
+	event, id, data string
+}
+
+// eventStream はテストサーバーの /room/events から受信する。
+type eventStream struct {
+	resp *http.Response
+	br   *bufio.Reader
+}
+
+func openEventStream(t *testing.T, srv *httptest.Server, userData map[string]any, lastEventID string) *eventStream {
+	t.Helper()
+	// 届かないイベントを待ち続けないよう期限を設ける
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/room/events", nil)
+	req.Header.Set("Cookie", "auth="+makeAuthCookieValue(userData))
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+	return &eventStream{resp: resp, br: bufio.NewReader(resp.Body)}
+}
+
+// next はコメント行を読み飛ばして次のイベントを返す。
+func (s *eventStream) next(t *testing.T) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := s.br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.data != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// ready は ready イベントからストリームの ID を読み取る。
+func (s *eventStream) ready(t *testing.T) string {
+	t.Helper()
+	ev := s.next(t)
+	var body struct{ Stream string }
+	if ev.event != "ready" || json.Unmarshal([]byte(ev.data), &body) != nil || body.Stream == "" {
+		t.Fatalf("expected ready event, got %+v", ev)
+	}
+	return body.Stream
+}
+
+// message は参加時の hello を読み飛ばして次のメッセージを返す。
+func (s *eventStream) message(t *testing.T) (message, sseEvent) {
+	t.Helper()
+	for {
+		ev := s.next(t)
+		var msg message
+		if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+			t.Fatalf("failed to decode %q: %v", ev.data, err)
+		}
+		if !isAnnouncement(&msg) {
+			return msg, ev
+		}
+	}
+}
+
+func postMessage(t *testing.T, srv *httptest.Server, userData map[string]any, stream, body string, origin bool) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/room/messages?stream="+stream, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", "auth="+makeAuthCookieValue(userData))
+	if origin {
+		req.Header.Set("Origin", srv.URL)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to post message: %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRoom_EventStream(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	defer r.Stop()
+	srv := newStreamServer(t, r)
+
+	alice := map[string]any{"id": "u1", "name": "alice", "avatar_url": "a.png"}
+	stream := openEventStream(t, srv, alice, "")
+	id := stream.ready(t)
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u2", "name": "bob", "avatar_url": "b.png"})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+	syncRoom(r)
+
+	if code := postMessage(t, srv, alice, id, `{"Message":"hello"}`, true); code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", code)
+	}
+	msg, ev := stream.message(t)
+	if msg.Message != "hello" || msg.UserID != "u1" || ev.id != r.node+":1" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	// WebSocket の接続にも同じルームのメッセージとして届く
+	if got := readMessage(t, ws); got.Message != "hello" || got.Name != "alice" {
+		t.Errorf("unexpected WebSocket message %+v", got)
+	}
+
+	if err := ws.WriteJSON(map[string]string{"Message": "hi"}); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if msg, ev := stream.message(t); msg.Message != "hi" || msg.UserID != "u2" || ev.id != r.node+":2" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestRoom_EventStreamResume(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	go r.run()
+	defer r.Stop()
+	srv := newStreamServer(t, r)
+	for i := range 3 {
+		r.forward <- &message{ID: string(rune('a' + i)), Message: "m", When: time.Now()}
+	}
+	syncRoom(r)
+
+	// EventSource は再接続時に最後に受け取ったイベントの ID を送る
+	stream := openEventStream(t, srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "a.png"}, r.node+":1")
+	stream.ready(t)
+	if hello := stream.next(t); hello.id != r.node+":3" || !strings.Contains(hello.data, `"hello"`) {
+		t.Errorf("expected hello with the current position, got %+v", hello)
+	}
+	for _, want := range []string{r.node + ":2", r.node + ":3"} {
+		if _, ev := stream.message(t); ev.id != want {
+			t.Errorf("expected replayed event %s, got %+v", want, ev)
+		}
+	}
+}
+
+func TestRoom_MessagesRejected(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	r.connConfig.MaxMessageSize = 64
+	go r.run()
+	defer r.Stop()
+	srv := newStreamServer(t, r)
+
+	alice := map[string]any{"id": "u1", "name": "alice", "avatar_url": "a.png"}
+	id := openEventStream(t, srv, alice, "").ready(t)
+	tests := []struct {
+		name     string
+		userData map[string]any
+		stream   string
+		body     string
+		noOrigin bool
+		want     int
+	}{
+		{name: "cross site", userData: alice, stream: id, body: `{"Message":"hi"}`, noOrigin: true, want: http.StatusForbidden},
+		{name: "unknown stream", userData: alice, stream: "missing", body: `{"Message":"hi"}`, want: http.StatusNotFound},
+		{name: "other user's stream", userData: map[string]any{"id": "u2", "name": "bob", "avatar_url": "b.png"}, stream: id, body: `{"Message":"hi"}`, want: http.StatusNotFound},
+		{name: "invalid json", userData: alice, stream: id, body: `{`, want: http.StatusBadRequest},
+		{name: "too large", userData: alice, stream: id, body: `{"Message":"` + strings.Repeat("a", 100) + `"}`, want: http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := postMessage(t, srv, tt.userData, tt.stream, tt.body, !tt.noOrigin); got != tt.want {
+				t.Errorf("expected status %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	resp, err := http.Get(srv.URL + "/room/events")
+	if err != nil {
+		t.Fatalf("failed to request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status 403 without a cookie, got %d", resp.StatusCode)
+	}
+}
+
+func TestRoom_EventStreamClosed(t *testing.T) {
+	r := newRoom(UseAuthAvatar)
+	r.metrics = NewMetrics()
+	go r.run()
+	defer r.Stop()
+	srv := newStreamServer(t, r)
+
+	stream := openEventStream(t, srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "a.png"}, "")
+	stream.ready(t)
+	syncRoom(r)
+	r.sendTo("u1", newSystemMessage("bye", systemEvent{Action: "kick"}), true)
+	if msg, _ := stream.message(t); msg.System == nil || msg.System.Action != "kick" {
+		t.Fatalf("expected kick event, got %+v", msg)
+	}
+	if ev := stream.next(t); ev.event != "close" || ev.data != `{"code":1000}` {
+		t.Errorf("expected close event, got %+v", ev)
+	}
+	waitClosed(t, r.metrics, closeReasonDisconnected)
+}
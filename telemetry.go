@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName は OpenTelemetry のスパンを作るトレーサーの名前。
+const instrumentationName = "github.com/dchf12/chat"
+
+// TelemetryConfig は OpenTelemetry の分散トレーシングの設定。
+type TelemetryConfig struct {
+	// Exporter は none、stdout、otlp のいずれか。
+	Exporter string
+	// Endpoint は OTLP/HTTP の送信先（host:port）。空の場合は OTEL_EXPORTER_OTLP_ENDPOINT 等の環境変数に従う。
+	Endpoint string
+	// Insecure は OTLP の送信に TLS を使わない。
+	Insecure bool
+	// SampleRatio は親のないトレースを記録する割合。
+	SampleRatio float64
+}
+
+func defaultTelemetryConfig() TelemetryConfig {
+	return TelemetryConfig{Exporter: "none", SampleRatio: 1}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+func (c *TelemetryConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Exporter, "otel-exporter", c.Exporter, "OpenTelemetry span exporter: none, stdout or otlp.")
+	fs.StringVar(&c.Endpoint, "otel-endpoint", c.Endpoint, "OTLP/HTTP collector host:port. If empty, OTEL_EXPORTER_OTLP_* environment variables are used.")
+	fs.BoolVar(&c.Insecure, "otel-insecure", c.Insecure, "Send OTLP spans without TLS.")
+	fs.Float64Var(&c.SampleRatio, "otel-sample", c.SampleRatio, "Fraction of new traces to sample, between 0 and 1.")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c TelemetryConfig) Validate() error {
+	var errs []error
+	switch c.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		errs = append(errs, fmt.Errorf("otel-exporter must be none, stdout or otlp, got %q", c.Exporter))
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("otel-sample must be between 0 and 1, got %g", c.SampleRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// setupTelemetry はグローバルの TracerProvider とプロパゲーターを設定する。
+// 返した関数はサーバー終了時に呼び出し、未送信のスパンを書き出す。
+func setupTelemetry(ctx context.Context, c TelemetryConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch c.Exporter {
+	case "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s span exporter: %w", c.Exporter, err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("chat")))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// startSpan はグローバルの TracerProvider でスパンを開始する。
+func startSpan(ctx context.Context, name string, opts ...oteltrace.SpanStartOption) (context.Context, oteltrace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// TracingMiddleware は HTTP リクエストごとにサーバースパンを開始する。
+// traceparent ヘッダーがあれば呼び出し元のトレースに繋げる。
+func TracingMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			route := c.Path()
+			if route == "" {
+				route = req.URL.Path
+			}
+			ctx, span := startSpan(ctx, req.Method+" "+route,
+				oteltrace.WithSpanKind(oteltrace.SpanKindServer),
+				oteltrace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(req.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(req.URL.Path),
+					semconv.ClientAddress(c.RealIP()),
+				))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			} else if err != nil {
+				status = 500
+			}
+			span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+			if status >= 500 || err != nil {
+				span.SetStatus(codes.Error, strconv.Itoa(status))
+				if err != nil {
+					span.RecordError(err)
+				}
+			}
+			return err
+		}
+	}
+}
+
+// startHandlerSpan はハンドラーの処理を表すスパンを開始し、リクエストのコンテキストを差し替える。
+// 返した関数で終了し、応答が 4xx/5xx の場合はエラーとして記録する。
+func startHandlerSpan(c echo.Context, name string) func() {
+	ctx, span := startSpan(c.Request().Context(), name)
+	c.SetRequest(c.Request().WithContext(ctx))
+	return func() {
+		if status := c.Response().Status; status >= 400 {
+			span.SetStatus(codes.Error, strconv.Itoa(status))
+		}
+		span.End()
+	}
+}
+
+// messagePropagator はメッセージのエンベロープでトレースコンテキストを運ぶ。
+// バゲージはクライアントが自由に書けて同じルームの全員に配られてしまうので、traceparent と tracestate だけを扱う。
+var messagePropagator = propagation.TraceContext{}
+
+// maxTraceValueLen はクライアントから受け付ける traceparent と tracestate の長さの上限。
+// W3C Trace Context が tracestate に求める上限に合わせる。
+const maxTraceValueLen = 512
+
+// clientTrace はクライアントが送ってきたエンベロープから traceparent と tracestate だけを残す。
+// 上限より長い値は捨てる。
+func clientTrace(trace map[string]string) map[string]string {
+	var kept map[string]string
+	for _, key := range messagePropagator.Fields() {
+		v, ok := trace[key]
+		if !ok || len(v) > maxTraceValueLen {
+			continue
+		}
+		if kept == nil {
+			kept = make(map[string]string, 2)
+		}
+		kept[key] = v
+	}
+	return kept
+}
+
+// injectTrace はスパンのコンテキストをメッセージのエンベロープに書き込む。
+func injectTrace(ctx context.Context, msg *message) {
+	carrier := propagation.MapCarrier{}
+	messagePropagator.Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		msg.Trace = nil
+		return
+	}
+	msg.Trace = carrier
+}
+
+// extractTrace はメッセージのエンベロープからトレースコンテキストを取り出す。
+func extractTrace(ctx context.Context, msg *message) context.Context {
+	if len(msg.Trace) == 0 {
+		return ctx
+	}
+	return messagePropagator.Extract(ctx, propagation.MapCarrier(msg.Trace))
+}
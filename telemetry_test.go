@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceParent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// useTestTracerProvider はスパンをメモリに記録する TracerProvider をグローバルに設定する。
+func useTestTracerProvider(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		_ = tp.Shutdown(t.Context())
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return exporter
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := useTestTracerProvider(t)
+	e := echo.New()
+	e.Use(TracingMiddleware())
+	e.GET("/rooms/:room/reports", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) })
+
+	req := httptest.NewRequest(http.MethodGet, "/rooms/general/reports", nil)
+	req.Header.Set("traceparent", testTraceParent)
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	span, ok := findSpan(exporter.GetSpans(), "GET /rooms/:room/reports")
+	if !ok {
+		t.Fatalf("expected server span, got %v", exporter.GetSpans())
+	}
+	if span.SpanContext.TraceID().String() != testTraceID {
+		t.Errorf("expected span to continue the incoming trace, got %s", span.SpanContext.TraceID())
+	}
+	attrs := make(map[string]string)
+	for _, kv := range span.Attributes {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["http.route"] != "/rooms/:room/reports" || attrs["http.response.status_code"] != "204" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestTracing_MessageLifecycle(t *testing.T) {
+	exporter := useTestTracerProvider(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filters.json")
+	writeFilterConfig(t, path, `{"default": [{"type": "max_length", "max": 100}]}`)
+	filters, err := LoadFilterSet(path)
+	if err != nil {
+		t.Fatalf("LoadFilterSet: %v", err)
+	}
+	r := newRoom(UseAuthAvatar)
+	r.filters = filters
+	go r.run()
+	t.Cleanup(r.Stop)
+
+	e := echo.New()
+	e.Use(TracingMiddleware())
+	srv := newRoomServer(t, e, r)
+
+	ws, _, err := dialRoom(srv, map[string]any{"id": "u1", "name": "alice", "avatar_url": "/a.png"})
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer func() { _ = ws.Close() }()
+
+	trace := map[string]string{"traceparent": testTraceParent, "baggage": "session=secret", "x-padding": "x"}
+	if err := ws.WriteJSON(map[string]any{"Message": "hello", "Trace": trace}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := readMessage(t, ws)
+	if !strings.Contains(got.Trace["traceparent"], testTraceID) {
+		t.Errorf("expected delivered message to carry the trace, got %v", got.Trace)
+	}
+	// クライアントのバゲージや他のキーは他の参加者に配らない
+	if _, ok := got.Trace["baggage"]; ok || len(got.Trace) != 1 {
+		t.Errorf("expected only traceparent to be delivered, got %v", got.Trace)
+	}
+
+	// 送信スパンは書き込みの後に終了するので、記録されるまで待つ
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := findSpan(exporter.GetSpans(), "chat.message.send"); ok || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, name := range []string{"chat.message.receive", "chat.message.filter", "chat.message.broadcast", "chat.message.send"} {
+		span, ok := findSpan(spans, name)
+		if !ok {
+			t.Fatalf("missing span %s in %v", name, spans)
+		}
+		if span.SpanContext.TraceID().String() != testTraceID {
+			t.Errorf("%s: expected trace %s, got %s", name, testTraceID, span.SpanContext.TraceID())
+		}
+		byName[name] = span
+	}
+	for child, parent := range map[string]string{
+		"chat.message.filter":    "chat.message.receive",
+		"chat.message.broadcast": "chat.message.receive",
+		"chat.message.send":      "chat.message.broadcast",
+	} {
+		if byName[child].Parent.SpanID() != byName[parent].SpanContext.SpanID() {
+			t.Errorf("expected %s to be a child of %s", child, parent)
+		}
+	}
+	if conn, ok := findSpan(spans, "GET /room"); ok {
+		t.Errorf("connection span should still be open, got %v", conn)
+	}
+	if links := byName["chat.message.receive"].Links; len(links) != 1 || !links[0].SpanContext.IsValid() {
+		t.Errorf("expected receive span to link to the connection span, got %v", links)
+	}
+}
+
+func TestTracing_PasskeyCeremony(t *testing.T) {
+	exporter := useTestTracerProvider(t)
+	h, _, _, auth := newLoginTestHandler(t, 5, ClonePolicyReject)
+	auth.signCount = 6
+	if rec := loginWithAuthenticator(t, h, auth, "http://localhost:8080"); rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	spans := exporter.GetSpans()
+	for _, name := range []string{"passkey.begin_login", "passkey.finish_login"} {
+		if _, ok := findSpan(spans, name); !ok {
+			t.Errorf("missing span %s in %v", name, spans)
+		}
+	}
+	span, _ := findSpan(spans, "passkey.finish_login")
+	for _, kv := range span.Attributes {
+		if kv.Key == "enduser.id" && kv.Value.AsString() == "u1" {
+			return
+		}
+	}
+	t.Errorf("expected finish_login span to record the user, got %v", span.Attributes)
+}
+
+func TestClientTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		trace map[string]string
+		want  map[string]string
+	}{
+		{name: "none", trace: nil, want: nil},
+		{
+			name:  "trace context",
+			trace: map[string]string{"traceparent": testTraceParent, "tracestate": "vendor=1"},
+			want:  map[string]string{"traceparent": testTraceParent, "tracestate": "vendor=1"},
+		},
+		{
+			name:  "baggage and other keys",
+			trace: map[string]string{"traceparent": testTraceParent, "baggage": "user=alice", "x": "y"},
+			want:  map[string]string{"traceparent": testTraceParent},
+		},
+		{
+			name:  "too long",
+			trace: map[string]string{"traceparent": testTraceParent, "tracestate": strings.Repeat("a", maxTraceValueLen+1)},
+			want:  map[string]string{"traceparent": testTraceParent},
+		},
+		{name: "only unknown keys", trace: map[string]string{"baggage": "user=alice"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientTrace(tt.trace); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package trace
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// Config はコマンドラインから指定するトレースの設定。
+type Config struct {
+	// Output は "stdout"、"none"、またはファイルのパス。
+	Output string
+	// Level は出力する最低レベル。debug、info、warn、error のいずれか。
+	Level string
+	// SampleRate は Warn 未満のイベントを残す割合。1 ですべて残す。
+	SampleRate float64
+	// MaxSizeMB はファイル出力時のローテーションサイズ。0 の場合はローテーションしない。
+	MaxSizeMB int
+	// MaxBackups はローテーションで残す古いファイルの数。
+	MaxBackups int
+}
+
+// DefaultConfig は標準出力に info 以上を JSON で出力する設定を返す。
+func DefaultConfig() Config {
+	return Config{
+		Output:     "stdout",
+		Level:      "info",
+		SampleRate: 1,
+		MaxSizeMB:  100,
+		MaxBackups: 3,
+	}
+}
+
+// RegisterFlags は設定用のフラグを fs に登録する。
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Output, "trace-output", c.Output, `Trace destination: "stdout", "none" or a file path.`)
+	fs.StringVar(&c.Level, "trace-level", c.Level, "Minimum trace level: debug, info, warn or error.")
+	fs.Float64Var(&c.SampleRate, "trace-sample", c.SampleRate, "Fraction of trace events below warn to keep, between 0 and 1.")
+	fs.IntVar(&c.MaxSizeMB, "trace-max-size", c.MaxSizeMB, "Size in MiB at which the trace file is rotated; 0 disables rotation.")
+	fs.IntVar(&c.MaxBackups, "trace-max-backups", c.MaxBackups, "Number of rotated trace files to keep.")
+}
+
+// Validate は設定値を検証する。起動時に呼び出す。
+func (c Config) Validate() error {
+	var errs []error
+	if c.Output == "" {
+		errs = append(errs, errors.New(`trace-output must be "stdout", "none" or a file path`))
+	}
+	if _, err := parseLevel(c.Level); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		errs = append(errs, fmt.Errorf("trace-sample must be between 0 and 1, got %g", c.SampleRate))
+	}
+	if c.MaxSizeMB < 0 || c.MaxBackups < 0 {
+		errs = append(errs, errors.New("trace-max-size and trace-max-backups must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Open は設定に従って Tracer を生成する。返した io.Closer はサーバー終了時に閉じる。
+// Output が "none" の場合は何も出力しない nil の Tracer を返す。
+func (c Config) Open() (*Tracer, io.Closer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	level, _ := parseLevel(c.Level)
+	var w io.Writer
+	var closer io.Closer = io.NopCloser(nil)
+	switch c.Output {
+	case "none":
+		return nil, closer, nil
+	case "stdout":
+		w = os.Stdout
+	default:
+		rf, err := OpenRotatingFile(c.Output, int64(c.MaxSizeMB)<<20, c.MaxBackups)
+		if err != nil {
+			return nil, nil, fmt.Errorf("open trace file: %w", err)
+		}
+		w, closer = rf, rf
+	}
+	var opts []Option
+	if c.SampleRate < 1 {
+		opts = append(opts, WithSampler(SampleRate(c.SampleRate)))
+	}
+	return New(NewJSONSink(w, level), opts...), closer, nil
+}
+
+func parseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("trace-level must be debug, info, warn or error, got %q", s)
+	}
+	return level, nil
+}
@@ -0,0 +1,37 @@
+package trace
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+)
+
+// Sampler はイベントを記録するかを決める。false を返したイベントは捨てる。
+type Sampler func(level slog.Level, event string) bool
+
+// SampleRate は Warn 未満のイベントを rate の確率で残す。Warn 以上は常に残す。
+func SampleRate(rate float64) Sampler {
+	return func(level slog.Level, _ string) bool {
+		if level >= slog.LevelWarn || rate >= 1 {
+			return true
+		}
+		return rand.Float64() < rate
+	}
+}
+
+// SampleEvery は Warn 未満のイベントをイベント名ごとに n 件に 1 件だけ残す。
+// 最初の 1 件は必ず残す。Warn 以上は常に残す。
+func SampleEvery(n uint64) Sampler {
+	var mu sync.Mutex
+	counts := make(map[string]uint64)
+	return func(level slog.Level, event string) bool {
+		if level >= slog.LevelWarn || n <= 1 {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		c := counts[event]
+		counts[event] = c + 1
+		return c%n == 0
+	}
+}
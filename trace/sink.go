@@ -0,0 +1,224 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// NewJSONSink は 1 イベントを 1 行の JSON として w に書き出すシンクを生成する。
+func NewJSONSink(w io.Writer, level slog.Leveler) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+}
+
+// RotatingFile はサイズが上限を超えるとローテーションするファイル。
+// path を path.1 に、path.1 を path.2 にずらし、maxBackups を超えた古いファイルは削除する。
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+// OpenRotatingFile は path を追記モードで開く。maxSize が 0 以下の場合はローテーションしない。
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write は p を書き込む。書き込むと上限を超える場合は先にローテーションする。
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	rf.f = nil
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", rf.path, i) }
+	if err := os.Remove(backup(rf.maxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if rf.maxBackups > 0 {
+		if err := os.Rename(rf.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+// Close はファイルを閉じる。
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
+
+// Record は RingBuffer に保存されたイベント。Attrs のグループは "group.key" に展開する。
+type Record struct {
+	Time  time.Time
+	Level slog.Level
+	Event string
+	Attrs map[string]any
+}
+
+// RingBuffer は直近のイベントをメモリに保持するシンク。主にテストで使う。
+type RingBuffer struct {
+	level slog.Leveler
+	state *ringState
+	attrs []slog.Attr
+	group string
+}
+
+type ringState struct {
+	mu      sync.Mutex
+	records []Record
+	next    int
+	full    bool
+}
+
+// NewRingBuffer は最大 size 件のイベントを保持する RingBuffer を生成する。
+func NewRingBuffer(size int, level slog.Leveler) *RingBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &RingBuffer{level: level, state: &ringState{records: make([]Record, size)}}
+}
+
+// Enabled は level が RingBuffer の最低レベル以上かを返す。
+func (b *RingBuffer) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if b.level != nil {
+		minLevel = b.level.Level()
+	}
+	return level >= minLevel
+}
+
+// Handle はイベントを保存する。いっぱいの場合は最も古いイベントを上書きする。
+func (b *RingBuffer) Handle(_ context.Context, r slog.Record) error {
+	rec := Record{Time: r.Time, Level: r.Level, Event: r.Message, Attrs: make(map[string]any)}
+	for _, a := range b.attrs {
+		addAttr(rec.Attrs, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		addAttr(rec.Attrs, b.group, a)
+		return true
+	})
+
+	s := b.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[s.next] = rec
+	s.next = (s.next + 1) % len(s.records)
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+// WithAttrs は attrs を常に付与する RingBuffer を返す。保存先は共有する。
+func (b *RingBuffer) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nb := *b
+	nb.attrs = slices.Clone(b.attrs)
+	for _, a := range attrs {
+		if b.group != "" {
+			a.Key = b.group + "." + a.Key
+		}
+		nb.attrs = append(nb.attrs, a)
+	}
+	return &nb
+}
+
+// WithGroup は以降の属性をグループ name に入れる RingBuffer を返す。保存先は共有する。
+func (b *RingBuffer) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return b
+	}
+	nb := *b
+	if b.group != "" {
+		name = b.group + "." + name
+	}
+	nb.group = name
+	return &nb
+}
+
+// Records は保存しているイベントを古い順に返す。
+func (b *RingBuffer) Records() []Record {
+	s := b.state
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return slices.Clone(s.records[:s.next])
+	}
+	return append(slices.Clone(s.records[s.next:]), s.records[:s.next]...)
+}
+
+func addAttr(dst map[string]any, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	key := a.Key
+	if prefix != "" && key != "" {
+		key = prefix + "." + key
+	} else if key == "" {
+		key = prefix
+	}
+	if v.Kind() == slog.KindGroup {
+		for _, ga := range v.Group() {
+			addAttr(dst, key, ga)
+		}
+		return
+	}
+	if key == "" {
+		return
+	}
+	dst[key] = v.Any()
+}
@@ -1,20 +1,83 @@
+// Package trace はチャットサーバーの動作を構造化イベントとして記録する。
+// イベントは log/slog のハンドラー（シンク）に渡すため、出力先や形式を差し替えられる。
 package trace
 
 import (
-	"fmt"
-	"io"
+	"context"
+	"log/slog"
+	"time"
 )
 
+// Event はトレースする一つの出来事。空のフィールドは出力しない。
+type Event struct {
+	// Name は "message.received" のようなイベント名。
+	Name      string
+	Room      string
+	User      string
+	MessageID string
+	Duration  time.Duration
+	// Attrs はイベント固有の追加情報。
+	Attrs []slog.Attr
+}
+
+// Tracer はイベントをレベルとサンプリングで絞り込んでシンクに書き出す。
+// nil の Tracer は何も出力しない。
 type Tracer struct {
-	out io.Writer
+	handler slog.Handler
+	sampler Sampler
 }
 
-func (t Tracer) Trace(a ...any) {
-	if t.out == nil {
-		return
+// Option は Tracer の設定を変更する。
+type Option func(*Tracer)
+
+// WithSampler はイベントを間引く Sampler を設定する。
+func WithSampler(s Sampler) Option {
+	return func(t *Tracer) { t.sampler = s }
+}
+
+// New は handler に書き出す Tracer を生成する。出力するレベルは handler が決める。
+func New(handler slog.Handler, opts ...Option) *Tracer {
+	t := &Tracer{handler: handler}
+	for _, opt := range opts {
+		opt(t)
 	}
-	fmt.Fprintln(t.out, a...)
+	return t
 }
-func New(w io.Writer) Tracer {
-	return Tracer{out: w}
+
+// Debug は詳細なイベントを記録する。
+func (t *Tracer) Debug(ctx context.Context, e Event) { t.Emit(ctx, slog.LevelDebug, e) }
+
+// Info は通常のイベントを記録する。
+func (t *Tracer) Info(ctx context.Context, e Event) { t.Emit(ctx, slog.LevelInfo, e) }
+
+// Warn は注意が必要なイベントを記録する。
+func (t *Tracer) Warn(ctx context.Context, e Event) { t.Emit(ctx, slog.LevelWarn, e) }
+
+// Error は失敗を表すイベントを記録する。
+func (t *Tracer) Error(ctx context.Context, e Event) { t.Emit(ctx, slog.LevelError, e) }
+
+// Emit は level のイベントを記録する。シンクが level を無効にしているか、
+// サンプリングで間引かれた場合は何もしない。
+func (t *Tracer) Emit(ctx context.Context, level slog.Level, e Event) {
+	if t == nil || t.handler == nil || !t.handler.Enabled(ctx, level) {
+		return
+	}
+	if t.sampler != nil && !t.sampler(level, e.Name) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, e.Name, 0)
+	if e.Room != "" {
+		r.AddAttrs(slog.String("room", e.Room))
+	}
+	if e.User != "" {
+		r.AddAttrs(slog.String("user", e.User))
+	}
+	if e.MessageID != "" {
+		r.AddAttrs(slog.String("message_id", e.MessageID))
+	}
+	if e.Duration != 0 {
+		r.AddAttrs(slog.Duration("duration", e.Duration))
+	}
+	r.AddAttrs(e.Attrs...)
+	_ = t.handler.Handle(ctx, r)
 }
@@ -2,28 +2,167 @@ package trace
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
-func TestNew(t *testing.T) {
-	var buf bytes.Buffer
-	var tracer Tracer
-	if tracer.out != nil {
-		t.Error("Return from New should be nil")
-	} else {
-		tracer.Trace("Hello, trace package.")
-		if buf.String() != "" {
-			t.Error("Trace should not write blank.")
+func TestTracer_NilIsNoop(t *testing.T) {
+	var tracer *Tracer
+	tracer.Info(context.Background(), Event{Name: "client.joined"})
+}
+
+func TestTracer_StructuredEvent(t *testing.T) {
+	buf := NewRingBuffer(10, slog.LevelDebug)
+	tracer := New(buf)
+
+	tracer.Debug(context.Background(), Event{
+		Name:      "message.broadcast",
+		Room:      "general",
+		User:      "u1",
+		MessageID: "m1",
+		Duration:  3 * time.Millisecond,
+		Attrs:     []slog.Attr{slog.Int("recipients", 2)},
+	})
+	tracer.Info(context.Background(), Event{Name: "client.joined", Room: "general"})
+
+	records := buf.Records()
+	if len(records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(records))
+	}
+	r := records[0]
+	if r.Event != "message.broadcast" || r.Level != slog.LevelDebug {
+		t.Errorf("unexpected record %+v", r)
+	}
+	want := map[string]any{"room": "general", "user": "u1", "message_id": "m1", "duration": 3 * time.Millisecond, "recipients": int64(2)}
+	for k, v := range want {
+		if r.Attrs[k] != v {
+			t.Errorf("attr %s = %v, want %v", k, r.Attrs[k], v)
 		}
 	}
+	if _, ok := records[1].Attrs["user"]; ok {
+		t.Error("empty fields should be omitted")
+	}
+}
+
+func TestTracer_Level(t *testing.T) {
+	buf := NewRingBuffer(10, slog.LevelWarn)
+	tracer := New(buf)
+	tracer.Info(context.Background(), Event{Name: "client.joined"})
+	tracer.Warn(context.Background(), Event{Name: "client.dropped"})
+
+	records := buf.Records()
+	if len(records) != 1 || records[0].Event != "client.dropped" {
+		t.Fatalf("expected only the warn event, got %+v", records)
+	}
+}
+
+func TestTracer_Sampling(t *testing.T) {
+	buf := NewRingBuffer(100, slog.LevelDebug)
+	tracer := New(buf, WithSampler(SampleEvery(3)))
+	for range 6 {
+		tracer.Debug(context.Background(), Event{Name: "message.received"})
+		tracer.Warn(context.Background(), Event{Name: "client.dropped"})
+	}
+
+	counts := make(map[string]int)
+	for _, r := range buf.Records() {
+		counts[r.Event]++
+	}
+	if counts["message.received"] != 2 {
+		t.Errorf("expected every third debug event, got %d", counts["message.received"])
+	}
+	if counts["client.dropped"] != 6 {
+		t.Errorf("warn events should never be sampled out, got %d", counts["client.dropped"])
+	}
+}
+
+func TestRingBuffer_Wraps(t *testing.T) {
+	buf := NewRingBuffer(2, slog.LevelInfo)
+	logger := slog.New(buf).With("room", "general").WithGroup("req")
+	for _, name := range []string{"a", "b", "c"} {
+		logger.Info(name, "id", name)
+	}
 
-	tracer = New(&buf)
-	if tracer.out == nil {
-		t.Error("Return from New should not be nil")
-	} else {
-		tracer.Trace("Hello, trace package.")
-		if buf.String() != "Hello, trace package.\n" {
-			t.Errorf("Trace should not write '%s'.", buf.String())
+	records := buf.Records()
+	if len(records) != 2 || records[0].Event != "b" || records[1].Event != "c" {
+		t.Fatalf("expected the two newest records, got %+v", records)
+	}
+	if records[1].Attrs["room"] != "general" || records[1].Attrs["req.id"] != "c" {
+		t.Errorf("unexpected attrs %v", records[1].Attrs)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var out bytes.Buffer
+	tracer := New(NewJSONSink(&out, slog.LevelInfo))
+	tracer.Info(context.Background(), Event{Name: "client.left", Room: "general", User: "u1"})
+
+	var line map[string]any
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("output is not JSON: %v: %s", err, out.String())
+	}
+	if line["msg"] != "client.left" || line["level"] != "INFO" || line["room"] != "general" || line["user"] != "u1" {
+		t.Errorf("unexpected output %v", line)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.log")
+	rf, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile: %v", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
 		}
 	}
+	if err := rf.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	for file, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile(%s): %v", file, err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", file, got, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only %d backups to be kept", 2)
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(*Config)
+		wantErr bool
+	}{
+		{name: "default", mutate: func(*Config) {}},
+		{name: "unknown level", mutate: func(c *Config) { c.Level = "verbose" }, wantErr: true},
+		{name: "sample rate too high", mutate: func(c *Config) { c.SampleRate = 1.5 }, wantErr: true},
+		{name: "empty output", mutate: func(c *Config) { c.Output = "" }, wantErr: true},
+		{name: "negative backups", mutate: func(c *Config) { c.MaxBackups = -1 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.mutate(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
 }
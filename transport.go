@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport はルームからクライアントへメッセージを届ける接続。
+// WebSocket を使えないクライアントは Server-Sent Events で受信し、送信は HTTP の POST で行う。
+type transport interface {
+	// writeMessage はメッセージを 1 件書き込む。
+	writeMessage(msg *message) error
+	// ping は接続が生きていることを確かめるために書き込む。
+	ping() error
+	// writeClose は送信を終える理由をクローズコードで伝える。失敗しても無視する。
+	writeClose(code int)
+	// close は接続を閉じる。書き込み中の場合は中断させる。
+	close() error
+	// gone はクライアントが接続を閉じると閉じられる。読み込み側で検知する接続は nil を返す。
+	gone() <-chan struct{}
+}
+
+// wsTransport は WebSocket の接続。
+type wsTransport struct {
+	conn      *websocket.Conn
+	writeWait time.Duration
+}
+
+func (t *wsTransport) writeMessage(msg *message) error {
+	_ = t.conn.SetWriteDeadline(time.Now().Add(t.writeWait))
+	// ブロードキャストではエンコード済みのフレームを共有する
+	codec := codecFor(t.conn.Subprotocol())
+	if msg.frames != nil {
+		frame, err := msg.frames.get(codec, msg)
+		if err != nil {
+			return err
+		}
+		return t.conn.WritePreparedMessage(frame)
+	}
+	data, err := codec.marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.conn.WriteMessage(codec.messageType(), data)
+}
+
+func (t *wsTransport) ping() error {
+	return t.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(t.writeWait))
+}
+
+func (t *wsTransport) writeClose(code int) {
+	text := ""
+	if code == closeSlowConsumer {
+		text = "send buffer full"
+	}
+	_ = t.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(closeWriteWait))
+}
+
+func (t *wsTransport) close() error { return t.conn.Close() }
+
+// gone は nil を返す。切断は read が検知する。
+func (t *wsTransport) gone() <-chan struct{} { return nil }
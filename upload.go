@@ -6,14 +6,23 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/dchf12/chat/domain"
 	"github.com/labstack/echo/v4"
 )
 
 const maxAvatarUploadBytes int64 = 5 << 20 // 5 MiB
 
-func uploaderHandler(c echo.Context) error {
+// uploaderHandler はアバター画像を保存し、監査ログとメトリクスに記録する。
+func uploaderHandler(auditLog domain.AuditLog, metrics *Metrics) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return uploadAvatar(c, auditLog, metrics)
+	}
+}
+
+func uploadAvatar(c echo.Context, auditLog domain.AuditLog, metrics *Metrics) error {
 	req := c.Request()
 	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxAvatarUploadBytes)
 
@@ -60,6 +69,14 @@ func uploaderHandler(c echo.Context) error {
 	if err := os.WriteFile(filename, data, 0600); err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
+	metrics.uploaded(len(data))
+	actorID, _ := userData["id"].(string)
+	recordAudit(req.Context(), auditLog, domain.AuditEvent{
+		Action:  "avatar.uploaded",
+		ActorID: actorID,
+		Target:  filename,
+		Detail:  map[string]string{"size": strconv.Itoa(len(data)), "ip": c.RealIP()},
+	})
 
 	return c.String(http.StatusOK, "Successful")
 }